@@ -0,0 +1,538 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"leetcode/sstable"
+)
+
+/**
+backup dir layout
+
+	/shared/000005_2841053394_2097152.ldb   table file shared by backups, name is num_checksum_size
+	/private/1/MANIFEST-000004              manifest, current and journal of backup 1
+	/private/1/CURRENT
+	/private/1/000006.log
+	/meta/1                                 backup 1 meta info, json encoded
+
+**/
+
+const (
+	sharedDir  = "shared"
+	privateDir = "private"
+	metaDir    = "meta"
+	tmpDir     = "tmp"
+)
+
+var (
+	ErrBackupNotFound    = errors.New("leveldb/backup not found")
+	ErrRestoreDirNoEmpty = errors.New("leveldb/backup restore dir not empty")
+	ErrChecksumMismatch  = errors.New("leveldb/backup file checksum mismatch")
+	ErrSizeMismatch      = errors.New("leveldb/backup file size mismatch")
+)
+
+type FileInfo struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"`
+	Shared   bool   `json:"shared"`
+}
+
+// sharedName the name used in shared dir, tables with same name+size+checksum are deduplicated
+func (f FileInfo) sharedName() string {
+	num := strings.TrimSuffix(f.Name, path.Ext(f.Name))
+	return fmt.Sprintf("%s_%d_%d%s", num, f.Checksum, f.Size, path.Ext(f.Name))
+}
+
+type BackupInfo struct {
+	ID        uint32     `json:"id"`
+	Sequence  uint64     `json:"sequence"`
+	Timestamp int64      `json:"timestamp"`
+	Files     []FileInfo `json:"files"`
+}
+
+func (info *BackupInfo) Size() (size int64) {
+	for _, f := range info.Files {
+		size += f.Size
+	}
+	return
+}
+
+type Engine struct {
+	mutex   sync.Mutex
+	dir     string
+	backups []*BackupInfo // sorted by id
+	nextID  uint32
+}
+
+// Open open the backup engine in dir, create it if not exists
+func Open(dir string) (*Engine, error) {
+
+	for _, sub := range []string{sharedDir, privateDir, metaDir} {
+		if err := os.MkdirAll(path.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	// clear the unfinished backup
+	if err := os.RemoveAll(path.Join(dir, tmpDir)); err != nil {
+		return nil, err
+	}
+
+	engine := &Engine{
+		dir:    dir,
+		nextID: 1,
+	}
+
+	entries, err := ioutil.ReadDir(path.Join(dir, metaDir))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		id, pErr := strconv.ParseUint(entry.Name(), 10, 32)
+		if pErr != nil {
+			continue
+		}
+		info, rErr := engine.readMeta(uint32(id))
+		if rErr != nil {
+			return nil, rErr
+		}
+		engine.backups = append(engine.backups, info)
+		if info.ID >= engine.nextID {
+			engine.nextID = info.ID + 1
+		}
+	}
+
+	sort.Slice(engine.backups, func(i, j int) bool {
+		return engine.backups[i].ID < engine.backups[j].ID
+	})
+
+	return engine, nil
+}
+
+// CreateBackup take a checkpoint of db and store it as a new backup,
+// table files which are already in the shared dir won't be copied again
+func (engine *Engine) CreateBackup(db *sstable.DB) (*BackupInfo, error) {
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	id := engine.nextID
+	info := &BackupInfo{
+		ID:        id,
+		Timestamp: time.Now().Unix(),
+	}
+
+	checkpointDir := path.Join(engine.dir, tmpDir, strconv.Itoa(int(id)))
+	if err := os.MkdirAll(path.Dir(checkpointDir), 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(path.Join(engine.dir, tmpDir))
+
+	if err := db.Checkpoint(checkpointDir); err != nil {
+		return nil, err
+	}
+
+	// the writes after checkpoint are not in the backup, so the sequence is read from the checkpoint
+	seq, err := checkpointSequence(checkpointDir)
+	if err != nil {
+		return nil, err
+	}
+	info.Sequence = seq
+
+	entries, err := ioutil.ReadDir(checkpointDir)
+	if err != nil {
+		return nil, err
+	}
+
+	privatePath := engine.privatePath(id)
+	if err = os.MkdirAll(privatePath, 0755); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(privatePath)
+		}
+	}()
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "LOCK" || entry.IsDir() {
+			continue
+		}
+
+		src := path.Join(checkpointDir, name)
+		checksum, cErr := fileChecksum(src)
+		if cErr != nil {
+			err = cErr
+			return nil, err
+		}
+
+		fInfo := FileInfo{
+			Name:     name,
+			Size:     entry.Size(),
+			Checksum: checksum,
+			Shared:   isTableFile(name),
+		}
+
+		var dst string
+		if fInfo.Shared {
+			dst = path.Join(engine.dir, sharedDir, fInfo.sharedName())
+			if _, sErr := os.Stat(dst); sErr == nil {
+				info.Files = append(info.Files, fInfo)
+				continue
+			}
+		} else {
+			dst = path.Join(privatePath, name)
+		}
+
+		if err = os.Rename(src, dst); err != nil {
+			return nil, err
+		}
+		info.Files = append(info.Files, fInfo)
+	}
+
+	if err = engine.writeMeta(info); err != nil {
+		return nil, err
+	}
+
+	engine.backups = append(engine.backups, info)
+	engine.nextID++
+	return info, nil
+}
+
+// GetBackupInfo return all the backups sorted by id
+func (engine *Engine) GetBackupInfo() []BackupInfo {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	infos := make([]BackupInfo, 0, len(engine.backups))
+	for _, info := range engine.backups {
+		infos = append(infos, *info)
+	}
+	return infos
+}
+
+// VerifyBackup check the size and checksum of every file in backup,
+// and read every block of the table files through TableReader
+func (engine *Engine) VerifyBackup(id uint32) error {
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	info := engine.findBackup(id)
+	if info == nil {
+		return ErrBackupNotFound
+	}
+
+	for _, f := range info.Files {
+		filePath := engine.filePath(info.ID, f)
+		fInfo, err := os.Stat(filePath)
+		if err != nil {
+			return err
+		}
+		if fInfo.Size() != f.Size {
+			return fmt.Errorf("%w, file=%s", ErrSizeMismatch, f.Name)
+		}
+		checksum, err := fileChecksum(filePath)
+		if err != nil {
+			return err
+		}
+		if checksum != f.Checksum {
+			return fmt.Errorf("%w, file=%s", ErrChecksumMismatch, f.Name)
+		}
+		if f.Shared {
+			if err = verifyTable(filePath, f.Size); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeleteBackup delete the backup and the shared files no longer referenced
+func (engine *Engine) DeleteBackup(id uint32) error {
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	if engine.findBackup(id) == nil {
+		return ErrBackupNotFound
+	}
+
+	if err := engine.deleteBackup(id); err != nil {
+		return err
+	}
+
+	return engine.garbageCollect()
+}
+
+// PurgeOldBackups delete the oldest backups, only keep the latest numToKeep backups
+func (engine *Engine) PurgeOldBackups(numToKeep int) error {
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	for len(engine.backups) > numToKeep {
+		if err := engine.deleteBackup(engine.backups[0].ID); err != nil {
+			return err
+		}
+	}
+
+	return engine.garbageCollect()
+}
+
+// RestoreBackup restore the backup into dbDir, dbDir must not exist or be empty.
+// the restored db could be opened by sstable.Open
+func (engine *Engine) RestoreBackup(id uint32, dbDir string) (err error) {
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	info := engine.findBackup(id)
+	if info == nil {
+		return ErrBackupNotFound
+	}
+
+	entries, err := ioutil.ReadDir(dbDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrRestoreDirNoEmpty
+	}
+
+	if err = os.MkdirAll(dbDir, 0755); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			for _, f := range info.Files {
+				_ = os.Remove(path.Join(dbDir, f.Name))
+			}
+		}
+	}()
+
+	// copy CURRENT at last, so a half restored dir can't be opened
+	files := append([]FileInfo(nil), info.Files...)
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Name != "CURRENT" && files[j].Name == "CURRENT"
+	})
+
+	for _, f := range files {
+		checksum, cErr := copyFile(engine.filePath(info.ID, f), path.Join(dbDir, f.Name))
+		if cErr != nil {
+			err = cErr
+			return
+		}
+		if checksum != f.Checksum {
+			err = fmt.Errorf("%w, file=%s", ErrChecksumMismatch, f.Name)
+			return
+		}
+	}
+
+	return nil
+}
+
+// required: mutex held
+func (engine *Engine) deleteBackup(id uint32) error {
+	if err := os.Remove(engine.metaPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(engine.privatePath(id)); err != nil {
+		return err
+	}
+	for i, info := range engine.backups {
+		if info.ID == id {
+			engine.backups = append(engine.backups[:i], engine.backups[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// garbageCollect remove the shared files which are not referenced by any backup
+// required: mutex held
+func (engine *Engine) garbageCollect() error {
+
+	referenced := make(map[string]struct{})
+	for _, info := range engine.backups {
+		for _, f := range info.Files {
+			if f.Shared {
+				referenced[f.sharedName()] = struct{}{}
+			}
+		}
+	}
+
+	entries, err := ioutil.ReadDir(path.Join(engine.dir, sharedDir))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if _, ok := referenced[entry.Name()]; ok {
+			continue
+		}
+		if rErr := os.Remove(path.Join(engine.dir, sharedDir, entry.Name())); rErr != nil {
+			err = rErr
+		}
+	}
+
+	return err
+}
+
+func (engine *Engine) findBackup(id uint32) *BackupInfo {
+	for _, info := range engine.backups {
+		if info.ID == id {
+			return info
+		}
+	}
+	return nil
+}
+
+func (engine *Engine) filePath(id uint32, f FileInfo) string {
+	if f.Shared {
+		return path.Join(engine.dir, sharedDir, f.sharedName())
+	}
+	return path.Join(engine.privatePath(id), f.Name)
+}
+
+func (engine *Engine) privatePath(id uint32) string {
+	return path.Join(engine.dir, privateDir, strconv.Itoa(int(id)))
+}
+
+func (engine *Engine) metaPath(id uint32) string {
+	return path.Join(engine.dir, metaDir, strconv.Itoa(int(id)))
+}
+
+func (engine *Engine) writeMeta(info *BackupInfo) error {
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp := engine.metaPath(info.ID) + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, engine.metaPath(info.ID))
+}
+
+func (engine *Engine) readMeta(id uint32) (*BackupInfo, error) {
+	content, err := ioutil.ReadFile(engine.metaPath(id))
+	if err != nil {
+		return nil, err
+	}
+	info := &BackupInfo{}
+	if err = json.Unmarshal(content, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// checkpointSequence open the checkpoint read only and return the sequence of its last write
+func checkpointSequence(dir string) (uint64, error) {
+	db, err := sstable.OpenReadOnly(dir)
+	if err != nil {
+		return 0, err
+	}
+	seq := db.LatestSequence()
+	if err = db.Close(); err != nil {
+		return 0, err
+	}
+	return uint64(seq), nil
+}
+
+func isTableFile(name string) bool {
+	return strings.HasSuffix(name, ".ldb") || strings.HasSuffix(name, ".sst")
+}
+
+func fileChecksum(filePath string) (uint32, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	h := crc32.NewIEEE()
+	if _, err = io.Copy(h, file); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// copyFile copy src to dst and return the checksum of the content
+func copyFile(src, dst string) (uint32, error) {
+
+	reader, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	writer, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	h := crc32.NewIEEE()
+	_, err = io.Copy(io.MultiWriter(writer, h), reader)
+	if err == nil {
+		err = writer.Sync()
+	}
+	if cErr := writer.Close(); err == nil {
+		err = cErr
+	}
+	return h.Sum32(), err
+}
+
+// tableFile adapt os.File to sstable.Reader
+type tableFile struct {
+	*os.File
+}
+
+func (f tableFile) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(f.File, b[:])
+	return b[0], err
+}
+
+// verifyTable read every data block of the table, block checksum is verified by TableReader
+func verifyTable(filePath string, size int64) error {
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+
+	tr, err := sstable.NewTableReader(tableFile{file}, int(size))
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	defer tr.UnRef()
+
+	iter, err := tr.NewIterator()
+	if err != nil {
+		return err
+	}
+	defer iter.UnRef()
+
+	for iter.Next() {
+	}
+
+	return iter.Valid()
+}
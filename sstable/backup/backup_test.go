@@ -0,0 +1,183 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"leetcode/sstable"
+)
+
+func putKeys(t *testing.T, db *sstable.DB, from, to int) {
+	for i := from; i < to; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkKeys(t *testing.T, db *sstable.DB, n int) {
+	for i := 0; i < n; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("k%04d", i)))
+		if err != nil || string(v) != fmt.Sprintf("v%04d", i) {
+			t.Fatalf("get k%04d: %q %v", i, v, err)
+		}
+	}
+	if _, err := db.Get([]byte(fmt.Sprintf("k%04d", n))); err != sstable.ErrNotFound {
+		t.Fatalf("expect k%04d not found, got %v", n, err)
+	}
+}
+
+func sharedFiles(t *testing.T, dir string) int {
+	entries, err := ioutil.ReadDir(path.Join(dir, sharedDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestBackupEngine(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := sstable.Open(path.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	engine, err := Open(path.Join(dir, "backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putKeys(t, db, 0, 100)
+	first, err := engine.CreateBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Sequence != uint64(db.LatestSequence()) {
+		t.Fatalf("expect sequence %d, got %d", db.LatestSequence(), first.Sequence)
+	}
+
+	// the tables of first backup are shared, only the new flushed table is copied
+	putKeys(t, db, 100, 200)
+	second, err := engine.CreateBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		shared = make(map[string]struct{})
+		total  int
+	)
+	for _, info := range []*BackupInfo{first, second} {
+		for _, f := range info.Files {
+			if f.Shared {
+				shared[f.sharedName()] = struct{}{}
+				total++
+			}
+		}
+	}
+	if n := sharedFiles(t, engine.dir); n != len(shared) || n >= total {
+		t.Fatalf("expect %d deduplicated shared files, got %d", len(shared), n)
+	}
+
+	for _, info := range []*BackupInfo{first, second} {
+		if err = engine.VerifyBackup(info.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the backups are loaded when engine is reopened
+	engine, err = Open(engine.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos := engine.GetBackupInfo(); len(infos) != 2 || infos[1].Sequence != second.Sequence {
+		t.Fatalf("unexpected backups after reopen: %+v", infos)
+	}
+
+	if err = engine.PurgeOldBackups(1); err != nil {
+		t.Fatal(err)
+	}
+	if infos := engine.GetBackupInfo(); len(infos) != 1 || infos[0].ID != second.ID {
+		t.Fatalf("expect only backup %d kept, got %+v", second.ID, infos)
+	}
+	if err = engine.VerifyBackup(first.ID); err != ErrBackupNotFound {
+		t.Fatalf("expect purged backup not found, got %v", err)
+	}
+	if _, err = os.Stat(engine.privatePath(first.ID)); !os.IsNotExist(err) {
+		t.Fatalf("expect private dir of purged backup removed, got %v", err)
+	}
+	if err = engine.VerifyBackup(second.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreDir := path.Join(dir, "restore")
+	if err = engine.RestoreBackup(second.ID, restoreDir); err != nil {
+		t.Fatal(err)
+	}
+	if err = engine.RestoreBackup(second.ID, restoreDir); err != ErrRestoreDirNoEmpty {
+		t.Fatalf("expect restore dir not empty, got %v", err)
+	}
+
+	restored, err := sstable.Open(restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	checkKeys(t, restored, 200)
+	if uint64(restored.LatestSequence()) != second.Sequence {
+		t.Fatalf("expect restored sequence %d, got %d", second.Sequence, restored.LatestSequence())
+	}
+}
+
+func TestVerifyBackupCorruption(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := sstable.Open(path.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	engine, err := Open(path.Join(dir, "backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putKeys(t, db, 0, 100)
+	info, err := engine.CreateBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var table FileInfo
+	for _, f := range info.Files {
+		if f.Shared {
+			table = f
+		}
+	}
+	if !table.Shared {
+		t.Fatal("expect a shared table in backup")
+	}
+
+	filePath := engine.filePath(info.ID, table)
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[0] ^= 0xff
+	if err = ioutil.WriteFile(filePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = engine.VerifyBackup(info.ID); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expect checksum mismatch, got %v", err)
+	}
+	if err = engine.RestoreBackup(info.ID, path.Join(dir, "restore")); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expect checksum mismatch on restore, got %v", err)
+	}
+}
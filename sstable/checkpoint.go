@@ -0,0 +1,174 @@
+package sstable
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// Checkpoint create an openable copy of db in dir.
+// the live table files are hard linked when dir is in the same filesystem, otherwise copied.
+// the manifest is rebuilt from the pinned version, and the live journal is copied to keep the
+// writes after the memtable flush. background compaction is not blocked while copying.
+func (db *DB) Checkpoint(dir string) (err error) {
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return ErrClosed
+	}
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	if _, sErr := os.Stat(dir); sErr == nil {
+		return ErrDirExists
+	} else if !os.IsNotExist(sErr) {
+		return sErr
+	}
+
+	// build checkpoint in tmp dir, rename to dir when all done
+	tmpDir := dir + ".tmp"
+	if err = os.RemoveAll(tmpDir); err != nil {
+		return
+	}
+
+	dst, err := OpenPath(tmpDir)
+	if err != nil {
+		return
+	}
+
+	dstClosed := false
+	defer func() {
+		if err != nil {
+			if !dstClosed {
+				_ = dst.Close()
+			}
+			_ = os.RemoveAll(tmpDir)
+		}
+	}()
+
+	src := db.VersionSet.storage
+
+	db.rwMutex.Lock()
+
+	// the group commit leader writes the journal and mem with mutex released, switch mem in the write turn
+	w := db.waitForWriteTurn()
+	err = db.flushMemTable()
+	db.finishWriteTurn(w)
+	if err != nil {
+		db.rwMutex.Unlock()
+		return
+	}
+
+	// pin the versions of all column families, so the table files won't be removed by compaction
+	versions := []*Version{db.VersionSet.getCurrent()}
+	for _, family := range db.VersionSet.liveFamilies() {
+		versions = append(versions, family.getCurrent())
+	}
+	for _, v := range versions {
+		v.Ref()
+	}
+
+	manifestFd := db.VersionSet.manifestFd
+	journalNum := db.minJournalNum()
+	err = writeCheckpointManifest(db.VersionSet, dst, manifestFd)
+
+	db.rwMutex.Unlock()
+
+	defer func() {
+		db.rwMutex.Lock()
+		for _, v := range versions {
+			v.UnRef()
+		}
+		db.rwMutex.Unlock()
+	}()
+
+	if err != nil {
+		return
+	}
+
+	for _, v := range versions {
+		for _, level := range v.levels {
+			for _, t := range level {
+				if lErr := src.Link(t.fd, tmpDir); lErr != nil {
+					// maybe cross device, fallback to copy
+					if err = copyFile(src, dst, t.fd); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+
+	// copy the journal tail which hasn't been flushed
+	fds, err := src.List()
+	if err != nil {
+		return
+	}
+
+	for _, fd := range fds {
+		if fd.FileType == KJournalFile && fd.Num >= journalNum {
+			if err = copyFile(src, dst, fd); err != nil {
+				return
+			}
+		}
+	}
+
+	if err = dst.SetCurrent(manifestFd.Num); err != nil {
+		return
+	}
+
+	dstClosed = true
+	if err = dst.Close(); err != nil {
+		return
+	}
+
+	err = os.Rename(tmpDir, dir)
+	return
+}
+
+// required: mutex held
+func writeCheckpointManifest(vSet *VersionSet, dst Storage, manifestFd Fd) error {
+
+	writer, err := dst.Create(manifestFd)
+	if err != nil {
+		return err
+	}
+
+	journalWriter := NewJournalWriter(writer)
+	err = vSet.writeSnapShot(journalWriter)
+	if err == nil {
+		err = journalWriter.Sync()
+	}
+
+	if cErr := journalWriter.Close(); err == nil {
+		err = cErr
+	}
+
+	return err
+}
+
+func copyFile(src Storage, dst Storage, fd Fd) error {
+
+	reader, err := src.Open(fd)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := dst.Create(fd)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, reader)
+	if err == nil {
+		err = writer.Sync()
+	}
+
+	if cErr := writer.Close(); err == nil {
+		err = cErr
+	}
+
+	return err
+}
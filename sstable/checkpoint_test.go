@@ -0,0 +1,52 @@
+package sstable
+
+import (
+	"fmt"
+	"path"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := Open(path.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cpDir := path.Join(dir, "checkpoint")
+	if err := db.Checkpoint(cpDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(cpDir); err != ErrDirExists {
+		t.Fatalf("checkpoint into existing dir, got %v", err)
+	}
+
+	// the writes after the checkpoint are not seen by the checkpoint
+	if err := db.Put([]byte("k000"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := Open(cpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+
+	for i := 0; i < 100; i++ {
+		v, err := cp.Get([]byte(fmt.Sprintf("k%03d", i)))
+		if err != nil {
+			t.Fatalf("get k%03d: %v", i, err)
+		}
+		if string(v) != fmt.Sprintf("v%03d", i) {
+			t.Fatalf("get k%03d: %q", i, v)
+		}
+	}
+}
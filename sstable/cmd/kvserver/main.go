@@ -0,0 +1,64 @@
+// kvserver serve a db over the redis protocol
+//
+//	kvserver -dir ./data -addr :6380 -maxclients 1000
+//
+// the supported commands are GET, SET, DEL, MGET, SCAN, INFO, MULTI/EXEC/DISCARD, PING and QUIT.
+// SIGINT or SIGTERM stops accepting, waits the requests in flight and closes the db
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"leetcode/sstable"
+)
+
+func main() {
+
+	var (
+		dir        = flag.String("dir", "./data", "the db directory")
+		addr       = flag.String("addr", ":6380", "the listen address")
+		maxClients = flag.Int("maxclients", 1000, "the max number of connections")
+	)
+	flag.Parse()
+
+	db, err := sstable.Open(*dir)
+	if err != nil {
+		logf("open db %s failed, err=%v", *dir, err)
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		logf("listen %s failed, err=%v", *addr, err)
+		_ = db.Close()
+		os.Exit(1)
+	}
+
+	s := newServer(db, listener, *maxClients)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan error, 1)
+	go func() {
+		sig := <-signals
+		logf("received %s, shutting down", sig)
+		stopped <- s.shutdown()
+	}()
+
+	logf("serving %s on %s", *dir, listener.Addr())
+	if err := s.serve(); err != nil {
+		logf("serve failed, err=%v", err)
+		_ = s.shutdown()
+		os.Exit(1)
+	}
+
+	if err := <-stopped; err != nil {
+		logf("close db failed, err=%v", err)
+		os.Exit(1)
+	}
+	logf("stopped")
+}
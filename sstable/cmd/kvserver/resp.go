@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/**
+RESP, the redis serialization protocol
+
+	request:  *2\r\n$3\r\nGET\r\n$3\r\nkey\r\n   array of bulk strings
+	          GET key\r\n                        inline command, split by spaces
+
+	reply:    +OK\r\n                            simple string
+	          -ERR message\r\n                   error
+	          :1\r\n                             integer
+	          $5\r\nvalue\r\n  $-1\r\n           bulk string, null
+	          *2\r\n...                          array
+**/
+
+const (
+	maxBulkSize  = 512 << 20
+	maxArraySize = 1 << 20
+	maxInlineLen = 64 << 10
+)
+
+var errProtocol = errors.New("kvserver/protocol error")
+
+// readCommand read a request, the args are copied
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	if line[0] != '*' {
+		// inline command
+		fields := strings.Fields(string(line))
+		args := make([][]byte, len(fields))
+		for i, field := range fields {
+			args[i] = []byte(field)
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArraySize {
+		return nil, fmt.Errorf("%w, invalid multibulk length", errProtocol)
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
+	args := make([][]byte, n)
+	for i := range args {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w, expected '$', got %q", errProtocol, line)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, fmt.Errorf("%w, invalid bulk length", errProtocol)
+		}
+		arg := make([]byte, size+2)
+		if _, err = io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, fmt.Errorf("%w, bulk string not terminated by CRLF", errProtocol)
+		}
+		args[i] = arg[:size]
+	}
+	return args, nil
+}
+
+// readLine read a line terminated by CRLF or LF, the terminator is trimmed
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		fragment, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, fragment...)
+		if len(line) > maxInlineLen {
+			return nil, fmt.Errorf("%w, too big inline request", errProtocol)
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+// replyWriter buffer the replies, flushed after the pipelined requests handled
+type replyWriter struct {
+	*bufio.Writer
+}
+
+func (w replyWriter) simple(s string) {
+	_, _ = w.WriteString("+" + s + "\r\n")
+}
+
+func (w replyWriter) error(msg string) {
+	_, _ = w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(msg) + "\r\n")
+}
+
+func (w replyWriter) integer(n int64) {
+	_, _ = w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w replyWriter) bulk(p []byte) {
+	if p == nil {
+		_, _ = w.WriteString("$-1\r\n")
+		return
+	}
+	_, _ = w.WriteString("$" + strconv.Itoa(len(p)) + "\r\n")
+	_, _ = w.Write(p)
+	_, _ = w.WriteString("\r\n")
+}
+
+func (w replyWriter) array(n int) {
+	_, _ = w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
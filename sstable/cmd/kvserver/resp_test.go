@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"leetcode/sstable"
+)
+
+func TestReadCommand(t *testing.T) {
+
+	r := bufio.NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\nGET  k\r\n*1\r\n$3\r\nGETX\r\n"))
+
+	for _, expect := range []string{"SET|k|", "GET|k"} {
+		args, err := readCommand(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(bytes.Join(args, []byte("|"))); got != expect {
+			t.Fatalf("expect %q, got %q", expect, got)
+		}
+	}
+
+	if _, err := readCommand(r); !errors.Is(err, errProtocol) {
+		t.Fatalf("expect protocol error of unterminated bulk string, got %v", err)
+	}
+}
+
+func TestMultiAbort(t *testing.T) {
+
+	s := newServer(nil, nil, 1)
+	c := &conn{}
+	var buf bytes.Buffer
+	w := replyWriter{bufio.NewWriter(&buf)}
+
+	for _, cmd := range []string{"MULTI", "SET k v", "GET k", "EXEC"} {
+		var args [][]byte
+		for _, arg := range strings.Fields(cmd) {
+			args = append(args, []byte(arg))
+		}
+		s.handle(c, args, w)
+	}
+	_ = w.Flush()
+
+	replies := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	if len(replies) != 4 || replies[0] != "+OK" || replies[1] != "+QUEUED" ||
+		!strings.HasPrefix(replies[2], "-ERR") || !strings.HasPrefix(replies[3], "-EXECABORT") {
+		t.Fatalf("unexpected replies %q", replies)
+	}
+	if c.multi || c.queued != nil {
+		t.Fatal("expect the transaction discarded")
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+
+	for _, c := range []struct {
+		pattern, key string
+		matched      bool
+	}{
+		{"*", "a/b/c", true},
+		{"user:*", "user:1/profile", true},
+		{"user:*/name", "user:1/a/name", true},
+		{"user:*/name", "user:1/age", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "heello", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a**b", "ab", true},
+		{"[abc", "b", true},
+		{"", "", true},
+		{"a", "ab", false},
+	} {
+		if got := matchGlob([]byte(c.pattern), []byte(c.key)); got != c.matched {
+			t.Fatalf("match %q against %q: expect %v, got %v", c.key, c.pattern, c.matched, got)
+		}
+	}
+}
+
+type testClient struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, s *server) *testClient {
+	nc, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{Conn: nc, r: bufio.NewReader(nc)}
+}
+
+// do send the command, the reply is +simple, -error, :integer, the bulk string, nil for the null bulk, or []interface{}
+func (c *testClient) do(t *testing.T, args ...string) interface{} {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.Write([]byte(b.String())); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.readReply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func (c *testClient) readReply() (interface{}, error) {
+	line, err := readLine(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+', '-', ':':
+		return string(line), nil
+	case '$':
+		n, _ := strconv.Atoi(string(line[1:]))
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, _ := strconv.Atoi(string(line[1:]))
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// startServer serve a db in a temp dir, shutdown closes the db
+func startServer(t *testing.T, maxConns int) (*server, string) {
+	dir := t.TempDir()
+	db, err := sstable.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(db, listener, maxConns)
+	go func() {
+		_ = s.serve()
+	}()
+	return s, dir
+}
+
+func TestScanPaging(t *testing.T) {
+
+	s, _ := startServer(t, 10)
+	defer func() {
+		_ = s.shutdown()
+	}()
+	c := dial(t, s)
+	defer c.Close()
+
+	var expect []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("user:%02d/name", i)
+		expect = append(expect, key)
+		if reply := c.do(t, "SET", key, "v"); reply != "+OK" {
+			t.Fatalf("set %s: %v", key, reply)
+		}
+		if reply := c.do(t, "SET", fmt.Sprintf("order:%02d", i), "v"); reply != "+OK" {
+			t.Fatalf("set order:%02d: %v", i, reply)
+		}
+	}
+
+	// the pages are iterated until the cursor is back to 0, '*' matches '/'
+	var (
+		keys   []string
+		pages  int
+		cursor = "0"
+	)
+	for {
+		reply := c.do(t, "SCAN", cursor, "MATCH", "user:*", "COUNT", "10").([]interface{})
+		cursor = reply[0].(string)
+		for _, key := range reply[1].([]interface{}) {
+			keys = append(keys, key.(string))
+		}
+		pages++
+		if cursor == "0" {
+			break
+		}
+	}
+	if pages != 5 || strings.Join(keys, ",") != strings.Join(expect, ",") {
+		t.Fatalf("expect the user keys in 5 pages, got %d pages %v", pages, keys)
+	}
+
+	if reply := c.do(t, "SCAN", "zz"); !strings.HasPrefix(fmt.Sprint(reply), "-ERR invalid cursor") {
+		t.Fatalf("expect invalid cursor, got %v", reply)
+	}
+}
+
+func TestMultiExecAndDel(t *testing.T) {
+
+	s, _ := startServer(t, 10)
+	defer func() {
+		_ = s.shutdown()
+	}()
+	c := dial(t, s)
+	defer c.Close()
+
+	c.do(t, "SET", "a", "1")
+	c.do(t, "SET", "b", "2")
+	if reply := c.do(t, "DEL", "a", "b", "c"); reply != ":2" {
+		t.Fatalf("expect 2 keys deleted, got %v", reply)
+	}
+	if reply := c.do(t, "DEL", "a"); reply != ":0" {
+		t.Fatalf("expect no key deleted, got %v", reply)
+	}
+
+	// the queued commands are written as one batch, DEL counts the keys set in the same transaction
+	seq := s.db.LatestSequence()
+	for _, cmd := range [][]string{{"MULTI"}, {"SET", "x", "1"}, {"SET", "y", "2"}, {"DEL", "x", "z"}} {
+		c.do(t, cmd...)
+	}
+	if reply := fmt.Sprint(c.do(t, "EXEC")); reply != "[+OK +OK :1]" {
+		t.Fatalf("unexpected exec replies %s", reply)
+	}
+
+	it, err := s.db.GetUpdatesSince(seq + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := 0
+	for it.Next() {
+		batches++
+		if it.Sequence() != seq+1 || it.Batch().Len() != 4 {
+			t.Fatalf("expect a batch of 4 records at %d, got %d records at %d", seq+1, it.Batch().Len(), it.Sequence())
+		}
+	}
+	it.UnRef()
+	if batches != 1 {
+		t.Fatalf("expect the transaction written in 1 batch, got %d", batches)
+	}
+
+	if reply := c.do(t, "MGET", "x", "y"); fmt.Sprint(reply) != "[<nil> 2]" {
+		t.Fatalf("unexpected values %v", reply)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+
+	s, _ := startServer(t, 1)
+	defer func() {
+		_ = s.shutdown()
+	}()
+
+	c1 := dial(t, s)
+	defer c1.Close()
+	if reply := c1.do(t, "PING"); reply != "+PONG" {
+		t.Fatalf("expect pong, got %v", reply)
+	}
+
+	c2 := dial(t, s)
+	defer c2.Close()
+	reply, err := c2.readReply()
+	if err != nil || reply != "-ERR max number of clients reached" {
+		t.Fatalf("expect rejected, got %v, %v", reply, err)
+	}
+	if _, err = c2.readReply(); err != io.EOF {
+		t.Fatalf("expect the rejected connection closed, got %v", err)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+
+	s, dir := startServer(t, 10)
+	c := dial(t, s)
+	defer c.Close()
+
+	if reply := c.do(t, "SET", "k", "v"); reply != "+OK" {
+		t.Fatalf("set k: %v", reply)
+	}
+
+	// the idle connection is closed and the db is closed after it
+	if err := s.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.readReply(); err != io.EOF {
+		t.Fatalf("expect the connection closed, got %v", err)
+	}
+	if _, err := s.db.Get([]byte("k")); err != sstable.ErrClosed {
+		t.Fatalf("expect db closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", s.listener.Addr().String()); err == nil {
+		t.Fatal("expect the listener closed")
+	}
+
+	db, err := sstable.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get([]byte("k")); err != nil || string(value) != "v" {
+		t.Fatalf("expect k=v after restart, got %q, %v", value, err)
+	}
+}
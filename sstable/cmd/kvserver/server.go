@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"leetcode/sstable"
+)
+
+const (
+	defaultScanCount = 10
+	maxScanCount     = 10000
+)
+
+type server struct {
+	db       *sstable.DB
+	listener net.Listener
+	maxConns int
+
+	mu      sync.Mutex
+	conns   map[*conn]struct{}
+	closing bool
+	wg      sync.WaitGroup
+
+	started  time.Time
+	commands uint64 // atomic
+}
+
+// conn the state of a client connection, only accessed by its goroutine
+type conn struct {
+	net.Conn
+
+	// MULTI state, the queued writes are executed as a WriteBatch by EXEC
+	multi  bool
+	dirty  bool // a command failed to queue, EXEC is aborted
+	queued [][][]byte
+}
+
+func newServer(db *sstable.DB, listener net.Listener, maxConns int) *server {
+	return &server{
+		db:       db,
+		listener: listener,
+		maxConns: maxConns,
+		conns:    make(map[*conn]struct{}),
+		started:  time.Now(),
+	}
+}
+
+// serve accept the connections until shutdown
+func (s *server) serve() error {
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		c := &conn{Conn: nc}
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			_ = nc.Close()
+			continue
+		}
+		if len(s.conns) >= s.maxConns {
+			s.mu.Unlock()
+			_, _ = nc.Write([]byte("-ERR max number of clients reached\r\n"))
+			_ = nc.Close()
+			continue
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.handleConn(c)
+	}
+}
+
+// shutdown stop accepting, let the connections finish the requests in flight, then close the db
+func (s *server) shutdown() error {
+
+	s.mu.Lock()
+	s.closing = true
+	_ = s.listener.Close()
+	for c := range s.conns {
+		// wake up the connections blocked in reading the next request
+		_ = c.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return s.db.Close()
+}
+
+func (s *server) handleConn(c *conn) {
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		_ = c.Close()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(c)
+	w := replyWriter{bufio.NewWriter(c)}
+
+	for {
+		s.mu.Lock()
+		closing := s.closing
+		s.mu.Unlock()
+		if closing {
+			return
+		}
+
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				w.error("ERR " + err.Error())
+				_ = w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		atomic.AddUint64(&s.commands, 1)
+		quit := s.handle(c, args, w)
+
+		// flush after the pipelined requests handled
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// handle run the command and write the reply, return true if the connection should be closed
+func (s *server) handle(c *conn, args [][]byte, w replyWriter) bool {
+
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+
+	if c.multi {
+		switch name {
+		case "EXEC":
+			s.exec(c, w)
+		case "DISCARD":
+			c.multi, c.dirty, c.queued = false, false, nil
+			w.simple("OK")
+		case "MULTI":
+			w.error("ERR MULTI calls can not be nested")
+		case "SET", "DEL":
+			if err := checkArity(name, args); err != nil {
+				c.dirty = true
+				w.error(err.Error())
+				return false
+			}
+			c.queued = append(c.queued, append([][]byte{[]byte(name)}, args...))
+			w.simple("QUEUED")
+		default:
+			c.dirty = true
+			w.error(fmt.Sprintf("ERR command '%s' not allowed in MULTI, only SET and DEL are supported", name))
+		}
+		return false
+	}
+
+	if err := checkArity(name, args); err != nil {
+		w.error(err.Error())
+		return false
+	}
+
+	switch name {
+	case "PING":
+		if len(args) == 1 {
+			w.bulk(args[0])
+		} else {
+			w.simple("PONG")
+		}
+	case "QUIT":
+		w.simple("OK")
+		return true
+	case "GET":
+		s.get(args[0], w)
+	case "SET":
+		if err := s.db.Put(args[0], args[1]); err != nil {
+			w.error("ERR " + err.Error())
+			return false
+		}
+		w.simple("OK")
+	case "DEL":
+		s.del(args, w)
+	case "MGET":
+		w.array(len(args))
+		for _, key := range args {
+			s.get(key, w)
+		}
+	case "SCAN":
+		s.scan(args, w)
+	case "INFO":
+		s.info(w)
+	case "MULTI":
+		c.multi = true
+		w.simple("OK")
+	case "EXEC", "DISCARD":
+		w.error(fmt.Sprintf("ERR %s without MULTI", name))
+	default:
+		w.error(fmt.Sprintf("ERR unknown command '%s'", name))
+	}
+	return false
+}
+
+// checkArity min and max number of args, -1 means no limit
+func checkArity(name string, args [][]byte) error {
+	arity := map[string][2]int{
+		"PING":    {0, 1},
+		"QUIT":    {0, 0},
+		"GET":     {1, 1},
+		"SET":     {2, 2},
+		"DEL":     {1, -1},
+		"MGET":    {1, -1},
+		"SCAN":    {1, 5},
+		"INFO":    {0, 1},
+		"MULTI":   {0, 0},
+		"EXEC":    {0, 0},
+		"DISCARD": {0, 0},
+	}
+	a, ok := arity[name]
+	if !ok {
+		return nil
+	}
+	if len(args) < a[0] || (a[1] >= 0 && len(args) > a[1]) {
+		return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+	}
+	return nil
+}
+
+func (s *server) get(key []byte, w replyWriter) {
+	value, err := s.db.Get(key)
+	if err == sstable.ErrNotFound {
+		w.bulk(nil)
+		return
+	}
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	w.bulk(value)
+}
+
+// del delete the keys in a batch, reply the number of keys existed
+func (s *server) del(keys [][]byte, w replyWriter) {
+	wbi := sstable.NewWriteBatchWithIndex(nil)
+	deleted, err := s.deleteInto(wbi, keys)
+	if err == nil {
+		err = s.db.Write(wbi.Batch())
+	}
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.integer(deleted)
+}
+
+// deleteInto delete the keys in wbi, return the number of keys existed in wbi or db
+func (s *server) deleteInto(wbi *sstable.WriteBatchWithIndex, keys [][]byte) (int64, error) {
+	var deleted int64
+	for _, key := range keys {
+		_, err := wbi.GetFromBatchAndDB(s.db, key)
+		if err == nil {
+			deleted++
+		} else if err != sstable.ErrNotFound {
+			return 0, err
+		}
+		wbi.Delete(key)
+	}
+	return deleted, nil
+}
+
+// exec write the queued commands atomically
+func (s *server) exec(c *conn, w replyWriter) {
+
+	queued, dirty := c.queued, c.dirty
+	c.multi, c.dirty, c.queued = false, false, nil
+
+	if dirty {
+		w.error("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	wbi := sstable.NewWriteBatchWithIndex(nil)
+	replies := make([]int64, len(queued)) // -1 means OK
+	for i, cmd := range queued {
+		switch string(cmd[0]) {
+		case "SET":
+			wbi.Put(cmd[1], cmd[2])
+			replies[i] = -1
+		case "DEL":
+			deleted, err := s.deleteInto(wbi, cmd[1:])
+			if err != nil {
+				w.error("ERR " + err.Error())
+				return
+			}
+			replies[i] = deleted
+		}
+	}
+
+	if wbi.Len() > 0 {
+		if err := s.db.Write(wbi.Batch()); err != nil {
+			w.error("ERR " + err.Error())
+			return
+		}
+	}
+
+	w.array(len(replies))
+	for _, reply := range replies {
+		if reply < 0 {
+			w.simple("OK")
+		} else {
+			w.integer(reply)
+		}
+	}
+}
+
+// scan SCAN cursor [MATCH pattern] [COUNT count], the cursor is the hex encoded next key, "0" means the first key.
+// COUNT is the number of keys iterated, the keys not matched are skipped, see matchGlob for the pattern
+func (s *server) scan(args [][]byte, w replyWriter) {
+
+	var start []byte
+	if cursor := string(args[0]); cursor != "0" {
+		key, err := hex.DecodeString(cursor)
+		if err != nil || len(key) == 0 {
+			w.error("ERR invalid cursor")
+			return
+		}
+		start = key
+	}
+
+	var (
+		pattern []byte
+		count   = defaultScanCount
+	)
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n <= 0 {
+				w.error("ERR value is not an integer or out of range")
+				return
+			}
+			if n > maxScanCount {
+				n = maxScanCount
+			}
+			count = n
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	// merge mem, imm and tables
+	it, err := s.db.NewIterator()
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	defer it.UnRef()
+
+	var ok bool
+	if start == nil {
+		ok = it.SeekFirst()
+	} else {
+		ok = it.Seek(sstable.InternalKey(start))
+	}
+
+	var keys [][]byte
+	for n := 0; ok && n < count; n++ {
+		key := it.Key()
+		if pattern == nil || matchGlob(pattern, key) {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+		ok = it.Next()
+	}
+	if err := it.Valid(); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+
+	next := "0"
+	if ok {
+		next = hex.EncodeToString(it.Key())
+	}
+
+	w.array(2)
+	w.bulk([]byte(next))
+	w.array(len(keys))
+	for _, key := range keys {
+		w.bulk(key)
+	}
+}
+
+// matchGlob report whether key matches the redis style glob pattern, unlike path.Match '*' matches '/' too
+//
+//	user:*      '*' matches any bytes
+//	user:?      '?' matches any byte
+//	[a-z]       a byte in the set, [^a-z] a byte not in the set
+//	\*          the escaped byte itself
+func matchGlob(pattern, key []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchGlob(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			matched, rest := matchClass(pattern[1:], key[0])
+			if !matched {
+				return false
+			}
+			pattern, key = rest, key[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		}
+	}
+	return len(key) == 0
+}
+
+// matchClass match c against the set following '[', return the pattern after ']'.
+// an unterminated set ends at the end of pattern like redis
+func matchClass(pattern []byte, c byte) (bool, []byte) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			matched = matched || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (c >= lo && c <= hi)
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return matched != negate, pattern
+}
+
+func (s *server) info(w replyWriter) {
+
+	s.mu.Lock()
+	clients := len(s.conns)
+	s.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Server\r\nuptime_in_seconds:%d\r\n\r\n", int(time.Since(s.started).Seconds()))
+	fmt.Fprintf(&b, "# Clients\r\nconnected_clients:%d\r\nmaxclients:%d\r\n\r\n", clients, s.maxConns)
+	fmt.Fprintf(&b, "# Stats\r\ntotal_commands_processed:%d\r\nlatest_sequence:%d\r\n\r\n",
+		atomic.LoadUint64(&s.commands), s.db.LatestSequence())
+
+	levels, err := s.db.Levels()
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	b.WriteString("# Levels\r\n")
+	for _, level := range levels {
+		fmt.Fprintf(&b, "level%d:files=%d,bytes=%d\r\n", level.Level, len(level.Files), level.Size)
+	}
+
+	w.bulk([]byte(b.String()))
+}
+
+func logf(format string, args ...interface{}) {
+	log.Printf("kvserver: "+format, args...)
+}
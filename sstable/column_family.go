@@ -0,0 +1,431 @@
+package sstable
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	kDefaultColumnFamilyID   = 0
+	kDefaultColumnFamilyName = "default"
+)
+
+/**
+column families, the keyspaces share one journal and one manifest
+
+	db.VersionSet (default family, root) -> nextFileNum, stSeqNum, manifest
+	    \-> families[id] -> VersionSet -> versions, compactPtrs, tableCache, comparer
+	db.mem/imm (default family)
+	db.families[id] -> mem/imm
+
+	manifest: the edits of a family start with kColumnFamily, created by kAddColumnFamily,
+	          removed by kDropColumnFamily, the edits without kColumnFamily belong to default family
+	journal:  one batch may contain the records of several families, which are applied atomically,
+	          each family skips the journals older than its stJournalNum while recovering
+
+	all mems are frozen together when any of them is full, so the obsolete journal is the one
+	older than the minimum stJournalNum of the families
+**/
+
+// ColumnFamilyOptions the options of a column family, the other options are shared with the db
+type ColumnFamilyOptions struct {
+	// Comparer the user key comparer, nil means DefaultComparer, it can't be changed once the family created
+	Comparer BasicComparer
+
+	// Filter the filter of tables, nil means the default bloom filter
+	Filter IFilter
+}
+
+// ColumnFamilyHandle identify a column family, it's invalid once the family dropped
+type ColumnFamilyHandle struct {
+	id   uint32
+	name string
+}
+
+func (h *ColumnFamilyHandle) ID() uint32 {
+	return h.id
+}
+
+func (h *ColumnFamilyHandle) Name() string {
+	return h.name
+}
+
+var defaultColumnFamily = &ColumnFamilyHandle{
+	id:   kDefaultColumnFamilyID,
+	name: kDefaultColumnFamilyName,
+}
+
+// columnFamily the memtables of a non default family, the default one is kept in DB
+type columnFamily struct {
+	handle *ColumnFamilyHandle
+	vSet   *VersionSet
+
+	mem *MemDB
+	imm *MemDB
+}
+
+// rootSet the VersionSet owning the file numbers and manifest
+func (vSet *VersionSet) rootSet() *VersionSet {
+	if vSet.root == nil {
+		return vSet
+	}
+	return vSet.root
+}
+
+// liveFamilies the non default families which are not dropped, ordered by id
+func (vSet *VersionSet) liveFamilies() []*VersionSet {
+	families := make([]*VersionSet, 0, len(vSet.families))
+	for _, family := range vSet.families {
+		if !family.dropped {
+			families = append(families, family)
+		}
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].familyID < families[j].familyID
+	})
+	return families
+}
+
+// newFamilyVersionSet the VersionSet of a non default family, nil cfOpt means the default options
+func (vSet *VersionSet) newFamilyVersionSet(id uint32, name string, cfOpt *ColumnFamilyOptions) *VersionSet {
+
+	opt := *vSet.opt
+	cmp := IComparer
+	if cfOpt != nil && cfOpt.Comparer != nil {
+		cmp = &iComparer{uCmp: cfOpt.Comparer}
+	}
+
+	family := &VersionSet{
+		cmp:          cmp,
+		opt:          &opt,
+		comparerName: cmp.uCmp.Name(),
+		storage:      vSet.storage,
+		tableCache:   NewTableCache(vSet.storage, kDefaultCacheFileNums, fnv.New32a()),
+		versions:     list.New(),
+		snapshots:    vSet.snapshots,
+		manifestCond: vSet.manifestCond,
+		root:         vSet,
+		familyID:     id,
+		familyName:   name,
+	}
+	family.tableOperation = newTableOperation(vSet.storage, family)
+	if cfOpt != nil && cfOpt.Filter != nil {
+		family.tableCache.filter = cfOpt.Filter
+		family.tableOperation.filter = cfOpt.Filter
+	}
+	return family
+}
+
+// purgeDroppedFamilies forget the dropped families which are not being compacted,
+// then their tables are removed as obsolete files
+// required: mutex held
+func (vSet *VersionSet) purgeDroppedFamilies() {
+	for id, family := range vSet.families {
+		if family.dropped && !family.levelsCompacting(0, kLevelNum-1) {
+			delete(vSet.families, id)
+		}
+	}
+}
+
+// openColumnFamilies create the memtables of the recovered families
+// required: mutex held
+func (db *DB) openColumnFamilies() {
+	assertMutexHeld(&db.rwMutex)
+	for _, family := range db.VersionSet.liveFamilies() {
+		mem := NewMemTable(0, family.cmp)
+		mem.Ref()
+		db.families[family.familyID] = &columnFamily{
+			handle: &ColumnFamilyHandle{id: family.familyID, name: family.familyName},
+			vSet:   family,
+			mem:    mem,
+		}
+	}
+}
+
+// DefaultColumnFamily the family of Get, Put and Delete, it can't be dropped
+func (db *DB) DefaultColumnFamily() *ColumnFamilyHandle {
+	return defaultColumnFamily
+}
+
+// ColumnFamily return the handle of the family by name
+func (db *DB) ColumnFamily(name string) (*ColumnFamilyHandle, error) {
+	if name == kDefaultColumnFamilyName {
+		return defaultColumnFamily, nil
+	}
+
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+	for _, cf := range db.families {
+		if cf.handle.name == name {
+			return cf.handle, nil
+		}
+	}
+	return nil, ErrColumnFamilyNotFound
+}
+
+// ColumnFamilies return the handles of all families, the default family is the first
+func (db *DB) ColumnFamilies() []*ColumnFamilyHandle {
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	handles := []*ColumnFamilyHandle{defaultColumnFamily}
+	for _, family := range db.VersionSet.liveFamilies() {
+		if cf, ok := db.families[family.familyID]; ok {
+			handles = append(handles, cf.handle)
+		}
+	}
+	return handles
+}
+
+// CreateColumnFamily create an empty family, the creation is persisted in manifest before return
+func (db *DB) CreateColumnFamily(name string, opt *ColumnFamilyOptions) (*ColumnFamilyHandle, error) {
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return nil, ErrClosed
+	}
+
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("%w, empty column family name", ErrInvalidOption)
+	}
+
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+
+	// no write could run while the family is being created, so the journal is not switched
+	w := db.waitForWriteTurn()
+	defer db.finishWriteTurn(w)
+
+	if name == kDefaultColumnFamilyName {
+		return nil, ErrColumnFamilyExists
+	}
+	for _, cf := range db.families {
+		if cf.handle.name == name {
+			return nil, ErrColumnFamilyExists
+		}
+	}
+
+	root := db.VersionSet
+	id := root.nextFamilyID
+	family := root.newFamilyVersionSet(id, name, opt)
+
+	// the records of the family in current journal are newer than the creation
+	edit := &VersionEdit{}
+	edit.addColumnFamily(name, family.cmp.uCmp.Name())
+	edit.setLogNum(db.journalFd.Num)
+	if err := family.logAndApply(edit, &db.rwMutex); err != nil {
+		return nil, err
+	}
+
+	root.nextFamilyID++
+	root.families[id] = family
+
+	mem := NewMemTable(0, family.cmp)
+	mem.Ref()
+	cf := &columnFamily{
+		handle: &ColumnFamilyHandle{id: id, name: name},
+		vSet:   family,
+		mem:    mem,
+	}
+	db.families[id] = cf
+
+	root.logger().Infof("created column family %s, id=%d", name, id)
+	return cf.handle, nil
+}
+
+// DropColumnFamily drop the family and its data, the tables are removed after the running compactions of it finish
+func (db *DB) DropColumnFamily(h *ColumnFamilyHandle) error {
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return ErrClosed
+	}
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	if h.id == kDefaultColumnFamilyID {
+		return fmt.Errorf("%w, the default column family can't be dropped", ErrInvalidOption)
+	}
+
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+
+	w := db.waitForWriteTurn()
+	defer db.finishWriteTurn(w)
+
+	cf, ok := db.families[h.id]
+	if !ok {
+		return ErrColumnFamilyNotFound
+	}
+
+	edit := &VersionEdit{}
+	edit.dropColumnFamily()
+	if err := cf.vSet.logAndApply(edit, &db.rwMutex); err != nil {
+		return err
+	}
+
+	// the running flush and compactions of the family fail with ErrColumnFamilyDropped
+	cf.vSet.dropped = true
+	delete(db.families, h.id)
+	cf.mem.UnRef()
+	if cf.imm != nil {
+		cf.imm.UnRef()
+	}
+
+	db.VersionSet.logger().Infof("dropped column family %s, id=%d", h.name, h.id)
+
+	if err := db.removeObsoleteFiles(); err != nil {
+		db.VersionSet.logger().Warnf("remove obsolete files failed, err=%v", err)
+	}
+	return nil
+}
+
+// checkColumnFamilies the families written by batch must exist
+// required: mutex held
+func (db *DB) checkColumnFamilies(batch *WriteBatch) error {
+	for _, id := range batch.families {
+		if _, ok := db.families[id]; !ok {
+			return fmt.Errorf("%w, id=%d", ErrColumnFamilyNotFound, id)
+		}
+	}
+	return nil
+}
+
+// memTables the mems of all families by id, each mem is referenced
+// required: mutex held
+func (db *DB) memTables() map[uint32]*MemDB {
+	mems := make(map[uint32]*MemDB, len(db.families)+1)
+	mems[kDefaultColumnFamilyID] = db.mem
+	for id, cf := range db.families {
+		mems[id] = cf.mem
+	}
+	for _, mem := range mems {
+		mem.Ref()
+	}
+	return mems
+}
+
+// memTablesFull report whether any mem exceeds the write buffer size
+// required: mutex held
+func (db *DB) memTablesFull() bool {
+	if db.mem.ApproximateSize() > db.VersionSet.opt.WriteBufferSize {
+		return true
+	}
+	for _, cf := range db.families {
+		if cf.mem.ApproximateSize() > cf.vSet.opt.WriteBufferSize {
+			return true
+		}
+	}
+	return false
+}
+
+// memTablesEmpty report whether the mems of all families are empty
+// required: mutex held
+func (db *DB) memTablesEmpty() bool {
+	if db.mem.Size() > 0 {
+		return false
+	}
+	for _, cf := range db.families {
+		if cf.mem.Size() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// minJournalNum the journals older than it are not needed by any family
+// required: mutex held
+func (db *DB) minJournalNum() uint64 {
+	num := db.VersionSet.stJournalNum
+	for _, family := range db.VersionSet.liveFamilies() {
+		if family.stJournalNum < num {
+			num = family.stJournalNum
+		}
+	}
+	return num
+}
+
+// flushColumnFamilies flush the imm of each family into level0 table, the flushed families are
+// persisted with the current journal, so a failed flush only retries the unflushed families
+// required: mutex held
+func (db *DB) flushColumnFamilies() error {
+
+	assertMutexHeld(&db.rwMutex)
+
+	for _, family := range db.VersionSet.liveFamilies() {
+		cf, ok := db.families[family.familyID]
+		if !ok || cf.imm == nil {
+			continue
+		}
+
+		edit := &VersionEdit{}
+		err := db.writeLevel0Table(family.tableOperation, cf.imm, edit)
+		if err == nil {
+			edit.setLogNum(db.journalFd.Num)
+			err = family.logAndApply(edit, &db.rwMutex)
+			family.releaseEditOutputs(edit)
+		}
+
+		if err == ErrColumnFamilyDropped {
+			// dropped while flushing, the imm is released by DropColumnFamily
+			continue
+		} else if err != nil {
+			return fmt.Errorf("column family %s: %w", family.familyName, err)
+		}
+
+		cf.imm.UnRef()
+		cf.imm = nil
+	}
+
+	return nil
+}
+
+func (db *DB) GetCF(h *ColumnFamilyHandle, key []byte) ([]byte, error) {
+
+	if h.id == kDefaultColumnFamilyID {
+		return db.Get(key)
+	}
+
+	db.rwMutex.RLock()
+	cf, ok := db.families[h.id]
+	if !ok {
+		db.rwMutex.RUnlock()
+		return nil, ErrColumnFamilyNotFound
+	}
+	v := cf.vSet.getCurrent()
+	mem := cf.mem
+	imm := cf.imm
+	v.Ref()
+	mem.Ref()
+	if imm != nil {
+		imm.Ref()
+	}
+	seq := db.seqNum
+	db.rwMutex.RUnlock()
+
+	return db.get(v, mem, imm, seq, key)
+}
+
+func (db *DB) PutCF(h *ColumnFamilyHandle, key []byte, value []byte) error {
+	wb := &WriteBatch{}
+	wb.PutCF(h, key, value)
+	return db.write(wb)
+}
+
+func (db *DB) DeleteCF(h *ColumnFamilyHandle, key []byte) error {
+	wb := &WriteBatch{}
+	wb.DeleteCF(h, key)
+	return db.write(wb)
+}
+
+// Write apply the batch atomically, the batch may write several column families
+func (db *DB) Write(batch *WriteBatch) error {
+	return db.write(batch)
+}
@@ -0,0 +1,99 @@
+package sstable
+
+import (
+	"bytes"
+	"testing"
+)
+
+type bytesSequentialReader struct {
+	*bytes.Reader
+}
+
+func (r bytesSequentialReader) Close() error { return nil }
+
+func TestColumnFamilyEditRoundTrip(t *testing.T) {
+
+	edit := &VersionEdit{}
+	edit.setColumnFamily(3)
+	edit.addColumnFamily("index", DefaultComparer.Name())
+
+	var buf bytes.Buffer
+	edit.EncodeTo(&buf)
+	if edit.err != nil {
+		t.Fatal(edit.err)
+	}
+
+	decoded := &VersionEdit{}
+	decoded.DecodeFrom(bytesSequentialReader{bytes.NewReader(buf.Bytes())})
+	if decoded.err != nil {
+		t.Fatal(decoded.err)
+	}
+
+	if !decoded.hasRec(kColumnFamily) || decoded.familyID != 3 {
+		t.Fatalf("expect column family 3, got %d", decoded.familyID)
+	}
+	if !decoded.hasRec(kAddColumnFamily) || string(decoded.familyName) != "index" ||
+		!bytes.Equal(decoded.familyComparer, DefaultComparer.Name()) {
+		t.Fatalf("unexpected added family %q, comparer %q", decoded.familyName, decoded.familyComparer)
+	}
+	if decoded.hasRec(kDropColumnFamily) {
+		t.Fatal("unexpected drop record")
+	}
+}
+
+func TestWriteBatchColumnFamilies(t *testing.T) {
+
+	index := &ColumnFamilyHandle{id: 2, name: "index"}
+
+	wb := &WriteBatch{}
+	wb.Put([]byte("k1"), []byte("v1"))
+	wb.PutCF(index, []byte("k2"), []byte("v2"))
+	wb.DeleteCF(index, []byte("k3"))
+	wb.DeleteCF(defaultColumnFamily, []byte("k4"))
+	wb.SetSequence(10)
+
+	decoded, err := decodeBatchChunk(wb.Contents(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.families) != 1 || decoded.families[0] != index.id {
+		t.Fatalf("expect family %d written, got %v", index.id, decoded.families)
+	}
+
+	type record struct {
+		familyID uint32
+		kt       keyType
+		ukey     string
+		seq      Sequence
+		value    string
+	}
+	expect := []record{
+		{kDefaultColumnFamilyID, keyTypeValue, "k1", 10, "v1"},
+		{index.id, keyTypeValue, "k2", 11, "v2"},
+		{index.id, keyTypeDel, "k3", 12, ""},
+		{kDefaultColumnFamilyID, keyTypeDel, "k4", 13, ""},
+	}
+
+	var got []record
+	err = decoded.foreach(func(familyID uint32, kt keyType, ukey []byte, seq Sequence, value []byte) error {
+		got = append(got, record{familyID, kt, string(ukey), seq, string(value)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("expect %d records, got %d", len(expect), len(got))
+	}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Fatalf("record %d, expect %+v, got %+v", i, expect[i], got[i])
+		}
+	}
+
+	// a truncated batch is corrupted
+	contents := wb.Contents()
+	if _, err = decodeBatchChunk(contents[:len(contents)-1], 0); err == nil {
+		t.Fatal("expect truncated batch rejected")
+	}
+}
@@ -19,7 +19,7 @@ const (
 )
 
 func buildInternalKey(dst, uKey []byte, kt keyType, sequence Sequence) InternalKey {
-	dst = ensureBuffer(dst, len(dst)+8)
+	dst = ensureBuffer(dst, len(uKey)+8)
 	n := copy(dst, uKey)
 	binary.LittleEndian.PutUint64(dst[n:], (uint64(sequence)<<8)|uint64(kt))
 	return dst
@@ -81,94 +81,6 @@ func (vSet *VersionSet) pickCompaction() *Compaction {
 
 }
 
-func (vSet *VersionSet) finishCompactionOutputFile(tableWriter *TableWriter) error {
-	return nil
-}
-
-func (vSet *VersionSet) doCompaction(compaction *Compaction) error {
-
-	if len(compaction.tFiles[0]) == 1 &&
-		len(compaction.tFiles[1]) == 0 &&
-		len(compaction.gp) <= defaultGPOverlappedLimit {
-		// just update the manifest
-		edit := VersionEdit{}
-		tFile := compaction.tFiles[0][0]
-		edit.addNewTable(0, tFile.Size, tFile.fd.Num, tFile.iMin, tFile.iMax)
-
-	}
-
-	var (
-		hasCurrentUserKey   = false
-		currentUserKey      []byte
-		lastUserKeySequence = kMaxSequenceNum
-		minSeq              = compaction.minSeq
-	)
-
-	iter, err := compaction.makeInputMergedIterator()
-	if err != nil {
-		return err
-	}
-	defer iter.UnRef()
-
-	for iter.Next() {
-
-		if err := iter.Valid(); err != nil {
-			return err
-		}
-
-		var drop = false
-
-		ikey := iter.Key()
-		if compaction.tWriter != nil && compaction.shouldStopBefore(ikey) {
-			err := compaction.finishCompactionOutputFile()
-			if err != nil {
-				return err
-			}
-		}
-
-		ukey, kt, useq, kerr := parseInternalKey(ikey)
-		if kerr != nil {
-			hasCurrentUserKey = false
-			currentUserKey = nil
-			lastUserKeySequence = kMaxSequenceNum
-		} else {
-
-			if !hasCurrentUserKey || bytes.Compare(ukey, currentUserKey) != 0 {
-				currentUserKey = ukey
-				hasCurrentUserKey = true
-				lastUserKeySequence = kMaxSequenceNum
-			}
-
-			if lastUserKeySequence <= minSeq {
-				drop = true
-			} else if kt == keyTypeDel && useq <= minSeq && compaction.isBaseLevelForKey(currentUserKey) {
-				drop = true
-			}
-			lastUserKeySequence = useq
-		}
-
-		if !drop {
-			if compaction.tableWriter == nil {
-				builder, err := fileMeta.createNewTable(defaultCompactionTableSize)
-				if err != nil {
-					return err
-				}
-				compaction.tableWriter = builder
-			}
-
-			compaction.tableWriter.Append(ikey, iter.Value())
-			if compaction.tableWriter.fileSize() >= defaultCompactionTableSize {
-				cErr := fileMeta.finishCompactionOutputFile(compaction.tableWriter)
-				if cErr != nil {
-					return cErr
-				}
-			}
-		}
-
-	}
-	return nil
-}
-
 func newCompaction(inputLevel int, s0 tFiles, levels Levels, tableOperation *tableOperation) *Compaction {
 	c := &Compaction{
 		inputLevel:        inputLevel,
@@ -321,7 +233,7 @@ func (c *Compaction) makeInputMergedIterator() (iter Iterator, err error) {
 				iters = append(iters, iter)
 			}
 		} else {
-			indexedIterator := newIndexedIterator(newTFileArrIteratorIndexer(tFile))
+			indexedIterator := newIndexedIterator(newTFileArrIteratorIndexer(tFile, c.tableOperation.newIterator))
 			iters = append(iters, indexedIterator)
 		}
 	}
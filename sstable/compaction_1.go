@@ -3,7 +3,9 @@ package sstable
 import (
 	"bytes"
 	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type compaction1 struct {
@@ -29,42 +31,102 @@ type compaction1 struct {
 	edit           VersionEdit
 
 	baseLevelI [kLevelNum]int
+
+	outputLevel       int
+	maxOutputFileSize int
+
+	// universal compaction, merge the sorted runs into outputLevel
+	runs       []sortedRun
+	bottommost bool // the oldest run is included
+
+	// subcompaction, only compact the user keys in [start, end), nil means unbounded
+	start, end []byte
+
+	// fifo compaction, the inputs are dropped without rewriting
+	dropInputs bool
 }
 
+// pickCompaction1 pick a level compaction, the levels being compacted are skipped
+// required: mutex held
 func (vSet *VersionSet) pickCompaction1() *compaction1 {
-	sizeCompaction := vSet.current.cScore >= 1
+	cLevel, sizeCompaction := vSet.pickSizeCompactionLevel()
+	seekCompaction := vSet.current.seekCompactFile != nil &&
+		!vSet.levelsCompacting(vSet.current.seekCompactLevel, vSet.current.seekCompactLevel+1)
 
-	if !sizeCompaction {
-		return nil
-	}
+	var (
+		cPtr   compactPtr
+		inputs = make(tFiles, 0)
+	)
 
-	cLevel := vSet.current.cLevel
-	assert(cLevel < kLevelNum)
+	// size compaction is prior to seek compaction
+	if sizeCompaction {
+		assert(cLevel < kLevelNum-1)
 
-	level := vSet.current.levels[cLevel]
+		level := vSet.current.levels[cLevel]
 
-	inputs := make(tFiles, 0)
+		cPtr = vSet.compactPtrs[cLevel]
+		if cPtr.ikey != nil {
 
-	cPtr := vSet.compactPtrs[cLevel]
-	if cPtr.ikey != nil {
+			idx := sort.Search(len(level), func(i int) bool {
+				return vSet.cmp.Compare(level[i].iMax, cPtr.ikey) > 0
+			})
 
-		idx := sort.Search(len(level), func(i int) bool {
-			return vSet.cmp.Compare(level[i].iMax, cPtr.ikey) > 0
-		})
+			if idx < len(level) {
+				inputs = append(inputs, level[idx])
+			}
+		}
 
-		if idx < len(level) {
-			inputs = append(inputs, level[idx])
+		if len(inputs) == 0 {
+			inputs = append(inputs, level[0])
 		}
+	} else if seekCompaction {
+		cLevel = vSet.current.seekCompactLevel
+		cPtr = vSet.compactPtrs[cLevel]
+		inputs = append(inputs, *vSet.current.seekCompactFile)
+	} else {
+		return nil
 	}
 
-	if len(inputs) == 0 {
-		inputs = append(inputs, level[0])
-	}
+	cPtr.level = cLevel
 
 	return newCompaction1(inputs, cPtr, vSet.current, vSet.tableOperation,
 		vSet.current.levels, vSet.cmp)
 }
 
+// pickSizeCompactionLevel return the level with the highest score, whose level and next level are not being compacted
+func (vSet *VersionSet) pickSizeCompactionLevel() (cLevel int, ok bool) {
+	v := vSet.current
+	bestScore := float64(1)
+	for level := 0; level < kLevelNum-1; level++ {
+		if v.cScores[level] >= bestScore && !vSet.levelsCompacting(level, level+1) {
+			bestScore = v.cScores[level]
+			cLevel = level
+			ok = true
+		}
+	}
+	return
+}
+
+// levelsCompacting report whether any level in [lo, hi] is being compacted
+// required: mutex held
+func (vSet *VersionSet) levelsCompacting(lo, hi int) bool {
+	for level := lo; level <= hi; level++ {
+		if vSet.compactingLevels[level] {
+			return true
+		}
+	}
+	return false
+}
+
+// markCompacting mark or unmark the levels of compaction as being compacted
+// required: mutex held
+func (vSet *VersionSet) markCompacting(c *compaction1, compacting bool) {
+	for level := c.cPtr.level; level <= c.outputLevel; level++ {
+		assert(vSet.compactingLevels[level] != compacting)
+		vSet.compactingLevels[level] = compacting
+	}
+}
+
 func newCompaction1(inputs tFiles, cPtr compactPtr, version *Version, tableOperation *tableOperation,
 	levels Levels, cmp BasicComparer) *compaction1 {
 	version.Ref()
@@ -76,6 +138,8 @@ func newCompaction1(inputs tFiles, cPtr compactPtr, version *Version, tableOpera
 		cmp:               cmp,
 		gpOverlappedLimit: defaultGPOverlappedLimit * defaultCompactionTableSize,
 		tableOperation:    tableOperation,
+		outputLevel:       cPtr.level + 1,
+		maxOutputFileSize: defaultCompactionTableSize,
 	}
 	c.expand()
 	return c
@@ -87,118 +151,95 @@ func (c *compaction1) expand() {
 
 	vs0, vs1 := c.levels[c.cPtr.level], c.levels[c.cPtr.level+1]
 
-	imin, imax := append(t0, t1...).getRange1(c.cmp)
+	imin, imax := t0.getRange1(c.cmp)
 	if c.cPtr.level == 0 {
-		vs0.getOverlapped1(&t0, imin, imax, true)
+		t0 = vs0.getOverlapped1(t0[:0:0], imin, imax, true)
 
 		// recalculate the imin and imax
-		imin, imax = append(t0, t1...).getRange1(c.cmp)
+		imin, imax = t0.getRange1(c.cmp)
 	}
 
-	vs1.getOverlapped1(&t1, imin, imax, false)
+	t1 = vs1.getOverlapped1(t1[:0:0], imin, imax, false)
 
-	imin, imax = append(t0, t1...).getRange1(c.cmp)
-	var tmpT0 tFiles
-	vs0.getOverlapped1(&tmpT0, imin, imax, c.cPtr.level == 0)
+	amin, amax := append(t0[:len(t0):len(t0)], t1...).getRange1(c.cmp)
 
 	// see if we can expand the input 0 level file
-	if len(tmpT0) > len(t0) {
-		amin, amax := append(tmpT0, t1...).getRange1(c.cmp)
-		var tmpT1 tFiles
-		vs1.getOverlapped1(&tmpT1, amin, amax, false)
-		// compact level must not change
-		if len(tmpT1) == len(t1) && tmpT0.size()+vs1.size() < defaultCompactionTableSize*defaultCompactionExpandS0LimitFactor {
-			t0 = tmpT0
-			imin, imax = amin, amax
+	if len(t1) > 0 {
+		tmpT0 := vs0.getOverlapped1(nil, amin, amax, c.cPtr.level == 0)
+		if len(tmpT0) > len(t0) && tmpT0.size()+t1.size() < defaultCompactionTableSize*defaultCompactionExpandS0LimitFactor {
+			xmin, xmax := tmpT0.getRange1(c.cmp)
+			tmpT1 := vs1.getOverlapped1(nil, xmin, xmax, false)
+			// compact level must not change
+			if len(tmpT1) == len(t1) {
+				t0 = tmpT0
+				amin, amax = append(tmpT0[:len(tmpT0):len(tmpT0)], t1...).getRange1(c.cmp)
+			}
 		}
 	}
 
 	// calculate the grand parent's
 	gpLevel := c.cPtr.level + 2
 	if gpLevel < kLevelNum {
-		vs2 := c.levels[c.cPtr.level+2]
-		vs2.getOverlapped1(&c.gp, imin, imax, false)
+		c.gp = c.levels[gpLevel].getOverlapped1(c.gp[:0], amin, amax, false)
 	}
 
+	c.inputs[0], c.inputs[1] = t0, t1
 }
 
-func (tFiles tFiles) getOverlapped1(dst *tFiles, imin InternalKey, imax InternalKey, overlapped bool) {
+// getOverlapped1 append the files overlapped with the user key range of [imin, imax] to dst,
+// if overlapped is true the files may overlap each other, the range is expanded until no more file overlapped
+func (tFiles tFiles) getOverlapped1(dst tFiles, imin InternalKey, imax InternalKey, overlapped bool) tFiles {
 
 	umin := imin.ukey()
 	umax := imax.ukey()
 
 	if overlapped {
-		i := 0
-		for ; i < len(tFiles); i++ {
-			if tFiles[i].overlapped1(imin, imax) {
-				tMinR := bytes.Compare(tFiles[i].iMin.ukey(), umin)
-				tMaxR := bytes.Compare(tFiles[i].iMax.ukey(), umax)
-
-				if tMinR >= 0 && tMaxR <= 0 {
-					*dst = append(*dst, tFiles[i])
-				} else {
-					i = 0
-					*dst = (*dst)[:0]
-					if tMinR < 0 {
-						umin = tFiles[i].iMin.ukey()
-					}
-					if tMaxR > 0 {
-						umax = tFiles[i].iMax.ukey()
-					}
-				}
+		for i := 0; i < len(tFiles); {
+			t := tFiles[i]
+			i++
+			if !t.overlapped1(umin, umax) {
+				continue
 			}
+			if tMin := t.iMin.ukey(); bytes.Compare(tMin, umin) < 0 {
+				umin, dst, i = tMin, dst[:0], 0
+				continue
+			}
+			if tMax := t.iMax.ukey(); bytes.Compare(tMax, umax) > 0 {
+				umax, dst, i = tMax, dst[:0], 0
+				continue
+			}
+			dst = append(dst, t)
 		}
-	} else {
-
-		var (
-			begin int
-			end   int
-		)
-
-		idx := sort.Search(len(tFiles), func(i int) bool {
-			return bytes.Compare(tFiles[i].iMin.ukey(), umin) <= 0
-		})
-
-		if idx == 0 {
-			begin = 0
-		} else if idx < len(tFiles) && bytes.Compare(tFiles[idx].iMax.ukey(), umin) <= 0 {
-			begin -= 1
-		} else {
-			begin = idx
-		}
-
-		idx = sort.Search(len(tFiles), func(i int) bool {
-			return bytes.Compare(tFiles[i].iMax.ukey(), umax) >= 0
-		})
-
-		if idx == len(tFiles) {
-			end = idx
-		} else if idx < len(tFiles) && bytes.Compare(tFiles[idx].iMin.ukey(), umax) <= 0 {
-			end = idx + 1
-		} else {
-			end = idx
-		}
-
-		assert(end >= begin)
-		*dst = append(*dst, tFiles[begin:end]...)
+		return dst
 	}
 
+	// the files are sorted and not overlapped
+	begin := sort.Search(len(tFiles), func(i int) bool {
+		return bytes.Compare(tFiles[i].iMax.ukey(), umin) >= 0
+	})
+	end := sort.Search(len(tFiles), func(i int) bool {
+		return bytes.Compare(tFiles[i].iMin.ukey(), umax) > 0
+	})
+	if begin < end {
+		dst = append(dst, tFiles[begin:end]...)
+	}
+	return dst
 }
 
-func (tFile tFile) overlapped1(imin InternalKey, imax InternalKey) bool {
-	if bytes.Compare(tFile.iMax.ukey(), imin.ukey()) < 0 ||
-		bytes.Compare(tFile.iMin.ukey(), imax.ukey()) > 0 {
+func (tFile tFile) overlapped1(umin, umax []byte) bool {
+	if bytes.Compare(tFile.iMax.ukey(), umin) < 0 ||
+		bytes.Compare(tFile.iMin.ukey(), umax) > 0 {
 		return false
 	}
 	return true
 }
 
 func (tFiles tFiles) getRange1(cmp BasicComparer) (imin, imax InternalKey) {
-	for _, tFile := range tFiles {
-		if cmp.Compare(tFile.iMin, imin) < 0 {
+	for i, tFile := range tFiles {
+		if i == 0 || cmp.Compare(tFile.iMin, imin) < 0 {
 			imin = tFile.iMin
 		}
-		if cmp.Compare(tFile.iMax, imax) > 0 {
+		if i == 0 || cmp.Compare(tFile.iMax, imax) > 0 {
 			imax = tFile.iMax
 		}
 	}
@@ -207,36 +248,126 @@ func (tFiles tFiles) getRange1(cmp BasicComparer) (imin, imax InternalKey) {
 
 func (db *DB) doCompactionWork(c *compaction1) error {
 
+	// the compaction may belong to a column family
+	vSet := c.version.vSet
+
 	if db.VersionSet.snapshots.Len() == 0 {
 		c.minSeq = db.seqNum
 	} else {
 		c.minSeq = db.VersionSet.snapshots.Front().Value.(Sequence)
 	}
 
-	iter, iterErr := db.VersionSet.makeInputIterator(c)
-	if iterErr != nil {
-		return iterErr
+	var (
+		listeners = vSet.listeners()
+		info      = c.compactionJobInfo()
+		start     = time.Now()
+	)
+	listeners.notify(func(l EventListener) {
+		l.OnCompactionBegin(info)
+	})
+
+	subs := c.split(vSet.opt.MaxSubcompactions)
+
+	iters := make([]Iterator, 0, len(subs))
+	for _, sub := range subs {
+		iter, iterErr := vSet.makeInputIterator(sub)
+		if iterErr != nil {
+			for _, iter := range iters {
+				iter.UnRef()
+			}
+			return iterErr
+		}
+		iters = append(iters, iter)
 	}
 
 	db.rwMutex.Unlock()
 
+	errs := make([]error, len(subs))
+	if len(subs) == 1 {
+		errs[0] = db.runSubcompaction(subs[0], iters[0])
+	} else {
+		var wg sync.WaitGroup
+		for i := range subs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = db.runSubcompaction(subs[i], iters[i])
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	db.rwMutex.Lock()
+
+	var err error
+	for i, sub := range subs {
+		if err == nil {
+			err = errs[i]
+		}
+		if sub != c {
+			c.edit.addedTables = append(c.edit.addedTables, sub.edit.addedTables...)
+			if sub.tWriter != nil {
+				sub.tWriter.drop()
+			}
+		}
+	}
+
+	if err == nil {
+		c.addInputDeletions()
+		err = vSet.logAndApply(&c.edit, &db.rwMutex)
+	}
+	vSet.releaseEditOutputs(&c.edit)
+
+	for _, t := range c.edit.addedTables {
+		info.Outputs = append(info.Outputs, TableFileInfo{Level: t.level, FileNum: t.number, Size: t.size})
+		info.OutputBytes += t.size
+	}
+	info.Duration = time.Since(start)
+	info.Err = err
+	if err == nil {
+		atomic.AddUint64(&db.metrics.compactions, 1)
+		atomic.AddUint64(&db.metrics.compactionReadBytes, uint64(info.InputBytes))
+		atomic.AddUint64(&db.metrics.compactionWriteBytes, uint64(info.OutputBytes))
+	}
+	listeners.notify(func(l EventListener) {
+		l.OnCompactionCompleted(info)
+	})
+
+	if err == nil {
+		vSet.logger().Infof("compacted %d tables of level %d => %d tables of level %d, %d bytes => %d bytes, %d subcompactions, duration %v",
+			len(info.Inputs), info.InputLevel, len(info.Outputs), info.OutputLevel, info.InputBytes, info.OutputBytes, len(subs), info.Duration)
+	}
+
+	return err
+
+}
+
+// runSubcompaction merge the input keys in [c.start, c.end) into the output tables, the iter is released
+func (db *DB) runSubcompaction(c *compaction1, iter Iterator) error {
+
+	defer iter.UnRef()
+
 	var (
 		drop     bool
 		err      error
 		lastIKey InternalKey
 		lastSeq  Sequence
+		ok       bool
 	)
 
-	for iter.Next() && iter.Valid() == nil && atomic.LoadUint32(&db.shutdown) == 0 {
+	if c.start != nil {
+		ok = iter.Seek(buildInternalKey(make([]byte, len(c.start)), c.start, kTypeSeek, Sequence(kMaxSequenceNum)))
+	} else {
+		ok = iter.Next()
+	}
+
+	for ; ok && iter.Valid() == nil && atomic.LoadUint32(&db.shutdown) == 0; ok = iter.Next() {
 
-		if atomic.LoadUint32(&db.hasImm) == 1 {
-			db.rwMutex.Lock()
-			db.compactMemTable()
-			db.backgroundWorkFinishedSignal.Broadcast()
-			db.rwMutex.Unlock()
+		inputKey := iter.Key()
+		if c.end != nil && bytes.Compare(InternalKey(inputKey).ukey(), c.end) >= 0 {
+			break
 		}
 
-		inputKey := iter.Key()
 		value := iter.Value()
 		// if current file input key will expand the overlapped with grand parent,
 		// it need to finish current table and create a new one
@@ -274,14 +405,14 @@ func (db *DB) doCompactionWork(c *compaction1) error {
 			continue
 		}
 
-		if c.tWriter != nil && c.tWriter.size() > defaultCompactionTableSize {
+		if c.tWriter != nil && c.tWriter.size() > c.maxOutputFileSize {
 			if err = db.finishCompactionOutputFile(c); err != nil {
 				break
 			}
 		}
 
 		if c.tWriter == nil {
-			if c.tWriter, err = c.tableOperation.create(); err != nil {
+			if c.tWriter, err = c.tableOperation.create(IOPriorityLow); err != nil {
 				break
 			}
 		}
@@ -291,20 +422,94 @@ func (db *DB) doCompactionWork(c *compaction1) error {
 		}
 	}
 
-	if c.tWriter != nil {
+	// the inputs are deleted once the outputs installed, a partial output must not be installed
+	if err == nil {
+		if vErr := iter.Valid(); vErr != nil {
+			err = vErr
+		} else if atomic.LoadUint32(&db.shutdown) == 1 {
+			err = ErrClosed
+		}
+	}
+
+	if c.tWriter != nil && err == nil {
 		err = db.finishCompactionOutputFile(c)
 	}
 
-	iter.UnRef()
+	return err
+}
 
-	db.rwMutex.Lock()
+// split the compaction into at most n subcompactions by the boundaries of input files,
+// the input size of each subcompaction is approximately equal
+func (c *compaction1) split(n int) []*compaction1 {
 
-	if err == nil {
-		err = db.VersionSet.logAndApply(&c.edit, &db.rwMutex)
+	// the preallocated level0 output must be a single table
+	if n <= 1 || c.tWriter != nil {
+		return []*compaction1{c}
 	}
 
-	return err
+	var files tFiles
+	if c.runs != nil {
+		for _, run := range c.runs {
+			files = append(files, run.files...)
+		}
+	} else {
+		files = append(append(files, c.inputs[0]...), c.inputs[1]...)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return bytes.Compare(files[i].iMax.ukey(), files[j].iMax.ukey()) < 0
+	})
 
+	var (
+		boundaries [][]byte
+		size       int
+		totalSize  = files.size()
+		largest    = files[len(files)-1].iMax.ukey()
+	)
+
+	for _, t := range files[:len(files)-1] {
+		size += t.Size
+		if size*n >= totalSize*(len(boundaries)+1) {
+			boundary := t.iMax.ukey()
+			// the largest key as boundary leaves an empty subcompaction
+			if bytes.Compare(boundary, largest) >= 0 {
+				break
+			}
+			if len(boundaries) == 0 || bytes.Compare(boundaries[len(boundaries)-1], boundary) < 0 {
+				boundaries = append(boundaries, boundary)
+			}
+			if len(boundaries) == n-1 {
+				break
+			}
+		}
+	}
+
+	if len(boundaries) == 0 {
+		return []*compaction1{c}
+	}
+
+	// the boundary user key belongs to the left subcompaction, so all the versions of a user key
+	// are compacted by the same subcompaction
+	subs := make([]*compaction1, 0, len(boundaries)+1)
+	var start []byte
+	for i := 0; i <= len(boundaries); i++ {
+		sub := *c
+		sub.edit = VersionEdit{}
+		sub.start = start
+		sub.end = nil
+		if i < len(boundaries) {
+			sub.end = append(boundaries[i][:len(boundaries[i]):len(boundaries[i])], 0)
+		}
+		if start != nil {
+			sub.inputOverlappedGPIndex = sort.Search(len(c.gp), func(i int) bool {
+				return bytes.Compare(c.gp[i].iMax.ukey(), start) >= 0
+			})
+		}
+		subs = append(subs, &sub)
+		start = sub.end
+	}
+
+	return subs
 }
 
 func (vSet *VersionSet) makeInputIterator(c *compaction1) (iter Iterator, err error) {
@@ -320,18 +525,35 @@ func (vSet *VersionSet) makeInputIterator(c *compaction1) (iter Iterator, err er
 		}
 	}()
 
+	if c.runs != nil {
+		for _, run := range c.runs {
+			if run.level == 0 {
+				tIter, tErr := vSet.newTableIterator(run.files[0])
+				if tErr != nil {
+					err = tErr
+					return
+				}
+				iters = append(iters, tIter)
+			} else {
+				iters = append(iters, newIndexedIterator(newTFileArrIteratorIndexer(run.files, vSet.newTableIterator)))
+			}
+		}
+		iter = NewMergeIterator(iters)
+		return
+	}
+
 	for which, inputs := range c.inputs {
 		if c.cPtr.level+which == 0 {
 			for _, input := range inputs {
-				iter, err := vSet.newTableIterator(input)
-				if err != nil {
+				tIter, tErr := vSet.newTableIterator(input)
+				if tErr != nil {
+					err = tErr
 					return
 				}
-				iters = append(iters, iter)
+				iters = append(iters, tIter)
 			}
-			iters = append(iters, iter)
 		} else {
-			iters = append(iters, newIndexedIterator(newTFileArrIteratorIndexer(inputs)))
+			iters = append(iters, newIndexedIterator(newTFileArrIteratorIndexer(inputs, vSet.newTableIterator)))
 		}
 	}
 
@@ -341,22 +563,7 @@ func (vSet *VersionSet) makeInputIterator(c *compaction1) (iter Iterator, err er
 }
 
 func (vSet *VersionSet) newTableIterator(tFile tFile) (Iterator, error) {
-
-	reader, err := vSet.storage.Open(tFile.fd)
-	if err != nil {
-		return nil, err
-	}
-	tr, err := NewTableReader(reader, tFile.Size)
-	if err != nil {
-		return nil, err
-	}
-
-	iter, err := tr.NewIterator()
-	if err != nil {
-		return nil, err
-	}
-
-	return iter, nil
+	return vSet.tableCache.NewIterator(tFile)
 }
 
 func (c *compaction1) shouldStopBefore(nextKey InternalKey) bool {
@@ -381,15 +588,20 @@ func (db *DB) finishCompactionOutputFile(c *compaction1) error {
 
 	tFile, err := c.tWriter.finish()
 	if err != nil {
+		c.tWriter.drop()
+		c.tWriter = nil
 		return err
 	}
-	c.edit.addNewTable(c.cPtr.level+1, tFile.Size, tFile.fd.Num, tFile.iMin, tFile.iMax)
+	c.edit.addTableFile(c.outputLevel, *tFile)
 	c.tWriter = nil
 	return nil
 }
 
 func (c *compaction1) isBaseLevelForKey(input InternalKey) bool {
-	for levelI := c.cPtr.level + 2; levelI < len(c.levels); levelI++ {
+	if c.runs != nil {
+		return c.bottommost
+	}
+	for levelI := c.outputLevel + 1; levelI < len(c.levels); levelI++ {
 		level := c.levels[levelI]
 
 		for c.baseLevelI[levelI] < len(level) {
@@ -406,6 +618,23 @@ func (c *compaction1) isBaseLevelForKey(input InternalKey) bool {
 	return true
 }
 
+// addInputDeletions remove the input files from version
+func (c *compaction1) addInputDeletions() {
+	if c.runs != nil {
+		for _, run := range c.runs {
+			for _, t := range run.files {
+				c.edit.addDelTable(run.level, t.fd.Num)
+			}
+		}
+		return
+	}
+	for which, inputs := range c.inputs {
+		for _, t := range inputs {
+			c.edit.addDelTable(c.cPtr.level+which, t.fd.Num)
+		}
+	}
+}
+
 func (c *compaction1) releaseInputs() {
 	c.version.UnRef()
 }
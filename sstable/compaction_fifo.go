@@ -0,0 +1,69 @@
+package sstable
+
+import (
+	"sort"
+	"time"
+)
+
+// pickFIFOExpired return the level0 tables should be dropped, oldest first.
+// the tables older than TTL are expired, then the oldest tables are dropped until the total size fits.
+// the tables of unknown creation time are never expired by TTL
+// required: mutex held
+func (vSet *VersionSet) pickFIFOExpired() tFiles {
+
+	var (
+		opt    = &vSet.opt.FIFO
+		level0 = append(tFiles(nil), vSet.current.levels[0]...)
+	)
+
+	sort.Slice(level0, func(i, j int) bool {
+		return level0[i].fd.Num < level0[j].fd.Num
+	})
+
+	totalSize := level0.size()
+
+	n := 0
+	if opt.TTL > 0 {
+		deadline := time.Now().Add(-opt.TTL).UnixNano()
+		for ; n < len(level0); n++ {
+			if ctime := level0[n].ctime; ctime == 0 || ctime > deadline {
+				break
+			}
+			totalSize -= level0[n].Size
+		}
+	}
+
+	for ; n < len(level0) && totalSize > opt.MaxTableFilesSize; n++ {
+		totalSize -= level0[n].Size
+	}
+
+	return level0[:n]
+}
+
+func (vSet *VersionSet) needFIFOCompaction() bool {
+	return !vSet.compactingLevels[0] && len(vSet.pickFIFOExpired()) > 0
+}
+
+// pickFIFOCompaction pick the expired tables, they are dropped without rewriting
+// required: mutex held
+func (vSet *VersionSet) pickFIFOCompaction() *compaction1 {
+
+	if vSet.compactingLevels[0] {
+		return nil
+	}
+
+	expired := vSet.pickFIFOExpired()
+	if len(expired) == 0 {
+		return nil
+	}
+
+	v := vSet.current
+	v.Ref()
+	return &compaction1{
+		inputs:     [2]tFiles{expired},
+		version:    v,
+		levels:     v.levels,
+		cmp:        vSet.cmp,
+		dropInputs: true,
+	}
+}
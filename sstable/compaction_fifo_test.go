@@ -0,0 +1,107 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func putFIFOBatch(t *testing.T, db *DB, batch int) {
+	value := bytes.Repeat([]byte{'v'}, 100)
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("b%02d-%03d", batch, i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// flush the batch into a level0 table
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFIFOBatch(t *testing.T, db *DB, batch int, exist bool) {
+	for i := 0; i < 100; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("b%02d-%03d", batch, i)))
+		if exist && err != nil {
+			t.Fatalf("batch %d key %d: %v", batch, i, err)
+		}
+		if !exist && err != ErrNotFound {
+			t.Fatalf("batch %d key %d should be dropped, got %v", batch, i, err)
+		}
+	}
+}
+
+func TestFIFOCompactionTTL(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{
+		CompactionStyle: CompactionStyleFIFO,
+		FIFO:            FIFOOptions{TTL: 300 * time.Millisecond},
+	}
+	db, err := OpenWithOptions(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	putFIFOBatch(t, db, 0)
+	level0 := db.VersionSet.current.levels[0]
+	if len(level0) != 1 || level0[0].ctime == 0 {
+		t.Fatalf("expect a level0 table with creation time, got %+v", level0)
+	}
+	ctime := level0[0].ctime
+
+	// the creation time is kept by the manifest
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenWithOptions(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	if level0 := db.VersionSet.current.levels[0]; len(level0) != 1 || level0[0].ctime != ctime {
+		t.Fatalf("expect creation time %d recovered, got %+v", ctime, level0)
+	}
+
+	time.Sleep(2 * opt.FIFO.TTL)
+	putFIFOBatch(t, db, 1)
+
+	checkFIFOBatch(t, db, 0, false)
+	checkFIFOBatch(t, db, 1, true)
+	if n := len(db.VersionSet.current.levels[0]); n != 1 {
+		t.Fatalf("expect the expired table dropped, %d tables left", n)
+	}
+}
+
+func TestFIFOCompactionMaxSize(t *testing.T) {
+
+	opt := &Options{
+		CompactionStyle: CompactionStyleFIFO,
+		FIFO:            FIFOOptions{MaxTableFilesSize: 30 << 10},
+	}
+	db, err := OpenWithOptions(t.TempDir(), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const batches = 6
+	for batch := 0; batch < batches; batch++ {
+		putFIFOBatch(t, db, batch)
+	}
+
+	level0 := db.VersionSet.current.levels[0]
+	if size := level0.size(); size > opt.FIFO.MaxTableFilesSize {
+		t.Fatalf("expect the total size fits %d, got %d", opt.FIFO.MaxTableFilesSize, size)
+	}
+	if len(level0) == 0 || len(level0) >= batches {
+		t.Fatalf("expect the oldest tables dropped, %d tables left", len(level0))
+	}
+
+	// the oldest tables are dropped first
+	for batch := 0; batch < batches; batch++ {
+		checkFIFOBatch(t, db, batch, batch >= batches-len(level0))
+	}
+}
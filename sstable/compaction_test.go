@@ -1,6 +1,10 @@
 package sstable
 
 import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -12,3 +16,364 @@ func Test_ensureBuffer(t *testing.T) {
 		ik = ensureBuffer(ik, start+i%2)
 	}
 }
+
+func testTFile(num uint64, min, max string, size int) tFile {
+	return newTFile(Fd{FileType: KTableFile, Num: num}, size,
+		buildInternalKey(nil, []byte(min), keyTypeValue, 1),
+		buildInternalKey(nil, []byte(max), keyTypeValue, 1))
+}
+
+func TestCompactionSplit(t *testing.T) {
+
+	c := &compaction1{cmp: IComparer}
+	c.inputs[0] = tFiles{testTFile(1, "a", "z", 400)}
+	c.inputs[1] = tFiles{
+		testTFile(2, "a", "d", 100),
+		testTFile(3, "e", "h", 100),
+		testTFile(4, "i", "m", 100),
+		testTFile(5, "n", "z", 100),
+	}
+
+	if subs := c.split(1); len(subs) != 1 || subs[0] != c {
+		t.Fatalf("split(1) expect the compaction itself, got %d", len(subs))
+	}
+
+	subs := c.split(4)
+	if len(subs) < 2 || len(subs) > 4 {
+		t.Fatalf("split(4) got %d subcompactions", len(subs))
+	}
+	if subs[0].start != nil || subs[len(subs)-1].end != nil {
+		t.Fatal("the subcompactions should cover the whole key space")
+	}
+	for i := 1; i < len(subs); i++ {
+		if !bytes.Equal(subs[i-1].end, subs[i].start) {
+			t.Fatalf("subcompaction %d end %q, %d start %q", i-1, subs[i-1].end, i, subs[i].start)
+		}
+		if bytes.Compare(subs[i-1].end, subs[i].end) >= 0 && subs[i].end != nil {
+			t.Fatalf("unordered boundaries %q %q", subs[i-1].end, subs[i].end)
+		}
+	}
+
+	// the boundaries are the largest user keys of the input files, which belong to the left subcompaction
+	for _, sub := range subs[:len(subs)-1] {
+		boundary := sub.end[:len(sub.end)-1]
+		switch string(boundary) {
+		case "d", "h", "m":
+		default:
+			t.Fatalf("unexpected boundary %q", boundary)
+		}
+		if sub.end[len(sub.end)-1] != 0 {
+			t.Fatalf("end %q should be the successor of the boundary", sub.end)
+		}
+	}
+
+	// the preallocated level0 output is never split
+	c.tWriter = &tWriter{}
+	if subs := c.split(4); len(subs) != 1 {
+		t.Fatalf("split with output writer got %d", len(subs))
+	}
+}
+
+func TestRunSubcompaction(t *testing.T) {
+
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mem := NewMemTable(0, IComparer)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("k%03d", i))
+		// the older version is dropped since no snapshot
+		_ = mem.Put(key, Sequence(i+1), []byte("old"))
+		_ = mem.Put(key, Sequence(i+1000), []byte(fmt.Sprintf("v%03d", i)))
+	}
+
+	c := &compaction1{
+		cmp:               IComparer,
+		version:           db.VersionSet.current,
+		tableOperation:    db.VersionSet.tableOperation,
+		minSeq:            Sequence(10000),
+		outputLevel:       kLevelNum - 1,
+		maxOutputFileSize: 2 << 20,
+		start:             []byte("k020"),
+		end:               []byte("k050"),
+	}
+	if err := db.runSubcompaction(c, mem.NewIterator()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.edit.addedTables) != 1 {
+		t.Fatalf("expect 1 output table, got %d", len(c.edit.addedTables))
+	}
+	added := c.edit.addedTables[0]
+
+	// the output is protected from removeObsoleteFiles until the edit is applied
+	if !db.VersionSet.isPendingOutput(added.number) {
+		t.Fatalf("output table %d is not pending", added.number)
+	}
+	db.VersionSet.releaseEditOutputs(&c.edit)
+	if db.VersionSet.isPendingOutput(added.number) {
+		t.Fatalf("output table %d is still pending", added.number)
+	}
+
+	iter, err := db.VersionSet.tableCache.NewIterator(newTFile(Fd{FileType: KTableFile, Num: added.number},
+		added.size, added.imin, added.imax))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.UnRef()
+
+	i := 20
+	for ok := iter.SeekFirst(); ok; ok = iter.Next() {
+		ikey := InternalKey(iter.Key())
+		if string(ikey.ukey()) != fmt.Sprintf("k%03d", i) || string(iter.Value()) != fmt.Sprintf("v%03d", i) {
+			t.Fatalf("expect k%03d, got %q %q", i, ikey.ukey(), iter.Value())
+		}
+		i++
+	}
+	if i != 50 {
+		t.Fatalf("expect the keys in [k020, k050), stop at %d", i)
+	}
+}
+
+func TestSubcompactionAbortedByClose(t *testing.T) {
+
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mem := NewMemTable(0, IComparer)
+	for i := 0; i < 100; i++ {
+		_ = mem.Put([]byte(fmt.Sprintf("k%03d", i)), Sequence(i+1), []byte(fmt.Sprintf("v%03d", i)))
+	}
+
+	c := &compaction1{
+		cmp:               IComparer,
+		version:           db.VersionSet.current,
+		tableOperation:    db.VersionSet.tableOperation,
+		minSeq:            Sequence(100),
+		outputLevel:       kLevelNum - 1,
+		maxOutputFileSize: 2 << 20,
+	}
+
+	// the partial outputs must not replace the inputs
+	atomic.StoreUint32(&db.shutdown, 1)
+	err = db.runSubcompaction(c, mem.NewIterator())
+	atomic.StoreUint32(&db.shutdown, 0)
+	if err != ErrClosed {
+		t.Fatalf("expect aborted by close, got %v", err)
+	}
+	if len(c.edit.addedTables) != 0 {
+		t.Fatalf("expect no output installed, got %d tables", len(c.edit.addedTables))
+	}
+}
+
+func TestParallelFlushAndCompaction(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{
+		WriteBufferSize:      32 << 10,
+		MaxBytesForLevelBase: 128 << 10,
+		MaxBackgroundJobs:    4,
+		MaxSubcompactions:    4,
+	}
+	db, err := OpenWithOptions(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		writers = 4
+		n       = 3000
+	)
+	value := bytes.Repeat([]byte("v"), 100)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if err := db.Put([]byte(fmt.Sprintf("w%d-%06d", w, i)), value); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *DB) {
+		for w := 0; w < writers; w++ {
+			for i := 0; i < n; i++ {
+				v, err := db.Get([]byte(fmt.Sprintf("w%d-%06d", w, i)))
+				if err != nil || !bytes.Equal(v, value) {
+					t.Fatalf("get w%d-%06d: %v", w, i, err)
+				}
+			}
+		}
+	}
+	check(db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestSeekCompaction(t *testing.T) {
+
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the newer table covers m without containing it, so each get of m probes both tables
+	for _, keys := range [][]string{{"m"}, {"a", "z"}} {
+		for _, key := range keys {
+			if err := db.Put([]byte(key), []byte("v"+key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	levelFiles := func(level int) int {
+		levels, err := db.Levels()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(levels[level].Files)
+	}
+	if n := levelFiles(0); n != 2 {
+		t.Fatalf("expect 2 level0 tables, got %d", n)
+	}
+
+	for i := 0; i < kMinAllowedSeeks; i++ {
+		if v, err := db.Get([]byte("m")); err != nil || string(v) != "vm" {
+			t.Fatalf("get m: %q %v", v, err)
+		}
+	}
+
+	// the seek budget of the newer table runs out, it's compacted with the overlapped level0 table
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if n0, n1 := levelFiles(0), levelFiles(1); n0 != 0 || n1 == 0 {
+		t.Fatalf("expect level0 compacted by seek, level0=%d, level1=%d", n0, n1)
+	}
+	for _, key := range []string{"a", "m", "z"} {
+		if v, err := db.Get([]byte(key)); err != nil || string(v) != "v"+key {
+			t.Fatalf("get %s: %q %v", key, v, err)
+		}
+	}
+}
+
+func TestConcurrentPutAndCompact(t *testing.T) {
+
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const (
+		writers = 8
+		keys    = 1000
+	)
+
+	var (
+		wg       sync.WaitGroup
+		done     = make(chan struct{})
+		finished = make(chan struct{})
+		errs     = make(chan error, writers+1)
+	)
+
+	// the group commit leader writes with mutex released while Compact switches the memtable
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-finished:
+				return
+			default:
+			}
+			if err := db.Compact(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprintf("w%d-%04d", w, i)
+				if err := db.Put([]byte(key), []byte(key)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(finished)
+	<-done
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// every acknowledged write is readable
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("w%d-%04d", w, i)
+			if v, err := db.Get([]byte(key)); err != nil || string(v) != key {
+				t.Fatalf("get %s: %q %v", key, v, err)
+			}
+		}
+	}
+}
+
+func TestCompactionInputDeletions(t *testing.T) {
+
+	c := &compaction1{cPtr: compactPtr{level: 1}}
+	c.inputs[0] = tFiles{{fd: Fd{FileType: KTableFile, Num: 1}}, {fd: Fd{FileType: KTableFile, Num: 2}}}
+	c.inputs[1] = tFiles{{fd: Fd{FileType: KTableFile, Num: 3}}}
+	c.addInputDeletions()
+
+	// the inputs of both levels are removed once the outputs installed
+	expect := []delTable{{level: 1, number: 1}, {level: 1, number: 2}, {level: 2, number: 3}}
+	if len(c.edit.delTables) != len(expect) {
+		t.Fatalf("expect %d deleted tables, got %v", len(expect), c.edit.delTables)
+	}
+	for i, dt := range c.edit.delTables {
+		if dt != expect[i] {
+			t.Fatalf("expect %v deleted, got %v", expect[i], dt)
+		}
+	}
+}
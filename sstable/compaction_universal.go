@@ -0,0 +1,179 @@
+package sstable
+
+import "sort"
+
+/**
+universal compaction
+
+each level0 file is a sorted run, each non-empty level [1,n] is a sorted run.
+runs are ordered from newest to oldest
+
+	run0      run1      run2      run3          run4
+	/------/  /------/  /------/  /----------/  /------------------------------/
+	| L0 9 |  | L0 8 |  | L0 7 |  |    L4    |  |              L6              |
+	/------/  /------/  /------/  /----------/  /------------------------------/
+
+a compaction merges adjacent runs [i, j) and output into one run, the output level is
+the deepest level above run j, so the runs are still ordered by age.
+
+**/
+
+type sortedRun struct {
+	level int
+	files tFiles
+	size  int
+}
+
+// sortedRuns return the runs of version ordered from newest to oldest
+func (v *Version) sortedRuns() []sortedRun {
+
+	runs := make([]sortedRun, 0, len(v.levels[0])+kLevelNum)
+
+	level0 := append(tFiles(nil), v.levels[0]...)
+	sort.Slice(level0, func(i, j int) bool {
+		return level0[i].fd.Num > level0[j].fd.Num
+	})
+
+	for _, t := range level0 {
+		runs = append(runs, sortedRun{
+			level: 0,
+			files: tFiles{t},
+			size:  t.Size,
+		})
+	}
+
+	for level := 1; level < kLevelNum; level++ {
+		if len(v.levels[level]) > 0 {
+			runs = append(runs, sortedRun{
+				level: level,
+				files: v.levels[level],
+				size:  v.levels[level].size(),
+			})
+		}
+	}
+
+	return runs
+}
+
+// universalOutputLevel the output level of merging runs [i, j)
+func universalOutputLevel(runs []sortedRun, j int) int {
+	if j == len(runs) {
+		return kLevelNum - 1
+	}
+	if next := runs[j].level; next > 0 {
+		return next - 1
+	}
+	return 0
+}
+
+// pickUniversalRuns pick the runs [start, end) to merge, return false if no need to compact
+func pickUniversalRuns(runs []sortedRun, opt *UniversalOptions) (start, end int, ok bool) {
+
+	if len(runs) < opt.CompactionTrigger {
+		return
+	}
+
+	// 1. size amplification, merge all the runs
+	var newerSize int
+	for _, run := range runs[:len(runs)-1] {
+		newerSize += run.size
+	}
+	if newerSize*100 > runs[len(runs)-1].size*opt.MaxSizeAmplificationPercent {
+		return 0, len(runs), true
+	}
+
+	maxWidth := len(runs)
+	if opt.MaxMergeWidth > 0 && opt.MaxMergeWidth < maxWidth {
+		maxWidth = opt.MaxMergeWidth
+	}
+
+	// 2. size ratio, from newer runs pick the adjacent runs whose size are similar
+	for i := 0; i < len(runs); i++ {
+		candidateSize := runs[i].size
+		j := i + 1
+		for ; j < len(runs) && j-i < maxWidth; j++ {
+			if candidateSize*(100+opt.SizeRatio)/100 < runs[j].size {
+				break
+			}
+			candidateSize += runs[j].size
+		}
+		if j-i >= opt.MinMergeWidth && validUniversalPick(runs, i, j) {
+			return i, j, true
+		}
+	}
+
+	// 3. run count, merge the newest runs to bring the run count under trigger
+	width := len(runs) - opt.CompactionTrigger + 1
+	if width < opt.MinMergeWidth {
+		width = opt.MinMergeWidth
+	}
+	if width > maxWidth {
+		width = maxWidth
+	}
+	if width > len(runs) {
+		width = len(runs)
+	}
+	return 0, width, width >= 2
+}
+
+// validUniversalPick output into level0 is only allowed when merging from the newest run,
+// otherwise the output file with bigger file num would shadow the newer level0 files
+func validUniversalPick(runs []sortedRun, start, end int) bool {
+	return start == 0 || universalOutputLevel(runs, end) > 0
+}
+
+// pickUniversalCompaction pick the runs to merge, the output table of level0 is created at once,
+// so its file num is bigger than the tables flushed later.
+// required: mutex held and no memtable is being flushed
+func (vSet *VersionSet) pickUniversalCompaction() *compaction1 {
+
+	// the runs span most of the levels, only one universal compaction runs at a time
+	if vSet.levelsCompacting(0, kLevelNum-1) {
+		return nil
+	}
+
+	v := vSet.current
+	runs := v.sortedRuns()
+
+	start, end, ok := pickUniversalRuns(runs, &vSet.opt.Universal)
+	if !ok {
+		return nil
+	}
+
+	outputLevel := universalOutputLevel(runs, end)
+
+	v.Ref()
+	c := &compaction1{
+		version:           v,
+		levels:            v.levels,
+		cmp:               vSet.cmp,
+		tableOperation:    vSet.tableOperation,
+		runs:              runs[start:end],
+		outputLevel:       outputLevel,
+		maxOutputFileSize: defaultCompactionTableSize,
+		bottommost:        end == len(runs),
+	}
+	c.cPtr.level = runs[start].level
+
+	// level0 run must be a single file
+	if outputLevel == 0 {
+		tWriter, err := vSet.tableOperation.create(IOPriorityLow)
+		if err != nil {
+			c.releaseInputs()
+			return nil
+		}
+		c.tWriter = tWriter
+		c.maxOutputFileSize = int(^uint(0) >> 1)
+	}
+
+	return c
+}
+
+func (vSet *VersionSet) needUniversalCompaction() bool {
+	if vSet.levelsCompacting(0, kLevelNum-1) {
+		return false
+	}
+	runs := vSet.current.sortedRuns()
+	_, _, ok := pickUniversalRuns(runs, &vSet.opt.Universal)
+	return ok
+}
@@ -0,0 +1,95 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+)
+
+// measureWriteAmp write the same keys into a db of style, return the bytes written by flushes
+// and compactions divided by the bytes flushed
+func measureWriteAmp(t *testing.T, style CompactionStyle) float64 {
+
+	opt := &Options{
+		CompactionStyle:      style,
+		WriteBufferSize:      32 << 10,
+		MaxBytesForLevelBase: 128 << 10,
+	}
+	db, err := OpenWithOptions(t.TempDir(), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the keys are overwritten randomly, so each flush overlaps with the existing data
+	var (
+		rnd    = rand.New(rand.NewSource(1))
+		latest = make(map[string][]byte)
+	)
+	for i := 0; i < 30000; i++ {
+		key, value := fmt.Sprintf("k%06d", rnd.Intn(10000)), make([]byte, 100)
+		rnd.Read(value)
+		if err := db.Put([]byte(key), value); err != nil {
+			t.Fatal(err)
+		}
+		latest[key] = value
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range latest {
+		v, err := db.Get([]byte(key))
+		if err != nil || !bytes.Equal(v, value) {
+			t.Fatalf("get %s: %v", key, err)
+		}
+	}
+
+	flushed := atomic.LoadUint64(&db.metrics.flushWriteBytes)
+	compacted := atomic.LoadUint64(&db.metrics.compactionWriteBytes)
+	if flushed == 0 || atomic.LoadUint64(&db.metrics.compactions) == 0 {
+		t.Fatalf("expect flushes and compactions, flushed=%d, compactions=%d",
+			flushed, atomic.LoadUint64(&db.metrics.compactions))
+	}
+	return float64(flushed+compacted) / float64(flushed)
+}
+
+func TestUniversalWriteAmplification(t *testing.T) {
+
+	universal := measureWriteAmp(t, CompactionStyleUniversal)
+	level := measureWriteAmp(t, CompactionStyleLevel)
+
+	t.Logf("write amplification, universal=%.2f, level=%.2f", universal, level)
+
+	if universal >= level {
+		t.Fatalf("universal write amplification should be lower, universal=%.2f, level=%.2f", universal, level)
+	}
+}
+
+func TestPickUniversalRuns(t *testing.T) {
+
+	opt := sanitizeOptions(&Options{Universal: UniversalOptions{CompactionTrigger: 4}}).Universal
+
+	runs := []sortedRun{{level: 0, size: 1}, {level: 0, size: 1}, {level: 6, size: 100}}
+	if _, _, ok := pickUniversalRuns(runs, &opt); ok {
+		t.Fatalf("runs less than trigger should not be picked")
+	}
+
+	// size amplification
+	runs = []sortedRun{{level: 0, size: 10}, {level: 0, size: 10}, {level: 0, size: 10}, {level: 6, size: 10}}
+	if start, end, ok := pickUniversalRuns(runs, &opt); !ok || start != 0 || end != 4 {
+		t.Fatalf("should pick all runs by size amplification, start=%d, end=%d", start, end)
+	}
+
+	// size ratio
+	runs = []sortedRun{{level: 0, size: 1}, {level: 0, size: 1}, {level: 0, size: 2}, {level: 5, size: 50}, {level: 6, size: 100}}
+	start, end, ok := pickUniversalRuns(runs, &opt)
+	if !ok || start != 0 || end != 3 {
+		t.Fatalf("should pick the similar runs, start=%d, end=%d", start, end)
+	}
+	if level := universalOutputLevel(runs, end); level != 4 {
+		t.Fatalf("output level should be 4, level=%d", level)
+	}
+}
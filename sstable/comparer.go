@@ -1,6 +1,9 @@
 package sstable
 
-import "bytes"
+import (
+	"bytes"
+	"encoding/binary"
+)
 
 type BasicComparer interface {
 	Compare(a, b []byte) int
@@ -27,11 +30,14 @@ func (ic iComparer) Compare(a, b []byte) int {
 	if r != 0 {
 		return r
 	}
-	m, n := ia.seq(), ib.seq()
+	// the newer first, the sequence and key type are packed in the trailer
+	m, n := binary.LittleEndian.Uint64(a[len(a)-8:]), binary.LittleEndian.Uint64(b[len(b)-8:])
 	if m < n {
 		return 1
+	} else if m > n {
+		return -1
 	}
-	return -1
+	return 0
 }
 
 func (ic iComparer) Name() []byte {
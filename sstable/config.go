@@ -1,5 +1,7 @@
 package sstable
 
+import "time"
+
 const kMaxSequenceNum = (uint64(1) << 56) - 1
 const kMaxNum = kMaxSequenceNum | uint64(keyTypeValue)
 
@@ -23,11 +25,18 @@ const kWriteBatchCountSize = 4
 const kWriteBatchHeaderSize = 12 // first 8 bytes represent sequence, last 4 bytes represent batch count
 const kTypeValue = 1
 const kTypeDel = 2
+const kTypeColumnFamilyValue = 3 // followed by the uvarint column family id
+const kTypeColumnFamilyDel = 4
 const kTypeSeek = kTypeValue
 const kDefaultCacheFileNums = 1000
+const kSeekCostBytes = 16 << 10 // 16k
+const kMinAllowedSeeks = 100
+const kRecoveryBaseBackoff = 100 * time.Millisecond
+const kRecoveryMaxBackoff = 10 * time.Second
+const kMaxRecoveryAttempts = 10
 
-func maxBytesForLevel(level int) uint64 {
-	result := uint64(kLevel1SizeThreshold)
+func maxBytesForLevel(base uint64, level int) uint64 {
+	result := base
 	for level > 1 {
 		result *= 10
 		level--
@@ -2,7 +2,6 @@ package sstable
 
 import (
 	"container/list"
-	"encoding/binary"
 	"hash/fnv"
 	"io"
 	"os"
@@ -34,9 +33,24 @@ type DB struct {
 
 	backgroundWorkFinishedSignal *sync.Cond
 
-	backgroundCompactionScheduled bool
+	// background jobs
+	bgFlushScheduled      bool
+	bgCompactionScheduled int
 
-	bgErr error
+	// the obsolete files are being removed by a background job,
+	// obsoleteRescan asks it to scan again for the files obsolete after it started
+	removingObsolete bool
+	obsoleteRescan   bool
+
+	bgErr         error
+	bgErrSeverity bgErrorSeverity
+
+	// the tail of journal may be torn by a failed write, switch to a new journal before next write
+	journalBroken bool
+
+	// auto recovery of transient background error
+	recovering       bool
+	recoveryAttempts int
 
 	scratchBatch *WriteBatch
 
@@ -45,11 +59,35 @@ type DB struct {
 	// atomic state
 	hasImm uint32
 
+	// opened by OpenReadOnly or OpenAsSecondary, never write any file
+	readOnly bool
+
+	// tailing state of secondary instance, nil if not opened by OpenAsSecondary
+	secondary *secondaryState
+
 	tableOperation *tableOperation
+
+	// the non default column families by id, protected by mutex
+	families map[uint32]*columnFamily
+
+	// the LOG file opened by OpenWithOptions, closed with db
+	fileLogger *FileLogger
+
+	// the opened iterators of GetUpdatesSince and the min journal they would read, protected by mutex
+	updatesPins map[*UpdatesIterator]uint64
+
+	// atomic, the unreleased iterators of NewIterator and GetUpdatesSince, Close is rejected until released
+	openIterators int32
+
+	metrics *dbMetrics
 }
 
 func (db *DB) Get(key []byte) ([]byte, error) {
 
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return nil, ErrClosed
+	}
+
 	db.rwMutex.RLock()
 	v := db.VersionSet.getCurrent()
 	mem := db.mem
@@ -62,20 +100,32 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	seq := db.seqNum
 	db.rwMutex.RUnlock()
 
+	return db.get(v, mem, imm, seq, key)
+}
+
+// get look up the key in mem, imm and v of the same family, the references are released
+func (db *DB) get(v *Version, mem, imm *MemDB, seq Sequence, key []byte) ([]byte, error) {
+
+	defer db.metrics.getLatency.observeSince(time.Now())
+
 	ikey := buildInternalKey(nil, key, kTypeSeek, seq)
 	var (
 		mErr  error
 		value []byte
+		sStat seekStat
 	)
 	if memGet(mem, ikey, &value, &mErr) {
 		// done
 	} else if imm != nil && memGet(imm, ikey, &value, &mErr) {
 		// done
 	} else {
-		mErr = v.get(ikey, &value)
+		mErr = v.get(ikey, &value, &sStat)
 	}
 
 	db.rwMutex.Lock()
+	if v.updateSeekStat(sStat) && !v.vSet.dropped {
+		db.MaybeScheduleCompaction()
+	}
 	v.UnRef()
 	db.rwMutex.Unlock()
 
@@ -91,12 +141,25 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	return value, nil
 }
 
+// LatestSequence return the sequence number of the last write
+func (db *DB) LatestSequence() Sequence {
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+	return db.seqNum
+}
+
 func (db *DB) Put(key []byte, value []byte) error {
 	wb := &WriteBatch{}
 	wb.Put(key, value)
 	return db.write(wb)
 }
 
+func (db *DB) Delete(key []byte) error {
+	wb := &WriteBatch{}
+	wb.Delete(key)
+	return db.write(wb)
+}
+
 func memGet(mem *MemDB, ikey InternalKey, value *[]byte, err *error) (ok bool) {
 
 	_, rValue, rErr := mem.Find(ikey)
@@ -122,28 +185,60 @@ func memGet(mem *MemDB, ikey InternalKey, value *[]byte, err *error) (ok bool) {
 }
 
 func (db *DB) write(batch *WriteBatch) error {
+	return db.writeWithCheck(batch, nil)
+}
+
+// writeWithCheck write the batch if check passes, check is called with mutex held,
+// no other write could run between the check and the write
+func (db *DB) writeWithCheck(batch *WriteBatch, check func() error) error {
 
 	if atomic.LoadUint32(&db.shutdown) == 1 {
 		return ErrClosed
 	}
 
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
 	if batch.Len() == 0 {
 		return nil
 	}
 
+	defer db.metrics.writeLatency.observeSince(time.Now())
+
 	w := newWriter(batch, &db.rwMutex)
+	w.check = check
 	db.rwMutex.Lock()
+	if err := db.checkColumnFamilies(batch); err != nil {
+		db.rwMutex.Unlock()
+		return err
+	}
 	db.writers.PushBack(w)
 
-	header := db.writers.Front().Value.(*writer)
-	for w != header {
+	for !w.done && w != db.writers.Front().Value.(*writer) {
 		w.cv.Wait()
 	}
 
 	if w.done {
+		db.rwMutex.Unlock()
 		return w.err
 	}
 
+	// closed while waiting
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		db.finishWriteTurn(w)
+		db.rwMutex.Unlock()
+		return ErrClosed
+	}
+
+	if w.check != nil {
+		if err := w.check(); err != nil {
+			db.finishWriteTurn(w)
+			db.rwMutex.Unlock()
+			return err
+		}
+	}
+
 	// may temporary unlock and lock mutex
 	err := db.makeRoomForWrite()
 	lastWriter := w
@@ -152,48 +247,52 @@ func (db *DB) write(batch *WriteBatch) error {
 
 	if err == nil {
 		newWriteBatch := db.mergeWriteBatch(&lastWriter) // write into scratchbatch
-		db.scratchBatch.SetSequence(lastSequence + 1)
-		lastSequence += Sequence(db.scratchBatch.Len())
-		mem := db.mem
-		mem.Ref()
+		newWriteBatch.SetSequence(lastSequence + 1)
+		lastSequence += Sequence(newWriteBatch.Len())
+		mems := db.memTables()
 		db.rwMutex.Unlock()
 		// expensive syscall need to unlock !!!
 		_, syncErr := db.journalWriter.Write(newWriteBatch.Contents())
 		if syncErr == nil {
-			err = db.writeMem(mem, newWriteBatch)
+			err = db.writeMem(mems, newWriteBatch)
 		}
 
 		db.rwMutex.Lock()
-		db.seqNum = lastSequence
-
+		for _, mem := range mems {
+			mem.UnRef()
+		}
 		if syncErr != nil {
+			// the batch is neither in journal nor in mem, don't consume its sequences
+			err = syncErr
+			db.journalBroken = true
 			db.recordBackgroundError(syncErr)
+		} else {
+			db.seqNum = lastSequence
 		}
 
 		if newWriteBatch == db.scratchBatch {
 			db.scratchBatch.Reset()
 		}
+	}
 
+	// the merged writers are done, the writer failed to make room is removed alone
+	for {
 		ready := db.writers.Front()
-		for {
-			readyW := ready.Value.(*writer)
-			if readyW != lastWriter {
-				readyW.done = true
-				readyW.err = err
-				readyW.cv.Signal()
-			}
-			db.writers.Remove(ready)
-			if readyW == lastWriter {
-				break
-			}
-			ready = ready.Next()
-		}
-
-		if ready.Next() != nil {
-			readyW := ready.Value.(*writer)
+		readyW := ready.Value.(*writer)
+		db.writers.Remove(ready)
+		if readyW != w {
+			readyW.done = true
+			readyW.err = err
 			readyW.cv.Signal()
 		}
+		if readyW == lastWriter {
+			break
+		}
+	}
 
+	// wake up the new head
+	if front := db.writers.Front(); front != nil {
+		front.Value.(*writer).cv.Signal()
 	}
 
 	db.rwMutex.Unlock()
@@ -201,106 +300,46 @@ func (db *DB) write(batch *WriteBatch) error {
 	return err
 }
 
-func (db *DB) writeMem(mem *MemDB, batch *WriteBatch) error {
-
-	seq := batch.seq
-	idx := 0
-
-	reqLen := len(batch.rep)
-
-	for i := 0; i < batch.count; i++ {
-		c := batch.rep[idx]
-		idx += 1
-		assert(idx < reqLen)
-		kLen, n := binary.Uvarint(batch.rep[idx:])
-		idx += n
-
-		assert(idx < reqLen)
-		var (
-			key []byte
-			val []byte
-		)
-
-		switch c {
-		case kTypeValue:
-			vLen, n := binary.Uvarint(batch.rep[idx:])
-			idx += n
-			assert(idx < reqLen)
-
-			key = batch.rep[idx : idx+int(kLen)]
-			idx += int(kLen)
-
-			val = batch.rep[idx : idx+int(vLen)]
-			idx += int(vLen)
-			assert(idx < reqLen)
-
-			err := mem.Put(key, seq+Sequence(i), val)
-			if err != nil {
-				return err
-			}
-
-		case kTypeDel:
-			key = batch.rep[idx : idx+int(kLen)]
-			idx += int(kLen)
-			assert(idx < reqLen)
-
-			err := mem.Del(key, seq+Sequence(i))
-			if err != nil {
-				return err
-			}
-
-		default:
-			panic("invalid key type support")
-		}
-
-	}
-
-	return nil
-
+// writeMem apply the batch to the mems of the families, the batch may write several families
+func (db *DB) writeMem(mems map[uint32]*MemDB, batch *WriteBatch) error {
+	return batch.insertInto(mems)
 }
 
 func (db *DB) makeRoomForWrite() error {
 
 	assertMutexHeld(&db.rwMutex)
 	allowDelay := true
+	stalled := false
+
+	stall := func(condition WriteStallCondition, cause string) {
+		if stalled {
+			return
+		}
+		stalled = true
+		db.VersionSet.listeners().notify(func(l EventListener) {
+			l.OnWriteStall(WriteStallInfo{Condition: condition, Cause: cause})
+		})
+	}
 
 	for {
 		if db.bgErr != nil {
 			return db.bgErr
-		} else if allowDelay && db.VersionSet.levelFilesNum(0) >= kLevel0SlowDownTrigger {
+		} else if allowDelay && db.VersionSet.level0StallFilesNum() >= db.VersionSet.opt.Level0SlowdownWritesTrigger {
 			allowDelay = false
+			stall(WriteStallDelayed, "level0 slowdown trigger")
 			db.rwMutex.Unlock()
 			time.Sleep(time.Microsecond * 1000)
 			db.rwMutex.Lock()
-		} else if db.mem.ApproximateSize() <= kMemTableWriteBufferSize {
+		} else if !db.memTablesFull() && !db.journalBroken {
 			break
 		} else if db.imm != nil { // wait background compaction compact imm table
+			stall(WriteStallStopped, "memtable flush pending")
 			db.backgroundWorkFinishedSignal.Wait()
-		} else if db.VersionSet.levelFilesNum(0) >= kLevel0StopWriteTrigger {
+		} else if db.VersionSet.level0StallFilesNum() >= db.VersionSet.opt.Level0StopWritesTrigger {
+			stall(WriteStallStopped, "level0 stop trigger")
 			db.backgroundWorkFinishedSignal.Wait()
 		} else {
-
-			journalFd := Fd{
-				FileType: KJournalFile,
-				Num:      db.VersionSet.allocFileNum(),
-			}
-			stor := db.VersionSet.storage
-			writer, err := stor.Create(journalFd)
-			if err == nil {
-				_ = db.journalWriter.Close()
-				db.frozenSeq = db.seqNum
-				db.frozenJournalFd = db.journalFd
-				db.journalFd = journalFd
-				db.journalWriter = NewJournalWriter(writer)
-				imm := db.imm
-				imm.UnRef()
-				db.imm = db.mem
-				atomic.StoreUint32(&db.hasImm, 1)
-				mem := NewMemTable(kMemTableWriteBufferSize, db.VersionSet.cmp)
-				mem.Ref()
-				db.mem = mem
-			} else {
-				db.VersionSet.reuseFileNum(journalFd.Num)
+			if err := db.switchMemTable(); err != nil {
 				return err
 			}
 			db.MaybeScheduleCompaction()
@@ -310,6 +349,75 @@ func (db *DB) makeRoomForWrite() error {
 	return nil
 }
 
+// switchMemTable freeze the mem into imm and create a new journal for the new mem
+// required: mutex held and imm is nil, the imm of default family is flushed last, so the others are nil too
+func (db *DB) switchMemTable() error {
+
+	assertMutexHeld(&db.rwMutex)
+	assert(db.imm == nil)
+
+	journalFd := Fd{
+		FileType: KJournalFile,
+		Num:      db.VersionSet.allocFileNum(),
+	}
+	stor := db.VersionSet.storage
+	writer, err := stor.Create(journalFd)
+	if err != nil {
+		db.VersionSet.reuseFileNum(journalFd.Num)
+		return err
+	}
+	_ = db.journalWriter.Close()
+	db.frozenSeq = db.seqNum
+	db.frozenJournalFd = db.journalFd
+	db.journalFd = journalFd
+	db.journalWriter = NewJournalWriter(newRateLimitedWriter(writer, db.VersionSet.opt.RateLimiter, IOPriorityHigh))
+	db.journalBroken = false
+	db.imm = db.mem
+	atomic.StoreUint32(&db.hasImm, 1)
+	mem := NewMemTable(db.VersionSet.opt.WriteBufferSize, db.VersionSet.cmp)
+	mem.Ref()
+	db.mem = mem
+
+	// the families share the journal, their mems are frozen together
+	for _, cf := range db.families {
+		assert(cf.imm == nil)
+		cf.imm = cf.mem
+		cf.mem = NewMemTable(cf.vSet.opt.WriteBufferSize, cf.vSet.cmp)
+		cf.mem.Ref()
+	}
+	return nil
+}
+
+// flushMemTable force the mem compact into level0 table and wait until done
+// required: mutex held
+func (db *DB) flushMemTable() error {
+
+	assertMutexHeld(&db.rwMutex)
+
+	for db.imm != nil && db.bgErr == nil {
+		db.backgroundWorkFinishedSignal.Wait()
+	}
+
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+
+	if db.memTablesEmpty() {
+		return nil
+	}
+
+	if err := db.switchMemTable(); err != nil {
+		return err
+	}
+	db.MaybeScheduleCompaction()
+
+	for db.imm != nil && db.bgErr == nil {
+		db.backgroundWorkFinishedSignal.Wait()
+	}
+
+	return db.bgErr
+}
+
 func (db *DB) mergeWriteBatch(lastWriter **writer) *WriteBatch {
 
 	assertMutexHeld(&db.rwMutex)
@@ -326,9 +434,16 @@ func (db *DB) mergeWriteBatch(lastWriter **writer) *WriteBatch {
 	}
 
 	result := firstBatch
+	batches := 1
 	w := front.Next()
 	for w != nil {
 		wr := w.Value.(*writer)
+		if wr.batch == nil { // exclusive writer, see waitForWriteTurn
+			break
+		}
+		if wr.check != nil { // must be checked before written
+			break
+		}
 		if size+wr.batch.Size() > maxSize {
 			break
 		}
@@ -337,18 +452,38 @@ func (db *DB) mergeWriteBatch(lastWriter **writer) *WriteBatch {
 			result.append(firstBatch)
 		}
 		result.append(wr.batch)
-		lastWriter = &wr
+		batches++
+		*lastWriter = wr
 		w = w.Next()
 	}
 
+	db.metrics.groupBatches.observe(uint64(batches))
+	db.metrics.groupBytes.observe(uint64(result.Size()))
 	return result
 
 }
 
-func (db *DB) recordBackgroundError(err error) {
-	if db.bgErr == nil {
-		db.bgErr = err
-		db.backgroundWorkFinishedSignal.Broadcast()
+// waitForWriteTurn queue up as a writer without batch and wait until it becomes the head,
+// no other write could run until finishWriteTurn called
+// required: mutex held
+func (db *DB) waitForWriteTurn() *writer {
+	assertMutexHeld(&db.rwMutex)
+	w := newWriter(nil, &db.rwMutex)
+	db.writers.PushBack(w)
+	for db.writers.Front().Value.(*writer) != w {
+		w.cv.Wait()
+	}
+	return w
+}
+
+// required: mutex held
+func (db *DB) finishWriteTurn(w *writer) {
+	assertMutexHeld(&db.rwMutex)
+	front := db.writers.Front()
+	assert(front.Value.(*writer) == w)
+	db.writers.Remove(front)
+	if next := db.writers.Front(); next != nil {
+		next.Value.(*writer).cv.Signal()
 	}
 }
 
@@ -356,35 +491,56 @@ func (db *DB) recordBackgroundError(err error) {
 func (db *DB) MaybeScheduleCompaction() {
 	assertMutexHeld(&db.rwMutex)
 
-	if db.backgroundCompactionScheduled {
+	if db.readOnly {
 		// do nothing
 	} else if db.bgErr != nil {
 		// do nothing
 	} else if atomic.LoadUint32(&db.shutdown) == 1 {
 		// do nothing
-	} else if atomic.LoadUint32(&db.hasImm) == 0 && !db.VersionSet.needCompaction() {
-		// do nothing
 	} else {
-		go db.backgroundCall()
+		// flush has a dedicated lane, so it's never blocked by the long running compactions
+		if db.imm != nil && !db.bgFlushScheduled {
+			db.bgFlushScheduled = true
+			go db.backgroundFlushCall()
+		}
+
+		// universal compaction may output a level0 table, which must be newer than the flushing one
+		if db.bgFlushScheduled && db.VersionSet.opt.CompactionStyle == CompactionStyleUniversal {
+			return
+		}
+
+		// the families share the compaction pool
+		vSets := append([]*VersionSet{db.VersionSet}, db.VersionSet.liveFamilies()...)
+		for _, vSet := range vSets {
+			for db.bgCompactionScheduled < db.VersionSet.opt.MaxBackgroundJobs-1 && vSet.needCompaction() {
+				c := vSet.pickCompactionByStyle()
+				if c == nil {
+					break
+				}
+				vSet.markCompacting(c, true)
+				db.bgCompactionScheduled++
+				go db.backgroundCompactionCall(c)
+			}
+		}
 	}
 
 }
 
-func (db *DB) backgroundCall() {
+func (db *DB) backgroundFlushCall() {
 
 	db.rwMutex.Lock()
 
-	assert(db.backgroundCompactionScheduled)
+	assert(db.bgFlushScheduled)
 
 	if db.bgErr != nil {
 		// do nothing
 	} else if atomic.LoadUint32(&db.shutdown) == 1 {
 		// do nothing
-	} else {
-		db.backgroundCompaction()
+	} else if db.imm != nil {
+		db.compactMemTable()
 	}
 
-	db.backgroundCompactionScheduled = false
+	db.bgFlushScheduled = false
 	db.MaybeScheduleCompaction()
 	db.rwMutex.Unlock()
 
@@ -392,39 +548,117 @@ func (db *DB) backgroundCall() {
 
 }
 
-func (db *DB) backgroundCompaction() {
-	assertMutexHeld(&db.rwMutex)
+func (db *DB) backgroundCompactionCall(c *compaction1) {
 
-	if db.imm != nil {
-		db.compactMemTable()
-		return
+	db.rwMutex.Lock()
+
+	assert(db.bgCompactionScheduled > 0)
+
+	if db.bgErr != nil {
+		// do nothing
+	} else if atomic.LoadUint32(&db.shutdown) == 1 {
+		// do nothing
+	} else {
+		db.backgroundCompaction(c)
 	}
 
-	c := db.VersionSet.pickCompaction1()
-	if c == nil {
-		return
-	} else if len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 && c.gp.size() <= c.gpOverlappedLimit {
+	if c.tWriter != nil {
+		// the preallocated output is not finished
+		c.tWriter.drop()
+	}
+	c.releaseInputs()
+	c.version.vSet.markCompacting(c, false)
 
-		edit := &VersionEdit{}
-		addTable := c.inputs[0][0]
-		edit.addNewTable(c.cPtr.level+1, addTable.Size, addTable.fd.Num, addTable.iMin, addTable.iMax)
-		err := db.VersionSet.logAndApply(edit, &db.rwMutex)
-		if err != nil {
-			db.recordBackgroundError(err)
+	// the inputs are pinned by the compaction version until released
+	if db.bgErr == nil {
+		if err := db.removeObsoleteFiles(); err != nil {
+			db.VersionSet.logger().Warnf("remove obsolete files failed, err=%v", err)
 		}
-	} else {
-		err := db.doCompactionWork(c)
-		if err != nil {
-			db.recordBackgroundError(err)
+	}
+	db.bgCompactionScheduled--
+	db.MaybeScheduleCompaction()
+	db.rwMutex.Unlock()
+
+	db.backgroundWorkFinishedSignal.Broadcast()
+
+}
+
+// backgroundCompaction required: mutex held, the levels of c are marked as compacting
+func (db *DB) backgroundCompaction(c *compaction1) {
+	assertMutexHeld(&db.rwMutex)
+
+	var (
+		err    error
+		vSet   = c.version.vSet
+		logger = vSet.logger()
+	)
+
+	if c.dropInputs {
+		err = db.applyCompactionEdit(c, func(info *CompactionJobInfo) {
+			info.Dropped = true
+		})
+		if err == nil {
+			logger.Infof("fifo dropped %d tables, %d bytes", len(c.inputs[0]), c.inputs[0].size())
 		}
-		c.releaseInputs()
-		err = db.removeObsoleteFiles()
-		if err != nil {
-			// todo log warn msg
+	} else if c.runs == nil && len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 && c.gp.size() <= c.gpOverlappedLimit {
+		// trivial move
+		addTable := c.inputs[0][0]
+		err = db.applyCompactionEdit(c, func(info *CompactionJobInfo) {
+			c.edit.addTableFile(c.outputLevel, addTable)
+			info.TrivialMove = true
+			info.Outputs = []TableFileInfo{{Level: c.outputLevel, FileNum: addTable.fd.Num, Size: addTable.Size}}
+			info.OutputBytes = addTable.Size
+		})
+		if err == nil {
+			logger.Infof("moved table %d to level %d, %d bytes", addTable.fd.Num, c.outputLevel, addTable.Size)
 		}
+	} else {
+		err = db.doCompactionWork(c)
+	}
 
+	if err == ErrColumnFamilyDropped {
+		// the outputs are removed as obsolete files
+		logger.Infof("compaction of dropped column family %s discarded", vSet.familyName)
+	} else if err == ErrClosed {
+		// the unfinished compaction is picked again when opened
+		logger.Infof("compaction from level %d aborted by close", c.cPtr.level)
+	} else if err != nil {
+		logger.Warnf("compaction from level %d failed, err=%v", c.cPtr.level, err)
+		db.recordBackgroundError(err)
+		return
 	}
+	db.backgroundJobSucceeded()
+}
+
+// applyCompactionEdit install the compaction which doesn't rewrite the inputs, e.g. trivial move and fifo drop,
+// build adds the outputs into the edit and the job info
+// required: mutex held
+func (db *DB) applyCompactionEdit(c *compaction1, build func(info *CompactionJobInfo)) error {
+
+	var (
+		vSet      = c.version.vSet
+		listeners = vSet.listeners()
+		info      = c.compactionJobInfo()
+		start     = time.Now()
+	)
+
+	build(&info)
+	listeners.notify(func(l EventListener) {
+		l.OnCompactionBegin(info)
+	})
+
+	c.addInputDeletions()
+	err := vSet.logAndApply(&c.edit, &db.rwMutex)
 
+	info.Duration = time.Since(start)
+	info.Err = err
+	if err == nil {
+		atomic.AddUint64(&db.metrics.compactions, 1)
+	}
+	listeners.notify(func(l EventListener) {
+		l.OnCompactionCompleted(info)
+	})
+	return err
 }
 
 func (db *DB) compactMemTable() {
@@ -432,32 +666,76 @@ func (db *DB) compactMemTable() {
 	assertMutexHeld(&db.rwMutex)
 	assert(db.imm != nil)
 
+	var (
+		listeners = db.VersionSet.listeners()
+		info      = FlushJobInfo{JournalNum: db.frozenJournalFd.Num}
+		start     = time.Now()
+	)
+	listeners.notify(func(l EventListener) {
+		l.OnFlushBegin(info)
+	})
+
 	edit := &VersionEdit{}
-	err := db.writeLevel0Table(db.imm, edit)
+	err := db.flushColumnFamilies()
+	if err == nil {
+		err = db.writeLevel0Table(db.tableOperation, db.imm, edit)
+	}
 	if err == nil {
-		imm := db.imm
-		db.imm = nil
-		imm.UnRef()
-		atomic.StoreUint32(&db.hasImm, 1)
 		edit.setLogNum(db.journalFd.Num)
 		edit.setLastSeq(db.frozenSeq)
 		err = db.VersionSet.logAndApply(edit, &db.rwMutex)
-		if err == nil {
-			err = db.removeObsoleteFiles()
+		db.VersionSet.releaseEditOutputs(edit)
+	}
+	// the imm is kept readable until the table is installed, a failed flush is retried with it
+	if err == nil {
+		imm := db.imm
+		db.imm = nil
+		imm.UnRef()
+		atomic.StoreUint32(&db.hasImm, 0)
+		if rErr := db.removeObsoleteFiles(); rErr != nil {
+			db.VersionSet.logger().Warnf("remove obsolete files failed, err=%v", rErr)
 		}
 	}
 
+	for _, t := range edit.addedTables {
+		info.Output = TableFileInfo{Level: t.level, FileNum: t.number, Size: t.size}
+	}
+	if err == nil {
+		atomic.AddUint64(&db.metrics.flushes, 1)
+		atomic.AddUint64(&db.metrics.flushWriteBytes, uint64(info.Output.Size))
+	}
+	info.Duration = time.Since(start)
+	info.Err = err
+	listeners.notify(func(l EventListener) {
+		l.OnFlushCompleted(info)
+	})
+
+	if err != nil {
+		db.VersionSet.logger().Warnf("flush journal %d failed, err=%v", info.JournalNum, err)
+	} else {
+		db.VersionSet.logger().Infof("flushed journal %d into table %d, %d bytes, duration %v",
+			info.JournalNum, info.Output.FileNum, info.Output.Size, info.Duration)
+	}
+
 	if err != nil {
 		db.recordBackgroundError(err)
+	} else {
+		db.backgroundJobSucceeded()
 	}
 }
 
-func (db *DB) writeLevel0Table(memDb *MemDB, edit *VersionEdit) (err error) {
+// writeLevel0Table write the mem into a level0 table of the family of op
+func (db *DB) writeLevel0Table(op *tableOperation, memDb *MemDB, edit *VersionEdit) (err error) {
+
+	if memDb.Size() == 0 {
+		// e.g. the journal is switched after write failed, nothing to flush
+		return nil
+	}
 
 	db.rwMutex.Unlock()
 	defer db.rwMutex.Lock()
 
-	tWriter, err := db.tableOperation.create()
+	tWriter, err := op.create(IOPriorityHigh)
 	if err != nil {
 		return err
 	}
@@ -468,49 +746,93 @@ func (db *DB) writeLevel0Table(memDb *MemDB, edit *VersionEdit) (err error) {
 	for iter.Next() {
 		err = tWriter.append(iter.Key(), iter.Value())
 		if err != nil {
-			db.rwMutex.Lock()
+			tWriter.drop()
 			return err
 		}
 	}
 
 	tFile, err := tWriter.finish()
-	if err == nil {
-		edit.addNewTable(0, tFile.Size, tFile.fd.Num, tFile.iMin, tFile.iMax)
+	if err != nil {
+		tWriter.drop()
+		return err
 	}
+	edit.addTableFile(0, *tFile)
 	return
 }
 
 func Open(dbpath string) (*DB, error) {
+	return OpenWithOptions(dbpath, nil)
+}
+
+// OpenWithOptions open the db with options, nil options means default options
+func OpenWithOptions(dbpath string, opt *Options) (*DB, error) {
+	if err := validateOptions(sanitizeOptions(opt)); err != nil {
+		return nil, err
+	}
+
 	storage, err := OpenPath(dbpath)
 	if err != nil {
 		return nil, err
 	}
 
-	db := &DB{
-		VersionSet: &VersionSet{
-			cmp:        IComparer,
-			storage:    storage,
-			tableCache: NewTableCache(storage, kDefaultCacheFileNums, fnv.New32a()),
-			versions:   list.New(),
-			snapshots:  list.New(),
-		},
-	}
+	return openWithStorage(storage, dbpath, opt)
+}
 
-	tableOperation := newTableOperation(storage, db.VersionSet)
-	db.VersionSet.tableOperation = tableOperation
+// openWithStorage open the db on storage, the LOG file is written into dbpath
+func openWithStorage(storage Storage, dbpath string, opt *Options) (_ *DB, err error) {
+
+	db := newDB(storage, opt)
+	if db.VersionSet.opt.Logger == nil {
+		fileLogger, lErr := NewFileLogger(dbpath, db.VersionSet.opt.MaxLogFileSize, db.VersionSet.opt.KeepLogFileNum)
+		if lErr != nil {
+			_ = storage.Close()
+			return nil, lErr
+		}
+		db.VersionSet.opt.Logger = fileLogger
+		db.fileLogger = fileLogger
+	}
 
 	db.rwMutex.Lock()
 	defer db.rwMutex.Unlock()
 
+	// release the files and the LOCK when failed, e.g. paranoid checks, so the db could be opened again
+	defer func() {
+		if err == nil {
+			return
+		}
+		if db.journalWriter != nil {
+			_ = db.journalWriter.Close()
+		}
+		if db.VersionSet.manifestWriter != nil {
+			_ = db.VersionSet.manifestWriter.Close()
+		}
+		db.VersionSet.tableCache.Close()
+		_ = storage.Close()
+		if db.fileLogger != nil {
+			_ = db.fileLogger.Close()
+		}
+	}()
+
 	err = db.recover()
 	if err != nil {
 		return nil, err
 	}
 
+	if db.VersionSet.opt.ParanoidChecks {
+		report, vErr := db.VersionSet.verifyVersion(db.VersionSet.current)
+		if vErr != nil {
+			db.VersionSet.logger().Warnf("paranoid checks failed, %d of %d tables corrupted, err=%v",
+				report.Corrupted, len(report.Tables), vErr)
+			return nil, vErr
+		}
+		db.VersionSet.logger().Infof("paranoid checks verified %d tables, %d entries", len(report.Tables), report.Entries)
+	}
+
 	memDB := NewMemTable(0, db.VersionSet.cmp)
 	memDB.Ref()
 
 	db.mem = memDB
+	db.openColumnFamilies()
 	journalFd := Fd{
 		FileType: KJournalFile,
 		Num:      db.VersionSet.allocFileNum(),
@@ -520,7 +842,7 @@ func Open(dbpath string) (*DB, error) {
 		return nil, err
 	}
 	db.journalFd = journalFd
-	db.journalWriter = NewJournalWriter(sequentialWriter)
+	db.journalWriter = NewJournalWriter(newRateLimitedWriter(sequentialWriter, db.VersionSet.opt.RateLimiter, IOPriorityHigh))
 
 	edit := &VersionEdit{}
 	edit.setLastSeq(db.seqNum)
@@ -530,47 +852,181 @@ func Open(dbpath string) (*DB, error) {
 		return nil, err
 	}
 
-	//todo warn err log
+	// the records of the families in old journals are flushed by recover
+	for _, family := range db.VersionSet.liveFamilies() {
+		edit = &VersionEdit{}
+		edit.setLogNum(db.journalFd.Num)
+		if err = family.logAndApply(edit, &db.rwMutex); err != nil {
+			return nil, err
+		}
+	}
+
+	err = db.writeOptionsFile(optionsMap(db.VersionSet.opt))
+	if err != nil {
+		return nil, err
+	}
+
 	err = db.removeObsoleteFiles()
+	if err != nil {
+		db.VersionSet.logger().Warnf("remove obsolete files failed, err=%v", err)
+	}
 	db.MaybeScheduleCompaction()
 
 	return db, nil
 }
 
+// Compact flush the mem into level0, then wait the background compactions until no level needs compaction
+func (db *DB) Compact() error {
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return ErrClosed
+	}
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+
+	// the group commit leader writes the journal and mem with mutex released, switch mem in the write turn
+	w := db.waitForWriteTurn()
+	err := db.flushMemTable()
+	db.finishWriteTurn(w)
+	if err != nil {
+		return err
+	}
+
+	// each finished job schedules the next one if needed
+	db.MaybeScheduleCompaction()
+	for (db.bgFlushScheduled || db.bgCompactionScheduled > 0) && db.bgErr == nil {
+		db.backgroundWorkFinishedSignal.Wait()
+	}
+	return db.bgErr
+}
+
+// Close wait the queued writes and background jobs finished, then release the journal, manifest and storage.
+// the unflushed writes are recovered from journal when opened again, the calls after closed return ErrClosed.
+// ErrIteratorsOpen is returned and db is kept open if any iterator is not released
+func (db *DB) Close() (err error) {
+
+	db.rwMutex.Lock()
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		db.rwMutex.Unlock()
+		return ErrClosed
+	}
+
+	// the iterators read the tables and journals released below
+	if atomic.LoadInt32(&db.openIterators) > 0 {
+		db.rwMutex.Unlock()
+		return ErrIteratorsOpen
+	}
+	atomic.StoreUint32(&db.shutdown, 1)
+
+	// the writers queued before are finished, the later ones see the shutdown
+	w := db.waitForWriteTurn()
+	db.finishWriteTurn(w)
+
+	for db.bgFlushScheduled || db.bgCompactionScheduled > 0 {
+		db.backgroundWorkFinishedSignal.Wait()
+	}
+
+	if db.journalWriter != nil {
+		err = db.journalWriter.Sync()
+		if cErr := db.journalWriter.Close(); err == nil {
+			err = cErr
+		}
+		db.journalWriter = nil
+	}
+	if db.VersionSet.manifestWriter != nil {
+		if cErr := db.VersionSet.manifestWriter.Close(); err == nil {
+			err = cErr
+		}
+		db.VersionSet.manifestWriter = nil
+	}
+
+	db.rwMutex.Unlock()
+
+	db.VersionSet.tableCache.Close()
+	if cErr := db.VersionSet.storage.Close(); err == nil {
+		err = cErr
+	}
+	if db.fileLogger != nil {
+		_ = db.fileLogger.Close()
+	}
+	return
+}
+
+func newDB(storage Storage, opt *Options) *DB {
+	db := &DB{
+		VersionSet: &VersionSet{
+			cmp:        IComparer,
+			opt:        sanitizeOptions(opt),
+			storage:    storage,
+			tableCache: NewTableCache(storage, kDefaultCacheFileNums, fnv.New32a()),
+			versions:   list.New(),
+			snapshots:  list.New(),
+
+			families:     make(map[uint32]*VersionSet),
+			nextFamilyID: kDefaultColumnFamilyID + 1,
+		},
+		writers:      list.New(),
+		scratchBatch: &WriteBatch{},
+		families:     make(map[uint32]*columnFamily),
+		updatesPins:  make(map[*UpdatesIterator]uint64),
+		metrics:      newDBMetrics(),
+	}
+
+	tableOperation := newTableOperation(storage, db.VersionSet)
+	db.VersionSet.tableOperation = tableOperation
+	db.tableOperation = tableOperation
+	db.backgroundWorkFinishedSignal = sync.NewCond(&db.rwMutex)
+	db.VersionSet.manifestCond = sync.NewCond(&db.rwMutex)
+	return db
+}
+
 func (db *DB) recover() error {
+	logger := db.VersionSet.logger()
+
 	manifestFd, err := db.VersionSet.storage.GetCurrent()
 	if err != nil {
-		if err != os.ErrNotExist {
+		if !os.IsNotExist(err) {
 			return err
 		}
+		logger.Infof("creating new db")
 		err = db.newDb()
 	} else {
+		logger.Infof("recovering from manifest %s", manifestFd)
 		err = db.VersionSet.recover(manifestFd)
 	}
 
 	if err != nil {
+		logger.Warnf("recover manifest failed, err=%v", err)
 		return err
 	}
+	db.seqNum = db.VersionSet.stSeqNum
 
 	fds, err := db.VersionSet.storage.List()
 	if err != nil {
 		return err
 	}
 
-	var expectedFiles = make(map[uint64]struct{})
+	var expectedFiles = make(map[Fd]struct{})
 	db.VersionSet.addLiveFiles(expectedFiles)
 
 	logFiles := make([]Fd, 0)
 
 	for _, fd := range fds {
 		if fd.FileType == KTableFile {
-			delete(expectedFiles, fd.Num)
-		} else if fd.FileType == KJournalFile && fd.Num >= db.VersionSet.stJournalNum {
+			delete(expectedFiles, fd)
+		} else if fd.FileType == KJournalFile && fd.Num >= db.minJournalNum() {
 			logFiles = append(logFiles, fd)
 		}
 	}
 
 	if len(expectedFiles) > 0 {
+		logger.Warnf("%d table files are missing", len(expectedFiles))
 		err = NewErrCorruption("invalid table file, file not exists")
 		return err
 	}
@@ -579,19 +1035,39 @@ func (db *DB) recover() error {
 		return logFiles[i].Num < logFiles[j].Num
 	})
 
-	var edit VersionEdit
+	// the level0 tables flushed from journals, by family id
+	edits := map[uint32]*VersionEdit{kDefaultColumnFamilyID: {}}
+	for _, family := range db.VersionSet.liveFamilies() {
+		edits[family.familyID] = &VersionEdit{}
+	}
 
 	for _, logFile := range logFiles {
-		err = db.recoverLogFile(logFile, &edit)
+		logger.Infof("recovering journal %s", logFile)
+		err = db.recoverLogFile(logFile, edits)
 		if err != nil {
+			logger.Warnf("recover journal %s failed, err=%v", logFile, err)
 			return err
 		}
 	}
 
-	err = db.VersionSet.logAndApply(&edit, &db.rwMutex)
+	defer func() {
+		for _, edit := range edits {
+			db.VersionSet.releaseEditOutputs(edit)
+		}
+	}()
+
+	err = db.VersionSet.logAndApply(edits[kDefaultColumnFamilyID], &db.rwMutex)
 	if err != nil {
 		return err
 	}
+
+	for _, family := range db.VersionSet.liveFamilies() {
+		if err = family.logAndApply(edits[family.familyID], &db.rwMutex); err != nil {
+			return err
+		}
+	}
+
+	logger.Infof("recovered, last seq=%d, next file=%d", db.seqNum, atomic.LoadUint64(&db.VersionSet.nextFileNum))
 	return nil
 }
 
@@ -621,38 +1097,55 @@ func (db *DB) newDb() (err error) {
 		_ = db.VersionSet.storage.Remove(manifestFd)
 	}()
 
-	db.journalWriter = NewJournalWriter(writer)
+	manifestWriter := NewJournalWriter(writer)
 
-	newDb := &VersionEdit{
-		journalNum:   db.journalFd.Num,
-		nextFileNum:  3,
-		lastSeq:      0,
-		comparerName: IComparer.Name(),
-	}
+	newDb := &VersionEdit{}
+	newDb.setCompareName(IComparer.Name())
+	newDb.setLogNum(db.journalFd.Num)
+	newDb.setNextFile(3)
+	newDb.setLastSeq(0)
 
-	newDb.EncodeTo(db.journalWriter)
-	if newDb.err != nil {
-		err = newDb.err
+	if err = writeEditRecord(manifestWriter, newDb); err != nil {
+		return
+	}
+	if err = manifestWriter.Close(); err != nil {
 		return
 	}
 
-	err = db.VersionSet.storage.SetCurrent(manifestFd.Num)
+	if err = db.VersionSet.storage.SetCurrent(manifestFd.Num); err != nil {
+		return
+	}
 
-	return
+	// recover from the new manifest as an existing db
+	return db.VersionSet.recover(manifestFd)
 
 }
 
-func (db *DB) recoverLogFile(fd Fd, edit *VersionEdit) error {
+func (db *DB) recoverLogFile(fd Fd, edits map[uint32]*VersionEdit) error {
 
 	reader, err := db.VersionSet.storage.Open(fd)
 	if err != nil {
 		return err
 	}
+
+	// the families which have flushed the journal are skipped
+	var (
+		vSets = make(map[uint32]*VersionSet)
+		mems  = make(map[uint32]*MemDB)
+	)
+	for _, vSet := range append([]*VersionSet{db.VersionSet}, db.VersionSet.liveFamilies()...) {
+		if fd.Num >= vSet.stJournalNum {
+			vSets[vSet.familyID] = vSet
+			mems[vSet.familyID] = NewMemTable(0, vSet.cmp)
+			mems[vSet.familyID].Ref()
+		}
+	}
+
 	journalReader := NewJournalReader(reader)
-	memDB := NewMemTable(0, db.VersionSet.cmp)
-	memDB.Ref()
 	defer func() {
-		memDB.UnRef()
+		for _, memDB := range mems {
+			memDB.UnRef()
+		}
 		journalReader.Close()
 		_ = reader.Close()
 	}()
@@ -668,36 +1161,47 @@ func (db *DB) recoverLogFile(fd Fd, edit *VersionEdit) error {
 			return err
 		}
 
-		if memDB.ApproximateSize() > kMemTableWriteBufferSize {
-			err = db.writeLevel0Table(memDB, edit)
-			if err != nil {
-				return err
-			}
-			memDB.UnRef()
+		if writeBatch.stale(db.VersionSet.stSeqNum) {
+			continue
+		}
 
-			memDB = NewMemTable(0, db.VersionSet.cmp)
-			memDB.Ref()
+		for id, memDB := range mems {
+			if memDB.ApproximateSize() > vSets[id].opt.WriteBufferSize {
+				err = db.writeLevel0Table(vSets[id].tableOperation, memDB, edits[id])
+				if err != nil {
+					return err
+				}
+				memDB.UnRef()
+
+				memDB = NewMemTable(0, vSets[id].cmp)
+				memDB.Ref()
+				mems[id] = memDB
+			}
 		}
 
-		err = writeBatch.insertInto(memDB)
+		err = writeBatch.insertInto(mems)
 		if err != nil {
 			return err
 		}
 
-		db.seqNum += writeBatch.seq + Sequence(writeBatch.count) - 1
+		if last := writeBatch.nextSequence() - 1; last > db.seqNum {
+			db.seqNum = last
+		}
 
 		db.VersionSet.markFileUsed(fd.Num)
 
 	}
 
-	if memDB.Size() > 0 {
-		err = db.writeLevel0Table(memDB, edit)
-		if err != nil {
-			return err
+	for id, memDB := range mems {
+		if memDB.Size() > 0 {
+			err = db.writeLevel0Table(vSets[id].tableOperation, memDB, edits[id])
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	if db.VersionSet.nextFileNum != db.VersionSet.manifestFd.Num {
+	if atomic.LoadUint64(&db.VersionSet.nextFileNum) != db.VersionSet.manifestFd.Num {
 		db.VersionSet.manifestFd = Fd{
 			FileType: KDescriptorFile,
 			Num:      db.VersionSet.allocFileNum(),
@@ -708,21 +1212,52 @@ func (db *DB) recoverLogFile(fd Fd, edit *VersionEdit) error {
 
 }
 
-// clear the obsolete files
+// clear the obsolete files, only one job removes at a time
+// required: mutex held
 func (db *DB) removeObsoleteFiles() (err error) {
 
 	assertMutexHeld(&db.rwMutex)
 
+	// the running job removes the files obsolete by now in its next scan
+	if db.removingObsolete {
+		db.obsoleteRescan = true
+		return nil
+	}
+
+	db.removingObsolete = true
+	for {
+		db.obsoleteRescan = false
+		if rErr := db.removeObsoleteFilesOnce(); rErr != nil {
+			err = rErr
+		}
+		if !db.obsoleteRescan {
+			break
+		}
+	}
+	db.removingObsolete = false
+	return
+}
+
+// removeObsoleteFilesOnce the mutex is released while removing
+// required: mutex held
+func (db *DB) removeObsoleteFilesOnce() (err error) {
+
 	fds, lErr := db.VersionSet.storage.List()
 	if lErr != nil {
 		err = lErr
 		return
 	}
 
+	db.VersionSet.purgeDroppedFamilies()
 	liveTableFileSet := make(map[Fd]struct{})
 	db.VersionSet.addLiveFiles(liveTableFileSet)
+	minJournalNum := db.minJournalNum()
+	if pinned, ok := db.minPinnedJournalNum(); ok && pinned < minJournalNum {
+		minJournalNum = pinned
+	}
 
 	fileToClean := make([]Fd, 0)
+	obsoleteJournals := make([]Fd, 0)
 
 	for _, fd := range fds {
 		var keep bool
@@ -730,27 +1265,48 @@ func (db *DB) removeObsoleteFiles() (err error) {
 		case KDescriptorFile:
 			keep = fd.Num >= db.VersionSet.manifestFd.Num
 		case KJournalFile:
-			keep = fd.Num >= db.VersionSet.stJournalNum
+			keep = fd.Num >= minJournalNum
 		case KTableFile:
 			if _, ok := liveTableFileSet[fd]; ok {
 				keep = true
+			} else {
+				keep = db.VersionSet.isPendingOutput(fd.Num)
 			}
+		case KOptionsFile:
+			keep = fd.Num >= db.VersionSet.optionsFd.Num
 		case KCurrentFile, KDBLockFile, KDBTempFile:
 			keep = true
 		}
 
-		if !keep {
+		if !keep && fd.FileType == KJournalFile {
+			obsoleteJournals = append(obsoleteJournals, fd)
+		} else if !keep {
 			fileToClean = append(fileToClean, fd)
 		}
 
 	}
 
+	fileToClean = append(fileToClean, db.expiredJournals(obsoleteJournals)...)
+
 	db.rwMutex.Unlock()
 
+	var (
+		listeners = db.VersionSet.listeners()
+		logger    = db.VersionSet.logger()
+	)
 	for _, fd := range fileToClean {
 		rErr := db.VersionSet.storage.Remove(fd)
 		if rErr != nil {
 			err = rErr
+			logger.Warnf("remove obsolete file %s failed, err=%v", fd, rErr)
+		} else {
+			logger.Infof("removed obsolete file %s", fd)
+		}
+
+		if fd.FileType == KTableFile {
+			listeners.notify(func(l EventListener) {
+				l.OnTableFileDeleted(TableFileInfo{Level: -1, FileNum: fd.Num, Err: rErr})
+			})
 		}
 
 		// todo evict table cache
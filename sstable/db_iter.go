@@ -0,0 +1,208 @@
+package sstable
+
+import "sync/atomic"
+
+// NewIterator iterate the user keys of default family at the latest sequence, the deleted keys are skipped.
+// Seek takes a user key and Key returns the user key. caller should call UnRef after iterate end
+func (db *DB) NewIterator() (Iterator, error) {
+
+	db.rwMutex.RLock()
+	// checked with mutex held, so the iterator is either counted before Close or rejected
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		db.rwMutex.RUnlock()
+		return nil, ErrClosed
+	}
+	atomic.AddInt32(&db.openIterators, 1)
+	v := db.VersionSet.getCurrent()
+	mem := db.mem
+	imm := db.imm
+	v.Ref()
+	mem.Ref()
+	if imm != nil {
+		imm.Ref()
+	}
+	seq := db.seqNum
+	db.rwMutex.RUnlock()
+
+	release := func() {
+		db.rwMutex.Lock()
+		v.UnRef()
+		db.rwMutex.Unlock()
+		mem.UnRef()
+		if imm != nil {
+			imm.UnRef()
+		}
+		atomic.AddInt32(&db.openIterators, -1)
+	}
+
+	iter, err := v.newInternalIterator(mem, imm)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	return newDBIter(iter, seq, v.vSet.cmp.uCmp, release), nil
+}
+
+// newInternalIterator merge the internal keys of mems and tables of v
+func (v *Version) newInternalIterator(mems ...*MemDB) (Iterator, error) {
+
+	iters := make([]Iterator, 0, len(mems)+len(v.levels[0])+kLevelNum-1)
+	for _, mem := range mems {
+		if mem != nil {
+			iters = append(iters, mem.NewIterator())
+		}
+	}
+
+	for level, tables := range v.levels {
+		if len(tables) == 0 {
+			continue
+		}
+		if level > 0 {
+			// the tables of level are not overlapped, concatenate them
+			iters = append(iters, newIndexedIterator(newTFileArrIteratorIndexer(tables, v.vSet.newTableIterator)))
+			continue
+		}
+		for _, t := range tables {
+			iter, err := v.vSet.newTableIterator(t)
+			if err != nil {
+				for _, iter := range iters {
+					iter.UnRef()
+				}
+				return nil, err
+			}
+			iters = append(iters, iter)
+		}
+	}
+
+	return NewMergeIterator(iters), nil
+}
+
+/**
+dbIter convert the internal keys into user keys
+
+	internal keys: a@9(put) a@5(put) b@8(del) b@3(put) c@12(put) c@7(put)
+	seq=10:        a@9                                  c@7
+**/
+
+type dbIter struct {
+	*BasicReleaser
+	iter Iterator // internal keys
+	seq  Sequence
+	ucmp BasicComparer
+
+	dir        direction
+	key, value []byte
+	skip       []byte // the user key whose older entries are skipped
+	err        error
+}
+
+func newDBIter(iter Iterator, seq Sequence, ucmp BasicComparer, onClose func()) *dbIter {
+	it := &dbIter{
+		iter: iter,
+		seq:  seq,
+		ucmp: ucmp,
+	}
+	it.BasicReleaser = &BasicReleaser{
+		OnClose: func() {
+			iter.UnRef()
+			onClose()
+			it.key = nil
+			it.value = nil
+		},
+	}
+	it.Ref()
+	return it
+}
+
+func (it *dbIter) SeekFirst() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.released() {
+		it.err = ErrReleased
+		return false
+	}
+	it.skip = it.skip[:0]
+	return it.findNextUserEntry(it.iter.SeekFirst(), false)
+}
+
+// Seek move to the first user key >= key
+func (it *dbIter) Seek(key InternalKey) bool {
+	if it.err != nil {
+		return false
+	}
+	if it.released() {
+		it.err = ErrReleased
+		return false
+	}
+	it.skip = it.skip[:0]
+	ikey := buildInternalKey(make([]byte, len(key)), key, kTypeSeek, it.seq)
+	return it.findNextUserEntry(it.iter.Seek(ikey), false)
+}
+
+func (it *dbIter) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.released() {
+		it.err = ErrReleased
+		return false
+	}
+	if it.dir == dirEOI {
+		return false
+	} else if it.dir != dirForward {
+		return it.SeekFirst()
+	}
+	// the older entries of current key are skipped
+	it.skip = append(it.skip[:0], it.key...)
+	return it.findNextUserEntry(it.iter.Next(), true)
+}
+
+// findNextUserEntry find the newest visible entry of the next user key from the current entry of iter
+func (it *dbIter) findNextUserEntry(ok bool, skipping bool) bool {
+
+	for ; ok; ok = it.iter.Next() {
+		ukey, kt, seq, err := parseInternalKey(it.iter.Key())
+		if err != nil {
+			it.err = NewErrCorruption(err.Error())
+			return false
+		}
+		if Sequence(seq) > it.seq {
+			continue
+		}
+		if skipping && it.ucmp.Compare(ukey, it.skip) == 0 {
+			continue
+		}
+		if kt == keyTypeDel {
+			it.skip = append(it.skip[:0], ukey...)
+			skipping = true
+			continue
+		}
+		it.dir = dirForward
+		it.key = append(it.key[:0], ukey...)
+		it.value = append(it.value[:0], it.iter.Value()...)
+		return true
+	}
+
+	it.dir = dirEOI
+
+	if err := it.iter.Valid(); err != nil {
+		it.err = err
+	}
+	it.key = nil
+	it.value = nil
+	return false
+}
+
+func (it *dbIter) Key() []byte {
+	return it.key
+}
+
+func (it *dbIter) Value() []byte {
+	return it.value
+}
+
+func (it *dbIter) Valid() error {
+	return it.err
+}
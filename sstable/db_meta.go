@@ -0,0 +1,95 @@
+package sstable
+
+import "sync/atomic"
+
+// TableFileMeta the metadata of a live table file
+type TableFileMeta struct {
+	Level    int
+	FileNum  uint64
+	Size     int
+	Smallest []byte // user key
+	Largest  []byte
+}
+
+// LevelMeta the live table files of a level, the files of level0 may overlap
+type LevelMeta struct {
+	Level int
+	Files []TableFileMeta
+	Size  int
+}
+
+// Levels the table files of each level in the current version of default family
+func (db *DB) Levels() ([]LevelMeta, error) {
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return nil, ErrClosed
+	}
+
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	v := db.VersionSet.getCurrent()
+	levels := make([]LevelMeta, len(v.levels))
+	for level, tables := range v.levels {
+		levels[level].Level = level
+		for _, t := range tables {
+			levels[level].Files = append(levels[level].Files, TableFileMeta{
+				Level:    level,
+				FileNum:  t.fd.Num,
+				Size:     t.Size,
+				Smallest: append([]byte(nil), t.iMin.ukey()...),
+				Largest:  append([]byte(nil), t.iMax.ukey()...),
+			})
+			levels[level].Size += t.Size
+		}
+	}
+	return levels, nil
+}
+
+// Stats the runtime state of default family
+type Stats struct {
+	LatestSequence Sequence
+	MemTableSize   int // approximate bytes of mem
+	ImmutableSize  int // approximate bytes of imm waiting for flush, 0 if no imm
+
+	Flushing           bool
+	RunningCompactions int
+
+	// the background error stopping the writes, empty if none
+	BackgroundError string
+
+	LevelFiles []int
+	LevelBytes []int
+}
+
+func (db *DB) Stats() (Stats, error) {
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return Stats{}, ErrClosed
+	}
+
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	stats := Stats{
+		LatestSequence:     db.seqNum,
+		Flushing:           db.bgFlushScheduled,
+		RunningCompactions: db.bgCompactionScheduled,
+	}
+	if db.mem != nil {
+		stats.MemTableSize = db.mem.ApproximateSize()
+	}
+	if db.imm != nil {
+		stats.ImmutableSize = db.imm.ApproximateSize()
+	}
+	if db.bgErr != nil {
+		stats.BackgroundError = db.bgErr.Error()
+	}
+
+	v := db.VersionSet.getCurrent()
+	for _, tables := range v.levels {
+		stats.LevelFiles = append(stats.LevelFiles, len(tables))
+		stats.LevelBytes = append(stats.LevelBytes, tables.size())
+	}
+	return stats, nil
+}
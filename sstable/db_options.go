@@ -0,0 +1,253 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+type optionSetter func(opt *Options, value string) error
+
+func intOption(field func(opt *Options) *int) optionSetter {
+	return func(opt *Options, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(opt) = n
+		return nil
+	}
+}
+
+// mutableOptions the options can be changed by DB.SetOptions
+var mutableOptions = map[string]optionSetter{
+	"write_buffer_size": intOption(func(opt *Options) *int {
+		return &opt.WriteBufferSize
+	}),
+	"level0_file_num_compaction_trigger": intOption(func(opt *Options) *int {
+		return &opt.Level0FileNumCompactionTrigger
+	}),
+	"level0_slowdown_writes_trigger": intOption(func(opt *Options) *int {
+		return &opt.Level0SlowdownWritesTrigger
+	}),
+	"level0_stop_writes_trigger": intOption(func(opt *Options) *int {
+		return &opt.Level0StopWritesTrigger
+	}),
+	"max_bytes_for_level_base": intOption(func(opt *Options) *int {
+		return &opt.MaxBytesForLevelBase
+	}),
+}
+
+var compactionStyleNames = map[CompactionStyle]string{
+	CompactionStyleLevel:     "level",
+	CompactionStyleUniversal: "universal",
+	CompactionStyleFIFO:      "fifo",
+}
+
+// validateOptions check the options are consistent
+func validateOptions(opt *Options) error {
+	switch {
+	case opt.WriteBufferSize <= 0:
+		return fmt.Errorf("%w, write_buffer_size must be positive", ErrInvalidOption)
+	case opt.Level0FileNumCompactionTrigger <= 0:
+		return fmt.Errorf("%w, level0_file_num_compaction_trigger must be positive", ErrInvalidOption)
+	case opt.Level0SlowdownWritesTrigger < opt.Level0FileNumCompactionTrigger:
+		return fmt.Errorf("%w, level0_slowdown_writes_trigger must not be less than compaction trigger", ErrInvalidOption)
+	case opt.Level0StopWritesTrigger < opt.Level0SlowdownWritesTrigger:
+		return fmt.Errorf("%w, level0_stop_writes_trigger must not be less than slowdown trigger", ErrInvalidOption)
+	case opt.MaxBytesForLevelBase <= 0:
+		return fmt.Errorf("%w, max_bytes_for_level_base must be positive", ErrInvalidOption)
+	}
+	return nil
+}
+
+// SetOptions change the mutable options at runtime without restarting, the supported keys are
+//
+//	write_buffer_size, level0_file_num_compaction_trigger, level0_slowdown_writes_trigger,
+//	level0_stop_writes_trigger, max_bytes_for_level_base, rate_limiter_bytes_per_sec
+//
+// all the options are validated and persisted into a new OPTIONS file before any of them is applied,
+// the options are unchanged if it fails
+func (db *DB) SetOptions(opts map[string]string) error {
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return ErrClosed
+	}
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+
+	var (
+		opt       = db.VersionSet.opt
+		newOpt    = *opt
+		rateLimit int64
+	)
+
+	for key, value := range opts {
+		if key == "rate_limiter_bytes_per_sec" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("%w, %s=%s", ErrInvalidOption, key, value)
+			}
+			if opt.RateLimiter == nil {
+				return fmt.Errorf("%w, rate limiter not configured", ErrInvalidOption)
+			}
+			rateLimit = n
+			continue
+		}
+
+		// the table writer only writes uncompressed blocks, there is no compression to switch to
+		if key == "compression" {
+			return fmt.Errorf("%w, %s=%s, %v", ErrInvalidOption, key, value, ErrUnSupportCompressionType)
+		}
+
+		setter, ok := mutableOptions[key]
+		if !ok {
+			return fmt.Errorf("%w, %s is unknown or immutable", ErrInvalidOption, key)
+		}
+		if err := setter(&newOpt, value); err != nil {
+			return fmt.Errorf("%w, %s=%s, %v", ErrInvalidOption, key, value, err)
+		}
+	}
+
+	if err := validateOptions(&newOpt); err != nil {
+		return err
+	}
+
+	kvs := optionsMap(&newOpt)
+	if rateLimit > 0 {
+		kvs["rate_limiter_bytes_per_sec"] = strconv.FormatInt(rateLimit, 10)
+	}
+	if err := db.writeOptionsFile(kvs); err != nil {
+		return err
+	}
+
+	// RateLimiter is read by the background jobs without mutex, only copy the mutable fields
+	opt.WriteBufferSize = newOpt.WriteBufferSize
+	opt.Level0FileNumCompactionTrigger = newOpt.Level0FileNumCompactionTrigger
+	opt.Level0SlowdownWritesTrigger = newOpt.Level0SlowdownWritesTrigger
+	opt.Level0StopWritesTrigger = newOpt.Level0StopWritesTrigger
+	opt.MaxBytesForLevelBase = newOpt.MaxBytesForLevelBase
+	if rateLimit > 0 {
+		opt.RateLimiter.SetBytesPerSecond(rateLimit)
+	}
+
+	// the families follow the db
+	for _, family := range db.VersionSet.liveFamilies() {
+		fOpt := family.opt
+		fOpt.WriteBufferSize = opt.WriteBufferSize
+		fOpt.Level0FileNumCompactionTrigger = opt.Level0FileNumCompactionTrigger
+		fOpt.Level0SlowdownWritesTrigger = opt.Level0SlowdownWritesTrigger
+		fOpt.Level0StopWritesTrigger = opt.Level0StopWritesTrigger
+		fOpt.MaxBytesForLevelBase = opt.MaxBytesForLevelBase
+		finalize(family.current)
+	}
+
+	// the triggers and level size changed, recompute the compaction score
+	finalize(db.VersionSet.current)
+	db.MaybeScheduleCompaction()
+	db.backgroundWorkFinishedSignal.Broadcast()
+
+	return nil
+}
+
+// GetOptions return the current options in the same keys as the OPTIONS file
+func (db *DB) GetOptions() (map[string]string, error) {
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return nil, ErrClosed
+	}
+
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+	return optionsMap(db.VersionSet.opt), nil
+}
+
+// optionsMap the options as key=value
+func optionsMap(opt *Options) map[string]string {
+
+	kvs := map[string]string{
+		"compaction_style":                   compactionStyleNames[opt.CompactionStyle],
+		"write_buffer_size":                  strconv.Itoa(opt.WriteBufferSize),
+		"level0_file_num_compaction_trigger": strconv.Itoa(opt.Level0FileNumCompactionTrigger),
+		"level0_slowdown_writes_trigger":     strconv.Itoa(opt.Level0SlowdownWritesTrigger),
+		"level0_stop_writes_trigger":         strconv.Itoa(opt.Level0StopWritesTrigger),
+		"max_bytes_for_level_base":           strconv.Itoa(opt.MaxBytesForLevelBase),
+		"max_background_jobs":                strconv.Itoa(opt.MaxBackgroundJobs),
+		"max_subcompactions":                 strconv.Itoa(opt.MaxSubcompactions),
+		"universal.compaction_trigger":       strconv.Itoa(opt.Universal.CompactionTrigger),
+		"universal.size_ratio":               strconv.Itoa(opt.Universal.SizeRatio),
+		"universal.min_merge_width":          strconv.Itoa(opt.Universal.MinMergeWidth),
+		"universal.max_merge_width":          strconv.Itoa(opt.Universal.MaxMergeWidth),
+		"universal.max_size_amplification":   strconv.Itoa(opt.Universal.MaxSizeAmplificationPercent),
+		"fifo.max_table_files_size":          strconv.Itoa(opt.FIFO.MaxTableFilesSize),
+		"fifo.ttl":                           opt.FIFO.TTL.String(),
+		"paranoid_checks":                    strconv.FormatBool(opt.ParanoidChecks),
+	}
+
+	if opt.RateLimiter != nil {
+		kvs["rate_limiter_bytes_per_sec"] = strconv.FormatInt(opt.RateLimiter.BytesPerSecond(), 10)
+	}
+	return kvs
+}
+
+// encodeOptions encode the options as sorted key=value lines
+func encodeOptions(kvs map[string]string) []byte {
+
+	keys := make([]string, 0, len(kvs))
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString("# generated by db, changes would be overwritten\n")
+	for _, key := range keys {
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(kvs[key])
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// writeOptionsFile persist the options into a new OPTIONS file, the old one would be removed as obsolete file
+// required: mutex held
+func (db *DB) writeOptionsFile(kvs map[string]string) (err error) {
+
+	var (
+		vSet = db.VersionSet
+		fd   = Fd{
+			FileType: KOptionsFile,
+			Num:      vSet.allocFileNum(),
+		}
+	)
+
+	w, err := vSet.storage.Create(fd)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if cErr := w.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			_ = vSet.storage.Remove(fd)
+			return
+		}
+		vSet.optionsFd = fd
+	}()
+
+	if _, err = w.Write(encodeOptions(kvs)); err != nil {
+		return
+	}
+
+	return w.Sync()
+}
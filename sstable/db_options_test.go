@@ -0,0 +1,94 @@
+package sstable
+
+import (
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func readOptionsFile(t *testing.T, db *DB, dir string) string {
+	content, err := ioutil.ReadFile(path.Join(dir, db.VersionSet.optionsFd.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestSetOptions(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.SetOptions(map[string]string{
+		"write_buffer_size":        "1048576",
+		"max_bytes_for_level_base": "4194304",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := db.GetOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts["write_buffer_size"] != "1048576" || opts["max_bytes_for_level_base"] != "4194304" {
+		t.Fatalf("unexpected options %v", opts)
+	}
+	if db.VersionSet.opt.WriteBufferSize != 1<<20 {
+		t.Fatalf("write buffer size not applied, %d", db.VersionSet.opt.WriteBufferSize)
+	}
+	if content := readOptionsFile(t, db, dir); !strings.Contains(content, "write_buffer_size=1048576\n") {
+		t.Fatalf("options not persisted:\n%s", content)
+	}
+
+	// the invalid, unknown and immutable options are rejected as a whole
+	for _, opts := range []map[string]string{
+		{"write_buffer_size": "2097152", "level0_stop_writes_trigger": "1"},
+		{"write_buffer_size": "-1"},
+		{"write_buffer_size": "abc"},
+		{"max_background_jobs": "8"},
+		{"no_such_option": "1"},
+		{"compression": "snappy"},
+	} {
+		if err := db.SetOptions(opts); !errors.Is(err, ErrInvalidOption) {
+			t.Fatalf("SetOptions(%v) expect ErrInvalidOption, got %v", opts, err)
+		}
+	}
+	if err := db.SetOptions(map[string]string{"compression": "snappy"}); err == nil ||
+		!strings.Contains(err.Error(), ErrUnSupportCompressionType.Error()) {
+		t.Fatalf("expect compression rejected as unsupported, got %v", err)
+	}
+	if db.VersionSet.opt.WriteBufferSize != 1<<20 {
+		t.Fatalf("rejected options applied, write buffer size %d", db.VersionSet.opt.WriteBufferSize)
+	}
+
+	// the options are unchanged if they can't be persisted
+	optionsFd := db.VersionSet.optionsFd
+	stor := db.VersionSet.storage
+	fs := &faultStorage{Storage: stor, fileTypes: KOptionsFile}
+	fs.inject(syscall.ENOSPC)
+	db.VersionSet.storage = fs
+	err = db.SetOptions(map[string]string{"write_buffer_size": "2097152"})
+	db.VersionSet.storage = stor
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expect ENOSPC, got %v", err)
+	}
+	if db.VersionSet.opt.WriteBufferSize != 1<<20 || db.VersionSet.optionsFd != optionsFd {
+		t.Fatalf("options changed after persisting failed, write buffer size %d, %v",
+			db.VersionSet.opt.WriteBufferSize, db.VersionSet.optionsFd)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetOptions(); err != ErrClosed {
+		t.Fatalf("expect ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package sstable
+
+import "testing"
+
+func TestClose(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	putTestKeys(t, db, 100)
+
+	// the unreleased iterators keep db open
+	iter, err := db.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, err := db.GetUpdatesSince(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != ErrIteratorsOpen {
+		t.Fatalf("expect close rejected by iterators, got %v", err)
+	}
+	iter.UnRef()
+	if err = db.Close(); err != ErrIteratorsOpen {
+		t.Fatalf("expect close rejected by updates iterator, got %v", err)
+	}
+	updates.UnRef()
+	checkTestKeys(t, db, 100)
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the calls after closed are rejected
+	if err = db.Close(); err != ErrClosed {
+		t.Fatalf("close: expect ErrClosed, got %v", err)
+	}
+	if err = db.Put([]byte("k"), []byte("v")); err != ErrClosed {
+		t.Fatalf("put: expect ErrClosed, got %v", err)
+	}
+	if err = db.Delete([]byte("k")); err != ErrClosed {
+		t.Fatalf("delete: expect ErrClosed, got %v", err)
+	}
+	if _, err = db.Get([]byte("k0000")); err != ErrClosed {
+		t.Fatalf("get: expect ErrClosed, got %v", err)
+	}
+	if _, err = db.NewIterator(); err != ErrClosed {
+		t.Fatalf("iterator: expect ErrClosed, got %v", err)
+	}
+	if _, err = db.GetUpdatesSince(1); err != ErrClosed {
+		t.Fatalf("updates: expect ErrClosed, got %v", err)
+	}
+	if err = db.Compact(); err != ErrClosed {
+		t.Fatalf("compact: expect ErrClosed, got %v", err)
+	}
+
+	// the LOCK is released, the unflushed writes are recovered from journal
+	if db, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkTestKeys(t, db, 100)
+	putTestKeys(t, db, 200)
+	checkTestKeys(t, db, 200)
+}
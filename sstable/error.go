@@ -25,5 +25,27 @@ var (
 	ErrMissingChunk             = errors.New("leveldb/journal chunk miss")
 	ErrClosed                   = errors.New("leveldb/shutdown")
 	ErrFileIsDir                = errors.New("leveldb/path is dir")
+	ErrLocked                   = errors.New("leveldb/db locked by another process")
 	ErrDeleted                  = errors.New("leveldb/memdb key deleted")
+	ErrDirExists                = errors.New("leveldb/checkpoint dir exists")
+	ErrKeyNotSorted             = errors.New("leveldb/sst file writer key not sorted")
+	ErrEmptySstFile             = errors.New("leveldb/sst file writer no entries")
+	ErrIngestOverlapped         = errors.New("leveldb/ingest external files overlapped")
+	ErrReadOnly                 = errors.New("leveldb/db opened in read only mode")
+	ErrNotSecondary             = errors.New("leveldb/db not opened as secondary")
+	ErrInvalidOption            = errors.New("leveldb/options invalid option")
+	ErrColumnFamilyNotFound     = errors.New("leveldb/column family not found")
+	ErrColumnFamilyExists       = errors.New("leveldb/column family already exists")
+	ErrColumnFamilyDropped      = errors.New("leveldb/column family dropped")
+	ErrConflict                 = errors.New("leveldb/txn write conflict")
+	ErrTxnDone                  = errors.New("leveldb/txn already committed or rolled back")
+	ErrLockTimeout              = errors.New("leveldb/txn lock timeout")
+	ErrDeadlock                 = errors.New("leveldb/txn deadlock detected")
+	ErrNoSavePoint              = errors.New("leveldb/txn no save point")
+	ErrBatchColumnFamily        = errors.New("leveldb/batch column family record not handled")
+	ErrUpdatesPurged            = errors.New("leveldb/journal of the sequence has been removed")
+	ErrReplicationProtocol      = errors.New("leveldb/replication protocol error")
+	ErrReplicaTooFarBehind      = errors.New("leveldb/replication replica too far behind the primary")
+	ErrReplicationGap           = errors.New("leveldb/replication batch sequence not continuous")
+	ErrIteratorsOpen            = errors.New("leveldb/db closed with unreleased iterators")
 )
@@ -0,0 +1,183 @@
+package sstable
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type bgErrorSeverity uint8
+
+const (
+	// bgErrorTransient the cause may go away by itself, e.g. disk full, the failed job is retried automatically
+	bgErrorTransient bgErrorSeverity = iota
+	// bgErrorHard the cause needs the operator to fix, cleared by DB.Resume
+	bgErrorHard
+	// bgErrorFatal the data is corrupted, the db must be reopened and repaired
+	bgErrorFatal
+)
+
+func (s bgErrorSeverity) String() string {
+	switch s {
+	case bgErrorTransient:
+		return "transient"
+	case bgErrorHard:
+		return "hard"
+	default:
+		return "fatal"
+	}
+}
+
+// transientErrnos the io errors may disappear without operator, e.g. another process frees the disk space
+var transientErrnos = []syscall.Errno{
+	syscall.ENOSPC,
+	syscall.EAGAIN,
+	syscall.EINTR,
+	syscall.EBUSY,
+}
+
+// classifyBackgroundError the errno is unwrapped from *os.PathError and *os.SyscallError
+func classifyBackgroundError(err error) bgErrorSeverity {
+
+	var corruption *ErrCorruption
+	if errors.As(err, &corruption) {
+		return bgErrorFatal
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		for _, transient := range transientErrnos {
+			if errno == transient {
+				return bgErrorTransient
+			}
+		}
+	}
+
+	return bgErrorHard
+}
+
+/**
+background error recovery
+
+	flush/compaction/journal err -> recordBackgroundError -> bgErr set, writes fail
+	    transient -> sleep backoff -> clear bgErr -> reschedule the jobs -> fail again -> backoff * 2
+	                                                                    \-> done -> attempts reset
+	    transient, out of attempts -> same as hard
+	    hard -> Resume -> clear bgErr -> reschedule and wait the flush
+	    fatal -> never cleared
+**/
+
+// recordBackgroundError required: mutex held
+func (db *DB) recordBackgroundError(err error) {
+
+	assertMutexHeld(&db.rwMutex)
+
+	if db.bgErr != nil {
+		return
+	}
+
+	db.bgErr = err
+	db.bgErrSeverity = classifyBackgroundError(err)
+	db.backgroundWorkFinishedSignal.Broadcast()
+	db.VersionSet.listeners().notify(func(l EventListener) {
+		l.OnBackgroundError(err)
+	})
+	db.VersionSet.logger().Warnf("background error, severity=%s, err=%v", db.bgErrSeverity, err)
+
+	if db.bgErrSeverity == bgErrorTransient {
+		db.scheduleRecovery()
+	}
+}
+
+// scheduleRecovery retry the failed jobs after backoff
+// required: mutex held
+func (db *DB) scheduleRecovery() {
+
+	assertMutexHeld(&db.rwMutex)
+
+	if db.recovering {
+		return
+	}
+
+	if db.recoveryAttempts >= kMaxRecoveryAttempts {
+		db.VersionSet.logger().Warnf("give up auto recovery after %d attempts, call Resume after fixed", db.recoveryAttempts)
+		return
+	}
+
+	backoff := kRecoveryBaseBackoff << uint(db.recoveryAttempts)
+	if backoff > kRecoveryMaxBackoff {
+		backoff = kRecoveryMaxBackoff
+	}
+	db.recoveryAttempts++
+	db.recovering = true
+
+	go func(attempt int) {
+		time.Sleep(backoff)
+
+		db.rwMutex.Lock()
+		defer db.rwMutex.Unlock()
+
+		db.recovering = false
+		if atomic.LoadUint32(&db.shutdown) == 1 {
+			return
+		}
+		if db.bgErr == nil || db.bgErrSeverity != bgErrorTransient {
+			// resumed by operator, or a worse error happened
+			return
+		}
+
+		db.VersionSet.logger().Infof("auto recovery attempt %d, err=%v", attempt, db.bgErr)
+		db.clearBackgroundError()
+	}(db.recoveryAttempts)
+}
+
+// clearBackgroundError allow writes and reschedule the failed jobs
+// required: mutex held
+func (db *DB) clearBackgroundError() {
+	assertMutexHeld(&db.rwMutex)
+	db.bgErr = nil
+	db.MaybeScheduleCompaction()
+	db.backgroundWorkFinishedSignal.Broadcast()
+}
+
+// backgroundJobSucceeded reset the retry backoff
+// required: mutex held
+func (db *DB) backgroundJobSucceeded() {
+	assertMutexHeld(&db.rwMutex)
+	db.recoveryAttempts = 0
+}
+
+// Resume clear the background error after the cause is fixed, e.g. the disk space is freed,
+// then wait the pending flush retried. corruption can't be resumed, the db must be reopened.
+func (db *DB) Resume() error {
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return ErrClosed
+	}
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+
+	if db.bgErr == nil {
+		return nil
+	}
+
+	if db.bgErrSeverity == bgErrorFatal {
+		return db.bgErr
+	}
+
+	db.VersionSet.logger().Infof("resume from background error, err=%v", db.bgErr)
+	db.recoveryAttempts = 0
+	db.clearBackgroundError()
+
+	for db.imm != nil && db.bgErr == nil {
+		db.backgroundWorkFinishedSignal.Wait()
+	}
+
+	return db.bgErr
+}
@@ -0,0 +1,364 @@
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// faultStorage fail the Create, Write and Sync of the files of fileTypes with the injected errno
+type faultStorage struct {
+	Storage
+	mu        sync.Mutex
+	fileTypes FileType
+	errno     error
+	creates   int
+}
+
+type memWriter struct {
+	bytes.Buffer
+}
+
+func (w *memWriter) Sync() error  { return nil }
+func (w *memWriter) Close() error { return nil }
+
+type faultWriter struct {
+	SequentialWriter
+	fs *faultStorage
+	fd Fd
+}
+
+func (w *faultWriter) Write(p []byte) (int, error) {
+	if err := w.fs.fault("write", w.fd); err != nil {
+		return 0, err
+	}
+	return w.SequentialWriter.Write(p)
+}
+
+func (w *faultWriter) Sync() error {
+	if err := w.fs.fault("fsync", w.fd); err != nil {
+		return err
+	}
+	return w.SequentialWriter.Sync()
+}
+
+func (fs *faultStorage) fault(op string, fd Fd) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.errno != nil && fd.FileType&fs.fileTypes != 0 {
+		return &os.PathError{Op: op, Path: fd.String(), Err: fs.errno}
+	}
+	return nil
+}
+
+func (fs *faultStorage) Create(fd Fd) (SequentialWriter, error) {
+	if fd.FileType&fs.fileTypes == 0 {
+		return fs.Storage.Create(fd)
+	}
+	fs.mu.Lock()
+	fs.creates++
+	fs.mu.Unlock()
+	if err := fs.fault("open", fd); err != nil {
+		return nil, err
+	}
+	w, err := fs.Storage.Create(fd)
+	if err != nil {
+		return nil, err
+	}
+	return &faultWriter{SequentialWriter: w, fs: fs, fd: fd}, nil
+}
+
+func (fs *faultStorage) inject(errno error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.errno = errno
+}
+
+// createCount the files of fileTypes created, include the failed ones
+func (fs *faultStorage) createCount() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.creates
+}
+
+// openFaultDB open a db in a temp dir on fs
+func openFaultDB(t *testing.T, fs *faultStorage) (*DB, string) {
+	dir := t.TempDir()
+	stor, err := OpenPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Storage = stor
+	db, err := openWithStorage(fs, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, dir
+}
+
+func putTestKeys(t *testing.T, db *DB, n int) {
+	for i := 0; i < n; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkTestKeys(t *testing.T, db *DB, n int) {
+	for i := 0; i < n; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("k%04d", i)))
+		if err != nil || string(v) != fmt.Sprintf("v%04d", i) {
+			t.Fatalf("get k%04d: %q %v", i, v, err)
+		}
+	}
+}
+
+func (db *DB) testBackgroundError() (error, bgErrorSeverity) {
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+	return db.bgErr, db.bgErrSeverity
+}
+
+func (db *DB) testHasImm() bool {
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+	return db.imm != nil
+}
+
+func TestClassifyBackgroundError(t *testing.T) {
+
+	cases := []struct {
+		err      error
+		severity bgErrorSeverity
+	}{
+		{&os.PathError{Op: "write", Path: "000001.ldb", Err: syscall.ENOSPC}, bgErrorTransient},
+		{os.NewSyscallError("fsync", syscall.EINTR), bgErrorTransient},
+		{&os.PathError{Op: "write", Path: "000001.ldb", Err: syscall.EIO}, bgErrorHard},
+		{errors.New("unknown"), bgErrorHard},
+		{NewErrCorruption("bad block"), bgErrorFatal},
+	}
+
+	for _, c := range cases {
+		if got := classifyBackgroundError(c.err); got != c.severity {
+			t.Fatalf("classify %v, expect %s, got %s", c.err, c.severity, got)
+		}
+	}
+}
+
+func TestTransientErrorAutoRetry(t *testing.T) {
+
+	fs := &faultStorage{fileTypes: KTableFile}
+	db, dir := openFaultDB(t, fs)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	putTestKeys(t, db, 100)
+	fs.inject(syscall.ENOSPC)
+	base := fs.createCount()
+
+	if err := db.Compact(); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expect flush failed, got %v", err)
+	}
+
+	// the unflushed keys are still readable
+	checkTestKeys(t, db, 100)
+
+	// 100ms + 200ms backoff
+	deadline := time.Now().Add(5 * time.Second)
+	for fs.createCount()-base < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := fs.createCount() - base; n < 3 {
+		t.Fatalf("expect the flush retried automatically, got %d attempts", n)
+	}
+
+	// the next retry succeeds once the space is freed
+	fs.inject(nil)
+	deadline = time.Now().Add(5 * time.Second)
+	for db.testHasImm() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err, _ := db.testBackgroundError(); err != nil || db.testHasImm() {
+		t.Fatalf("expect recovered automatically, err=%v", err)
+	}
+	if err := db.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestKeys(t, db, 100)
+}
+
+func TestHardErrorResume(t *testing.T) {
+
+	fs := &faultStorage{fileTypes: KTableFile}
+	db, _ := openFaultDB(t, fs)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	putTestKeys(t, db, 100)
+	fs.inject(syscall.EIO)
+	base := fs.createCount()
+
+	if err := db.Compact(); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expect flush failed, got %v", err)
+	}
+	if _, severity := db.testBackgroundError(); severity != bgErrorHard {
+		t.Fatalf("expect hard error, got %s", severity)
+	}
+
+	time.Sleep(2 * kRecoveryBaseBackoff)
+	if n := fs.createCount() - base; n != 1 {
+		t.Fatalf("hard error shouldn't be retried automatically, got %d attempts", n)
+	}
+	if err := db.Put([]byte("k"), []byte("v")); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expect writes fail before resumed, got %v", err)
+	}
+
+	// the fault is not fixed, the retried flush fails again
+	if err := db.Resume(); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expect resume fail, got %v", err)
+	}
+	if n := fs.createCount() - base; n != 2 {
+		t.Fatalf("expect the flush retried by resume, got %d attempts", n)
+	}
+
+	fs.inject(nil)
+	if err := db.Resume(); err != nil {
+		t.Fatalf("expect resumed, got %v", err)
+	}
+	if db.testHasImm() {
+		t.Fatal("expect imm flushed by resume")
+	}
+	if err := db.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("expect writes allowed after resume, got %v", err)
+	}
+	checkTestKeys(t, db, 100)
+}
+
+func TestManifestWriteErrorRollover(t *testing.T) {
+
+	fs := &faultStorage{fileTypes: KDescriptorFile}
+	db, dir := openFaultDB(t, fs)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	putTestKeys(t, db, 100)
+	manifestFd := db.VersionSet.manifestFd
+	fs.inject(syscall.EIO)
+
+	if err := db.Compact(); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expect manifest write failed, got %v", err)
+	}
+	// the flushed table is not installed, the keys are read from imm
+	if !db.testHasImm() {
+		t.Fatal("expect imm kept until the flush installed")
+	}
+	checkTestKeys(t, db, 100)
+
+	fs.inject(nil)
+	if err := db.Resume(); err != nil {
+		t.Fatalf("expect resumed, got %v", err)
+	}
+	if db.VersionSet.manifestFd.Num <= manifestFd.Num || db.VersionSet.manifestFd.FileType != KDescriptorFile {
+		t.Fatalf("expect a new manifest after write error, old %v, new %v", manifestFd, db.VersionSet.manifestFd)
+	}
+	checkTestKeys(t, db, 100)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestKeys(t, db, 100)
+}
+
+func TestFatalErrorNotResumable(t *testing.T) {
+
+	fs := &faultStorage{}
+	db, _ := openFaultDB(t, fs)
+	defer func() {
+		_ = db.Close()
+	}()
+	corruption := NewErrCorruption("bad block")
+
+	db.rwMutex.Lock()
+	db.recordBackgroundError(corruption)
+	db.rwMutex.Unlock()
+
+	if err := db.Resume(); err != corruption {
+		t.Fatalf("expect corruption not resumable, got %v", err)
+	}
+	if err, _ := db.testBackgroundError(); err != corruption {
+		t.Fatalf("expect the error kept, got %v", err)
+	}
+}
+
+func TestJournalWriteErrorNoPhantomSequence(t *testing.T) {
+
+	fs := &faultStorage{fileTypes: KJournalFile}
+	db, dir := openFaultDB(t, fs)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	putTestKeys(t, db, 100)
+	seq := db.LatestSequence()
+	fs.inject(syscall.ENOSPC)
+
+	if err := db.Put([]byte("lost"), []byte("v")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expect journal write failed, got %v", err)
+	}
+	if got := db.LatestSequence(); got != seq {
+		t.Fatalf("expect sequence %d kept, got %d", seq, got)
+	}
+	if _, err := db.Get([]byte("lost")); err != ErrNotFound {
+		t.Fatalf("expect failed write invisible, got %v", err)
+	}
+
+	fs.inject(nil)
+	if err := db.Resume(); err != nil {
+		t.Fatalf("expect resumed, got %v", err)
+	}
+	// the broken journal is switched, the next write reuses the sequence
+	if err := db.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.LatestSequence(); got != seq+1 {
+		t.Fatalf("expect sequence %d, got %d", seq+1, got)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestKeys(t, db, 100)
+	if _, err := db.Get([]byte("lost")); err != ErrNotFound {
+		t.Fatalf("expect failed write not recovered, got %v", err)
+	}
+	if v, err := db.Get([]byte("k")); err != nil || string(v) != "v" {
+		t.Fatalf("get k: %q %v", v, err)
+	}
+	if got := db.LatestSequence(); got != seq+1 {
+		t.Fatalf("expect recovered sequence %d, got %d", seq+1, got)
+	}
+}
@@ -0,0 +1,123 @@
+package sstable
+
+import "time"
+
+// EventListener receive the events of engine internals, e.g. feed the monitoring.
+// the callbacks may be called concurrently by the background jobs, and some of them are
+// called with the db mutex held, so they should return quickly and must not call into db.
+// embed NoopEventListener to implement part of the callbacks.
+type EventListener interface {
+	OnFlushBegin(info FlushJobInfo)
+	OnFlushCompleted(info FlushJobInfo)
+
+	OnCompactionBegin(info CompactionJobInfo)
+	OnCompactionCompleted(info CompactionJobInfo)
+
+	OnTableFileCreated(info TableFileInfo)
+	OnTableFileDeleted(info TableFileInfo)
+
+	OnWriteStall(info WriteStallInfo)
+
+	OnBackgroundError(err error)
+}
+
+type TableFileInfo struct {
+	Level   int // -1 if unknown, e.g. the created and deleted events
+	FileNum uint64
+	Size    int
+	Err     error
+}
+
+type FlushJobInfo struct {
+	JournalNum uint64 // the journal of the flushed mem
+	Output     TableFileInfo
+	Duration   time.Duration
+	Err        error
+}
+
+type CompactionJobInfo struct {
+	InputLevel  int
+	OutputLevel int
+	Inputs      []TableFileInfo
+	Outputs     []TableFileInfo
+	InputBytes  int
+	OutputBytes int
+	Duration    time.Duration
+	Err         error
+
+	// TrivialMove the input table is moved to the output level without rewriting
+	TrivialMove bool
+	// Dropped the inputs are dropped by fifo without outputs
+	Dropped bool
+}
+
+type WriteStallCondition uint8
+
+const (
+	// WriteStallDelayed each write is delayed 1ms
+	WriteStallDelayed WriteStallCondition = iota
+	// WriteStallStopped writes are blocked until background jobs catch up
+	WriteStallStopped
+)
+
+type WriteStallInfo struct {
+	Condition WriteStallCondition
+	Cause     string
+}
+
+type NoopEventListener struct{}
+
+func (NoopEventListener) OnFlushBegin(info FlushJobInfo)               {}
+func (NoopEventListener) OnFlushCompleted(info FlushJobInfo)           {}
+func (NoopEventListener) OnCompactionBegin(info CompactionJobInfo)     {}
+func (NoopEventListener) OnCompactionCompleted(info CompactionJobInfo) {}
+func (NoopEventListener) OnTableFileCreated(info TableFileInfo)        {}
+func (NoopEventListener) OnTableFileDeleted(info TableFileInfo)        {}
+func (NoopEventListener) OnWriteStall(info WriteStallInfo)             {}
+func (NoopEventListener) OnBackgroundError(err error)                  {}
+
+type eventListeners []EventListener
+
+func (vSet *VersionSet) listeners() eventListeners {
+	return vSet.opt.Listeners
+}
+
+func (listeners eventListeners) notify(f func(l EventListener)) {
+	for _, l := range listeners {
+		f(l)
+	}
+}
+
+// compactionJobInfo the inputs of c, outputs are filled after compaction
+func (c *compaction1) compactionJobInfo() CompactionJobInfo {
+
+	info := CompactionJobInfo{
+		InputLevel:  c.cPtr.level,
+		OutputLevel: c.outputLevel,
+	}
+
+	addInput := func(level int, t tFile) {
+		info.Inputs = append(info.Inputs, TableFileInfo{
+			Level:   level,
+			FileNum: t.fd.Num,
+			Size:    t.Size,
+		})
+		info.InputBytes += t.Size
+	}
+
+	if c.runs != nil {
+		for _, run := range c.runs {
+			for _, t := range run.files {
+				addInput(run.level, t)
+			}
+		}
+	} else {
+		for which, inputs := range c.inputs {
+			for _, t := range inputs {
+				addInput(c.cPtr.level+which, t)
+			}
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,169 @@
+package sstable
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type recordingListener struct {
+	NoopEventListener
+	mu          sync.Mutex
+	flushes     []FlushJobInfo
+	compactions []CompactionJobInfo
+	begins      int
+	created     map[uint64]bool
+	deleted     map[uint64]bool
+}
+
+func newRecordingListener() *recordingListener {
+	return &recordingListener{
+		created: make(map[uint64]bool),
+		deleted: make(map[uint64]bool),
+	}
+}
+
+func (l *recordingListener) OnFlushCompleted(info FlushJobInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushes = append(l.flushes, info)
+}
+
+func (l *recordingListener) OnCompactionBegin(info CompactionJobInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.begins++
+}
+
+func (l *recordingListener) OnCompactionCompleted(info CompactionJobInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.compactions = append(l.compactions, info)
+}
+
+func (l *recordingListener) OnTableFileCreated(info TableFileInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if info.Err == nil {
+		l.created[info.FileNum] = true
+	}
+}
+
+func (l *recordingListener) OnTableFileDeleted(info TableFileInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if info.Err == nil {
+		l.deleted[info.FileNum] = true
+	}
+}
+
+func putPrefixKeys(t *testing.T, db *DB, prefixes ...string) {
+	for _, prefix := range prefixes {
+		for i := 0; i < 50; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%s%03d", prefix, i)), []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEventListenerLeveled(t *testing.T) {
+
+	l := newRecordingListener()
+	opt := &Options{
+		Level0FileNumCompactionTrigger: 2,
+		Listeners:                      []EventListener{l},
+	}
+	db, err := OpenWithOptions(t.TempDir(), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// two disjoint level0 tables, one of them is moved to level1
+	putPrefixKeys(t, db, "a")
+	putPrefixKeys(t, db, "b")
+
+	l.mu.Lock()
+	if len(l.flushes) != 2 {
+		t.Fatalf("expect 2 flushes, got %d", len(l.flushes))
+	}
+	for _, info := range l.flushes {
+		if info.Err != nil || !l.created[info.Output.FileNum] {
+			t.Fatalf("expect flush output %d created, got %+v", info.Output.FileNum, info)
+		}
+	}
+	if len(l.compactions) != 1 || l.begins != 1 {
+		t.Fatalf("expect 1 compaction, got %d begins %d completions", l.begins, len(l.compactions))
+	}
+	move := l.compactions[0]
+	if !move.TrivialMove || move.Dropped || move.Err != nil || len(move.Inputs) != 1 || len(move.Outputs) != 1 ||
+		move.Outputs[0].FileNum != move.Inputs[0].FileNum || move.Outputs[0].Level != 1 {
+		t.Fatalf("expect trivial move to level1, got %+v", move)
+	}
+	if l.deleted[move.Inputs[0].FileNum] {
+		t.Fatalf("the moved table %d should not be deleted", move.Inputs[0].FileNum)
+	}
+	l.mu.Unlock()
+
+	// the new table overlaps both, the inputs are rewritten and deleted
+	putPrefixKeys(t, db, "a", "b")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.compactions) != 2 || l.begins != 2 {
+		t.Fatalf("expect 2 compactions, got %d begins %d completions", l.begins, len(l.compactions))
+	}
+	rewrite := l.compactions[1]
+	if rewrite.TrivialMove || rewrite.Dropped || rewrite.Err != nil || len(rewrite.Inputs) < 2 || len(rewrite.Outputs) == 0 {
+		t.Fatalf("expect compaction rewrites the inputs, got %+v", rewrite)
+	}
+	for _, input := range rewrite.Inputs {
+		if !l.deleted[input.FileNum] {
+			t.Fatalf("expect input table %d deleted", input.FileNum)
+		}
+	}
+	for _, output := range rewrite.Outputs {
+		if !l.created[output.FileNum] || l.deleted[output.FileNum] {
+			t.Fatalf("expect output table %d created and kept", output.FileNum)
+		}
+	}
+}
+
+func TestEventListenerFIFODrop(t *testing.T) {
+
+	l := newRecordingListener()
+	opt := &Options{
+		CompactionStyle: CompactionStyleFIFO,
+		FIFO:            FIFOOptions{MaxTableFilesSize: 30 << 10},
+		Listeners:       []EventListener{l},
+	}
+	db, err := OpenWithOptions(t.TempDir(), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for batch := 0; batch < 6; batch++ {
+		putFIFOBatch(t, db, batch)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.compactions) == 0 {
+		t.Fatal("expect fifo compactions")
+	}
+	for _, info := range l.compactions {
+		if !info.Dropped || info.TrivialMove || info.Err != nil || len(info.Inputs) == 0 || len(info.Outputs) != 0 {
+			t.Fatalf("expect fifo drop without outputs, got %+v", info)
+		}
+		for _, input := range info.Inputs {
+			if !l.deleted[input.FileNum] {
+				t.Fatalf("expect dropped table %d deleted", input.FileNum)
+			}
+		}
+	}
+}
@@ -26,7 +26,7 @@ func lockFile(path string) (FileLock, error) {
 	runtime.KeepAlive(file)
 	if ok := setFileLock(file, true); !ok {
 		_ = file.Close()
-		return nil, err
+		return nil, ErrLocked
 	}
 	fileLock := &UnixFileLock{
 		File: file,
@@ -3,6 +3,7 @@ package sstable
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -15,6 +16,7 @@ const (
 	KCurrentFile
 	KDBLockFile
 	KDBTempFile
+	KOptionsFile
 )
 
 type Fd struct {
@@ -37,6 +39,8 @@ func (fd Fd) String() string {
 		return fmt.Sprintf("CURRENT")
 	case KDBTempFile:
 		return fmt.Sprintf("%06d.dbtmp", fd.Num)
+	case KOptionsFile:
+		return fmt.Sprintf("OPTIONS-%06d", fd.Num)
 	default:
 		return fmt.Sprintf("%x-%06d", fd.FileType, fd.Num)
 	}
@@ -49,29 +53,30 @@ func (fd Fd) String() string {
 // %06d.log
 // %06d.ldb
 // %06d.dbtmp
+// OPTIONS-%06d
 func parseFd(fileName string) (fd Fd, err error) {
 
-	if fileName == "CURRENT" {
+	var num string
+	switch {
+	case fileName == "CURRENT":
 		fd.FileType = KCurrentFile
-	} else if fileName == "LOCK" {
+		return
+	case fileName == "LOCK":
 		fd.FileType = KDBLockFile
-	} else if strings.HasPrefix(fileName, "MANIFEST") {
-		if _, sErr := fmt.Sscanf("MANIFEST-%06d", fileName, &fd.Num); sErr != nil {
-			err = sErr
-			return
-		}
+		return
+	case strings.HasPrefix(fileName, "MANIFEST-"):
 		fd.FileType = KDescriptorFile
-	} else {
-
-		var ft string
-
-		_, sErr := fmt.Sscanf("%06d.%s", fileName, &fd.Num, &ft)
-		if sErr != nil {
-			err = sErr
+		num = strings.TrimPrefix(fileName, "MANIFEST-")
+	case strings.HasPrefix(fileName, "OPTIONS-"):
+		fd.FileType = KOptionsFile
+		num = strings.TrimPrefix(fileName, "OPTIONS-")
+	default:
+		dot := strings.IndexByte(fileName, '.')
+		if dot < 0 {
+			err = errors.New("undefined filetype")
 			return
 		}
-
-		switch ft {
+		switch fileName[dot+1:] {
 		case "ldb", "sst":
 			fd.FileType = KTableFile
 		case "log":
@@ -80,7 +85,11 @@ func parseFd(fileName string) (fd Fd, err error) {
 			fd.FileType = KDBTempFile
 		default:
 			err = errors.New("undefined filetype")
+			return
 		}
+		num = fileName[:dot]
 	}
+
+	fd.Num, err = strconv.ParseUint(num, 10, 64)
 	return
 }
@@ -5,10 +5,6 @@ import (
 	"hash/fnv"
 )
 
-var (
-	hash = fnv.New32()
-)
-
 type IFilter interface {
 	MayContains(filter, key []byte) bool
 	NewGenerator() IFilterGenerator
@@ -32,24 +28,36 @@ func NewBloomFilter(numBitsPerKey uint8) BloomFilter {
 }
 
 func (bf BloomFilter) NewGenerator() IFilterGenerator {
+	k := uint8(uint(bf) * 7 / 10) // number hash function, bits per key * ln2
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
 	return &BloomFilterGenerator{
-		numBitsPerKey: uint8(bf),          // per keys using number bits represent in filter bits
-		k:             uint8(bf) * 7 / 10, // number hash function
+		numBitsPerKey: uint8(bf), // per keys using number bits represent in filter bits
+		k:             k,
 	}
 }
 
 func (bf BloomFilter) MayContains(filter, key []byte) bool {
 
+	if len(filter) < 2 {
+		return false
+	}
 	bloomData := filter[:len(filter)-1]
+	numBits := uint32(len(bloomData) * 8)
 
 	k := filter[len(filter)-1]
+	if k > 30 {
+		// reserved for the new encodings, treat as matched
+		return true
+	}
 	h := hash32(key)
 	delta := h>>17 | h<<15
 	for i := uint8(0); i < k; i++ {
-		bitPos := uint8(h % uint32(8))
-		bytePos := h / uint32(8)
-		bloomByte := bloomData[bytePos]
-		if bitPos<<(7-bitPos)&bloomByte != bitPos<<(7-bitPos) {
+		bitPos := h % numBits
+		if bloomData[bitPos/8]&(1<<(bitPos%8)) == 0 {
 			return false
 		}
 		h += delta
@@ -65,6 +73,10 @@ func (bf *BloomFilterGenerator) Generate(b *bytes.Buffer) {
 	n := len(bf.keysHash)
 
 	numBits := n * int(bf.numBitsPerKey)
+	// too small a filter would see a very high false positive rate
+	if numBits < 64 {
+		numBits = 64
+	}
 
 	numBytes := numBits / 8
 	if numBits%8 != 0 {
@@ -77,11 +89,8 @@ func (bf *BloomFilterGenerator) Generate(b *bytes.Buffer) {
 	for _, h := range bf.keysHash {
 		delta := h>>17 | h<<15
 		for i := uint8(0); i < bf.k; i++ {
-			bitPos := h % uint32(8)
-			bytePos := h / uint32(8)
-			b := data[bytePos]
-			b = b | 1>>bitPos
-			data[bytePos] = b
+			bitPos := h % uint32(numBits)
+			data[bitPos/8] |= 1 << (bitPos % 8)
 			h += delta
 		}
 	}
@@ -96,7 +105,7 @@ func (bf *BloomFilterGenerator) Generate(b *bytes.Buffer) {
 }
 
 func hash32(key []byte) uint32 {
-	_, _ = hash.Write(key)
-	defer hash.Reset()
-	return hash.Sum32()
+	h := fnv.New32()
+	_, _ = h.Write(key)
+	return h.Sum32()
 }
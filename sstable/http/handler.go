@@ -0,0 +1,376 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"leetcode/sstable"
+)
+
+/**
+REST API of db
+
+	GET    /keys/{key}                   the value, 404 if not found
+	PUT    /keys/{key}                   the body is the value
+	DELETE /keys/{key}
+	GET    /scan?start=&end=&limit=      the keys in [start, end), streamed as json lines {"key":"k","value":"v"}
+	POST   /batch                        {"ops":[{"op":"put","key":"k","value":"v"},{"op":"delete","key":"k"}]}
+	POST   /compact                      flush the mem and wait the compactions
+	GET    /stats                        sstable.Stats
+	GET    /sstables                     the table files of each level
+	POST   /checkpoint                   {"dir":"name"} create a checkpoint in dir under the checkpoint dir of the server
+	GET    /metrics                      the metrics in the prometheus text format
+
+	the key in path is url escaped, e.g. /keys/a%2Fb is the key "a/b".
+	the keys and values in json are strings, use /keys for the binary values
+**/
+
+const (
+	maxValueSize = 64 << 20
+	maxBatchSize = 64 << 20
+
+	// the scanned entries are flushed every scanFlushEntries
+	scanFlushEntries = 128
+)
+
+type Handler struct {
+	db  *sstable.DB
+	mux *http.ServeMux
+
+	// the checkpoints are created under it, empty disables /checkpoint
+	checkpointDir string
+}
+
+// NewHandler serve the db, the checkpoint dirs of requests are confined to checkpointDir
+func NewHandler(db *sstable.DB, checkpointDir string) *Handler {
+	h := &Handler{
+		db:            db,
+		mux:           http.NewServeMux(),
+		checkpointDir: checkpointDir,
+	}
+	h.mux.HandleFunc("/keys/", h.handleKey)
+	h.mux.HandleFunc("/scan", h.only(http.MethodGet, h.handleScan))
+	h.mux.HandleFunc("/batch", h.only(http.MethodPost, h.handleBatch))
+	h.mux.HandleFunc("/compact", h.only(http.MethodPost, h.handleCompact))
+	h.mux.HandleFunc("/stats", h.only(http.MethodGet, h.handleStats))
+	h.mux.HandleFunc("/sstables", h.only(http.MethodGet, h.handleSSTables))
+	h.mux.HandleFunc("/checkpoint", h.only(http.MethodPost, h.handleCheckpoint))
+	h.mux.Handle("/metrics", MetricsHandler(db))
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) only(method string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		fn(w, r)
+	}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// statusOf the http status of the db error
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, sstable.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, sstable.ErrClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, sstable.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, sstable.ErrDirExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *Handler) handleKey(w http.ResponseWriter, r *http.Request) {
+
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/keys/"))
+	if err != nil || key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("invalid key"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		value, err := h.db.Get([]byte(key))
+		if err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		_, _ = w.Write(value)
+	case http.MethodPut:
+		value, err := ioutil.ReadAll(io.LimitReader(r.Body, maxValueSize+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(value) > maxValueSize {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("value larger than %d bytes", maxValueSize))
+			return
+		}
+		if err := h.db.Put([]byte(key), value); err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := h.db.Delete([]byte(key)); err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+type scanEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (h *Handler) handleScan(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	start, end := query.Get("start"), query.Get("end")
+	limit := 0
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid limit"))
+			return
+		}
+		limit = n
+	}
+
+	it, err := h.db.NewIterator()
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	defer it.UnRef()
+
+	writeScan(w, it, start, end, limit)
+}
+
+// writeScan stream the entries of it in [start, end) as json lines, empty end means unbounded, 0 limit means no limit.
+// an error after the response started is written as the last line {"error":"..."}
+func writeScan(w http.ResponseWriter, it sstable.Iterator, start, end string, limit int) {
+
+	var ok bool
+	if start == "" {
+		ok = it.SeekFirst()
+	} else {
+		ok = it.Seek(sstable.InternalKey(start))
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	for n := 0; ok && (limit == 0 || n < limit); n++ {
+		if end != "" && string(it.Key()) >= end {
+			break
+		}
+		if err := enc.Encode(scanEntry{Key: string(it.Key()), Value: string(it.Value())}); err != nil {
+			return
+		}
+		if (n+1)%scanFlushEntries == 0 {
+			if bw.Flush() != nil {
+				// client gone
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		ok = it.Next()
+	}
+
+	if err := it.Valid(); err != nil {
+		_ = enc.Encode(errorResponse{Error: err.Error()})
+	}
+	_ = bw.Flush()
+}
+
+type batchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type batchRequest struct {
+	Ops []batchOp `json:"ops"`
+}
+
+// decodeBatch decode the batch request into a WriteBatch
+func decodeBatch(r io.Reader) (*sstable.WriteBatch, error) {
+
+	var req batchRequest
+	dec := json.NewDecoder(io.LimitReader(r, maxBatchSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid batch, %v", err)
+	}
+
+	wb := &sstable.WriteBatch{}
+	for i, op := range req.Ops {
+		if op.Key == "" {
+			return nil, fmt.Errorf("op %d: empty key", i)
+		}
+		switch op.Op {
+		case "put":
+			wb.Put([]byte(op.Key), []byte(op.Value))
+		case "delete":
+			wb.Delete([]byte(op.Key))
+		default:
+			return nil, fmt.Errorf("op %d: unknown op %q, expected put or delete", i, op.Op)
+		}
+	}
+	return wb, nil
+}
+
+func (h *Handler) handleBatch(w http.ResponseWriter, r *http.Request) {
+	wb, err := decodeBatch(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := h.db.Write(wb); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"written": wb.Len()})
+}
+
+func (h *Handler) handleCompact(w http.ResponseWriter, r *http.Request) {
+	if err := h.db.Compact(); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.db.Stats()
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+type sstableFile struct {
+	FileNum  uint64 `json:"file_num"`
+	Size     int    `json:"size"`
+	Smallest string `json:"smallest"`
+	Largest  string `json:"largest"`
+}
+
+type sstableLevel struct {
+	Level int           `json:"level"`
+	Size  int           `json:"size"`
+	Files []sstableFile `json:"files"`
+}
+
+func (h *Handler) handleSSTables(w http.ResponseWriter, r *http.Request) {
+	levels, err := h.db.Levels()
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+
+	resp := make([]sstableLevel, 0, len(levels))
+	for _, level := range levels {
+		l := sstableLevel{Level: level.Level, Size: level.Size, Files: make([]sstableFile, 0, len(level.Files))}
+		for _, f := range level.Files {
+			l.Files = append(l.Files, sstableFile{
+				FileNum:  f.FileNum,
+				Size:     f.Size,
+				Smallest: string(f.Smallest),
+				Largest:  string(f.Largest),
+			})
+		}
+		resp = append(resp, l)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type checkpointRequest struct {
+	Dir string `json:"dir"`
+}
+
+// checkpointPath resolve dir under base, the absolute dirs and the dirs escaping base are rejected
+func checkpointPath(base, dir string) (string, error) {
+	if filepath.IsAbs(dir) || strings.HasPrefix(dir, "/") {
+		return "", errors.New("checkpoint dir must be relative")
+	}
+	for _, elem := range strings.FieldsFunc(dir, func(r rune) bool { return r == '/' || r == filepath.Separator }) {
+		if elem == ".." {
+			return "", errors.New("checkpoint dir must not contain ..")
+		}
+	}
+	if dir = filepath.Clean(dir); dir == "." {
+		return "", errors.New("empty checkpoint dir")
+	}
+	return filepath.Join(base, dir), nil
+}
+
+func (h *Handler) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	if h.checkpointDir == "" {
+		writeError(w, http.StatusForbidden, errors.New("checkpoint disabled, no checkpoint dir configured"))
+		return
+	}
+	var req checkpointRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil || req.Dir == "" {
+		writeError(w, http.StatusBadRequest, errors.New(`invalid checkpoint request, expected {"dir":"name"}`))
+		return
+	}
+	dir, err := checkpointPath(h.checkpointDir, req.Dir)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := h.db.Checkpoint(dir); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, req)
+}
@@ -0,0 +1,277 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"leetcode/sstable"
+)
+
+// sliceIterator a user key iterator over the sorted keys, the value is the key repeated
+type sliceIterator struct {
+	*sstable.BasicReleaser
+	keys []string
+	i    int
+}
+
+func newSliceIterator(keys ...string) *sliceIterator {
+	it := &sliceIterator{keys: keys, i: len(keys)}
+	it.BasicReleaser = &sstable.BasicReleaser{OnClose: func() {}}
+	it.Ref()
+	return it
+}
+
+func (it *sliceIterator) SeekFirst() bool {
+	it.i = 0
+	return it.i < len(it.keys)
+}
+
+func (it *sliceIterator) Seek(key sstable.InternalKey) bool {
+	it.i = sort.SearchStrings(it.keys, string(key))
+	return it.i < len(it.keys)
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.i < len(it.keys) {
+		it.i++
+	}
+	return it.i < len(it.keys)
+}
+
+func (it *sliceIterator) Key() []byte   { return []byte(it.keys[it.i]) }
+func (it *sliceIterator) Value() []byte { return []byte(it.keys[it.i] + it.keys[it.i]) }
+func (it *sliceIterator) Valid() error  { return nil }
+
+func TestHandlerBadRequests(t *testing.T) {
+
+	// the requests are rejected before reaching db
+	srv := httptest.NewServer(NewHandler(nil, t.TempDir()))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodGet, "/batch", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/keys/k", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/keys/", "", http.StatusBadRequest},
+		{http.MethodPost, "/batch", `{"ops":[{"op":"merge","key":"k"}]}`, http.StatusBadRequest},
+		{http.MethodPost, "/batch", `{"ops":[{"op":"put","key":""}]}`, http.StatusBadRequest},
+		{http.MethodPost, "/batch", `not json`, http.StatusBadRequest},
+		{http.MethodPost, "/checkpoint", `{}`, http.StatusBadRequest},
+		{http.MethodPost, "/checkpoint", `{"dir":"/tmp/cp"}`, http.StatusBadRequest},
+		{http.MethodPost, "/checkpoint", `{"dir":"../cp"}`, http.StatusBadRequest},
+		{http.MethodPost, "/checkpoint", `{"dir":"a/../../cp"}`, http.StatusBadRequest},
+		{http.MethodPost, "/checkpoint", `{"dir":"."}`, http.StatusBadRequest},
+		{http.MethodGet, "/scan?limit=-1", "", http.StatusBadRequest},
+		{http.MethodPost, "/metrics", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/unknown", "", http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(c.method, srv.URL+c.path, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Fatalf("%s %s: expect %d, got %d", c.method, c.path, c.status, resp.StatusCode)
+		}
+	}
+}
+
+type recordHandler struct {
+	records []string
+}
+
+func (h *recordHandler) Put(key, value []byte) error {
+	h.records = append(h.records, fmt.Sprintf("put %s=%s", key, value))
+	return nil
+}
+
+func (h *recordHandler) Delete(key []byte) error {
+	h.records = append(h.records, fmt.Sprintf("del %s", key))
+	return nil
+}
+
+func TestDecodeBatch(t *testing.T) {
+
+	wb, err := decodeBatch(strings.NewReader(`{"ops":[{"op":"put","key":"a","value":"1"},{"op":"delete","key":"b"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &recordHandler{}
+	if err := wb.Iterate(h); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(h.records) != "[put a=1 del b]" {
+		t.Fatalf("unexpected records %v", h.records)
+	}
+}
+
+func TestWriteScan(t *testing.T) {
+
+	keys := make([]string, 300)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%03d", i)
+	}
+
+	for _, c := range []struct {
+		start, end string
+		limit      int
+		first      string
+		count      int
+	}{
+		{"", "", 0, "k000", 300},
+		{"k100", "k150", 0, "k100", 50},
+		{"k100", "", 10, "k100", 10},
+		{"k299x", "", 0, "", 0},
+	} {
+		it := newSliceIterator(keys...)
+		rec := httptest.NewRecorder()
+		writeScan(rec, it, c.start, c.end, c.limit)
+		it.UnRef()
+
+		if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Fatalf("unexpected content type %s", ct)
+		}
+
+		var entries []scanEntry
+		scanner := bufio.NewScanner(rec.Body)
+		for scanner.Scan() {
+			var e scanEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Value != e.Key+e.Key {
+				t.Fatalf("unexpected entry %+v", e)
+			}
+			entries = append(entries, e)
+		}
+		if len(entries) != c.count || (c.count > 0 && entries[0].Key != c.first) {
+			t.Fatalf("scan [%s, %s) limit %d: expect %d entries from %s, got %d", c.start, c.end, c.limit, c.count, c.first, len(entries))
+		}
+	}
+}
+
+// do send the request to srv, return the status and body
+func do(t *testing.T, srv *httptest.Server, method, path, body string) (int, string) {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestHandlerDB(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := sstable.Open(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	checkpointDir := filepath.Join(dir, "checkpoints")
+	if err = os.Mkdir(checkpointDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(db, checkpointDir))
+	defer srv.Close()
+
+	expect := func(method, path, body string, status int, respBody string) {
+		t.Helper()
+		gotStatus, gotBody := do(t, srv, method, path, body)
+		if gotStatus != status || (respBody != "" && gotBody != respBody) {
+			t.Fatalf("%s %s: expect %d %q, got %d %q", method, path, status, respBody, gotStatus, gotBody)
+		}
+	}
+
+	// keys, the key in path is url escaped
+	expect(http.MethodPut, "/keys/a%2Fb", "v1", http.StatusNoContent, "")
+	expect(http.MethodGet, "/keys/a%2Fb", "", http.StatusOK, "v1")
+	if value, err := db.Get([]byte("a/b")); err != nil || string(value) != "v1" {
+		t.Fatalf("expect a/b=v1 in db, got %q, %v", value, err)
+	}
+	expect(http.MethodDelete, "/keys/a%2Fb", "", http.StatusNoContent, "")
+	expect(http.MethodGet, "/keys/a%2Fb", "", http.StatusNotFound, "")
+
+	// batch
+	expect(http.MethodPost, "/batch",
+		`{"ops":[{"op":"put","key":"k1","value":"1"},{"op":"put","key":"k2","value":"2"},{"op":"put","key":"k3","value":"3"},{"op":"delete","key":"k2"}]}`,
+		http.StatusOK, "{\"written\":4}\n")
+	expect(http.MethodGet, "/keys/k1", "", http.StatusOK, "1")
+	expect(http.MethodGet, "/keys/k2", "", http.StatusNotFound, "")
+
+	// scan skips the deleted key
+	expect(http.MethodGet, "/scan?start=k1&end=k9", "", http.StatusOK,
+		"{\"key\":\"k1\",\"value\":\"1\"}\n{\"key\":\"k3\",\"value\":\"3\"}\n")
+	expect(http.MethodGet, "/scan?limit=1", "", http.StatusOK, "{\"key\":\"k1\",\"value\":\"1\"}\n")
+
+	// compact flushes the mem into table
+	expect(http.MethodGet, "/compact", "", http.StatusMethodNotAllowed, "")
+	expect(http.MethodPost, "/compact", "", http.StatusNoContent, "")
+	_, body := do(t, srv, http.MethodGet, "/sstables", "")
+	var levels []sstableLevel
+	if err = json.Unmarshal([]byte(body), &levels); err != nil {
+		t.Fatal(err)
+	}
+	files := 0
+	for _, level := range levels {
+		files += len(level.Files)
+	}
+	if files == 0 {
+		t.Fatalf("expect tables after compact, got %s", body)
+	}
+	expect(http.MethodGet, "/keys/k3", "", http.StatusOK, "3")
+
+	// checkpoint is created under the checkpoint dir
+	expect(http.MethodPost, "/checkpoint", `{"dir":"cp1"}`, http.StatusCreated, "")
+	expect(http.MethodPost, "/checkpoint", `{"dir":"cp1"}`, http.StatusConflict, "")
+	expect(http.MethodPost, "/checkpoint", `{"dir":"../escaped"}`, http.StatusBadRequest, "")
+	if _, err = os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Fatalf("expect no checkpoint outside the checkpoint dir, got %v", err)
+	}
+
+	cp, err := sstable.Open(filepath.Join(checkpointDir, "cp1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cp.Close()
+	}()
+	for key, value := range map[string]string{"k1": "1", "k3": "3"} {
+		if got, err := cp.Get([]byte(key)); err != nil || string(got) != value {
+			t.Fatalf("checkpoint %s: expect %s, got %q, %v", key, value, got, err)
+		}
+	}
+
+	// no checkpoint dir configured
+	disabled := httptest.NewServer(NewHandler(db, ""))
+	defer disabled.Close()
+	if status, _ := do(t, disabled, http.MethodPost, "/checkpoint", `{"dir":"cp2"}`); status != http.StatusForbidden {
+		t.Fatalf("expect checkpoint disabled, got %d", status)
+	}
+}
@@ -0,0 +1,29 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"leetcode/sstable"
+)
+
+// MetricsHandler serve the metrics of db in the prometheus text format, for scraping on a separate port
+func MetricsHandler(db *sstable.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+
+		// buffered, so a failure is reported by the status instead of a truncated body
+		var buf bytes.Buffer
+		if err := db.WriteMetrics(&buf); err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = buf.WriteTo(w)
+	})
+}
@@ -0,0 +1,321 @@
+package sstable
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type externalFile struct {
+	path       string
+	size       int
+	imin, imax InternalKey
+}
+
+// IngestExternalFile load the table files created by SstFileWriter into db.
+// the files must not overlap with each other. each file is placed into the lowest level
+// where it won't overlap with upper levels, if the file overlaps with the data in db,
+// a new global sequence will be assigned to the keys of file.
+// the source files are removed after ingested, an empty batch is written into journal as the marker of ingestion.
+func (db *DB) IngestExternalFile(paths []string) (err error) {
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return ErrClosed
+	}
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	files := make([]*externalFile, 0, len(paths))
+	for _, path := range paths {
+		f, rErr := readExternalFile(path)
+		if rErr != nil {
+			return rErr
+		}
+		files = append(files, f)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return bytes.Compare(files[i].imin.ukey(), files[j].imin.ukey()) < 0
+	})
+
+	for i := 1; i < len(files); i++ {
+		if bytes.Compare(files[i-1].imax.ukey(), files[i].imin.ukey()) >= 0 {
+			return ErrIngestOverlapped
+		}
+	}
+
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+
+	// hold the write path, so no sequence is allocated concurrently
+	w := db.waitForWriteTurn()
+	defer db.finishWriteTurn(w)
+
+	// make sure the keys in memtable are older than the ingested keys
+	if err = db.flushMemTable(); err != nil {
+		return
+	}
+
+	v := db.VersionSet.getCurrent()
+	v.Ref()
+	defer v.UnRef()
+
+	var (
+		edit    = &VersionEdit{}
+		created = make([]Fd, 0, len(files))
+		tables  = make([]*tFile, 0, len(files))
+		stor    = db.VersionSet.storage
+		seqNum  = db.seqNum
+	)
+
+	defer func() {
+		for _, fd := range created {
+			if err != nil {
+				_ = stor.Remove(fd)
+			}
+			db.VersionSet.releasePendingOutputs(fd.Num)
+		}
+	}()
+
+	for _, f := range files {
+
+		// the writes are held, so the overlapped keys in db are always older than the ingested ones
+		_, overlapped := v.pickIngestLevel(f.imin.ukey(), f.imax.ukey())
+
+		var seq Sequence
+		if overlapped {
+			seqNum++
+			seq = seqNum
+		}
+
+		fd := Fd{
+			FileType: KTableFile,
+			Num:      db.VersionSet.allocFileNum(),
+		}
+		db.VersionSet.addPendingOutput(fd.Num)
+		created = append(created, fd)
+
+		db.rwMutex.Unlock()
+		t, iErr := installExternalFile(stor, f, fd, seq)
+		db.rwMutex.Lock()
+
+		if iErr != nil {
+			err = iErr
+			return
+		}
+		tables = append(tables, t)
+	}
+
+	// the levels may be changed by the background compactions while copying,
+	// so the levels are picked against the current version
+	current := db.VersionSet.getCurrent()
+	for _, t := range tables {
+		level, _ := current.pickIngestLevel(t.iMin.ukey(), t.iMax.ukey())
+		// the outputs of a running compaction are not in current yet, they may span the range of file,
+		// so the file is placed above the levels being compacted
+		for level > 0 && db.VersionSet.compactingLevels[level] {
+			level--
+		}
+		if db.VersionSet.opt.CompactionStyle == CompactionStyleFIFO {
+			// fifo keeps all the tables in level0
+			level = 0
+		}
+		edit.addTableFile(level, *t)
+	}
+
+	// the ingestion is recorded in journal by a marker consuming its own sequence,
+	// so the readers of journal, e.g. the replicas, know the data only in tables
+	seqNum++
+	edit.setLastSeq(seqNum)
+	if err = db.VersionSet.logAndApply(edit, &db.rwMutex); err != nil {
+		return
+	}
+	db.seqNum = seqNum
+
+	marker := &WriteBatch{}
+	marker.init()
+	marker.SetSequence(seqNum)
+	if _, jErr := db.journalWriter.Write(marker.Contents()); jErr != nil {
+		// the files are installed, the replicas find the missed sequence by the gap
+		db.journalBroken = true
+		db.recordBackgroundError(jErr)
+	}
+
+	for _, f := range files {
+		_ = os.Remove(f.path)
+	}
+
+	db.MaybeScheduleCompaction()
+	return nil
+}
+
+// pickIngestLevel return the lowest level that the range won't overlap with levels above it
+// overlapped report whether the range overlaps with any file in version
+func (v *Version) pickIngestLevel(umin, umax []byte) (level int, overlapped bool) {
+	for l := 0; l < kLevelNum; l++ {
+		for _, t := range v.levels[l] {
+			if t.isOverlapped(umin, umax) {
+				if l > 0 {
+					level = l - 1
+				}
+				overlapped = true
+				return
+			}
+		}
+	}
+	level = kLevelNum - 1
+	return
+}
+
+// readExternalFile check the keys of file are sorted and get the key range
+func readExternalFile(path string) (*externalFile, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fInfo, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	tr, err := NewTableReader(newFileReader(file), int(fInfo.Size()))
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	defer tr.UnRef()
+
+	iter, err := tr.NewIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.UnRef()
+
+	f := &externalFile{
+		path: path,
+		size: int(fInfo.Size()),
+	}
+
+	for iter.Next() {
+		ikey := InternalKey(iter.Key())
+		ukey, _, _, pErr := parseInternalKey(ikey)
+		if pErr != nil {
+			return nil, NewErrCorruption("external file invalid internal key")
+		}
+		if f.imax != nil && bytes.Compare(f.imax.ukey(), ukey) >= 0 {
+			return nil, ErrKeyNotSorted
+		}
+		if f.imin == nil {
+			f.imin = append(InternalKey(nil), ikey...)
+		}
+		f.imax = append(f.imax[:0], ikey...)
+	}
+
+	if err = iter.Valid(); err != nil {
+		return nil, err
+	}
+
+	if f.imin == nil {
+		return nil, ErrEmptySstFile
+	}
+
+	return f, nil
+}
+
+// installExternalFile copy the external file into db as fd, if seq > 0 the keys are rewritten with seq
+func installExternalFile(stor Storage, f *externalFile, fd Fd, seq Sequence) (*tFile, error) {
+
+	if seq == 0 {
+		src, err := os.Open(f.path)
+		if err != nil {
+			return nil, err
+		}
+		defer src.Close()
+
+		dst, err := stor.Create(fd)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = io.Copy(dst, src)
+		if err == nil {
+			err = dst.Sync()
+		}
+		if cErr := dst.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &tFile{
+			fd:    fd,
+			iMin:  f.imin,
+			iMax:  f.imax,
+			Size:  f.size,
+			ctime: time.Now().UnixNano(),
+		}, nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := NewTableReader(newFileReader(file), f.size)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	defer tr.UnRef()
+
+	iter, err := tr.NewIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.UnRef()
+
+	w, err := stor.Create(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	tw := &tWriter{
+		fd: fd,
+		fw: w,
+		tw: NewTableWriter(w),
+	}
+
+	var ikey InternalKey
+	for iter.Next() {
+		ukey, kt, _, pErr := parseInternalKey(iter.Key())
+		if pErr != nil {
+			_ = w.Close()
+			return nil, NewErrCorruption("external file invalid internal key")
+		}
+		ikey = buildInternalKey(ikey, ukey, kt, seq)
+		if err = tw.append(ikey, iter.Value()); err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+	}
+
+	if err = iter.Valid(); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+
+	return tw.finish()
+}
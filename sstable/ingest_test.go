@@ -0,0 +1,135 @@
+package sstable
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeSstFile(t *testing.T, name string, from, to int, prefix string) {
+	w, err := CreateSstFileWriter(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := from; i < to; i++ {
+		if err := w.Put([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("%s%04d", prefix, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestExternalFile(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := Open(path.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	// the ingested keys overlapping with the db are newer
+	for i := 50; i < 150; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("k%04d", i)), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f1, f2 := path.Join(dir, "1.sst"), path.Join(dir, "2.sst")
+	writeSstFile(t, f1, 0, 100, "a")
+	writeSstFile(t, f2, 200, 300, "b")
+
+	if err := db.IngestExternalFile([]string{f2, f1}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *DB) {
+		for i := 0; i < 300; i++ {
+			var expect string
+			switch {
+			case i < 100:
+				expect = fmt.Sprintf("a%04d", i)
+			case i < 150:
+				expect = "old"
+			case i < 200:
+				expect = ""
+			default:
+				expect = fmt.Sprintf("b%04d", i)
+			}
+			v, err := db.Get([]byte(fmt.Sprintf("k%04d", i)))
+			if expect == "" {
+				if err != ErrNotFound {
+					t.Fatalf("get k%04d, expect not found, got %q %v", i, v, err)
+				}
+				continue
+			}
+			if err != nil || string(v) != expect {
+				t.Fatalf("get k%04d, expect %q, got %q %v", i, expect, v, err)
+			}
+		}
+	}
+	check(db)
+
+	for _, f := range []string{f1, f2} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Fatalf("%s should be removed after ingested, err=%v", f, err)
+		}
+	}
+
+	// the overlapped files are rejected
+	writeSstFile(t, f1, 0, 10, "c")
+	writeSstFile(t, f2, 5, 20, "c")
+	if err := db.IngestExternalFile([]string{f1, f2}); err != ErrIngestOverlapped {
+		t.Fatalf("expect ErrIngestOverlapped, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+}
+
+func TestIngestSkipCompactingLevels(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := Open(path.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	// a compaction from level5 into level6 is running
+	db.rwMutex.Lock()
+	db.VersionSet.compactingLevels[kLevelNum-2] = true
+	db.VersionSet.compactingLevels[kLevelNum-1] = true
+	db.rwMutex.Unlock()
+
+	f := path.Join(dir, "1.sst")
+	writeSstFile(t, f, 0, 100, "a")
+	if err := db.IngestExternalFile([]string{f}); err != nil {
+		t.Fatal(err)
+	}
+
+	db.rwMutex.Lock()
+	db.VersionSet.compactingLevels[kLevelNum-2] = false
+	db.VersionSet.compactingLevels[kLevelNum-1] = false
+	db.rwMutex.Unlock()
+
+	for level := 0; level < kLevelNum; level++ {
+		n := db.VersionSet.levelFilesNum(level)
+		if level == kLevelNum-3 && n != 1 || level != kLevelNum-3 && n != 0 {
+			t.Fatalf("expect the file ingested into level%d, got %d files in level%d", kLevelNum-3, n, level)
+		}
+	}
+}
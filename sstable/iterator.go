@@ -111,12 +111,14 @@ type indexedIterator struct {
 func newIndexedIterator(indexed iteratorIndexer) Iterator {
 	ii := &indexedIterator{
 		indexed: indexed,
-		BasicReleaser: &BasicReleaser{
-			OnClose: func() {
-				indexed.UnRef()
-			},
+	}
+	ii.BasicReleaser = &BasicReleaser{
+		OnClose: func() {
+			ii.clearData()
+			indexed.UnRef()
 		},
 	}
+	ii.Ref()
 	return ii
 }
 
@@ -127,8 +129,13 @@ func (iter *indexedIterator) clearData() {
 	}
 }
 
-func (iter *indexedIterator) setData() {
+func (iter *indexedIterator) setData() bool {
 	iter.data = iter.indexed.Get()
+	if iter.data == nil {
+		iter.err = iter.indexed.Valid()
+		return false
+	}
+	return true
 }
 
 func (iter *indexedIterator) Next() bool {
@@ -142,18 +149,25 @@ func (iter *indexedIterator) Next() bool {
 		return false
 	}
 
-	if iter.data != nil && iter.data.Next() {
-		return true
-	}
-
-	iter.clearData()
-
-	if iter.indexed.Next() {
-		iter.setData()
-		return iter.Next()
+	for {
+		if iter.data != nil {
+			if iter.data.Next() {
+				return true
+			}
+			if err := iter.data.Valid(); err != nil {
+				iter.err = err
+				return false
+			}
+			iter.clearData()
+		}
+		if !iter.indexed.Next() {
+			iter.err = iter.indexed.Valid()
+			return false
+		}
+		if !iter.setData() {
+			return false
+		}
 	}
-
-	return false
 }
 
 func (iter *indexedIterator) SeekFirst() bool {
@@ -169,10 +183,13 @@ func (iter *indexedIterator) SeekFirst() bool {
 
 	iter.clearData()
 	if !iter.indexed.SeekFirst() {
+		iter.err = iter.indexed.Valid()
 		return false
 	}
 
-	iter.setData()
+	if !iter.setData() {
+		return false
+	}
 	return iter.Next()
 }
 
@@ -189,19 +206,23 @@ func (iter *indexedIterator) Seek(key InternalKey) bool {
 	iter.clearData()
 
 	if !iter.indexed.Seek(key) {
+		iter.err = iter.indexed.Valid()
 		return false
 	}
 
-	iter.setData()
-
-	if !iter.data.Seek(key) {
-		iter.clearData()
-		if !iter.Next() {
-			return false
-		}
+	if !iter.setData() {
+		return false
 	}
 
-	return true
+	if iter.data.Seek(key) {
+		return true
+	}
+	if err := iter.data.Valid(); err != nil {
+		iter.err = err
+		return false
+	}
+	iter.clearData()
+	return iter.Next()
 }
 
 func (iter *indexedIterator) Key() []byte {
@@ -242,15 +263,17 @@ func NewMergeIterator(iters []Iterator) *MergeIterator {
 	}
 
 	mi.heap = InitHeap(mi.minHeapLess)
-	mi.OnClose = func() {
-		mi.heap.Clear()
-		for i := range iters {
-			iters[i].UnRef()
-		}
-		mi.keys = mi.keys[:0]
-		mi.ikey = nil
-		mi.value = nil
+	mi.BasicReleaser = &BasicReleaser{
+		OnClose: func() {
+			mi.heap.Clear()
+			for i := range iters {
+				iters[i].UnRef()
+			}
+			mi.ikey = nil
+			mi.value = nil
+		},
 	}
+	mi.Ref()
 	return mi
 }
 
@@ -269,13 +292,10 @@ func (mi *MergeIterator) SeekFirst() bool {
 	mi.dir = dirSOI
 	mi.ikey = mi.ikey[:0]
 	mi.value = mi.value[:0]
-	for i := 0; i < len(mi.iters); i++ {
-		iter := mi.iters[i]
-		if !iter.SeekFirst() {
+	for i, iter := range mi.iters {
+		if !mi.push(i, iter.SeekFirst()) {
 			return false
 		}
-		mi.heap.Push(i)
-		mi.keys[i] = iter.Key()
 	}
 
 	return mi.next()
@@ -298,8 +318,7 @@ func (mi *MergeIterator) Next() bool {
 	} else if mi.dir == dirEOI {
 		return false
 	} else {
-		mi.SeekFirst()
-		return mi.next()
+		return mi.SeekFirst()
 	}
 }
 
@@ -314,14 +333,31 @@ func (mi *MergeIterator) Seek(ikey InternalKey) bool {
 		mi.err = ErrReleased
 		return false
 	}
-	for i := range mi.iters {
-		if mi.iters[i].Seek(ikey) {
-			mi.heap.Push(i)
+	for i, iter := range mi.iters {
+		if !mi.push(i, iter.Seek(ikey)) {
+			return false
 		}
 	}
 	return mi.next()
 }
 
+// push the iter into the heap if it is positioned, false if the iter failed
+func (mi *MergeIterator) push(i int, ok bool) bool {
+	iter := mi.iters[i]
+	if !ok {
+		mi.keys[i] = nil
+		if err := iter.Valid(); err != nil {
+			mi.err = err
+			mi.dir = dirEOI
+			return false
+		}
+		return true
+	}
+	mi.keys[i] = iter.Key()
+	mi.heap.Push(i)
+	return true
+}
+
 func (mi *MergeIterator) Key() []byte {
 	return mi.ikey
 }
@@ -339,15 +375,10 @@ func (mi *MergeIterator) next() bool {
 	}
 	mi.iterIdx = idx.(int)
 	iter := mi.iters[mi.iterIdx]
-	mi.ikey = iter.Key()
-	mi.value = iter.Value()
-	if iter.Next() {
-		mi.heap.Push(mi.iterIdx)
-		mi.keys[mi.iterIdx] = iter.Key()
-	} else {
-		mi.keys[mi.iterIdx] = nil
-	}
-	return true
+	// the key and value may be overwritten when the iter moves
+	mi.ikey = append(mi.ikey[:0], iter.Key()...)
+	mi.value = append(mi.value[:0], iter.Value()...)
+	return mi.push(mi.iterIdx, iter.Next())
 }
 
 func (iter *MergeIterator) Valid() error {
@@ -362,36 +393,35 @@ func (mi *MergeIterator) minHeapLess(data []interface{}, i, j int) bool {
 	keyi := mi.keys[indexi]
 	keyj := mi.keys[indexj]
 
+	// the smaller key first, the former iter first if the keys are equal
 	r := InternalKey(keyi).compare(keyj)
-
-	if r > 0 {
-		return true
+	if r != 0 {
+		return r < 0
 	}
-	return false
+	return indexi < indexj
 }
 
+// tFileArrIteratorIndexer index the sorted and not overlapped tables, the table iterator is opened by Get
 type tFileArrIteratorIndexer struct {
 	*BasicReleaser
-	err       error
-	tFiles    tFiles
-	tableIter Iterator
-	index     int
-	len       int
+	err    error
+	tFiles tFiles
+	open   func(tFile) (Iterator, error)
+	index  int // -1 before the first table
 }
 
-func newTFileArrIteratorIndexer(tFiles tFiles) iteratorIndexer {
+func newTFileArrIteratorIndexer(tFiles tFiles, open func(tFile) (Iterator, error)) iteratorIndexer {
 	indexer := &tFileArrIteratorIndexer{
 		tFiles: tFiles,
-		index:  0,
-		len:    len(tFiles),
+		open:   open,
+		index:  -1,
 	}
-	indexer.OnClose = func() {
-		if indexer.tableIter != nil {
-			indexer.tableIter.UnRef()
-		}
-		indexer.index = 0
-		indexer.tFiles = indexer.tFiles[:0]
+	indexer.BasicReleaser = &BasicReleaser{
+		OnClose: func() {
+			indexer.tFiles = nil
+		},
 	}
+	indexer.Ref()
 	return indexer
 }
 
@@ -405,26 +435,10 @@ func (indexer *tFileArrIteratorIndexer) Next() bool {
 		return false
 	}
 
-	if indexer.index <= indexer.len-1 {
-		tFile := indexer.tFiles[indexer.index]
-		tr, err := NewTableReader(nil, tFile.Size)
-		if err != nil {
-			indexer.err = err
-			return false
-		}
-		if indexer.tableIter != nil {
-			indexer.tableIter.UnRef()
-		}
-		indexer.tableIter, indexer.err = tr.NewIterator()
-		if indexer.err != nil {
-			return false
-		}
+	if indexer.index < len(indexer.tFiles) {
 		indexer.index++
-		return true
 	}
-
-	return false
-
+	return indexer.index < len(indexer.tFiles)
 }
 
 func (indexer *tFileArrIteratorIndexer) SeekFirst() bool {
@@ -436,9 +450,10 @@ func (indexer *tFileArrIteratorIndexer) SeekFirst() bool {
 		return false
 	}
 	indexer.index = 0
-	return indexer.Next()
+	return indexer.index < len(indexer.tFiles)
 }
 
+// Seek move to the first table whose max key >= ikey
 func (indexer *tFileArrIteratorIndexer) Seek(ikey InternalKey) bool {
 
 	if indexer.err != nil {
@@ -449,21 +464,23 @@ func (indexer *tFileArrIteratorIndexer) Seek(ikey InternalKey) bool {
 		return false
 	}
 
-	n := sort.Search(indexer.len, func(i int) bool {
-		r := indexer.tFiles[i].iMax.compare(ikey)
-		return r >= 0
+	indexer.index = sort.Search(len(indexer.tFiles), func(i int) bool {
+		return indexer.tFiles[i].iMax.compare(ikey) >= 0
 	})
-
-	if n == indexer.len {
-		return false
-	}
-
-	indexer.index = n
-	return indexer.Next()
+	return indexer.index < len(indexer.tFiles)
 }
 
+// Get open the iterator of current table, caller should call UnRef after iterate end
 func (indexer *tFileArrIteratorIndexer) Get() Iterator {
-	return indexer.tableIter
+	if indexer.err != nil || indexer.index < 0 || indexer.index >= len(indexer.tFiles) {
+		return nil
+	}
+	iter, err := indexer.open(indexer.tFiles[indexer.index])
+	if err != nil {
+		indexer.err = err
+		return nil
+	}
+	return iter
 }
 
 func (indexer *tFileArrIteratorIndexer) Valid() error {
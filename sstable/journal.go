@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"hash/crc32"
 	"io"
+	"math"
 )
 
 /**
@@ -44,6 +45,7 @@ type JournalWriter struct {
 	err         error
 	dest        *writableFile
 	blockOffset int
+	written     int // the bytes written into file, include the headers and paddings
 }
 
 func NewJournalWriter(writer SequentialWriter) *JournalWriter {
@@ -79,14 +81,20 @@ func (jw *JournalWriter) Write(chunk []byte) (n int, err error) {
 			break
 		}
 
-		blockRemain = kJournalBlockSize - (jw.blockOffset + journalBlockHeaderLen)
+		leftover := kJournalBlockSize - jw.blockOffset
 
-		if blockRemain < journalBlockHeaderLen {
-			_ = jw.dest.append(make([]byte, blockRemain))
+		// the trailer can't hold a header, fill it with zeros and switch to next block
+		if leftover < journalBlockHeaderLen {
+			if leftover > 0 {
+				_ = jw.dest.append(make([]byte, leftover))
+				jw.written += leftover
+			}
 			jw.blockOffset = 0
 			continue
 		}
 
+		blockRemain = leftover - journalBlockHeaderLen
+
 		if chunkRemain > blockRemain {
 			effectiveWrite = blockRemain
 		} else {
@@ -109,9 +117,7 @@ func (jw *JournalWriter) Write(chunk []byte) (n int, err error) {
 			}
 		}
 
-		if effectiveWrite > 0 {
-			writeNums++
-		}
+		writeNums++
 
 		jw.err = jw.writePhysicalRecord(chunk[n:n+effectiveWrite], chunkType)
 		if jw.err != nil {
@@ -121,6 +127,11 @@ func (jw *JournalWriter) Write(chunk []byte) (n int, err error) {
 
 	}
 
+	// the record reaches the file before returning, so it can be synced or read by the tailing readers
+	if jw.err = jw.dest.flush(); jw.err != nil {
+		return 0, jw.err
+	}
+
 	return
 
 }
@@ -142,14 +153,27 @@ func (jw *JournalWriter) writePhysicalRecord(data []byte, chunkType byte) error
 	if err != nil {
 		return err
 	}
+	jw.written += journalBlockHeaderLen + avail
 	return jw.dest.flush()
 }
 
+// size the bytes written by jw
+func (jw *JournalWriter) size() int {
+	return jw.written
+}
+
 func (jw *JournalWriter) Close() error {
-	return jw.dest.Close()
+	err := jw.dest.flush()
+	if cErr := jw.dest.Close(); err == nil {
+		err = cErr
+	}
+	return err
 }
 
 func (jw *JournalWriter) Sync() error {
+	if err := jw.dest.flush(); err != nil {
+		return err
+	}
 	return jw.dest.w.Sync()
 }
 
@@ -233,17 +257,35 @@ func (w *writableFile) Close() error {
 type JournalReader struct {
 	src     *sequentialFile
 	scratch bytes.Buffer // for reused read
+
+	// the current chunk hits eof before its last fragment, it's being written or torn
+	partial bool
 }
 
 func NewJournalReader(reader SequentialReader) *JournalReader {
 	return &JournalReader{
 		src: &sequentialFile{
-			SequentialReader: reader,
+			Reader: reader,
 		},
 		scratch: *bytes.NewBuffer(nil),
 	}
 }
 
+// newJournalReaderAt read the journal from offset, offset must be the end of a chunk returned by offset()
+func newJournalReaderAt(reader ReaderAt, offset int64) *JournalReader {
+	blockStart := offset - offset%kJournalBlockSize
+	jr := NewJournalReader(nil)
+	jr.src.Reader = io.NewSectionReader(reader, blockStart, math.MaxInt64-blockStart)
+	jr.src.blockOffset = blockStart
+	jr.src.skip = int(offset - blockStart)
+	return jr
+}
+
+// offset the end of the consumed fragments in file, it's the start of next chunk when the current chunk is read over
+func (jr *JournalReader) offset() int64 {
+	return jr.src.blockOffset + int64(jr.src.physicalReadOffset)
+}
+
 type chunkReader struct {
 	jr               *JournalReader
 	inFragmentRecord bool // current fragment is part of chunk ?
@@ -252,6 +294,7 @@ type chunkReader struct {
 
 func (jr *JournalReader) NextChunk() (SequentialReader, error) {
 
+	jr.partial = false
 	for {
 		kRecordType, fragment, err := jr.seekNextFragment(true)
 		if err == io.EOF {
@@ -293,6 +336,7 @@ func (chunk *chunkReader) ReadByte() (byte, error) {
 		}
 		rt, fragment, err := jr.seekNextFragment(false)
 		if err == io.EOF {
+			jr.partial = true
 			return byte(0), io.EOF
 		}
 		if err != nil {
@@ -312,12 +356,12 @@ func (chunk *chunkReader) Read(p []byte) (nRead int, rErr error) {
 			return nRead, io.EOF
 		}
 
-		n, _ := jr.scratch.Read(p)
+		n, _ := jr.scratch.Read(p[nRead:])
 
 		nRead += n
 
 		// p is fill full
-		if n == cap(p) {
+		if nRead == len(p) {
 			return nRead, nil
 		}
 
@@ -326,6 +370,7 @@ func (chunk *chunkReader) Read(p []byte) (nRead int, rErr error) {
 			recordType, fragment, err := jr.seekNextFragment(false)
 			if err == io.EOF {
 				chunk.eof = true
+				jr.partial = true
 				return nRead, nil
 			}
 			if err != nil {
@@ -377,9 +422,11 @@ func (jr *JournalReader) seekNextFragment(first bool) (kRecordType byte, fragmen
 }
 
 type sequentialFile struct {
-	SequentialReader
-	physicalReadOffset int // current cursor read offset
-	physicalN          int // current physical offset
+	io.Reader
+	physicalReadOffset int   // current cursor read offset
+	physicalN          int   // current physical offset
+	blockOffset        int64 // the file offset of buf
+	skip               int   // the bytes to skip in the first block
 	buf                [kJournalBlockSize]byte
 	eof                bool
 }
@@ -387,50 +434,56 @@ type sequentialFile struct {
 func (s *sequentialFile) readPhysicalRecord() (kRecordType byte, fragment []byte) {
 
 	for {
-		if s.physicalReadOffset+journalBlockHeaderLen > s.physicalN {
-			if !s.eof {
-				n, err := s.Read(s.buf[:])
-				s.physicalN += n
-				if err != nil {
-					s.eof = true
-					kRecordType = kEof
-					return
-				}
-				if n < kJournalBlockSize {
-					s.eof = true
-				}
-				continue
-			} else {
+		// the trailer less than header is padding, read next block
+		if s.physicalN-s.physicalReadOffset < journalBlockHeaderLen {
+			if s.eof {
 				kRecordType = kEof
 				return
 			}
+			s.blockOffset += int64(s.physicalN)
+			n, err := io.ReadFull(s.Reader, s.buf[:])
+			s.physicalReadOffset = 0
+			s.physicalN = n
+			if s.skip > 0 {
+				s.physicalReadOffset, s.skip = s.skip, 0
+				if s.physicalReadOffset > n {
+					s.physicalReadOffset = n
+				}
+			}
+			if err != nil {
+				// the last block
+				s.eof = true
+			}
+			continue
 		}
 
-		expectedSum := binary.LittleEndian.Uint32(s.buf[s.physicalReadOffset : s.physicalReadOffset+4])
-		dataLen := int(binary.LittleEndian.Uint16(s.buf[s.physicalReadOffset+4 : s.physicalReadOffset+6]))
-		kRecordType = s.buf[s.physicalReadOffset+6]
+		header := s.buf[s.physicalReadOffset : s.physicalReadOffset+journalBlockHeaderLen]
+		expectedSum := binary.LittleEndian.Uint32(header[:4])
+		dataLen := int(binary.LittleEndian.Uint16(header[4:6]))
+		kRecordType = header[6]
 
-		if dataLen+s.physicalReadOffset > s.physicalN {
+		start := s.physicalReadOffset + journalBlockHeaderLen
+		if start+dataLen > s.physicalN {
+			s.physicalReadOffset = s.physicalN // drop whole block
+			if s.eof {
+				// torn tail of the last write
+				kRecordType = kEof
+				return
+			}
 			kRecordType = kBadRecord
-			s.physicalReadOffset = s.physicalN // drop whole record
 			return
 		}
 
-		actualSum := crc32.ChecksumIEEE(s.buf[s.physicalReadOffset+journalBlockHeaderLen : s.physicalReadOffset+journalBlockHeaderLen+dataLen])
-		if expectedSum != actualSum {
+		fragment = s.buf[start : start+dataLen]
+		s.physicalReadOffset = start + dataLen
+
+		if expectedSum != crc32.ChecksumIEEE(fragment) {
 			kRecordType = kBadRecord
-			s.physicalReadOffset = s.physicalN // drop whole record
+			s.physicalReadOffset = s.physicalN // drop whole block
+			fragment = nil
 			return
 		}
 
-		s.physicalReadOffset += dataLen
-
-		// last empty block
-		if dataLen == 0 {
-			continue
-		}
-
 		return
-
 	}
 }
@@ -0,0 +1,114 @@
+package sstable
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestJournalRoundTrip(t *testing.T) {
+
+	// the chunks fill the block exactly, leave a trailer less than header and cross blocks
+	chunks := [][]byte{
+		bytes.Repeat([]byte{1}, kJournalBlockSize-journalBlockHeaderLen),
+		bytes.Repeat([]byte{2}, kJournalBlockSize-2*journalBlockHeaderLen-3),
+		bytes.Repeat([]byte{3}, 3*kJournalBlockSize),
+		[]byte("tail"),
+	}
+
+	w := &memWriter{}
+	jw := NewJournalWriter(w)
+	for _, chunk := range chunks {
+		if _, err := jw.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jr := NewJournalReader(&memReader{bytes.NewReader(w.Bytes())})
+	for i, expect := range chunks {
+		chunk, err := jr.NextChunk()
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		got, err := ioutil.ReadAll(chunk)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if !bytes.Equal(got, expect) {
+			t.Fatalf("chunk %d: expect %d bytes, got %d bytes", i, len(expect), len(got))
+		}
+	}
+	if _, err := jr.NextChunk(); err != io.EOF {
+		t.Fatalf("expect eof, got %v", err)
+	}
+}
+
+func TestJournalReaderAt(t *testing.T) {
+
+	chunks := [][]byte{
+		[]byte("first"),
+		bytes.Repeat([]byte{1}, kJournalBlockSize-2*journalBlockHeaderLen-8),
+		bytes.Repeat([]byte{2}, 2*kJournalBlockSize),
+		[]byte("last"),
+	}
+
+	w := &memWriter{}
+	jw := NewJournalWriter(w)
+	for _, chunk := range chunks {
+		if _, err := jw.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := w.Bytes()
+
+	// collect the end offset of every chunk
+	offsets := []int64{0}
+	jr := NewJournalReader(&memReader{bytes.NewReader(data)})
+	for range chunks {
+		chunk, err := jr.NextChunk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ioutil.ReadAll(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if jr.partial {
+			t.Fatal("unexpected partial chunk")
+		}
+		offsets = append(offsets, jr.offset())
+	}
+
+	// resume from every offset
+	for i, offset := range offsets[:len(chunks)] {
+		jr := newJournalReaderAt(bytes.NewReader(data), offset)
+		chunk, err := jr.NextChunk()
+		if err != nil {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+		got, err := ioutil.ReadAll(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, chunks[i]) {
+			t.Fatalf("offset %d: expect chunk %d", offset, i)
+		}
+		if jr.offset() != offsets[i+1] {
+			t.Fatalf("offset %d: expect next offset %d, got %d", offset, offsets[i+1], jr.offset())
+		}
+	}
+
+	// the cross block chunk is cut in the middle, it's reported as partial
+	torn := data[:2*kJournalBlockSize]
+	jr = newJournalReaderAt(bytes.NewReader(torn), offsets[2])
+	chunk, err := jr.NextChunk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(chunk); err != nil {
+		t.Fatal(err)
+	}
+	if !jr.partial {
+		t.Fatal("expect partial chunk")
+	}
+}
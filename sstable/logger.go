@@ -0,0 +1,174 @@
+package sstable
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxLogFileSize = 1 << 24 // 16m
+	defaultKeepLogFileNum = 10
+
+	kLogFileName       = "LOG"
+	kOldLogFilePrefix  = "LOG.old."
+	kLogTimeFormat     = "2006/01/02-15:04:05.000000"
+	kOldLogTimeSuffix  = "20060102150405.000000"
+	kLogLevelInfo      = "INFO"
+	kLogLevelWarn      = "WARN"
+	kLogFileCreateMode = 0644
+)
+
+// Logger record the engine internals, e.g. recovery, compaction and file deletion
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Infof(format string, args ...interface{}) {}
+func (noopLogger) Warnf(format string, args ...interface{}) {}
+
+// logger the Logger of options, logs are discarded if not set
+func (vSet *VersionSet) logger() Logger {
+	if vSet.opt.Logger == nil {
+		return noopLogger{}
+	}
+	return vSet.opt.Logger
+}
+
+/**
+FileLogger write the logs into the LOG file in db directory.
+when the LOG file exceeds maxSize, it is renamed to LOG.old.<time> and a new LOG file is created,
+only the newest keep old log files are kept.
+**/
+
+type FileLogger struct {
+	mu      sync.Mutex
+	dir     string
+	file    *os.File
+	size    int64
+	maxSize int64
+	keep    int
+}
+
+// NewFileLogger open the LOG file in dir, the existing LOG file is rotated.
+// maxSize and keep use the default value if not positive
+func NewFileLogger(dir string, maxSize int64, keep int) (*FileLogger, error) {
+
+	if maxSize <= 0 {
+		maxSize = defaultMaxLogFileSize
+	}
+	if keep <= 0 {
+		keep = defaultKeepLogFileNum
+	}
+
+	l := &FileLogger{
+		dir:     dir,
+		maxSize: maxSize,
+		keep:    keep,
+	}
+
+	if err := l.rotate(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *FileLogger) Infof(format string, args ...interface{}) {
+	l.logf(kLogLevelInfo, format, args...)
+}
+
+func (l *FileLogger) Warnf(format string, args ...interface{}) {
+	l.logf(kLogLevelWarn, format, args...)
+}
+
+func (l *FileLogger) logf(level string, format string, args ...interface{}) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return
+	}
+
+	if l.size >= l.maxSize {
+		if err := l.rotate(); err != nil {
+			return
+		}
+	}
+
+	msg := fmt.Sprintf("%s %s %s\n", time.Now().Format(kLogTimeFormat), level, fmt.Sprintf(format, args...))
+	n, _ := l.file.WriteString(msg)
+	l.size += int64(n)
+}
+
+// rotate rename the current LOG file to LOG.old.<time> and create a new one
+// required: l.mu held
+func (l *FileLogger) rotate() error {
+
+	if l.file != nil {
+		_ = l.file.Close()
+		l.file = nil
+	}
+
+	logPath := path.Join(l.dir, kLogFileName)
+	if _, err := os.Stat(logPath); err == nil {
+		oldPath := path.Join(l.dir, kOldLogFilePrefix+time.Now().Format(kOldLogTimeSuffix))
+		if err = os.Rename(logPath, oldPath); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, kLogFileCreateMode)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.size = 0
+
+	l.removeOldLogs()
+	return nil
+}
+
+// removeOldLogs only keep the newest old log files, the time suffix is sortable
+func (l *FileLogger) removeOldLogs() {
+
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return
+	}
+
+	var olds []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), kOldLogFilePrefix) {
+			olds = append(olds, entry.Name())
+		}
+	}
+
+	if len(olds) <= l.keep {
+		return
+	}
+
+	sort.Strings(olds)
+	for _, name := range olds[:len(olds)-l.keep] {
+		_ = os.Remove(path.Join(l.dir, name))
+	}
+}
+
+func (l *FileLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,107 @@
+package sstable
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// oldLogFiles the names of the rotated log files in dir
+func oldLogFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var olds []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), kOldLogFilePrefix) {
+			olds = append(olds, entry.Name())
+		}
+	}
+	return olds
+}
+
+func TestFileLoggerRotate(t *testing.T) {
+
+	dir := t.TempDir()
+	l, err := NewFileLogger(dir, 100, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = l.Close()
+	}()
+
+	// each line exceeds maxSize, so the next one is written into a new LOG file
+	line := strings.Repeat("x", 100)
+	l.Infof("first %s", line)
+	if olds := oldLogFiles(t, dir); len(olds) != 0 {
+		t.Fatalf("expect no rotation before maxSize reached, got %v", olds)
+	}
+	for i := 0; i < 5; i++ {
+		// the old log files are named by time
+		time.Sleep(time.Millisecond)
+		l.Warnf("next %s", line)
+	}
+
+	olds := oldLogFiles(t, dir)
+	if len(olds) != 3 {
+		t.Fatalf("expect 3 old log files kept, got %v", olds)
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, kLogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(data); strings.Count(s, "\n") != 1 || !strings.Contains(s, kLogLevelWarn+" next") {
+		t.Fatalf("expect only the last line in LOG, got %q", s)
+	}
+
+	// the first log file is the oldest one, it's removed
+	for _, name := range olds {
+		data, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "first") {
+			t.Fatalf("expect the oldest log file removed, found in %s", name)
+		}
+	}
+}
+
+func TestDefaultFileLogger(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestKeys(t, db, 100)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(dir, kLogFileName))
+	if err != nil {
+		t.Fatalf("expect LOG created in db dir, got %v", err)
+	}
+	if len(data) == 0 {
+		t.Fatal("expect the engine internals logged")
+	}
+
+	// the LOG of the last open is rotated when reopened
+	if db, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if olds := oldLogFiles(t, dir); len(olds) != 1 {
+		t.Fatalf("expect the last LOG rotated, got %v", olds)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	hash2 "hash"
 	"sync"
+	"sync/atomic"
 )
 
 const htInitSlots = uint32(1 << 2)
@@ -15,6 +16,21 @@ type Cache interface {
 	Prune()
 	Close()
 	UnRef(h *LRUHandle)
+	Stats() CacheStats
+}
+
+// CacheStats the lookups counted since the cache created
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// HitRatio 0 if no lookup
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
 }
 
 type LRUHandle struct {
@@ -59,18 +75,18 @@ func (ht *HandleTable) Insert(handle *LRUHandle) *LRUHandle {
 	ptr := ht.FindPointer(handle.key, handle.hash)
 	old := *ptr
 
+	if old != nil {
+		handle.nextHash = old.nextHash
+	}
+	*ptr = handle
+
 	if old == nil {
-		*ptr = handle
 		ht.size++
 		if ht.size > ht.slots {
 			ht.Resize(true)
 		}
 	}
 
-	if old != nil {
-		handle.nextHash = old.nextHash
-	}
-
 	return old
 }
 
@@ -84,7 +100,7 @@ func (ht *HandleTable) Erase(key []byte, hash uint32) *LRUHandle {
 	old := *ptr
 	if old != nil {
 		ht.size--
-		*ptr = old.next
+		*ptr = old.nextHash
 		if ht.size < ht.slots>>1 && ht.slots > htInitSlots {
 			ht.Resize(false)
 		}
@@ -93,9 +109,9 @@ func (ht *HandleTable) Erase(key []byte, hash uint32) *LRUHandle {
 }
 
 func (ht *HandleTable) FindPointer(key []byte, hash uint32) **LRUHandle {
-	slot := hash & ht.slots
+	slot := hash & (ht.slots - 1)
 	ptr := &ht.list[slot]
-	for *ptr != nil && (*ptr).hash != hash || bytes.Compare((*ptr).key, key) != 0 {
+	for *ptr != nil && ((*ptr).hash != hash || !bytes.Equal((*ptr).key, key)) {
 		ptr = &(*ptr).nextHash
 	}
 	return ptr
@@ -114,15 +130,13 @@ func (ht *HandleTable) Resize(growth bool) {
 	newList := make([]*LRUHandle, newSlots)
 
 	for i := uint32(0); i < ht.slots; i++ {
-		ptr := &ht.list[i]
-		for *ptr != nil {
-			head := &newList[(*ptr).hash&newSlots]
-			next := (*ptr).nextHash
-			if *head != nil {
-				(*ptr).nextHash = *head
-			}
-			*head = *ptr
-			ptr = &next
+		h := ht.list[i]
+		for h != nil {
+			next := h.nextHash
+			head := &newList[h.hash&(newSlots-1)]
+			h.nextHash = *head
+			*head = h
+			h = next
 		}
 	}
 
@@ -144,14 +158,15 @@ type LRUCache struct {
 	lru LRUHandle
 }
 
-func (lruCache *LRUCache) Close() {
-	lruCache.rwMutex.Lock()
-	defer lruCache.rwMutex.Unlock()
-	for inUse := lruCache.inUse.next; inUse != &lruCache.inUse; inUse = inUse.next {
-		lruCache.finishErase(inUse)
+// Close erase all the entries, the entries in use are deleted when the callers UnRef them
+func (c *LRUCache) Close() {
+	c.rwMutex.Lock()
+	defer c.rwMutex.Unlock()
+	for c.inUse.next != &c.inUse {
+		h := c.inUse.next
+		c.finishErase(c.table.Erase(h.key, h.hash))
 	}
-	assert(lruCache.inUse.next == &lruCache.inUse)
-	lruCache.Prune()
+	c.prune()
 }
 
 func newCache(capacity uint32) *LRUCache {
@@ -201,8 +216,9 @@ func (c *LRUCache) Insert(key []byte, hash uint32, charge uint32,
 }
 
 func (c *LRUCache) Lookup(key []byte, hash uint32) *LRUHandle {
-	c.rwMutex.RLock()
-	defer c.rwMutex.RUnlock()
+	// Ref moves the handle between the lists
+	c.rwMutex.Lock()
+	defer c.rwMutex.Unlock()
 	h := c.table.Lookup(key, hash)
 	if h != nil {
 		c.Ref(h)
@@ -221,8 +237,15 @@ func (c *LRUCache) Erase(key []byte, hash uint32) *LRUHandle {
 func (c *LRUCache) Prune() {
 	c.rwMutex.Lock()
 	defer c.rwMutex.Unlock()
-	for next := c.lru.next; next != &c.lru; next = next.next {
-		c.finishErase(next)
+	c.prune()
+}
+
+// prune erase the entries not in use
+// required: rwMutex held
+func (c *LRUCache) prune() {
+	for c.lru.next != &c.lru {
+		h := c.lru.next
+		c.finishErase(c.table.Erase(h.key, h.hash))
 	}
 }
 
@@ -270,8 +293,14 @@ func (c *LRUCache) Ref(h *LRUHandle) {
 const kNumShardBits = 4
 
 type ShardedLRUCache struct {
+	// atomic, keep at the head for alignment
+	hits   uint64
+	misses uint64
+
 	caches [1 << kNumShardBits]*LRUCache
-	hash32 hash2.Hash32
+
+	hashMutex sync.Mutex
+	hash32    hash2.Hash32
 }
 
 func NewCache(capacity uint32, hash32 hash2.Hash32) Cache {
@@ -296,17 +325,30 @@ func (c *ShardedLRUCache) Close() {
 func (c *ShardedLRUCache) Insert(key []byte, charge uint32,
 	value interface{}, deleter func(key []byte, value interface{})) *LRUHandle {
 	hash := c.hash(key)
-	return c.caches[hash].Insert(key, hash, charge, value, deleter)
+	return c.caches[shardOf(hash)].Insert(key, hash, charge, value, deleter)
 }
 
 func (c *ShardedLRUCache) Lookup(key []byte) *LRUHandle {
 	hash := c.hash(key)
-	return c.caches[hash].Lookup(key, hash)
+	h := c.caches[shardOf(hash)].Lookup(key, hash)
+	if h != nil {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return h
+}
+
+func (c *ShardedLRUCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
 }
 
 func (c *ShardedLRUCache) Erase(key []byte) *LRUHandle {
 	hash := c.hash(key)
-	return c.caches[hash].Erase(key, hash)
+	return c.caches[shardOf(hash)].Erase(key, hash)
 }
 
 func (c *ShardedLRUCache) Prune() {
@@ -315,14 +357,22 @@ func (c *ShardedLRUCache) Prune() {
 	}
 }
 
+// hash the hash32 is not safe for concurrent use
 func (c *ShardedLRUCache) hash(key []byte) uint32 {
+	c.hashMutex.Lock()
+	defer c.hashMutex.Unlock()
 	c.hash32.Reset()
 	_, _ = c.hash32.Write(key)
-	return c.hash32.Sum32() >> (32 - kNumShardBits)
+	return c.hash32.Sum32()
+}
+
+// shardOf the high bits of hash select the shard, the low bits select the slot
+func shardOf(hash uint32) uint32 {
+	return hash >> (32 - kNumShardBits)
 }
 
 func (c *ShardedLRUCache) UnRef(h *LRUHandle) {
-	cache := c.caches[h.hash>>(32-kNumShardBits)]
+	cache := c.caches[shardOf(h.hash)]
 	cache.rwMutex.Lock()
 	defer cache.rwMutex.Unlock()
 	cache.UnRef(h)
@@ -39,9 +39,9 @@ func (memTable *MemDB) Find(ikey InternalKey) (rkey []byte, value []byte, err er
 		ikeyN := node.key(memTable.SkipList.kvData)
 		valueN := node.value(memTable.SkipList.kvData)
 		memTable.SkipList.rw.RUnlock()
-		ukey, kt, _, err := parseInternalKey(ikeyN)
-		if err != nil {
-			return nil, nil, err
+		ukey, kt, _, pErr := parseInternalKey(ikeyN)
+		if pErr != nil {
+			return nil, nil, pErr
 		}
 		if bytes.Compare(ukey, ikey.ukey()) == 0 {
 			rkey = ikeyN
@@ -0,0 +1,197 @@
+package sstable
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/**
+metrics of engine internals, exported in the prometheus text format by WriteMetrics
+
+	# HELP leveldb_get_duration_seconds ...
+	# TYPE leveldb_get_duration_seconds histogram
+	leveldb_get_duration_seconds_bucket{le="0.0001"} 3
+	...
+	leveldb_get_duration_seconds_bucket{le="+Inf"} 5
+	leveldb_get_duration_seconds_sum 0.0042
+	leveldb_get_duration_seconds_count 5
+
+the counters are updated atomically on the hot paths, the gauges are sampled when exported
+**/
+
+var (
+	// upper bounds in nanoseconds, 10us ~ 10s
+	latencyBuckets = []uint64{
+		10e3, 50e3, 100e3, 250e3, 500e3,
+		1e6, 2.5e6, 5e6, 10e6, 25e6, 50e6, 100e6, 250e6, 500e6,
+		1e9, 10e9,
+	}
+
+	// number of batches merged into a group commit
+	groupBatchesBuckets = []uint64{1, 2, 4, 8, 16, 32, 64, 128}
+
+	// bytes of a group commit, 64b ~ 1m
+	groupBytesBuckets = []uint64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+)
+
+// histogram the cumulative buckets are computed when exported
+type histogram struct {
+	sum uint64 // atomic, keep at the head for alignment
+
+	bounds []uint64
+	counts []uint64 // atomic, the last one is +Inf
+	scale  float64  // exported value = observed value * scale
+}
+
+func newHistogram(bounds []uint64, scale float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+		scale:  scale,
+	}
+}
+
+func (h *histogram) observe(v uint64) {
+	i := sort.Search(len(h.bounds), func(i int) bool {
+		return v <= h.bounds[i]
+	})
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, v)
+}
+
+func (h *histogram) observeSince(start time.Time) {
+	h.observe(uint64(time.Since(start)))
+}
+
+type dbMetrics struct {
+	// atomic counters
+	compactions          uint64
+	compactionReadBytes  uint64
+	compactionWriteBytes uint64
+	flushes              uint64
+	flushWriteBytes      uint64
+
+	getLatency   *histogram
+	writeLatency *histogram
+	groupBatches *histogram
+	groupBytes   *histogram
+}
+
+func newDBMetrics() *dbMetrics {
+	return &dbMetrics{
+		getLatency:   newHistogram(latencyBuckets, 1e-9),
+		writeLatency: newHistogram(latencyBuckets, 1e-9),
+		groupBatches: newHistogram(groupBatchesBuckets, 1),
+		groupBytes:   newHistogram(groupBytesBuckets, 1),
+	}
+}
+
+// WriteMetrics write the metrics in the prometheus text format
+func (db *DB) WriteMetrics(w io.Writer) error {
+
+	stats, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	cacheStats := db.tableCacheStats()
+
+	m := db.metrics
+	e := &metricsEncoder{w: bufio.NewWriter(w)}
+
+	e.histogram("leveldb_get_duration_seconds", "Latency of the point lookups.", m.getLatency)
+	e.histogram("leveldb_write_duration_seconds", "Latency of the writes, including the wait for group commit.", m.writeLatency)
+	e.histogram("leveldb_write_group_batches", "Number of batches merged into a group commit.", m.groupBatches)
+	e.histogram("leveldb_write_group_bytes", "Bytes written to the journal by a group commit.", m.groupBytes)
+
+	e.single("leveldb_latest_sequence", "gauge", "The latest sequence number.", float64(stats.LatestSequence))
+	e.single("leveldb_memtable_bytes", "gauge", "Approximate bytes of the mutable memtable.", float64(stats.MemTableSize))
+	e.single("leveldb_immutable_memtable_bytes", "gauge", "Approximate bytes of the immutable memtable waiting for flush.", float64(stats.ImmutableSize))
+	e.single("leveldb_running_compactions", "gauge", "Number of the running compactions.", float64(stats.RunningCompactions))
+
+	e.header("leveldb_level_files", "gauge", "Number of table files of each level.")
+	for level, n := range stats.LevelFiles {
+		e.sample("leveldb_level_files", `level="`+strconv.Itoa(level)+`"`, float64(n))
+	}
+	e.header("leveldb_level_bytes", "gauge", "Bytes of table files of each level.")
+	for level, n := range stats.LevelBytes {
+		e.sample("leveldb_level_bytes", `level="`+strconv.Itoa(level)+`"`, float64(n))
+	}
+
+	e.single("leveldb_flushes_total", "counter", "Number of the completed memtable flushes.", float64(atomic.LoadUint64(&m.flushes)))
+	e.single("leveldb_flush_written_bytes_total", "counter", "Bytes of table files written by flushes.", float64(atomic.LoadUint64(&m.flushWriteBytes)))
+	e.single("leveldb_compactions_total", "counter", "Number of the completed compactions.", float64(atomic.LoadUint64(&m.compactions)))
+	e.single("leveldb_compaction_read_bytes_total", "counter", "Bytes of input table files read by compactions.", float64(atomic.LoadUint64(&m.compactionReadBytes)))
+	e.single("leveldb_compaction_written_bytes_total", "counter", "Bytes of output table files written by compactions.", float64(atomic.LoadUint64(&m.compactionWriteBytes)))
+
+	e.header("leveldb_cache_hits_total", "counter", "Number of the cache lookups hit.")
+	e.sample("leveldb_cache_hits_total", `cache="table"`, float64(cacheStats.Hits))
+	e.header("leveldb_cache_misses_total", "counter", "Number of the cache lookups missed.")
+	e.sample("leveldb_cache_misses_total", `cache="table"`, float64(cacheStats.Misses))
+	e.header("leveldb_cache_hit_ratio", "gauge", "Ratio of the cache lookups hit, 0 if no lookup.")
+	e.sample("leveldb_cache_hit_ratio", `cache="table"`, cacheStats.HitRatio())
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// tableCacheStats sum up the table caches of all column families
+func (db *DB) tableCacheStats() CacheStats {
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+	stats := db.VersionSet.tableCache.Stats()
+	for _, cf := range db.families {
+		s := cf.vSet.tableCache.Stats()
+		stats.Hits += s.Hits
+		stats.Misses += s.Misses
+	}
+	return stats
+}
+
+// metricsEncoder keep the first error, the later writes are dropped
+type metricsEncoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *metricsEncoder) printf(format string, args ...interface{}) {
+	if e.err == nil {
+		_, e.err = fmt.Fprintf(e.w, format, args...)
+	}
+}
+
+func (e *metricsEncoder) header(name, typ, help string) {
+	e.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (e *metricsEncoder) sample(name, labels string, v float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	e.printf("%s %s\n", name, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (e *metricsEncoder) single(name, typ, help string, v float64) {
+	e.header(name, typ, help)
+	e.sample(name, "", v)
+}
+
+func (e *metricsEncoder) histogram(name, help string, h *histogram) {
+	e.header(name, "histogram", help)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		le := strconv.FormatFloat(float64(bound)*h.scale, 'g', -1, 64)
+		e.sample(name+"_bucket", `le="`+le+`"`, float64(cumulative))
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	e.sample(name+"_bucket", `le="+Inf"`, float64(cumulative))
+	e.sample(name+"_sum", "", float64(atomic.LoadUint64(&h.sum))*h.scale)
+	e.sample(name+"_count", "", float64(cumulative))
+}
@@ -0,0 +1,86 @@
+package sstable
+
+import (
+	"bufio"
+	"hash/fnv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramEncode(t *testing.T) {
+
+	h := newHistogram([]uint64{10, 100}, 1)
+	for _, v := range []uint64{1, 10, 50, 1000} {
+		h.observe(v)
+	}
+
+	var b strings.Builder
+	e := &metricsEncoder{w: bufio.NewWriter(&b)}
+	e.histogram("test_size", "Test sizes.", h)
+	if err := e.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `# HELP test_size Test sizes.
+# TYPE test_size histogram
+test_size_bucket{le="10"} 2
+test_size_bucket{le="100"} 3
+test_size_bucket{le="+Inf"} 4
+test_size_sum 1061
+test_size_count 4
+`
+	if b.String() != expect {
+		t.Fatalf("unexpected output\n%s", b.String())
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+
+	c := NewCache(16, fnv.New32a())
+	c.UnRef(c.Insert([]byte("a"), 1, 1, func(key []byte, value interface{}) {}))
+
+	for _, key := range []string{"a", "a", "a", "b"} {
+		if h := c.Lookup([]byte(key)); h != nil {
+			c.UnRef(h)
+		}
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 3 || stats.Misses != 1 || stats.HitRatio() != 0.75 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if (CacheStats{}).HitRatio() != 0 {
+		t.Fatalf("expect 0 hit ratio without lookup")
+	}
+}
+
+func TestMergeWriteBatchGroup(t *testing.T) {
+
+	js := &journalStorage{files: make(map[Fd]*memWriter), modTimes: make(map[Fd]time.Time)}
+	db := newDB(js, &Options{})
+
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+
+	var writers []*writer
+	for _, key := range []string{"a", "b", "c"} {
+		wb := &WriteBatch{}
+		wb.Put([]byte(key), []byte(key))
+		w := newWriter(wb, &db.rwMutex)
+		db.writers.PushBack(w)
+		writers = append(writers, w)
+	}
+
+	lastWriter := writers[0]
+	merged := db.mergeWriteBatch(&lastWriter)
+	if merged.Len() != 3 {
+		t.Fatalf("expect 3 records merged, got %d", merged.Len())
+	}
+	if lastWriter != writers[2] {
+		t.Fatalf("expect the last writer of the group updated")
+	}
+	if db.metrics.groupBatches.counts[2] != 1 {
+		t.Fatalf("expect the group of 3 batches observed, counts=%v", db.metrics.groupBatches.counts)
+	}
+}
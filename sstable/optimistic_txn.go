@@ -0,0 +1,69 @@
+package sstable
+
+import "fmt"
+
+/**
+optimistic transaction, no lock is taken before commit
+
+	Get/Put/Delete -> track the key with the latest sequence when first accessed
+	               \-> writes are buffered in batch, Get reads its own writes
+	Commit -> becomes the head writer -> any tracked key written after its sequence ? -> ErrConflict
+	                                                                                 \-> write the batch
+
+	the check and the write are atomic since no other write could run while the head writer is checking.
+	suits the low contention workloads, the conflicted transaction should be retried by caller
+**/
+
+// OptimisticTransactionDB the DB supports optimistic transactions
+type OptimisticTransactionDB struct {
+	*DB
+}
+
+func NewOptimisticTransactionDB(db *DB) *OptimisticTransactionDB {
+	return &OptimisticTransactionDB{DB: db}
+}
+
+// Begin start a transaction, the transaction is not safe for concurrent use
+func (odb *OptimisticTransactionDB) Begin() *Txn {
+	return newTxn(odb.DB)
+}
+
+// checkConflict return ErrConflict if any key is written after its tracked sequence
+// required: mutex held
+func (db *DB) checkConflict(tracked map[string]Sequence) error {
+
+	assertMutexHeld(&db.rwMutex)
+
+	for key, seq := range tracked {
+		latest, found, err := db.latestSequence([]byte(key))
+		if err != nil {
+			return err
+		}
+		if found && latest > seq {
+			return fmt.Errorf("%w, key %q written at %d after %d", ErrConflict, key, latest, seq)
+		}
+	}
+	return nil
+}
+
+// latestSequence the sequence of the newest write of key in mem, imm and current version
+// required: mutex held
+func (db *DB) latestSequence(key []byte) (seq Sequence, found bool, err error) {
+
+	ikey := buildInternalKey(nil, key, kTypeSeek, db.seqNum)
+
+	for _, mem := range []*MemDB{db.mem, db.imm} {
+		if mem == nil {
+			continue
+		}
+		rkey, _, fErr := mem.Find(ikey)
+		if fErr == nil || fErr == ErrDeleted {
+			return InternalKey(rkey).seq(), true, nil
+		}
+		if fErr != ErrNotFound {
+			return 0, false, fErr
+		}
+	}
+
+	return db.VersionSet.getCurrent().latestSequence(ikey)
+}
@@ -0,0 +1,136 @@
+package sstable
+
+import (
+	"errors"
+	"testing"
+)
+
+func openOptimisticTxnDB(t *testing.T) *OptimisticTransactionDB {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewOptimisticTransactionDB(db)
+}
+
+func TestOptimisticTxnConflict(t *testing.T) {
+
+	odb := openOptimisticTxnDB(t)
+	defer func() {
+		_ = odb.Close()
+	}()
+	if err := odb.Put([]byte("k"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn1 := odb.Begin()
+	txn2 := odb.Begin()
+	if _, err := txn1.Get([]byte("k")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn2.Put([]byte("k"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn1.Put([]byte("k"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first committed wins, the other one conflicts
+	if err := txn2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn1.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expect conflict, got %v", err)
+	}
+	if value, err := odb.Get([]byte("k")); err != nil || string(value) != "2" {
+		t.Fatalf("expect k=2, got %q, %v", value, err)
+	}
+
+	// the keys untouched by others commit
+	txn3 := odb.Begin()
+	_ = txn3.Put([]byte("k"), []byte("3"))
+	if err := txn3.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := odb.Get([]byte("k")); err != nil || string(value) != "3" {
+		t.Fatalf("expect k=3, got %q, %v", value, err)
+	}
+}
+
+func TestOptimisticTxnReadOnlyCommit(t *testing.T) {
+
+	odb := openOptimisticTxnDB(t)
+	defer func() {
+		_ = odb.Close()
+	}()
+
+	txn := odb.Begin()
+	if _, err := txn.Get([]byte("k")); err != ErrNotFound {
+		t.Fatalf("expect not found, got %v", err)
+	}
+	if err := odb.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is written, the read key written by others is not a conflict
+	seq := odb.LatestSequence()
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("expect read only txn committed, got %v", err)
+	}
+	if got := odb.LatestSequence(); got != seq {
+		t.Fatalf("expect nothing written, sequence %d -> %d", seq, got)
+	}
+}
+
+func TestOptimisticTxnConflictInTable(t *testing.T) {
+
+	odb := openOptimisticTxnDB(t)
+	defer func() {
+		_ = odb.Close()
+	}()
+
+	txn := odb.Begin()
+	if err := txn.Put([]byte("k"), []byte("txn")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the conflicting write is flushed into table, found by the version
+	if err := odb.Put([]byte("k"), []byte("db")); err != nil {
+		t.Fatal(err)
+	}
+	if err := odb.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if n := odb.VersionSet.levelFilesNum(0); n == 0 {
+		t.Fatal("expect the write flushed into table")
+	}
+
+	if err := txn.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expect conflict, got %v", err)
+	}
+	if value, err := odb.Get([]byte("k")); err != nil || string(value) != "db" {
+		t.Fatalf("expect k=db, got %q, %v", value, err)
+	}
+}
+
+func TestOptimisticTxnCommitAfterRollback(t *testing.T) {
+
+	odb := openOptimisticTxnDB(t)
+	defer func() {
+		_ = odb.Close()
+	}()
+
+	txn := odb.Begin()
+	_ = txn.Put([]byte("k"), []byte("v"))
+	txn.Rollback()
+
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Fatalf("expect txn done, got %v", err)
+	}
+	if err := txn.Put([]byte("k"), []byte("v")); err != ErrTxnDone {
+		t.Fatalf("expect txn done, got %v", err)
+	}
+	if _, err := odb.Get([]byte("k")); err != ErrNotFound {
+		t.Fatalf("expect the rollback writes discarded, got %v", err)
+	}
+}
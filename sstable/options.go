@@ -0,0 +1,187 @@
+package sstable
+
+import "time"
+
+type CompactionStyle uint8
+
+const (
+	// CompactionStyleLevel each level is 10x larger than the previous one,
+	// a compaction merges one file with the overlapped files in next level
+	CompactionStyleLevel CompactionStyle = iota
+
+	// CompactionStyleUniversal tiered compaction, data is kept in sorted runs,
+	// a compaction merges several adjacent runs by size ratio and run count,
+	// lower write amplification with higher space and read amplification
+	CompactionStyleUniversal
+
+	// CompactionStyleFIFO all tables stay in level0 and are never rewritten,
+	// the oldest tables are dropped when the total size or age exceeds the limit.
+	// suits the append only data like logs and metrics, keys should not be updated
+	CompactionStyleFIFO
+)
+
+const (
+	defaultWriteBufferSize                = kMemTableWriteBufferSize
+	defaultLevel0FileNumCompactionTrigger = kLevel0CompactionTrigger
+	defaultLevel0SlowdownWritesTrigger    = kLevel0SlowDownTrigger
+	defaultLevel0StopWritesTrigger        = kLevel0StopWriteTrigger
+	defaultMaxBytesForLevelBase           = kLevel1SizeThreshold
+
+	defaultMaxBackgroundJobs = 2
+	defaultMaxSubcompactions = 1
+
+	defaultUniversalCompactionTrigger           = 8
+	defaultUniversalSizeRatio                   = 1
+	defaultUniversalMinMergeWidth               = 2
+	defaultUniversalMaxSizeAmplificationPercent = 200
+
+	defaultFIFOMaxTableFilesSize = 1 << 30 // 1g
+)
+
+type Options struct {
+	CompactionStyle CompactionStyle
+
+	// the options below are mutable by DB.SetOptions
+
+	// WriteBufferSize the mem is frozen and flushed into level0 when its size exceeds WriteBufferSize
+	WriteBufferSize int
+
+	// Level0FileNumCompactionTrigger level0 is compacted when the number of level0 files reaches it
+	Level0FileNumCompactionTrigger int
+
+	// Level0SlowdownWritesTrigger each write is delayed 1ms when the number of level0 files reaches it
+	Level0SlowdownWritesTrigger int
+
+	// Level0StopWritesTrigger writes are stopped until level0 is compacted when the number of level0 files reaches it
+	Level0StopWritesTrigger int
+
+	// MaxBytesForLevelBase the max bytes of level1, each next level is 10x larger
+	MaxBytesForLevelBase int
+
+	// the options below are immutable
+
+	// MaxBackgroundJobs the max number of concurrent background jobs,
+	// one of them is reserved for flushing memtable, the others run compactions
+	MaxBackgroundJobs int
+
+	// MaxSubcompactions a compaction is split into at most MaxSubcompactions key ranges,
+	// which are compacted in parallel
+	MaxSubcompactions int
+
+	// RateLimiter limit the write rate of flush, compaction and journal, nil means no limit
+	RateLimiter *RateLimiter
+
+	// Listeners receive the events of flush, compaction, table files, write stall and background error
+	Listeners []EventListener
+
+	// Logger record the engine internals, a FileLogger writing LOG file in db directory is used if nil
+	Logger Logger
+
+	// MaxLogFileSize and KeepLogFileNum are used by the default FileLogger
+	MaxLogFileSize int64
+	KeepLogFileNum int
+
+	// ColumnFamilies the options of the existing column families by name, used when the db is opened,
+	// the families not listed use the default comparer and filter
+	ColumnFamilies map[string]*ColumnFamilyOptions
+
+	// JournalTTL the obsolete journals are kept for JournalTTL since last modified, so DB.GetUpdatesSince
+	// could read the flushed writes, 0 means no limit of age
+	JournalTTL time.Duration
+
+	// JournalSizeLimit the newest obsolete journals are kept until their total size exceeds it, 0 means no limit of size.
+	// the obsolete journals are removed at once if both JournalTTL and JournalSizeLimit are 0,
+	// otherwise a journal is kept only if it's within all the limits set
+	JournalSizeLimit int64
+
+	// ParanoidChecks verify every block of the live tables when opened, see DB.VerifyChecksums,
+	// the db refuses to open if any table is corrupted
+	ParanoidChecks bool
+
+	// only used by CompactionStyleUniversal
+	Universal UniversalOptions
+
+	// only used by CompactionStyleFIFO
+	FIFO FIFOOptions
+}
+
+type UniversalOptions struct {
+	// CompactionTrigger the number of sorted runs to trigger a compaction
+	CompactionTrigger int
+
+	// SizeRatio the percentage flexibility while comparing the size of runs,
+	// run is picked if the size of picked runs * (100 + SizeRatio) / 100 >= the size of run
+	SizeRatio int
+
+	// MinMergeWidth minimum number of runs merged in one compaction
+	MinMergeWidth int
+
+	// MaxMergeWidth maximum number of runs merged in one compaction, 0 means no limit
+	MaxMergeWidth int
+
+	// MaxSizeAmplificationPercent if the size of all runs except the oldest one is larger than
+	// MaxSizeAmplificationPercent percent of the oldest run, all the runs will be merged
+	MaxSizeAmplificationPercent int
+}
+
+type FIFOOptions struct {
+	// MaxTableFilesSize the oldest tables are dropped when the total size of tables exceeds it
+	MaxTableFilesSize int
+
+	// TTL the tables older than TTL are dropped, 0 means never expire.
+	// the age is checked when a compaction is scheduled, e.g. after memtable flushed
+	TTL time.Duration
+}
+
+// sanitizeOptions copy the options and fill the default values
+func sanitizeOptions(o *Options) *Options {
+	opt := &Options{}
+	if o != nil {
+		*opt = *o
+	}
+
+	if opt.WriteBufferSize <= 0 {
+		opt.WriteBufferSize = defaultWriteBufferSize
+	}
+	if opt.Level0FileNumCompactionTrigger <= 0 {
+		opt.Level0FileNumCompactionTrigger = defaultLevel0FileNumCompactionTrigger
+	}
+	if opt.Level0SlowdownWritesTrigger <= 0 {
+		opt.Level0SlowdownWritesTrigger = defaultLevel0SlowdownWritesTrigger
+	}
+	if opt.Level0StopWritesTrigger <= 0 {
+		opt.Level0StopWritesTrigger = defaultLevel0StopWritesTrigger
+	}
+	if opt.MaxBytesForLevelBase <= 0 {
+		opt.MaxBytesForLevelBase = defaultMaxBytesForLevelBase
+	}
+
+	if opt.MaxBackgroundJobs < 2 {
+		opt.MaxBackgroundJobs = defaultMaxBackgroundJobs
+	}
+	if opt.MaxSubcompactions < 1 {
+		opt.MaxSubcompactions = defaultMaxSubcompactions
+	}
+
+	u := &opt.Universal
+	if u.CompactionTrigger < 2 {
+		u.CompactionTrigger = defaultUniversalCompactionTrigger
+	}
+	if u.SizeRatio <= 0 {
+		u.SizeRatio = defaultUniversalSizeRatio
+	}
+	if u.MinMergeWidth < 2 {
+		u.MinMergeWidth = defaultUniversalMinMergeWidth
+	}
+	if u.MaxMergeWidth > 0 && u.MaxMergeWidth < u.MinMergeWidth {
+		u.MaxMergeWidth = u.MinMergeWidth
+	}
+	if u.MaxSizeAmplificationPercent <= 0 {
+		u.MaxSizeAmplificationPercent = defaultUniversalMaxSizeAmplificationPercent
+	}
+
+	if opt.FIFO.MaxTableFilesSize <= 0 {
+		opt.FIFO.MaxTableFilesSize = defaultFIFOMaxTableFilesSize
+	}
+	return opt
+}
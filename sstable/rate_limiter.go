@@ -0,0 +1,210 @@
+package sstable
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type IOPriority uint8
+
+const (
+	// IOPriorityLow compaction writes
+	IOPriorityLow IOPriority = iota
+	// IOPriorityHigh flush and journal writes
+	IOPriorityHigh
+	kIOPriorityNum
+)
+
+const (
+	defaultRateLimiterRefillPeriod = 100 * time.Millisecond
+	defaultRateLimiterFairness     = 10
+)
+
+/**
+token bucket rate limiter
+
+every refill period, bytesPerSecond * refillPeriod bytes are added into the bucket.
+the requests can't be satisfied are queued by priority, and granted in FIFO order when refilled.
+high priority queue is served first, except once every fairness refills the low priority queue is
+served first, so compaction won't be starved by the flush and journal writes.
+
+	request(n) -> enough tokens and no waiting requests -> return
+	           \-> queue[pri] -> wait for refill -> granted -> return
+
+**/
+
+type rlRequest struct {
+	bytes   int64
+	granted bool
+}
+
+type RateLimiter struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	bytesPerSecond int64 // atomic, adjustable at runtime
+	refillPeriod   time.Duration
+	fairness       int
+
+	available  int64
+	nextRefill time.Time
+	refills    int
+	leader     bool // a waiting request is sleeping until next refill
+	queues     [kIOPriorityNum]*list.List
+
+	// the clock, replaced by tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewRateLimiter create a rate limiter allows bytesPerSecond bytes written per second,
+// refillPeriod and fairness use the default value if not positive
+func NewRateLimiter(bytesPerSecond int64, refillPeriod time.Duration, fairness int) *RateLimiter {
+	if refillPeriod <= 0 {
+		refillPeriod = defaultRateLimiterRefillPeriod
+	}
+	if fairness <= 0 {
+		fairness = defaultRateLimiterFairness
+	}
+	r := &RateLimiter{
+		bytesPerSecond: bytesPerSecond,
+		refillPeriod:   refillPeriod,
+		fairness:       fairness,
+		nextRefill:     time.Now(),
+		now:            time.Now,
+		sleep:          time.Sleep,
+	}
+	r.cond = sync.NewCond(&r.mu)
+	for i := range r.queues {
+		r.queues[i] = list.New()
+	}
+	return r
+}
+
+// SetBytesPerSecond change the rate limit, take effect from next refill
+func (r *RateLimiter) SetBytesPerSecond(bytesPerSecond int64) {
+	assert(bytesPerSecond > 0)
+	atomic.StoreInt64(&r.bytesPerSecond, bytesPerSecond)
+}
+
+func (r *RateLimiter) BytesPerSecond() int64 {
+	return atomic.LoadInt64(&r.bytesPerSecond)
+}
+
+// singleBurstBytes the bytes added into bucket every refill
+func (r *RateLimiter) singleBurstBytes() int64 {
+	burst := r.BytesPerSecond() * int64(r.refillPeriod) / int64(time.Second)
+	if burst < 1 {
+		burst = 1
+	}
+	return burst
+}
+
+// Request block until n bytes are allowed to write, request larger than a single burst is split
+func (r *RateLimiter) Request(n int, pri IOPriority) {
+	for remain := int64(n); remain > 0; {
+		chunk := remain
+		if burst := r.singleBurstBytes(); chunk > burst {
+			chunk = burst
+		}
+		r.request(chunk, pri)
+		remain -= chunk
+	}
+}
+
+func (r *RateLimiter) request(n int64, pri IOPriority) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refill(r.now())
+	r.cond.Broadcast()
+
+	if r.queues[IOPriorityLow].Len() == 0 && r.queues[IOPriorityHigh].Len() == 0 && r.available >= n {
+		r.available -= n
+		return
+	}
+
+	req := &rlRequest{bytes: n}
+	r.queues[pri].PushBack(req)
+
+	for !req.granted {
+		if r.leader {
+			r.cond.Wait()
+			continue
+		}
+
+		// sleep until next refill, then grant the waiting requests
+		r.leader = true
+		wait := r.nextRefill.Sub(r.now())
+		r.mu.Unlock()
+		r.sleep(wait)
+		r.mu.Lock()
+		r.leader = false
+
+		r.refill(r.now())
+		r.cond.Broadcast()
+	}
+}
+
+// refill add tokens into bucket and grant the waiting requests
+// required: r.mu held
+func (r *RateLimiter) refill(now time.Time) {
+
+	if now.Before(r.nextRefill) {
+		return
+	}
+
+	// the unused tokens are not accumulated, avoid burst after idle
+	burst := r.singleBurstBytes()
+	r.available += burst
+	if r.available > burst {
+		r.available = burst
+	}
+	r.nextRefill = now.Add(r.refillPeriod)
+	r.refills++
+
+	order := [kIOPriorityNum]IOPriority{IOPriorityHigh, IOPriorityLow}
+	if r.refills%r.fairness == 0 {
+		order = [kIOPriorityNum]IOPriority{IOPriorityLow, IOPriorityHigh}
+	}
+
+	for _, pri := range order {
+		queue := r.queues[pri]
+		for queue.Len() > 0 {
+			req := queue.Front().Value.(*rlRequest)
+			// the request may be larger than the burst after the rate is lowered, grant it with a full bucket
+			if req.bytes > r.available && r.available < burst {
+				return
+			}
+			r.available -= req.bytes
+			req.granted = true
+			queue.Remove(queue.Front())
+		}
+	}
+}
+
+// rateLimitedWriter charge the rate limiter before writing
+type rateLimitedWriter struct {
+	SequentialWriter
+	limiter *RateLimiter
+	pri     IOPriority
+}
+
+func newRateLimitedWriter(w SequentialWriter, limiter *RateLimiter, pri IOPriority) SequentialWriter {
+	if limiter == nil {
+		return w
+	}
+	return &rateLimitedWriter{
+		SequentialWriter: w,
+		limiter:          limiter,
+		pri:              pri,
+	}
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	w.limiter.Request(len(p), w.pri)
+	return w.SequentialWriter.Write(p)
+}
@@ -0,0 +1,126 @@
+package sstable
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	if d > 0 {
+		c.t = c.t.Add(d)
+	}
+}
+
+// newTestRateLimiter create a rate limiter with 100 bytes burst every 100ms, the time is driven by the clock
+func newTestRateLimiter(fairness int) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	r := NewRateLimiter(1000, 100*time.Millisecond, fairness)
+	r.now, r.sleep = clock.now, clock.sleep
+	r.nextRefill = clock.t
+	return r, clock
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+
+	r, clock := newTestRateLimiter(0)
+	start := clock.now()
+
+	// the first burst is granted at once
+	r.Request(100, IOPriorityHigh)
+	if elapsed := clock.now().Sub(start); elapsed != 0 {
+		t.Fatalf("expect no wait, waited %v", elapsed)
+	}
+
+	// split into 3 bursts
+	r.Request(250, IOPriorityHigh)
+	if elapsed := clock.now().Sub(start); elapsed != 300*time.Millisecond {
+		t.Fatalf("expect wait 300ms, waited %v", elapsed)
+	}
+
+	// the unused tokens are not accumulated while idle
+	clock.sleep(time.Second)
+	start = clock.now()
+	r.Request(200, IOPriorityLow)
+	if elapsed := clock.now().Sub(start); elapsed != 100*time.Millisecond {
+		t.Fatalf("expect wait 100ms after idle, waited %v", elapsed)
+	}
+}
+
+func TestRateLimiterPriorityFairness(t *testing.T) {
+
+	r, clock := newTestRateLimiter(3)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// drain the first burst
+	r.refill(clock.now())
+	r.available = 0
+
+	// every refill grants one request, low priority is served first every 3 refills
+	var (
+		high, low []*rlRequest
+		expect    = []IOPriority{IOPriorityHigh, IOPriorityLow, IOPriorityHigh, IOPriorityHigh, IOPriorityLow}
+	)
+	for range expect {
+		high = append(high, &rlRequest{bytes: 100})
+		r.queues[IOPriorityHigh].PushBack(high[len(high)-1])
+		low = append(low, &rlRequest{bytes: 100})
+		r.queues[IOPriorityLow].PushBack(low[len(low)-1])
+	}
+
+	granted := [kIOPriorityNum]int{}
+	for i, pri := range expect {
+		clock.sleep(r.nextRefill.Sub(clock.now()))
+		r.refill(clock.now())
+		granted[pri]++
+		if n := countGranted(high); n != granted[IOPriorityHigh] {
+			t.Fatalf("refill %d: expect %d high requests granted, got %d", i, granted[IOPriorityHigh], n)
+		}
+		if n := countGranted(low); n != granted[IOPriorityLow] {
+			t.Fatalf("refill %d: expect %d low requests granted, got %d", i, granted[IOPriorityLow], n)
+		}
+	}
+}
+
+func countGranted(reqs []*rlRequest) (n int) {
+	for _, req := range reqs {
+		if req.granted {
+			n++
+		}
+	}
+	return
+}
+
+func TestRateLimiterSetBytesPerSecond(t *testing.T) {
+
+	r, clock := newTestRateLimiter(0)
+	r.Request(100, IOPriorityHigh)
+
+	// the larger burst is added at next refill
+	r.SetBytesPerSecond(2000)
+	start := clock.now()
+	r.Request(200, IOPriorityHigh)
+	if elapsed := clock.now().Sub(start); elapsed != 100*time.Millisecond {
+		t.Fatalf("expect wait 100ms, waited %v", elapsed)
+	}
+
+	// 50 bytes every refill
+	r.SetBytesPerSecond(500)
+	start = clock.now()
+	r.Request(100, IOPriorityLow)
+	if elapsed := clock.now().Sub(start); elapsed != 200*time.Millisecond {
+		t.Fatalf("expect wait 200ms, waited %v", elapsed)
+	}
+	if got := r.BytesPerSecond(); got != 500 {
+		t.Fatalf("expect 500 bytes per second, got %d", got)
+	}
+}
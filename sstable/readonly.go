@@ -0,0 +1,144 @@
+package sstable
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// OpenReadOnly open the db without taking the LOCK, so it can be opened by multiple readers
+// while a primary process owns it. the manifest and journals are replayed into an in-memory
+// memtable, no file would be written, compaction and obsolete files removing never run,
+// Put and Delete return ErrReadOnly.
+func OpenReadOnly(dbpath string) (*DB, error) {
+	storage, err := OpenPathReadOnly(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	db := newDB(storage, nil)
+	db.readOnly = true
+
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+
+	if err = db.recoverReadOnly(); err != nil {
+		_ = storage.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// recoverReadOnly same as recover, but the journals are only replayed into mem
+// required: mutex held
+func (db *DB) recoverReadOnly() error {
+
+	manifestFd, err := db.VersionSet.storage.GetCurrent()
+	if err != nil {
+		return err
+	}
+
+	if err = db.VersionSet.recover(manifestFd); err != nil {
+		return err
+	}
+
+	db.seqNum = db.VersionSet.stSeqNum
+
+	fds, err := db.VersionSet.storage.List()
+	if err != nil {
+		return err
+	}
+
+	var expectedFiles = make(map[Fd]struct{})
+	db.VersionSet.addLiveFiles(expectedFiles)
+
+	logFiles := make([]Fd, 0)
+
+	for _, fd := range fds {
+		if fd.FileType == KTableFile {
+			delete(expectedFiles, fd)
+		} else if fd.FileType == KJournalFile && fd.Num >= db.VersionSet.stJournalNum {
+			logFiles = append(logFiles, fd)
+		}
+	}
+
+	if len(expectedFiles) > 0 {
+		return NewErrCorruption("invalid table file, file not exists")
+	}
+
+	sort.Slice(logFiles, func(i, j int) bool {
+		return logFiles[i].Num < logFiles[j].Num
+	})
+
+	mem := NewMemTable(0, db.VersionSet.cmp)
+	mem.Ref()
+	db.mem = mem
+
+	for _, logFile := range logFiles {
+		if _, err = db.replayJournal(logFile, mem, 0); err != nil {
+			return err
+		}
+		db.journalFd = logFile
+	}
+
+	return nil
+}
+
+// replayJournal insert the batches in journal from offset into mem.
+// the unfinished record at the tail is being written by primary or torn, replaying stops before it.
+// return the end of the last complete record, the next replay resumes from it
+// required: mutex held
+func (db *DB) replayJournal(fd Fd, mem *MemDB, offset int64) (next int64, err error) {
+
+	next = offset
+	reader, err := db.VersionSet.storage.Open(fd)
+	if err != nil {
+		return
+	}
+	journalReader := newJournalReaderAt(reader, offset)
+	defer func() {
+		_ = journalReader.Close()
+		_ = reader.Close()
+	}()
+
+	for {
+		chunkReader, cErr := journalReader.NextChunk()
+		if cErr == io.EOF {
+			break
+		}
+		if cErr != nil {
+			err = cErr
+			return
+		}
+
+		writeBatch, bErr := buildBatchGroup(chunkReader, db.VersionSet.stSeqNum)
+		if _, err = ioutil.ReadAll(chunkReader); err != nil {
+			return
+		}
+		if journalReader.partial {
+			break
+		}
+		if bErr != nil {
+			err = bErr
+			return
+		}
+
+		if writeBatch.stale(db.VersionSet.stSeqNum) {
+			next = journalReader.offset()
+			continue
+		}
+
+		// only the default family is opened
+		if err = writeBatch.insertInto(map[uint32]*MemDB{kDefaultColumnFamilyID: mem}); err != nil {
+			return
+		}
+
+		if lastSeq := writeBatch.nextSequence() - 1; lastSeq > db.seqNum {
+			db.seqNum = lastSeq
+		}
+		next = journalReader.offset()
+	}
+
+	return
+}
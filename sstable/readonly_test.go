@@ -0,0 +1,58 @@
+package sstable
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	// the first keys are flushed into table, the others are only in journal
+	putTestKeys(t, db, 100)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 200; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the LOCK is held by primary
+	if _, err := Open(dir); err == nil {
+		t.Fatal("expect the locked db not opened")
+	}
+
+	rdb, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = rdb.Close()
+	}()
+
+	checkTestKeys(t, rdb, 200)
+	if got := rdb.LatestSequence(); got != db.LatestSequence() {
+		t.Fatalf("expect sequence %d, got %d", db.LatestSequence(), got)
+	}
+
+	if err := rdb.Put([]byte("k"), []byte("v")); err != ErrReadOnly {
+		t.Fatalf("expect put rejected, got %v", err)
+	}
+	if err := rdb.Delete([]byte("k0000")); err != ErrReadOnly {
+		t.Fatalf("expect delete rejected, got %v", err)
+	}
+	if err := rdb.Compact(); err != ErrReadOnly {
+		t.Fatalf("expect compact rejected, got %v", err)
+	}
+	checkTestKeys(t, rdb, 200)
+}
@@ -0,0 +1,723 @@
+package sstable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+replication, the primary streams the journal records to the replicas over tcp
+
+	replica                                   primary
+	   | -- stream(seq = latest + 1) -------->  |
+	   | <------------- batch(seq, contents) -- |  GetUpdatesSince(seq)
+	   | <------------- batch(seq, contents) -- |
+	   | <------------- ingest(seq) ----------- |  the files ingested at seq, which are not in journal
+	   | <------------- heartbeat(latest) ----- |  no more batches, poll again later
+	   | <------------- too far behind -------- |  the journal of seq has been removed
+
+	   | -- checkpoint ---------------------->  |  Checkpoint into a tmp dir
+	   | <------------- file(name, data) ------ |
+	   | <------------- checkpoint end -------- |
+
+	frame: | kind (1 byte) | seq (8 bytes) | payload len (4 bytes) | payload | crc32 of the previous fields (4 bytes) |
+
+	the replica applies the batches in order with the sequences of primary, so it must not be written by others.
+	a replica missing the data only in tables of primary, i.e. too far behind, files ingested, or a sequence gap,
+	is rebuilt by FetchCheckpoint and streams again from the sequence of checkpoint
+**/
+
+const (
+	frameStream byte = iota + 1
+	frameCheckpoint
+	frameBatch
+	frameHeartbeat
+	frameTooFarBehind
+	frameFile
+	frameCheckpointEnd
+	frameError
+	frameIngest
+)
+
+const (
+	frameHeaderSize     = 13
+	frameMaxPayloadSize = 1 << 30
+
+	replicationPollInterval   = 100 * time.Millisecond
+	replicationReadTimeout    = 10 * time.Second
+	replicationFileChunkSize  = 64 << 10
+	replicationCheckpointName = "checkpoint"
+)
+
+func writeFrame(w io.Writer, kind byte, seq Sequence, payload []byte) error {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload)+4)
+	frame[0] = kind
+	binary.LittleEndian.PutUint64(frame[1:9], uint64(seq))
+	binary.LittleEndian.PutUint32(frame[9:13], uint32(len(payload)))
+	frame = append(frame, payload...)
+	checksum := crc32.ChecksumIEEE(frame)
+	frame = frame[:len(frame)+4]
+	binary.LittleEndian.PutUint32(frame[len(frame)-4:], checksum)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) (kind byte, seq Sequence, payload []byte, err error) {
+
+	header := make([]byte, frameHeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	size := binary.LittleEndian.Uint32(header[9:13])
+	if size > frameMaxPayloadSize {
+		err = fmt.Errorf("%w, payload size %d", ErrReplicationProtocol, size)
+		return
+	}
+
+	body := make([]byte, size+4)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	payload = body[:size]
+
+	checksum := crc32.NewIEEE()
+	_, _ = checksum.Write(header)
+	_, _ = checksum.Write(payload)
+	if checksum.Sum32() != binary.LittleEndian.Uint32(body[size:]) {
+		err = fmt.Errorf("%w, frame checksum mismatch", ErrReplicationProtocol)
+		return
+	}
+
+	return header[0], Sequence(binary.LittleEndian.Uint64(header[1:9])), payload, nil
+}
+
+// ReplicationPrimary serve the journal records of db to the replicas
+type ReplicationPrimary struct {
+	db       *DB
+	listener net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// ServeReplication listen on addr, e.g. "127.0.0.1:0", and serve the replicas until Close called
+// the streams hold the UpdatesIterators of db, close the primary before closing db
+func ServeReplication(db *DB, addr string) (*ReplicationPrimary, error) {
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ReplicationPrimary{
+		db:       db,
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	p.wg.Add(1)
+	go p.accept()
+	return p, nil
+}
+
+// Addr the listened address
+func (p *ReplicationPrimary) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+// Close stop listening and disconnect the replicas
+func (p *ReplicationPrimary) Close() error {
+
+	p.mu.Lock()
+	select {
+	case <-p.closed:
+		p.mu.Unlock()
+		return nil
+	default:
+	}
+	close(p.closed)
+	err := p.listener.Close()
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return err
+}
+
+func (p *ReplicationPrimary) accept() {
+	defer p.wg.Done()
+
+	logger := p.db.VersionSet.logger()
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			select {
+			case <-p.closed:
+			default:
+				logger.Warnf("replication accept failed, err=%v", err)
+			}
+			return
+		}
+
+		p.mu.Lock()
+		select {
+		case <-p.closed:
+			p.mu.Unlock()
+			_ = conn.Close()
+			return
+		default:
+		}
+		p.conns[conn] = struct{}{}
+		p.wg.Add(1)
+		p.mu.Unlock()
+
+		go p.serve(conn)
+	}
+}
+
+func (p *ReplicationPrimary) serve(conn net.Conn) {
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+		_ = conn.Close()
+		p.wg.Done()
+	}()
+
+	logger := p.db.VersionSet.logger()
+
+	kind, seq, _, err := readFrame(conn)
+	if err != nil {
+		logger.Warnf("replication read request from %s failed, err=%v", conn.RemoteAddr(), err)
+		return
+	}
+
+	w := bufio.NewWriter(conn)
+	switch kind {
+	case frameStream:
+		logger.Infof("replication stream to %s since %d", conn.RemoteAddr(), seq)
+		err = p.stream(w, seq)
+	case frameCheckpoint:
+		logger.Infof("replication checkpoint to %s", conn.RemoteAddr())
+		err = p.sendCheckpoint(w)
+	default:
+		err = fmt.Errorf("%w, unknown request %d", ErrReplicationProtocol, kind)
+	}
+
+	if err != nil {
+		select {
+		case <-p.closed:
+			return
+		default:
+		}
+		logger.Warnf("replication to %s stopped, err=%v", conn.RemoteAddr(), err)
+		if writeFrame(w, frameError, 0, []byte(err.Error())) == nil {
+			_ = w.Flush()
+		}
+	}
+}
+
+// stream send the batches since seq, then poll the new batches and send heartbeat when caught up.
+// the iterator is kept and refreshed, so each poll continues from the journal offset of the last batch sent
+func (p *ReplicationPrimary) stream(w *bufio.Writer, seq Sequence) error {
+
+	it, err := p.db.GetUpdatesSince(seq)
+	if err == ErrUpdatesPurged {
+		if err := writeFrame(w, frameTooFarBehind, seq, nil); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	defer it.UnRef()
+
+	for {
+		for it.Next() {
+			batch := it.Batch()
+			if batch.nextSequence() <= seq {
+				continue
+			}
+			if batch.ingestMarker() {
+				err = writeFrame(w, frameIngest, it.Sequence(), nil)
+			} else {
+				err = writeFrame(w, frameBatch, it.Sequence(), batch.Data())
+			}
+			if err != nil {
+				break
+			}
+			seq = batch.nextSequence()
+		}
+		if err == nil {
+			err = it.Valid()
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := writeFrame(w, frameHeartbeat, p.db.LatestSequence(), nil); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		select {
+		case <-p.closed:
+			return nil
+		case <-time.After(replicationPollInterval):
+		}
+
+		if err = it.Refresh(); err != nil {
+			return err
+		}
+	}
+}
+
+// sendCheckpoint create a checkpoint of db and send its files
+func (p *ReplicationPrimary) sendCheckpoint(w *bufio.Writer) error {
+
+	tmpDir, err := ioutil.TempDir("", "replication")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dir := path.Join(tmpDir, replicationCheckpointName)
+	if err := p.db.Checkpoint(dir); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, replicationFileChunkSize)
+	for _, file := range files {
+		if file.IsDir() || file.Name() == "LOCK" {
+			continue
+		}
+		if err := sendFile(w, path.Join(dir, file.Name()), file.Name(), buf); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFrame(w, frameCheckpointEnd, 0, nil); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// sendFile send the file in chunks, payload: | name len (uvarint) | name | data |
+func sendFile(w io.Writer, filePath, name string, buf []byte) error {
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	prefix := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(name)+len(buf))
+	prefix = append(prefix[:binary.PutUvarint(prefix, uint64(len(name)))], name...)
+
+	for first := true; ; first = false {
+		n, rErr := io.ReadFull(f, buf)
+		if n > 0 || first {
+			// an empty file is sent as an empty chunk
+			if err := writeFrame(w, frameFile, 0, append(prefix, buf[:n]...)); err != nil {
+				return err
+			}
+		}
+		if rErr == io.EOF || rErr == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if rErr != nil {
+			return rErr
+		}
+	}
+}
+
+// FetchCheckpoint copy a checkpoint of the primary into dir, which could be opened as a new replica
+func FetchCheckpoint(addr, dir string) (err error) {
+
+	if _, sErr := os.Stat(dir); sErr == nil {
+		return ErrDirExists
+	} else if !os.IsNotExist(sErr) {
+		return sErr
+	}
+
+	tmpDir := dir + ".tmp"
+	if err = os.RemoveAll(tmpDir); err != nil {
+		return
+	}
+	if err = os.MkdirAll(tmpDir, 0755); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(tmpDir)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if err = writeFrame(conn, frameCheckpoint, 0, nil); err != nil {
+		return
+	}
+
+	var (
+		r    = bufio.NewReader(conn)
+		f    *os.File
+		name string
+	)
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+		}
+	}()
+
+	for {
+		kind, _, payload, rErr := readFrame(r)
+		if rErr != nil {
+			return rErr
+		}
+
+		switch kind {
+		case frameFile:
+			fileName, data, pErr := parseFilePayload(payload)
+			if pErr != nil {
+				return pErr
+			}
+			if f == nil || fileName != name {
+				if f != nil {
+					if err = f.Close(); err != nil {
+						return
+					}
+				}
+				if f, err = os.Create(path.Join(tmpDir, fileName)); err != nil {
+					return
+				}
+				name = fileName
+			}
+			if _, err = f.Write(data); err != nil {
+				return
+			}
+		case frameCheckpointEnd:
+			if f != nil {
+				err = f.Close()
+				f = nil
+				if err != nil {
+					return
+				}
+			}
+			return os.Rename(tmpDir, dir)
+		case frameError:
+			return fmt.Errorf("%w, primary: %s", ErrReplicationProtocol, payload)
+		default:
+			return fmt.Errorf("%w, unexpected frame %d", ErrReplicationProtocol, kind)
+		}
+	}
+}
+
+func parseFilePayload(payload []byte) (name string, data []byte, err error) {
+	n, m := binary.Uvarint(payload)
+	if m <= 0 || n > uint64(len(payload)-m) {
+		err = fmt.Errorf("%w, invalid file frame", ErrReplicationProtocol)
+		return
+	}
+	name = string(payload[m : m+int(n)])
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		err = fmt.Errorf("%w, invalid file name %q", ErrReplicationProtocol, name)
+		return
+	}
+	return name, payload[m+int(n):], nil
+}
+
+// Replica apply the batches streamed from the primary to the db in dir
+type Replica struct {
+	dir  string
+	addr string
+	opt  *Options
+
+	// db is replaced when bootstrapped from a checkpoint, conn is replaced when reconnected
+	mu      sync.Mutex
+	db      *DB
+	conn    net.Conn
+	stopped bool
+
+	primarySeq uint64 // atomic, the latest sequence of primary known
+
+	done chan struct{}
+	err  error
+}
+
+// StartReplica open the db in dir and apply the batches of the primary at addr after its latest sequence in background.
+// the db is bootstrapped from a checkpoint of primary if it doesn't exist, it's too far behind,
+// or the primary ingested files, which are not in the journal.
+// the db must not be written by others, read it by DB, see Stop and Err
+func StartReplica(dir, addr string, opt *Options) (*Replica, error) {
+
+	r := &Replica{
+		dir:  dir,
+		addr: addr,
+		opt:  opt,
+		done: make(chan struct{}),
+	}
+
+	if _, err := os.Stat(path.Join(dir, Fd{FileType: KCurrentFile}.String())); os.IsNotExist(err) {
+		if err = r.bootstrap(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if r.db, err = OpenWithOptions(dir, opt); err != nil {
+		return nil, err
+	}
+
+	r.primarySeq = uint64(r.db.LatestSequence())
+	conn, reader, err := r.connect()
+	if err != nil {
+		_ = r.db.Close()
+		return nil, err
+	}
+	go r.run(conn, reader)
+	return r, nil
+}
+
+// connect request the batches after the latest sequence of db
+func (r *Replica) connect() (net.Conn, *bufio.Reader, error) {
+
+	conn, err := net.Dial("tcp", r.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		_ = conn.Close()
+		return nil, nil, net.ErrClosed
+	}
+	r.conn = conn
+	seq := r.db.LatestSequence()
+	r.mu.Unlock()
+
+	if err := writeFrame(conn, frameStream, seq+1, nil); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, bufio.NewReader(conn), nil
+}
+
+// bootstrap replace the db in dir with a checkpoint of primary, the old db is readable until replaced
+func (r *Replica) bootstrap() error {
+
+	tmpDir := r.dir + ".bootstrap"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := FetchCheckpoint(r.addr, tmpDir); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		_ = os.RemoveAll(tmpDir)
+		return net.ErrClosed
+	}
+	if r.db != nil {
+		if err := r.db.Close(); err != nil {
+			return err
+		}
+	}
+
+	oldDir := r.dir + ".old"
+	if err := os.RemoveAll(oldDir); err != nil {
+		return err
+	}
+	if err := os.Rename(r.dir, oldDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmpDir, r.dir); err != nil {
+		return err
+	}
+	_ = os.RemoveAll(oldDir)
+
+	db, err := OpenWithOptions(r.dir, r.opt)
+	if err != nil {
+		return err
+	}
+	r.db = db
+	return nil
+}
+
+// run apply the frames until stopped, db is only replaced by run, so it's read without mutex here
+func (r *Replica) run(conn net.Conn, reader *bufio.Reader) {
+	defer close(r.done)
+
+	// the bootstraps without any progress, the replica still behind after bootstrapped gives up
+	bootstraps := 0
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(replicationReadTimeout))
+		kind, seq, payload, err := readFrame(reader)
+		if err != nil {
+			r.err = err
+			return
+		}
+
+		// the data missed by the replica, which is only in the tables of primary
+		var missed error
+
+		switch kind {
+		case frameBatch:
+			batch, dErr := NewWriteBatchFromContents(payload)
+			if dErr != nil {
+				r.err = dErr
+				return
+			}
+			if batch.seq != seq {
+				r.err = fmt.Errorf("%w, batch sequence %d of frame %d", ErrReplicationProtocol, batch.seq, seq)
+				return
+			}
+			if err := r.db.writeReplicated(batch); errors.Is(err, ErrReplicationGap) {
+				missed = err
+			} else if err != nil {
+				r.err = err
+				return
+			} else {
+				bootstraps = 0
+				r.updatePrimarySeq(batch.nextSequence() - 1)
+			}
+		case frameIngest:
+			if seq > r.db.LatestSequence() {
+				missed = fmt.Errorf("files ingested at %d", seq)
+			} else {
+				r.updatePrimarySeq(seq)
+			}
+		case frameHeartbeat:
+			bootstraps = 0
+			r.updatePrimarySeq(seq)
+		case frameTooFarBehind:
+			missed = fmt.Errorf("%w, sequence %d", ErrReplicaTooFarBehind, seq)
+		case frameError:
+			r.err = fmt.Errorf("%w, primary: %s", ErrReplicationProtocol, payload)
+			return
+		default:
+			r.err = fmt.Errorf("%w, unexpected frame %d", ErrReplicationProtocol, kind)
+			return
+		}
+
+		if missed == nil {
+			continue
+		}
+		if bootstraps++; bootstraps > 1 {
+			r.err = missed
+			return
+		}
+		r.db.VersionSet.logger().Infof("replica bootstrap from checkpoint of %s, reason=%v", r.addr, missed)
+		_ = conn.Close()
+		if err := r.bootstrap(); err != nil {
+			r.err = err
+			return
+		}
+		if conn, reader, err = r.connect(); err != nil {
+			r.err = err
+			return
+		}
+	}
+}
+
+func (r *Replica) updatePrimarySeq(seq Sequence) {
+	for {
+		old := atomic.LoadUint64(&r.primarySeq)
+		if uint64(seq) <= old || atomic.CompareAndSwapUint64(&r.primarySeq, old, uint64(seq)) {
+			return
+		}
+	}
+}
+
+// DB the replica db, it's replaced and the old one is closed when bootstrapped from a checkpoint
+func (r *Replica) DB() *DB {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.db
+}
+
+// Lag the number of sequences the replica is behind the primary, as of the last heartbeat
+func (r *Replica) Lag() Sequence {
+	primarySeq := Sequence(atomic.LoadUint64(&r.primarySeq))
+	seq := r.DB().LatestSequence()
+	if primarySeq <= seq {
+		return 0
+	}
+	return primarySeq - seq
+}
+
+// Done closed when the replica stopped, see Err
+func (r *Replica) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err the reason why replica stopped, e.g. ErrReplicaTooFarBehind if it's still behind after bootstrapped
+func (r *Replica) Err() error {
+	<-r.done
+	return r.err
+}
+
+// Stop disconnect the primary, wait the applying batch finished and close the db
+func (r *Replica) Stop() error {
+	r.mu.Lock()
+	r.stopped = true
+	if r.conn != nil {
+		_ = r.conn.Close()
+	}
+	r.mu.Unlock()
+
+	<-r.done
+	return r.DB().Close()
+}
+
+// writeReplicated write the batch with the sequence assigned by primary,
+// the batches already applied are skipped, ErrReplicationGap is returned if any batch is missed
+func (db *DB) writeReplicated(batch *WriteBatch) error {
+
+	seq := batch.seq
+	if seq+Sequence(batch.Len()) <= db.LatestSequence()+1 {
+		return nil
+	}
+
+	return db.writeWithCheck(batch, func() error {
+		// write assigns the sequence after the latest one
+		if seq != db.seqNum+1 {
+			return fmt.Errorf("%w, batch sequence %d, latest %d", ErrReplicationGap, seq, db.seqNum)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,205 @@
+package sstable
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// newPrimaryDB a db with journals of batches (1, 2) (3, 1) (4, 3) (7, 1)
+func newPrimaryDB(t *testing.T) (*DB, *journalStorage) {
+	js := &journalStorage{files: make(map[Fd]*memWriter), modTimes: make(map[Fd]time.Time)}
+	js.writeJournal(t, 5, [2]int{1, 2}, [2]int{3, 1})
+	js.writeJournal(t, 8, [2]int{4, 3}, [2]int{7, 1})
+	db := newDB(js, nil)
+	db.seqNum = 7
+	return db, js
+}
+
+func TestReplicationStream(t *testing.T) {
+
+	db, _ := newPrimaryDB(t)
+	p, err := ServeReplication(db, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeFrame(conn, frameStream, 5, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	for _, expect := range []struct {
+		kind  byte
+		seq   Sequence
+		count int
+	}{
+		{frameBatch, 4, 3},
+		{frameBatch, 7, 1},
+		{frameHeartbeat, 7, 0},
+	} {
+		kind, seq, payload, err := readFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != expect.kind || seq != expect.seq {
+			t.Fatalf("expect frame %d at %d, got %d at %d", expect.kind, expect.seq, kind, seq)
+		}
+		if kind != frameBatch {
+			continue
+		}
+		batch, err := NewWriteBatchFromContents(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch.seq != seq || batch.Len() != expect.count {
+			t.Fatalf("expect %d records at %d, got %d at %d", expect.count, seq, batch.Len(), batch.seq)
+		}
+	}
+}
+
+// waitReplicated wait the replica caught up with the primary and has the keys [0, n)
+func waitReplicated(t *testing.T, r *Replica, db *DB, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for r.DB().LatestSequence() != db.LatestSequence() {
+		select {
+		case <-r.Done():
+			t.Fatalf("replica stopped, err=%v", r.Err())
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect replica at %d, got %d", db.LatestSequence(), r.DB().LatestSequence())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkTestKeys(t, r.DB(), n)
+}
+
+func TestReplicaLag(t *testing.T) {
+
+	db, js := newPrimaryDB(t)
+	p, err := ServeReplication(db, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// the replica has applied all the batches in journals, the primary is 2 sequences ahead
+	db.seqNum = 9
+	r := &Replica{db: newDB(&journalStorage{}, nil), addr: p.Addr().String(), done: make(chan struct{})}
+	r.db.seqNum = 7
+	conn, reader, err := r.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.run(conn, reader)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Lag() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect lag 2, got %d", r.Lag())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = r.conn.Close()
+	<-r.done
+
+	// the journal of sequence 1 has been removed, the replica must be bootstrapped from a checkpoint
+	delete(js.files, Fd{FileType: KJournalFile, Num: 5})
+	if conn, err = net.Dial("tcp", p.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeFrame(conn, frameStream, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if kind, seq, _, err := readFrame(bufio.NewReader(conn)); err != nil || kind != frameTooFarBehind || seq != 1 {
+		t.Fatalf("expect too far behind at 1, got %d at %d, %v", kind, seq, err)
+	}
+}
+
+func TestReplicaBootstrap(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := Open(path.Join(dir, "primary"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ServeReplication(db, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = p.Close()
+		_ = db.Close()
+	}()
+	putTestKeys(t, db, 100)
+
+	// the new replica is bootstrapped from a checkpoint, then streams the batches after it
+	replicaDir := path.Join(dir, "replica")
+	r, err := StartReplica(replicaDir, p.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("k0100"), []byte("v0100")); err != nil {
+		t.Fatal(err)
+	}
+	waitReplicated(t, r, db, 101)
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the journals of the batches missed by the stopped replica are removed after flushed
+	putTestKeys(t, db, 200)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = StartReplica(replicaDir, p.Addr().String(), nil); err != nil {
+		t.Fatal(err)
+	}
+	waitReplicated(t, r, db, 200)
+
+	// the ingested keys are not in journal, the running replica is bootstrapped again
+	f := path.Join(dir, "1.sst")
+	writeSstFile(t, f, 200, 300, "v")
+	if err := db.IngestExternalFile([]string{f}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("k0300"), []byte("v0300")); err != nil {
+		t.Fatal(err)
+	}
+	waitReplicated(t, r, db, 301)
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(replicaDir + ".old"); !os.IsNotExist(err) {
+		t.Fatalf("expect the replaced db removed, got %v", err)
+	}
+}
+
+func TestReplicationFrameCorrupted(t *testing.T) {
+
+	w := &memWriter{}
+	if err := writeFrame(w, frameBatch, 3, []byte("batch")); err != nil {
+		t.Fatal(err)
+	}
+	p := w.Bytes()
+	p[frameHeaderSize] ^= 1
+	if _, _, _, err := readFrame(bytes.NewReader(p[:frameHeaderSize])); err == nil {
+		t.Fatal("expect error of truncated frame")
+	}
+	if _, _, _, err := readFrame(bytes.NewReader(p)); !errors.Is(err, ErrReplicationProtocol) {
+		t.Fatalf("expect checksum mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package sstable
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+type secondaryState struct {
+	// manifest tailing cursor, the end of the last applied edit
+	manifestFd     Fd
+	manifestOffset int64
+
+	// the start journal num when mem is built, mem is rebuilt after primary flushes journals into table
+	journalNum     uint64
+	journalOffsets map[uint64]int64
+}
+
+// OpenAsSecondary open the db as a secondary instance without taking the LOCK.
+// secondary is read only, call TryCatchUpWithPrimary periodically to see the new writes of primary.
+func OpenAsSecondary(dbpath string) (*DB, error) {
+	storage, err := OpenPathReadOnly(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	db := newDB(storage, nil)
+	db.readOnly = true
+	db.secondary = &secondaryState{
+		journalOffsets: make(map[uint64]int64),
+	}
+
+	if err = db.TryCatchUpWithPrimary(); err != nil {
+		_ = storage.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// TryCatchUpWithPrimary apply the new version edits in current manifest and the new
+// records in journals written by primary since last call
+func (db *DB) TryCatchUpWithPrimary() error {
+
+	if db.secondary == nil {
+		return ErrNotSecondary
+	}
+
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+
+	if err := db.catchUpManifest(); err != nil {
+		return err
+	}
+
+	return db.catchUpJournals()
+}
+
+// required: mutex held
+func (db *DB) catchUpManifest() error {
+
+	var (
+		st   = db.secondary
+		vSet = db.VersionSet
+		base = vSet.current
+	)
+
+	manifestFd, err := vSet.storage.GetCurrent()
+	if err != nil {
+		return err
+	}
+
+	// primary rolled a new manifest, it starts with a full snapshot so rebuild from it
+	if manifestFd != st.manifestFd || base == nil {
+		base = nil
+		st.manifestFd = manifestFd
+		st.manifestOffset = 0
+	}
+
+	reader, err := vSet.storage.Open(manifestFd)
+	if err != nil {
+		return err
+	}
+	journalReader := newJournalReaderAt(reader, st.manifestOffset)
+	defer func() {
+		_ = journalReader.Close()
+		_ = reader.Close()
+	}()
+
+	var (
+		edits  []VersionEdit
+		offset = st.manifestOffset
+	)
+
+	for {
+		chunkReader, cErr := journalReader.NextChunk()
+		if cErr == io.EOF {
+			break
+		}
+		if cErr != nil {
+			return cErr
+		}
+
+		var edit VersionEdit
+		edit.DecodeFrom(chunkReader)
+		if _, err = ioutil.ReadAll(chunkReader); err != nil {
+			return err
+		}
+		if journalReader.partial {
+			// the record is being written by primary, pick it up next time
+			break
+		}
+		if edit.err != nil {
+			return edit.err
+		}
+
+		if edit.comparerName != nil && bytes.Compare(edit.comparerName, vSet.cmp.Name()) != 0 {
+			return NewErrCorruption("invalid comparator")
+		}
+
+		edits = append(edits, edit)
+		offset = journalReader.offset()
+	}
+
+	if len(edits) == 0 && base != nil {
+		return nil
+	}
+
+	v := newVersion(vSet)
+	if base != nil {
+		v.levels = base.levels
+	}
+
+	// the edits of the non default families are applied to their own versions like recover,
+	// the families are rebuilt from the snapshot of a new manifest
+	if base == nil {
+		vSet.families = make(map[uint32]*VersionSet)
+	}
+	familyBuilders := make(map[uint32]*vBuilder)
+	for id, family := range vSet.families {
+		familyBuilders[id] = newBuilder(family, family.current)
+	}
+
+	builder := newBuilder(vSet, base)
+	for i := range edits {
+		edit := &edits[i]
+		if edit.hasRec(kColumnFamily) && edit.familyID != kDefaultColumnFamilyID {
+			if err = vSet.recoverFamilyEdit(edit, familyBuilders); err != nil {
+				return err
+			}
+			continue
+		}
+
+		builder.apply(*edit)
+		if edit.journalNum > vSet.stJournalNum {
+			vSet.stJournalNum = edit.journalNum
+		}
+		if edit.lastSeq > vSet.stSeqNum {
+			vSet.stSeqNum = edit.lastSeq
+		}
+		if edit.nextFileNum > 0 {
+			vSet.markFileUsed(edit.nextFileNum)
+		}
+	}
+	builder.saveTo(v)
+	finalize(v)
+	vSet.appendVersion(v)
+	vSet.manifestFd = manifestFd
+
+	for id, familyBuilder := range familyBuilders {
+		family := vSet.families[id]
+		fv := newVersion(family)
+		familyBuilder.saveTo(fv)
+		finalize(fv)
+		family.appendVersion(fv)
+	}
+
+	st.manifestOffset = offset
+	return nil
+}
+
+// required: mutex held
+func (db *DB) catchUpJournals() error {
+
+	var (
+		st   = db.secondary
+		vSet = db.VersionSet
+	)
+
+	// the journals before stJournalNum are flushed into tables by primary, rebuild mem
+	if db.mem == nil || st.journalNum != vSet.stJournalNum {
+		if db.mem != nil {
+			db.mem.UnRef()
+		}
+		mem := NewMemTable(0, vSet.cmp)
+		mem.Ref()
+		db.mem = mem
+		st.journalNum = vSet.stJournalNum
+		st.journalOffsets = make(map[uint64]int64)
+	}
+
+	if db.seqNum < vSet.stSeqNum {
+		db.seqNum = vSet.stSeqNum
+	}
+
+	fds, err := vSet.storage.List()
+	if err != nil {
+		return err
+	}
+
+	logFiles := make([]Fd, 0)
+	for _, fd := range fds {
+		if fd.FileType == KJournalFile && fd.Num >= vSet.stJournalNum {
+			logFiles = append(logFiles, fd)
+		}
+	}
+
+	sort.Slice(logFiles, func(i, j int) bool {
+		return logFiles[i].Num < logFiles[j].Num
+	})
+
+	for _, logFile := range logFiles {
+		offset, rErr := db.replayJournal(logFile, db.mem, st.journalOffsets[logFile.Num])
+		if rErr != nil {
+			return rErr
+		}
+		st.journalOffsets[logFile.Num] = offset
+		db.journalFd = logFile
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package sstable
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSecondaryCatchUp(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%04d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(0, 100)
+
+	secondary, err := OpenAsSecondary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+
+	check := func(n int) {
+		if err := secondary.TryCatchUpWithPrimary(); err != nil {
+			t.Fatal(err)
+		}
+		checkTestKeys(t, secondary, n)
+		if _, err := secondary.Get([]byte(fmt.Sprintf("k%04d", n))); err != ErrNotFound {
+			t.Fatalf("expect k%04d not found, got %v", n, err)
+		}
+	}
+	check(100)
+
+	// tail the same journal
+	put(100, 200)
+	check(200)
+
+	// primary flushes the journal into table and writes new edits
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(200)
+	put(200, 300)
+	check(300)
+
+	// an unfinished record at the tail of journal is not replayed until it's completed
+	f, err := os.OpenFile(path.Join(dir, secondary.journalFd.String()), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &memWriter{}
+	jw := NewJournalWriter(w)
+	jw.blockOffset = int(stat.Size() % kJournalBlockSize)
+	if _, err = jw.Write(make([]byte, 2*kJournalBlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write(w.Bytes()[:kJournalBlockSize]); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	check(300)
+}
+
+func TestSecondaryColumnFamilyFlush(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	index, err := db.CreateColumnFamily("index", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestKeys(t, db, 100)
+	if err = db.PutCF(index, []byte("family-only"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	secondary, err := OpenAsSecondary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+
+	// only the family is flushed, the default keys are still in the old journal
+	db.rwMutex.Lock()
+	w := db.waitForWriteTurn()
+	err = db.switchMemTable()
+	if err == nil {
+		err = db.flushColumnFamilies()
+	}
+	db.finishWriteTurn(w)
+	db.rwMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		if err := secondary.TryCatchUpWithPrimary(); err != nil {
+			t.Fatal(err)
+		}
+		checkTestKeys(t, secondary, 100)
+		if _, err := secondary.Get([]byte("family-only")); err != ErrNotFound {
+			t.Fatalf("expect the family table not in default family, got %v", err)
+		}
+		family, ok := secondary.VersionSet.families[index.ID()]
+		if !ok || family.levelFilesNum(0) != 1 {
+			t.Fatal("expect the family table applied to the family")
+		}
+	}
+	check()
+
+	db.rwMutex.Lock()
+	db.MaybeScheduleCompaction()
+	db.rwMutex.Unlock()
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
@@ -7,37 +7,40 @@ import (
 
 const (
 	kMaxHeight = 12
-	p          = 1 / 4
 	kBranching = 4
 )
 
+// SkipList the keys and values are appended into kvData, the nodes keep the offsets.
+// the writes are serialized by rw, the readers hold the read lock
 type SkipList struct {
 	*BasicReleaser
-	level          int8
-	rand           *rand.Rand
-	seed           int64
-	dummyHead      *skipListNode
-	tail           *skipListNode
-	kvData         []byte
-	length         int
-	kvSize         int
-	rw             sync.RWMutex
-	updatesScratch [kMaxHeight]*skipListNode
+	level     int8
+	rand      *rand.Rand
+	seed      int64
+	dummyHead *skipListNode
+	tail      *skipListNode
+	kvData    []byte
+	length    int
+	kvSize    int
+	rw        sync.RWMutex
 
 	BasicComparer
 }
 
 func NewSkipList(seed int64, capacity int, cmp BasicComparer) *SkipList {
 	skl := &SkipList{
+		BasicReleaser: &BasicReleaser{},
 		rand:          rand.New(rand.NewSource(seed)),
 		seed:          seed,
-		dummyHead:     &skipListNode{},
+		dummyHead:     newSkipListNode(kMaxHeight),
 		kvData:        make([]byte, 0, capacity),
+		level:         1,
 		BasicComparer: cmp,
 	}
 	return skl
 }
 
+// Put insert the key, the value is replaced if key exists
 func (skl *SkipList) Put(key, value []byte) (err error) {
 	if skl.released() {
 		err = ErrReleased
@@ -45,77 +48,49 @@ func (skl *SkipList) Put(key, value []byte) (err error) {
 	}
 	skl.rw.Lock()
 	defer skl.rw.Unlock()
-	n := skl.dummyHead
-	for i := skl.level - 1; i >= 0; i-- {
-		for n.next(i) != nil && skl.Compare(n.next(i).key(skl.kvData), key) < 0 {
-			n = n.next(i)
-		}
-		skl.updatesScratch[i] = n
-	}
 
-	updates := skl.updatesScratch[:skl.level]
+	var updates [kMaxHeight]*skipListNode
+	skl.findLT(key, updates[:])
 
 	// if key exists, just update the value
-	if updates[0] != nil && skl.Compare(updates[0].next(0).key(skl.kvData), key) == 0 {
-
-		replaceNode := updates[0].next(0)
-
-		// just replace the old value
-		if replaceNode.valLen >= len(value) {
-			nodeKvData := skl.kvData[replaceNode.kvOffset+replaceNode.keyLen : replaceNode.kvOffset+replaceNode.keyLen+replaceNode.valLen]
-			m := copy(nodeKvData[:], value)
-			skl.kvSize += replaceNode.valLen - m
-			replaceNode.valLen = m
-			return
-		}
-
-		replaceNode.kvOffset = len(skl.kvData)
+	if next := updates[0].next(0); next != nil && skl.Compare(next.key(skl.kvData), key) == 0 {
+		skl.kvSize += len(value) - next.valLen
+		next.kvOffset = len(skl.kvData)
 		skl.kvData = append(skl.kvData, key...)
 		skl.kvData = append(skl.kvData, value...)
-		skl.kvSize += len(value) - replaceNode.valLen
-		replaceNode.valLen = len(value)
+		next.valLen = len(value)
 		return
 	}
 
 	level := skl.randLevel()
-
 	for i := skl.level; i < level; i++ {
 		updates[i] = skl.dummyHead
 	}
-
 	if level > skl.level {
 		skl.level = level
 	}
 
-	newNode := &skipListNode{
-		keyLen: len(key),
-		valLen: len(value),
-		level: skipListNodeLevel{
-			maxLevel: level,
-			next:     make([]*skipListNode, level),
-		},
-	}
-
-	for l := 0; l < len(updates); l++ {
-		updates[l].setNext(int8(l), newNode)
-	}
+	newNode := newSkipListNode(level)
+	newNode.keyLen = len(key)
+	newNode.valLen = len(value)
+	newNode.kvOffset = len(skl.kvData)
+	skl.kvData = append(skl.kvData, key...)
+	skl.kvData = append(skl.kvData, value...)
 
-	// update forward
-	updateNextLevel0 := newNode.next(0)
-	if updateNextLevel0 != nil {
-		updateNextLevel0.backward = newNode
-	} else {
-		skl.tail = updateNextLevel0
+	for i := int8(0); i < level; i++ {
+		newNode.setNext(i, updates[i].next(i))
+		updates[i].setNext(i, newNode)
 	}
 
 	if updates[0] != skl.dummyHead {
 		newNode.backward = updates[0]
 	}
+	if next := newNode.next(0); next != nil {
+		next.backward = newNode
+	} else {
+		skl.tail = newNode
+	}
 
-	newNode.kvOffset = len(skl.kvData)
-
-	skl.kvData = append(skl.kvData, key...)
-	skl.kvData = append(skl.kvData, value...)
 	skl.kvSize += len(key) + len(value)
 	skl.length++
 	return
@@ -131,40 +106,28 @@ func (skl *SkipList) Del(key []byte) (updated bool, err error) {
 	skl.rw.Lock()
 	defer skl.rw.Unlock()
 
-	if skl.tail == nil || skl.dummyHead.next(0) == nil {
-		updated = false
-		return
-	}
+	var updates [kMaxHeight]*skipListNode
+	skl.findLT(key, updates[:])
 
-	updates := skl.findLT(key)
-
-	if skl.Compare(updates[0].next(0).key(skl.kvData), key) != 0 {
-		updated = false
+	foundNode := updates[0].next(0)
+	if foundNode == nil || skl.Compare(foundNode.key(skl.kvData), key) != 0 {
 		return
 	}
 
-	foundNode := updates[0].next(0)
-	for i := foundNode.level.maxLevel - 1; i >= 0; i-- {
-		updates[i].setNext(i, foundNode.next(0))
+	for i := int8(0); i < foundNode.level.maxLevel; i++ {
+		updates[i].setNext(i, foundNode.next(i))
 	}
 
 	// update skl level if is empty
-	var level = foundNode.level.maxLevel
-	for ; skl.dummyHead.next(level-1) == nil; level-- {
+	for skl.level > 1 && skl.dummyHead.next(skl.level-1) == nil {
+		skl.level--
 	}
-	skl.level = level
-
-	// update forward
-	prev := foundNode.backward
-	next := foundNode.next(0)
 
-	if next != nil {
-		if prev != nil {
-			next.backward = prev
-		}
+	// update backward
+	if next := foundNode.next(0); next != nil {
+		next.backward = foundNode.backward
 	} else {
-		// foundNode is the last one, so if prev is not null(prev not link dummy head)
-		skl.tail = prev
+		skl.tail = foundNode.backward
 	}
 
 	skl.length--
@@ -174,14 +137,19 @@ func (skl *SkipList) Del(key []byte) (updated bool, err error) {
 }
 
 func (skl *SkipList) Get(key []byte) ([]byte, error) {
-	if n, found, err := skl.FindGreaterOrEqual(key); err != nil {
+	n, found, err := skl.FindGreaterOrEqual(key)
+	if err != nil {
 		return nil, err
-	} else if found == true {
-		return n.value(skl.kvData), nil
 	}
-	return nil, ErrNotFound
+	if !found {
+		return nil, ErrNotFound
+	}
+	skl.rw.RLock()
+	defer skl.rw.RUnlock()
+	return n.value(skl.kvData), nil
 }
 
+// FindGreaterOrEqual the first node whose key >= key, found is true if the keys equal, nil if none
 func (skl *SkipList) FindGreaterOrEqual(key []byte) (*skipListNode, bool, error) {
 	if skl.released() {
 		return nil, false, ErrReleased
@@ -189,26 +157,34 @@ func (skl *SkipList) FindGreaterOrEqual(key []byte) (*skipListNode, bool, error)
 
 	skl.rw.RLock()
 	defer skl.rw.RUnlock()
+	n := skl.findGreaterOrEqual(key)
+	if n == nil {
+		return nil, false, nil
+	}
+	return n, skl.Compare(n.key(skl.kvData), key) == 0, nil
+}
+
+// required: rw held
+func (skl *SkipList) findGreaterOrEqual(key []byte) *skipListNode {
 	n := skl.dummyHead
-	var (
-		hitLevel int8 = -1
-	)
 	for i := skl.level - 1; i >= 0; i-- {
-		for ; n.next(i) != nil && skl.Compare(n.next(i).key(skl.kvData), key) < 0; n = n.next(i) {
-		}
-		if n.next(i) != nil && skl.Compare(n.next(i).key(skl.kvData), key) == 0 {
-			hitLevel = i
-			break
+		for next := n.next(i); next != nil && skl.Compare(next.key(skl.kvData), key) < 0; next = n.next(i) {
+			n = next
 		}
 	}
-	if hitLevel >= 0 { // case found
-		return n.next(hitLevel), true, nil
-	}
-	next := n.next(0)
-	if next != nil {
-		return next, false, nil
+	return n.next(0)
+}
+
+// findLT fill the last node whose key < key of each level into updates
+// required: rw held
+func (skl *SkipList) findLT(key []byte, updates []*skipListNode) {
+	n := skl.dummyHead
+	for i := skl.level - 1; i >= 0; i-- {
+		for next := n.next(i); next != nil && skl.Compare(next.key(skl.kvData), key) < 0; next = n.next(i) {
+			n = next
+		}
+		updates[i] = n
 	}
-	return nil, false, nil
 }
 
 func (skl *SkipList) Size() int {
@@ -229,10 +205,14 @@ func (skl *SkipList) NewIterator() Iterator {
 	skl.Ref()
 	sklIter := &SkipListIter{
 		skl: skl,
+		dir: dirSOI,
 	}
-	sklIter.OnClose = func() {
-		skl.UnRef()
+	sklIter.BasicReleaser = &BasicReleaser{
+		OnClose: func() {
+			skl.UnRef()
+		},
 	}
+	sklIter.Ref()
 	return sklIter
 }
 
@@ -240,7 +220,6 @@ type SkipListIter struct {
 	skl *SkipList
 	n   *skipListNode
 	dir direction
-	Iterator
 	*BasicReleaser
 	iterErr error
 }
@@ -251,9 +230,10 @@ func (sklIter *SkipListIter) SeekFirst() bool {
 		return false
 	}
 
-	sklIter.n = sklIter.skl.dummyHead
-	sklIter.dir = dirSOI
-	return sklIter.Next()
+	skl := sklIter.skl
+	skl.rw.RLock()
+	defer skl.rw.RUnlock()
+	return sklIter.setNode(skl.dummyHead.next(0))
 }
 
 func (sklIter *SkipListIter) Next() bool {
@@ -261,35 +241,25 @@ func (sklIter *SkipListIter) Next() bool {
 		sklIter.iterErr = ErrReleased
 		return false
 	}
-	if sklIter.dir == dirSOI {
+
+	switch sklIter.dir {
+	case dirSOI:
+		return sklIter.SeekFirst()
+	case dirEOI:
 		return false
 	}
+
 	skl := sklIter.skl
 	skl.rw.RLock()
 	defer skl.rw.RUnlock()
-
-	if sklIter.n == nil {
-		return sklIter.SeekFirst()
-	}
-
-	n := sklIter.n.next(0)
-	if n == nil {
-		sklIter.dir = dirEOI
-		return false
-	}
-	sklIter.dir = dirForward
-	sklIter.n = n
-	return true
+	return sklIter.setNode(sklIter.n.next(0))
 }
 
 func (sklIter *SkipListIter) Valid() error {
 	if sklIter.released() {
 		return ErrReleased
 	}
-	if sklIter.iterErr != nil {
-		return sklIter.iterErr
-	}
-	return nil
+	return sklIter.iterErr
 }
 
 func (sklIter *SkipListIter) Seek(key InternalKey) bool {
@@ -300,54 +270,40 @@ func (sklIter *SkipListIter) Seek(key InternalKey) bool {
 	}
 
 	skl := sklIter.skl
+	skl.rw.RLock()
+	defer skl.rw.RUnlock()
+	return sklIter.setNode(skl.findGreaterOrEqual(key))
+}
 
-	sklIter.skl.rw.RLock()
-	defer sklIter.skl.rw.RUnlock()
-
-	node, _, err := skl.FindGreaterOrEqual(key)
-	if err != nil {
-		sklIter.iterErr = err
-		return false
-	}
-
-	if node == nil {
+// required: rw held
+func (sklIter *SkipListIter) setNode(n *skipListNode) bool {
+	sklIter.n = n
+	if n == nil {
 		sklIter.dir = dirEOI
 		return false
 	}
-	sklIter.n = node
 	sklIter.dir = dirForward
 	return true
 }
 
 func (sklIter *SkipListIter) Key() []byte {
-	if sklIter.n == nil {
+	if sklIter.dir != dirForward {
 		return nil
 	}
+	sklIter.skl.rw.RLock()
+	defer sklIter.skl.rw.RUnlock()
 	return sklIter.n.key(sklIter.skl.kvData)
 }
 
 func (sklIter *SkipListIter) Value() []byte {
-	if sklIter.n == nil {
+	if sklIter.dir != dirForward {
 		return nil
 	}
+	sklIter.skl.rw.RLock()
+	defer sklIter.skl.rw.RUnlock()
 	return sklIter.n.value(sklIter.skl.kvData)
 }
 
-func (skl *SkipList) findLT(key []byte) []*skipListNode {
-
-	updates := skl.updatesScratch
-	n := skl.dummyHead
-	for i := skl.level - 1; i >= 0; i-- {
-		for n.next(i) != nil && skl.Compare(n.next(i).key(skl.kvData), key) < 0 {
-			n = n.next(i)
-		}
-		updates[i] = n
-	}
-
-	return updates[:skl.level]
-
-}
-
 type skipListNode struct {
 	kvOffset int // kvOffset in skipList kvData
 	keyLen   int
@@ -356,13 +312,18 @@ type skipListNode struct {
 	backward *skipListNode
 }
 
+func newSkipListNode(level int8) *skipListNode {
+	return &skipListNode{
+		level: skipListNodeLevel{
+			maxLevel: level,
+			next:     make([]*skipListNode, level),
+		},
+	}
+}
+
 func (node *skipListNode) setNext(i int8, n *skipListNode) {
 	assert(i < node.level.maxLevel)
-	next := node.level.next[i]
 	node.level.next[i] = n
-	if n != nil {
-		n.level.next[i] = next
-	}
 }
 
 func (node *skipListNode) next(i int8) *skipListNode {
@@ -383,32 +344,21 @@ type skipListNodeLevel struct {
 func (skl *SkipList) randLevel() int8 {
 	height := int8(1)
 	// n = (1/p)^kMaxHeight, n = 16m, p=1/4 => kMaxHeight=12
-	for height < kMaxHeight {
-		if skl.rand.Int()%kBranching == 1 {
-			height++
-		} else {
-			break
-		}
+	for height < kMaxHeight && skl.rand.Intn(kBranching) == 0 {
+		height++
 	}
-	assert(height <= kMaxHeight)
 	return height
 }
 
 func (node *skipListNode) keyValue(kvData []byte) (key []byte, value []byte) {
-	assert(node.kvOffset < len(kvData))
-	key = kvData[node.kvOffset : node.kvOffset+node.keyLen]
-	value = kvData[node.kvOffset+node.keyLen : node.kvOffset+node.keyLen+node.valLen]
-	return
+	return node.key(kvData), node.value(kvData)
 }
 
 func (node *skipListNode) key(kvData []byte) (key []byte) {
-	assert(node.kvOffset < len(kvData))
-	key = kvData[node.kvOffset : node.kvOffset+node.keyLen]
-	return
+	return kvData[node.kvOffset : node.kvOffset+node.keyLen : node.kvOffset+node.keyLen]
 }
 
-func (node *skipListNode) value(kvData []byte) (key []byte) {
-	assert(node.kvOffset < len(kvData))
-	key = kvData[node.kvOffset+node.keyLen : node.kvOffset+node.keyLen+node.keyLen]
-	return
+func (node *skipListNode) value(kvData []byte) (value []byte) {
+	start := node.kvOffset + node.keyLen
+	return kvData[start : start+node.valLen : start+node.valLen]
 }
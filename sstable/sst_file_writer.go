@@ -0,0 +1,95 @@
+package sstable
+
+import (
+	"bytes"
+	"os"
+)
+
+// SstFileWriter write sorted user keys into a standalone table file,
+// which could be loaded into db by DB.IngestExternalFile.
+// all the keys are written with sequence 0, ingestion will assign the global sequence if needed.
+// usage:
+//
+//	w, err := CreateSstFileWriter(path)
+//	w.Put(k1, v1)
+//	w.Put(k2, v2)
+//	err = w.Finish()
+type SstFileWriter struct {
+	file     *os.File
+	tw       *TableWriter
+	lastUKey []byte
+	ikey     InternalKey
+	entries  int
+	err      error
+}
+
+func CreateSstFileWriter(path string) (*SstFileWriter, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &SstFileWriter{
+		file: file,
+		tw:   NewTableWriter(file),
+	}, nil
+}
+
+func (w *SstFileWriter) Put(key, value []byte) error {
+	return w.add(key, keyTypeValue, value)
+}
+
+func (w *SstFileWriter) Delete(key []byte) error {
+	return w.add(key, keyTypeDel, nil)
+}
+
+func (w *SstFileWriter) add(ukey []byte, kt keyType, value []byte) error {
+
+	if w.err != nil {
+		return w.err
+	}
+
+	// user key must be strict increasing
+	if w.entries > 0 && bytes.Compare(ukey, w.lastUKey) <= 0 {
+		return ErrKeyNotSorted
+	}
+
+	w.ikey = buildInternalKey(w.ikey, ukey, kt, 0)
+	if err := w.tw.Append(w.ikey, value); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.lastUKey = append(w.lastUKey[:0], ukey...)
+	w.entries++
+	return nil
+}
+
+// FileSize return the bytes written so far
+func (w *SstFileWriter) FileSize() int {
+	return w.tw.fileSize()
+}
+
+// Finish flush the table and close the file, writer can't be used after finish
+func (w *SstFileWriter) Finish() (err error) {
+
+	defer func() {
+		if cErr := w.file.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			_ = os.Remove(w.file.Name())
+		}
+		w.err = ErrClosed
+	}()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.entries == 0 {
+		return ErrEmptySstFile
+	}
+
+	// table writer will sync the file after footer written
+	return w.tw.Close()
+}
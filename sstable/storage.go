@@ -1,12 +1,14 @@
 package sstable
 
 import (
+	"bufio"
 	"bytes"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"runtime"
+	"time"
 )
 
 type SequentialWriter interface {
@@ -56,6 +58,15 @@ type Storage interface {
 	// Rename rename fd
 	Rename(fd Fd) error
 
+	// Link hard link fd into dir, dir should be in the same filesystem
+	Link(fd Fd, dir string) error
+
+	// ModTime the last modification time of fd
+	ModTime(fd Fd) (time.Time, error)
+
+	// Size the size of fd in bytes
+	Size(fd Fd) (int64, error)
+
 	SetCurrent(num uint64) error
 
 	GetCurrent() (Fd, error)
@@ -66,8 +77,7 @@ type Storage interface {
 }
 
 type FileStorage struct {
-	dbPath string
-	Storage
+	dbPath   string
 	fileLock FileLock
 }
 
@@ -77,7 +87,7 @@ type FileLock interface {
 
 func OpenPath(dbPath string) (Storage, error) {
 
-	err := os.MkdirAll(dbPath, 0644)
+	err := os.MkdirAll(dbPath, 0755)
 	if err != nil {
 		return nil, err
 	}
@@ -96,16 +106,113 @@ func OpenPath(dbPath string) (Storage, error) {
 	return fs, nil
 }
 
+// OpenPathReadOnly open the db path without taking the LOCK, the path must exist
+func OpenPathReadOnly(dbPath string) (Storage, error) {
+
+	fInfo, err := os.Stat(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fInfo.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	fs := &FileStorage{
+		dbPath: dbPath,
+	}
+
+	return fs, nil
+}
+
 func (fs *FileStorage) Close() error {
-	fs.fileLock.Release()
+	if fs.fileLock != nil {
+		fs.fileLock.Release()
+	}
 	return nil
 }
 
+func (fs *FileStorage) path(fd Fd) string {
+	return path.Join(fs.dbPath, fd.String())
+}
+
+// Lock take the LOCK of the db path, fails if it is held by another storage
+func (fs *FileStorage) Lock() (Locker, error) {
+	fileLock, err := lockFile(path.Join(fs.dbPath, "LOCK"))
+	if err != nil {
+		return nil, err
+	}
+	return fileLocker{fileLock}, nil
+}
+
+func (fs *FileStorage) OpenDB() {}
+
+func (fs *FileStorage) Open(fd Fd) (Reader, error) {
+	file, err := os.Open(fs.path(fd))
+	if err != nil {
+		return nil, err
+	}
+	return newFileReader(file), nil
+}
+
+func (fs *FileStorage) Create(fd Fd) (SequentialWriter, error) {
+	return os.OpenFile(fs.path(fd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (fs *FileStorage) Remove(fd Fd) error {
+	return os.Remove(fs.path(fd))
+}
+
+// Rename rename the temp file of fd.Num to fd
+func (fs *FileStorage) Rename(fd Fd) error {
+	return os.Rename(fs.path(Fd{KDBTempFile, fd.Num}), fs.path(fd))
+}
+
+// List the files of db, the unknown files e.g. LOG are skipped
+func (fs *FileStorage) List() ([]Fd, error) {
+	entries, err := ioutil.ReadDir(fs.dbPath)
+	if err != nil {
+		return nil, err
+	}
+	fds := make([]Fd, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		fd, pErr := parseFd(entry.Name())
+		if pErr != nil {
+			continue
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+func (fs *FileStorage) Link(fd Fd, dir string) error {
+	return os.Link(path.Join(fs.dbPath, fd.String()), path.Join(dir, fd.String()))
+}
+
+func (fs *FileStorage) ModTime(fd Fd) (time.Time, error) {
+	fInfo, err := os.Stat(path.Join(fs.dbPath, fd.String()))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fInfo.ModTime(), nil
+}
+
+func (fs *FileStorage) Size(fd Fd) (int64, error) {
+	fInfo, err := os.Stat(path.Join(fs.dbPath, fd.String()))
+	if err != nil {
+		return 0, err
+	}
+	return fInfo.Size(), nil
+}
+
+// SetCurrent point CURRENT to the manifest num, the content is written into a temp file and renamed
 func (fs *FileStorage) SetCurrent(num uint64) (err error) {
 
-	descriptorFile := path.Join(fs.dbPath, Fd{KDescriptorFile, num}.String())
-	dbTmpFile := path.Join(fs.dbPath, Fd{KDBTempFile, num}.String())
-	content := descriptorFile + "\n"
+	content := Fd{KDescriptorFile, num}.String() + "\n"
+	dbTmpFile := fs.path(Fd{KDBTempFile, num})
 
 	tmp, err := os.OpenFile(dbTmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
@@ -119,15 +226,17 @@ func (fs *FileStorage) SetCurrent(num uint64) (err error) {
 	}()
 
 	_, err = tmp.Write([]byte(content))
-	if err != nil {
-		return err
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
 	}
-
-	err = os.Rename(dbTmpFile, descriptorFile)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return os.Rename(dbTmpFile, fs.path(Fd{FileType: KCurrentFile}))
 }
 
 // GetCurrent if current path not exists, will return os.ErrNotExist
@@ -163,7 +272,7 @@ func (fs *FileStorage) GetCurrent() (fd Fd, err error) {
 		return
 	}
 
-	currentFd, parseErr := parseFd(string(content))
+	currentFd, parseErr := parseFd(string(content[:len(content)-1]))
 	if parseErr != nil {
 		err = parseErr
 		return
@@ -173,3 +282,29 @@ func (fs *FileStorage) GetCurrent() (fd Fd, err error) {
 
 	return
 }
+
+// fileReader adapt os.File to Reader, the sequential reads are buffered, ReadAt reads the file directly
+type fileReader struct {
+	*os.File
+	br *bufio.Reader
+}
+
+func newFileReader(file *os.File) *fileReader {
+	return &fileReader{File: file, br: bufio.NewReader(file)}
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	return r.br.Read(p)
+}
+
+func (r *fileReader) ReadByte() (byte, error) {
+	return r.br.ReadByte()
+}
+
+type fileLocker struct {
+	FileLock
+}
+
+func (l fileLocker) UnLock() {
+	l.Release()
+}
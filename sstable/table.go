@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"sort"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -48,7 +50,7 @@ func (ik InternalKey) seq() Sequence {
 func (ik InternalKey) keyType() keyType {
 	ik.assert()
 	x := binary.LittleEndian.Uint64(ik[len(ik)-8:])
-	kt := uint8(x & 1 << 7)
+	kt := uint8(x & 0xff)
 	return keyType(kt)
 }
 
@@ -65,6 +67,7 @@ func parseInternalKey(ikey InternalKey) (ukey []byte, kt keyType, seq uint64, er
 		err = errors.New("invalid internal ikey keytype")
 		return
 	}
+	ukey = ikey[:len(ikey)-8]
 	return
 }
 
@@ -80,6 +83,28 @@ type tFile struct {
 	iMax InternalKey
 	iMin InternalKey
 	Size int
+
+	// seek budget, shared by the copies of the same file, when runs out the file should be compacted
+	seekLeft *int32
+
+	// the unix nano the table is created, 0 if unknown, e.g. recovered from an old manifest
+	ctime int64
+}
+
+func newTFile(fd Fd, size int, imin, imax InternalKey) tFile {
+	// one seek costs approximately the same as compacting 16kb data,
+	// so let the file be seeked size/16kb times before compaction
+	allowedSeeks := int32(size / kSeekCostBytes)
+	if allowedSeeks < kMinAllowedSeeks {
+		allowedSeeks = kMinAllowedSeeks
+	}
+	return tFile{
+		fd:       fd,
+		iMax:     imax,
+		iMin:     imin,
+		Size:     size,
+		seekLeft: &allowedSeeks,
+	}
 }
 
 type tFiles []tFile
@@ -93,26 +118,65 @@ func (sf tFiles) size() (size int) {
 
 type Levels [kLevelNum]tFiles
 
+// allocFileNum is called by the concurrent background jobs without mutex,
+// the file numbers are shared by the column families
 func (vSet *VersionSet) allocFileNum() uint64 {
-	nextFileNum := vSet.nextFileNum
-	vSet.nextFileNum++
-	return nextFileNum
+	root := vSet.rootSet()
+	return atomic.AddUint64(&root.nextFileNum, 1) - 1
 }
 
 func (vSet *VersionSet) reuseFileNum(fileNum uint64) bool {
-	if vSet.nextFileNum-1 == fileNum {
-		vSet.nextFileNum = fileNum
-		return true
-	}
-	return false
+	root := vSet.rootSet()
+	return atomic.CompareAndSwapUint64(&root.nextFileNum, fileNum+1, fileNum)
 }
 
 func (vSet *VersionSet) markFileUsed(fileNum uint64) bool {
-	if vSet.nextFileNum <= fileNum {
-		vSet.nextFileNum = fileNum + 1
-		return true
+	root := vSet.rootSet()
+	for {
+		next := atomic.LoadUint64(&root.nextFileNum)
+		if next > fileNum {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&root.nextFileNum, next, fileNum+1) {
+			return true
+		}
 	}
-	return false
+}
+
+// addPendingOutput protect the table being written from removeObsoleteFiles
+func (vSet *VersionSet) addPendingOutput(fileNum uint64) {
+	root := vSet.rootSet()
+	root.pendingMu.Lock()
+	defer root.pendingMu.Unlock()
+	if root.pendingOutputs == nil {
+		root.pendingOutputs = make(map[uint64]struct{})
+	}
+	root.pendingOutputs[fileNum] = struct{}{}
+}
+
+// releasePendingOutputs is called when the edit adding the tables is applied or dropped
+func (vSet *VersionSet) releasePendingOutputs(fileNums ...uint64) {
+	root := vSet.rootSet()
+	root.pendingMu.Lock()
+	defer root.pendingMu.Unlock()
+	for _, num := range fileNums {
+		delete(root.pendingOutputs, num)
+	}
+}
+
+// releaseEditOutputs release the tables added by edit
+func (vSet *VersionSet) releaseEditOutputs(edit *VersionEdit) {
+	for _, t := range edit.addedTables {
+		vSet.releasePendingOutputs(t.number)
+	}
+}
+
+func (vSet *VersionSet) isPendingOutput(fileNum uint64) bool {
+	root := vSet.rootSet()
+	root.pendingMu.Lock()
+	defer root.pendingMu.Unlock()
+	_, ok := root.pendingOutputs[fileNum]
+	return ok
 }
 
 func (vSet *VersionSet) loadCompactPtr(level int) InternalKey {
@@ -208,6 +272,7 @@ func (vSet *VersionSet) createNewTable(fd Fd, fileSize int) (*TableWriter, error
 type tableOperation struct {
 	session *VersionSet
 	storage Storage
+	filter  IFilter // nil means the default filter
 }
 
 func newTableOperation(s Storage, meta *VersionSet) *tableOperation {
@@ -222,7 +287,11 @@ func (tableOperation *tableOperation) open(f tFile) (*TableReader, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewTableReader(reader, f.Size)
+	tr, err := NewTableReader(reader, f.Size)
+	if err == nil && tableOperation.filter != nil {
+		tr.iFilter = tableOperation.filter
+	}
+	return tr, err
 }
 
 func (tableOperation *tableOperation) newIterator(f tFile) (Iterator, error) {
@@ -230,22 +299,34 @@ func (tableOperation *tableOperation) newIterator(f tFile) (Iterator, error) {
 	if err != nil {
 		return nil, err
 	}
+	// the reader is released with the iterator
+	defer tr.UnRef()
 	return tr.NewIterator()
 }
 
-func (tableOperation *tableOperation) create() (*tWriter, error) {
+// create a table writer, the writes are charged to the rate limiter with pri
+func (tableOperation *tableOperation) create(pri IOPriority) (*tWriter, error) {
 	fd := Fd{Num: tableOperation.session.allocFileNum(), FileType: KTableFile}
+	tableOperation.session.addPendingOutput(fd.Num)
 	w, err := tableOperation.storage.Create(fd)
 	if err != nil {
+		tableOperation.session.releasePendingOutputs(fd.Num)
 		tableOperation.session.reuseFileNum(fd.Num)
 		return nil, err
 	}
+	w = newRateLimitedWriter(w, tableOperation.session.opt.RateLimiter, pri)
+	tw := NewTableWriter(w)
+	if tableOperation.filter != nil {
+		tw.iFilter = tableOperation.filter
+	}
 	return &tWriter{
-		fd:    fd,
-		fw:    w,
-		tw:    NewTableWriter(w),
-		first: nil,
-		last:  nil,
+		fd:        fd,
+		fw:        w,
+		tw:        tw,
+		first:     nil,
+		last:      nil,
+		listeners: tableOperation.session.listeners(),
+		session:   tableOperation.session,
 	}, nil
 }
 
@@ -254,6 +335,8 @@ type tWriter struct {
 	fw          SequentialWriter
 	tw          *TableWriter
 	first, last InternalKey
+	listeners   eventListeners
+	session     *VersionSet
 }
 
 func (t *tWriter) append(ikey InternalKey, value []byte) error {
@@ -264,9 +347,19 @@ func (t *tWriter) append(ikey InternalKey, value []byte) error {
 	return t.tw.Append(ikey, value)
 }
 
-func (t *tWriter) finish() (*tFile, error) {
+func (t *tWriter) finish() (tf *tFile, err error) {
+
+	defer func() {
+		t.listeners.notify(func(l EventListener) {
+			info := TableFileInfo{Level: -1, FileNum: t.fd.Num, Err: err}
+			if tf != nil {
+				info.Size = tf.Size
+			}
+			l.OnTableFileCreated(info)
+		})
+	}()
 
-	err := t.tw.Close()
+	err = t.tw.Close()
 	if err != nil {
 		return nil, err
 	}
@@ -282,14 +375,21 @@ func (t *tWriter) finish() (*tFile, error) {
 	}
 
 	return &tFile{
-		fd:   t.fd,
-		iMax: t.last,
-		iMin: t.first,
-		Size: t.tw.fileSize(),
+		fd:    t.fd,
+		iMax:  t.last,
+		iMin:  t.first,
+		Size:  t.tw.fileSize(),
+		ctime: time.Now().UnixNano(),
 	}, nil
 
 }
 
+// drop close the unfinished table, the file would be removed as an obsolete file
+func (t *tWriter) drop() {
+	_ = t.fw.Close()
+	t.session.releasePendingOutputs(t.fd.Num)
+}
+
 func (t *tWriter) size() int {
 	return t.tw.fileSize()
 }
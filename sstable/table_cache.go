@@ -9,6 +9,7 @@ import (
 type TableCache struct {
 	cache   Cache
 	storage Storage
+	filter  IFilter // nil means the default filter
 }
 
 func (c *TableCache) Close() {
@@ -24,11 +25,17 @@ func NewTableCache(storage Storage, capacity uint32, hash32 hash2.Hash32) *Table
 	return c
 }
 
+// Stats the lookups of the opened tables, a miss opens the table file
+func (c *TableCache) Stats() CacheStats {
+	return c.cache.Stats()
+}
+
 func (c *TableCache) Get(ikey InternalKey, tFile tFile, f func(rkey InternalKey, value []byte)) error {
 	var cacheHandle *LRUHandle
 	if err := c.findTable(tFile, &cacheHandle); err != nil {
 		return err
 	}
+	defer c.cache.UnRef(cacheHandle)
 	tReader, ok := cacheHandle.value.(*TableReader)
 	if !ok {
 		panic("leveldb/cache value not type *TableReader")
@@ -38,10 +45,23 @@ func (c *TableCache) Get(ikey InternalKey, tFile tFile, f func(rkey InternalKey,
 		return rErr
 	}
 	f(rKey, append([]byte(nil), rValue...))
-	c.cache.UnRef(cacheHandle)
 	return nil
 }
 
+// NewIterator iterate the table, the reader is pinned by the iterator even if it's evicted
+func (c *TableCache) NewIterator(tFile tFile) (Iterator, error) {
+	var cacheHandle *LRUHandle
+	if err := c.findTable(tFile, &cacheHandle); err != nil {
+		return nil, err
+	}
+	defer c.cache.UnRef(cacheHandle)
+	tReader, ok := cacheHandle.value.(*TableReader)
+	if !ok {
+		panic("leveldb/cache value not type *TableReader")
+	}
+	return tReader.NewIterator()
+}
+
 func (c *TableCache) Evict(tFile tFile) {
 	lookupKey := make([]byte, 8)
 	binary.LittleEndian.PutUint64(lookupKey, tFile.fd.Num)
@@ -63,6 +83,9 @@ func (c *TableCache) findTable(tFile tFile, cacheHandle **LRUHandle) (err error)
 			err = tErr
 			return
 		}
+		if c.filter != nil {
+			tReader.iFilter = c.filter
+		}
 		handle = c.cache.Insert(lookupKey, 1, tReader, c.deleteEntry)
 	}
 	*cacheHandle = handle
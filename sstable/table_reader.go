@@ -21,7 +21,11 @@ func newDataBlock(data []byte) (*dataBlock, error) {
 	}
 	restartPointNums := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
 	restartPointOffset := len(data) - (restartPointNums+1)*4
+	if restartPointNums > dataLen/4 || restartPointOffset < 0 {
+		return nil, NewErrCorruption("block restart points corruption")
+	}
 	block := &dataBlock{
+		BasicReleaser:      &BasicReleaser{},
 		data:               data,
 		restartPointNums:   restartPointNums,
 		restartPointOffset: restartPointOffset,
@@ -56,11 +60,24 @@ func (br *dataBlock) entry(offset int) (entryLen, shareKeyLen int, unShareKey, v
 		err = ErrIterOutOfBounds
 		return
 	}
-	shareKeyLenU, n := binary.Uvarint(br.data[offset:])
+	entries := br.data[:br.restartPointOffset]
+	shareKeyLenU, n := binary.Uvarint(entries[offset:])
+	if n <= 0 {
+		err = NewErrCorruption("block entry corruption")
+		return
+	}
+	unShareKeyLenU, m := binary.Uvarint(entries[offset+n:])
+	if m <= 0 {
+		err = NewErrCorruption("block entry corruption")
+		return
+	}
+	vLenU, k := binary.Uvarint(entries[offset+n+m:])
+	if k <= 0 || unShareKeyLenU+vLenU > uint64(len(entries)-offset-n-m-k) {
+		err = NewErrCorruption("block entry corruption")
+		return
+	}
 	shareKeyLen = int(shareKeyLenU)
-	unShareKeyLenU, m := binary.Uvarint(br.data[offset+n:])
 	unShareKeyLen := int(unShareKeyLenU)
-	vLenU, k := binary.Uvarint(br.data[offset+n+m:])
 	vLen := int(vLenU)
 	unShareKey = br.data[offset+n+m+k : offset+n+m+k+unShareKeyLen]
 	value = br.data[offset+n+m+k+unShareKeyLen : offset+n+m+k+unShareKeyLen+vLen]
@@ -76,11 +93,11 @@ func (br *dataBlock) readRestartPoint(restartPoint int) (unShareKey InternalKey)
 	return
 }
 
+// SeekRestartPoint return the offset of the last restart point whose key <= key
 func (br *dataBlock) SeekRestartPoint(key InternalKey) int {
 
 	n := sort.Search(br.restartPointNums, func(i int) bool {
-		restartPoint := binary.LittleEndian.Uint32(br.data[br.restartPointOffset : br.restartPointOffset+i*4])
-		unShareKey := br.readRestartPoint(int(restartPoint))
+		unShareKey := br.readRestartPoint(br.restartPoint(i))
 		result := unShareKey.compare(key)
 		return result > 0
 	})
@@ -89,7 +106,11 @@ func (br *dataBlock) SeekRestartPoint(key InternalKey) int {
 		return 0
 	}
 
-	return n - 1
+	return br.restartPoint(n - 1)
+}
+
+func (br *dataBlock) restartPoint(i int) int {
+	return int(binary.LittleEndian.Uint32(br.data[br.restartPointOffset+i*4:]))
 }
 
 func (br *dataBlock) Close() {
@@ -112,6 +133,7 @@ type blockIter struct {
 }
 
 func newBlockIter(dataBlock *dataBlock) *blockIter {
+	dataBlock.Ref()
 	bi := &blockIter{
 		dataBlock: dataBlock,
 	}
@@ -180,6 +202,7 @@ func (bi *blockIter) Next() bool {
 	}
 
 	ikey := append(bi.prevKey[:shareKeyLen], unShareKey...)
+	bi.prevKey = ikey
 	bi.ikey = ikey
 	bi.value = value
 
@@ -219,17 +242,26 @@ func NewTableReader(r Reader, fileSize int) (*TableReader, error) {
 	tr := &TableReader{
 		r:         r,
 		tableSize: fileSize,
-		BasicReleaser: &BasicReleaser{
-			OnClose: func() {
-				_ = r.Close()
-			},
+		iFilter:   defaultFilter,
+	}
+	tr.BasicReleaser = &BasicReleaser{
+		OnClose: func() {
+			if tr.indexBlock != nil {
+				tr.indexBlock.UnRef()
+			}
+			_ = r.Close()
 		},
-		iFilter: defaultFilter,
 	}
 	err = tr.readFooter()
 	if err != nil {
 		return nil, err
 	}
+
+	// the index block is shared by the concurrent readers
+	tr.indexBlock, err = tr.readRawBlock(tr.indexBH)
+	if err != nil {
+		return nil, err
+	}
 	metaIndexData := make([]byte, tr.metaIndexBH.length)
 	_, err = r.ReadAt(metaIndexData, int64(tr.metaIndexBH.offset))
 	if err != nil {
@@ -280,8 +312,8 @@ func (tableReader *TableReader) readFooter() error {
 	return nil
 }
 
-// todo used cache
-func (tr *TableReader) readRawBlock(bh blockHandle) (*dataBlock, error) {
+// readBlockContents read the block and verify the crc, the tail is trimmed
+func (tr *TableReader) readBlockContents(bh blockHandle) ([]byte, error) {
 	r := tr.r
 
 	data := make([]byte, bh.length+blockTailLen)
@@ -309,30 +341,28 @@ func (tr *TableReader) readRawBlock(bh blockHandle) (*dataBlock, error) {
 		return nil, ErrUnSupportCompressionType
 	}
 
-	block, err := newDataBlock(data[:n])
-	if err != nil {
-		return nil, err
-	}
-	return block, nil
+	return rawData, nil
 }
 
-func (tr *TableReader) getIndexBlock() (b *dataBlock, err error) {
-
-	defer func() {
-		if b != nil {
-			b.Ref() // for caller
-		}
-	}()
+// todo used cache
+func (tr *TableReader) readRawBlock(bh blockHandle) (*dataBlock, error) {
 
-	if tr.indexBlock != nil {
-		return tr.indexBlock, nil
+	rawData, err := tr.readBlockContents(bh)
+	if err != nil {
+		return nil, err
 	}
-	b, err = tr.readRawBlock(tr.indexBH)
+
+	block, err := newDataBlock(rawData)
 	if err != nil {
 		return nil, err
 	}
-	tr.indexBlock = b
-	return
+	return block, nil
+}
+
+// getIndexBlock the index block is loaded when the reader opened, caller should call UnRef
+func (tr *TableReader) getIndexBlock() (*dataBlock, error) {
+	tr.indexBlock.Ref()
+	return tr.indexBlock, nil
 }
 
 // Seek return gte key
@@ -353,7 +383,7 @@ func (tr *TableReader) find(key InternalKey, noValue bool, filtered bool) (ikey
 
 	_, blockHandle := readBH(indexBlockIter.Value())
 
-	if filtered {
+	if filtered && tr.filterBlock != nil {
 		contains := tr.filterBlock.mayContains(tr.iFilter, blockHandle, key)
 		if !contains {
 			err = ErrNotFound
@@ -397,7 +427,7 @@ func (tr *TableReader) find(key InternalKey, noValue bool, filtered bool) (ikey
 	if err != nil {
 		return
 	}
-	dataBlock1.UnRef()
+	defer dataBlock1.UnRef()
 
 	dataBlockIter1 := newBlockIter(dataBlock1)
 	defer dataBlockIter1.UnRef()
@@ -409,7 +439,7 @@ func (tr *TableReader) find(key InternalKey, noValue bool, filtered bool) (ikey
 
 	ikey = dataBlockIter1.Key()
 	if !noValue {
-		value = append([]byte(nil), dataBlockIter.value...)
+		value = append([]byte(nil), dataBlockIter1.value...)
 	}
 	return
 }
@@ -459,6 +489,7 @@ func newIndexIter(tr *TableReader) (*indexIter, error) {
 	}
 	tr.Ref()
 	blockIter := newBlockIter(indexBlock)
+	indexBlock.UnRef()
 
 	ii := &indexIter{
 		blockIter: blockIter,
@@ -470,6 +501,7 @@ func newIndexIter(tr *TableReader) (*indexIter, error) {
 			},
 		},
 	}
+	ii.Ref()
 	return ii, nil
 }
 
@@ -502,25 +534,25 @@ type filterBlock struct {
 
 func (tr *TableReader) readFilterBlock(bh blockHandle) (*filterBlock, error) {
 
-	dataBlock, err := tr.readRawBlock(bh)
+	data, err := tr.readBlockContents(bh)
 	if err != nil {
 		return nil, err
 	}
 
-	dataLen := len(dataBlock.data)
+	dataLen := len(data)
 
-	baseLg := dataBlock.data[dataLen-1]
-	lastOffsetB := dataBlock.data[dataLen-5:]
+	baseLg := data[dataLen-1]
+	lastOffsetB := data[dataLen-5:]
 
 	lastOffset := int(binary.LittleEndian.Uint32(lastOffsetB))
 	nums := (dataLen - lastOffset - 1) / 4
 
 	offsets := make([]int, 0, nums)
 	for i := 0; i < nums; i++ {
-		offsets = append(offsets, int(binary.LittleEndian.Uint32(dataBlock.data[lastOffset+i*4:])))
+		offsets = append(offsets, int(binary.LittleEndian.Uint32(data[lastOffset+i*4:])))
 	}
 
-	filter := dataBlock.data[:lastOffset]
+	filter := data[:lastOffset]
 	return &filterBlock{
 		data:         filter,
 		offsetOffset: lastOffset,
@@ -532,7 +564,7 @@ func (tr *TableReader) readFilterBlock(bh blockHandle) (*filterBlock, error) {
 
 func (filterBlock *filterBlock) mayContains(iFilter IFilter, bh blockHandle, ikey InternalKey) bool {
 
-	idx := int(bh.offset / 1 << filterBlock.baseLg)
+	idx := int(bh.offset >> filterBlock.baseLg)
 	if idx+1 > filterBlock.filterNums {
 		return false
 	}
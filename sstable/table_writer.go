@@ -104,6 +104,13 @@ type blockWriter struct {
 	offset           int
 }
 
+func newBlockWriter(restartThreshold int) *blockWriter {
+	return &blockWriter{
+		scratch:          make([]byte, binary.MaxVarintLen64),
+		restartThreshold: restartThreshold,
+	}
+}
+
 func (bw *blockWriter) append(ikey InternalKey, value []byte) {
 
 	if bw.entries%bw.restartThreshold == 0 {
@@ -114,7 +121,7 @@ func (bw *blockWriter) append(ikey InternalKey, value []byte) {
 	bw.writeEntry(ikey, value)
 	bw.entries++
 
-	bw.prevIKey = append([]byte(nil), ikey...)
+	bw.prevIKey = append(bw.prevIKey[:0], ikey...)
 
 }
 
@@ -147,7 +154,7 @@ func (bw *blockWriter) writeEntry(ikey InternalKey, value []byte) {
 		shareUKey     = getPrefixKey(bw.prevIKey, ikey)
 		shareUKeyLen  = len(shareUKey)
 		unShareKeyLen = len(ikey) - shareUKeyLen
-		unShareKey    = ikey[unShareKeyLen:]
+		unShareKey    = ikey[shareUKeyLen:]
 		vLen          = len(value)
 	)
 
@@ -176,6 +183,9 @@ func (bw *blockWriter) reset() {
 	bw.entries = 0
 }
 
+// the filter of the data block at offset is filters[offset >> baseLg]
+const defaultFilterBaseLg = 11
+
 type FilterWriter struct {
 	data            bytes.Buffer
 	offsets         []int
@@ -262,7 +272,13 @@ type TableWriter struct {
 
 func NewTableWriter(w SequentialWriter) *TableWriter {
 	return &TableWriter{
-		writer:  w,
+		writer:     w,
+		dataBlock:  newBlockWriter(16),
+		indexBlock: newBlockWriter(1),
+		metaBlock:  newBlockWriter(1),
+		filterBlock: &FilterWriter{
+			baseLg: defaultFilterBaseLg,
+		},
 		iFilter: defaultFilter,
 	}
 }
@@ -272,10 +288,15 @@ func (tableWriter *TableWriter) Append(ikey InternalKey, value []byte) error {
 	dataBlock := tableWriter.dataBlock
 	filterBlock := tableWriter.filterBlock
 
-	if tableWriter.entries > 0 && bytes.Compare(dataBlock.prevIKey, ikey) > 0 {
+	if tableWriter.entries > 0 && IComparer.Compare(tableWriter.prevKey, ikey) > 0 {
 		return errors.New("tableWriter Append ikey not sorted")
 	}
 
+	// the filter may be replaced after the writer created
+	if filterBlock.filterGenerator == nil {
+		filterBlock.filterGenerator = tableWriter.iFilter.NewGenerator()
+	}
+
 	err := tableWriter.flushPendingBH(ikey)
 	if err != nil {
 		return err
@@ -285,6 +306,9 @@ func (tableWriter *TableWriter) Append(ikey InternalKey, value []byte) error {
 
 	filterBlock.addKey(ikey)
 
+	tableWriter.prevKey = append(tableWriter.prevKey[:0], ikey...)
+	tableWriter.entries++
+
 	if dataBlock.bytesLen() >= defaultDataBlockSize {
 		ferr := tableWriter.finishDataBlock()
 		if ferr != nil {
@@ -301,7 +325,7 @@ func (tableWriter *TableWriter) Close() error {
 	dataBlock := tableWriter.dataBlock
 
 	// finish all data block
-	if len(dataBlock.prevIKey) > 0 {
+	if dataBlock.entries > 0 {
 		err := tableWriter.finishDataBlock()
 		if err != nil {
 			return err
@@ -323,6 +347,7 @@ func (tableWriter *TableWriter) Close() error {
 	// flush meta block
 	metaBlock := tableWriter.metaBlock
 	metaBlock.append([]byte("filter.bloomFilter"), writeBH(nil, *bh))
+	metaBlock.finish()
 	metaBH, err := tableWriter.writeBlock(&metaBlock.data, compressionTypeNone)
 	if err != nil {
 		return err
@@ -330,6 +355,7 @@ func (tableWriter *TableWriter) Close() error {
 
 	// flush index block
 	indexBlock := tableWriter.indexBlock
+	indexBlock.finish()
 	indexBH, err := tableWriter.writeBlock(&indexBlock.data, compressionTypeNone)
 	if err != nil {
 		return err
@@ -345,6 +371,7 @@ func (tableWriter *TableWriter) Close() error {
 
 func (tableWriter *TableWriter) finishDataBlock() error {
 
+	tableWriter.dataBlock.finish()
 	bh, err := tableWriter.writeBlock(&tableWriter.dataBlock.data, compressionTypeNone)
 	if err != nil {
 		return err
@@ -366,6 +393,7 @@ func (tableWriter *TableWriter) finishFilterBlock() (*blockHandle, error) {
 		binary.LittleEndian.PutUint32(offsetBuf, uint32(offset))
 		filterWriter.data.Write(offsetBuf)
 	}
+	filterWriter.data.WriteByte(byte(filterWriter.baseLg))
 	bh, err := tableWriter.writeBlock(&filterWriter.data, compressionTypeNone)
 	if err != nil {
 		return nil, err
@@ -443,18 +471,24 @@ func (tableWriter *TableWriter) fileSize() int {
 	return tableWriter.offset
 }
 
+// iSuccessor the max trailer is only used when the user key is changed,
+// otherwise the separator would be less than a
 func iSuccessor(a InternalKey) (dest InternalKey) {
 	au := a.ukey()
 	destU := getSuccessor(au)
-	dest = append(destU, kMaxNumBytes...)
-	return
+	if bytes.Compare(destU, au) > 0 {
+		return append(destU, kMaxNumBytes...)
+	}
+	return append(dest, a...)
 }
 
 func iSeparator(a, b InternalKey) (dest InternalKey) {
 	au, bu := a.ukey(), b.ukey()
 	destU := getSeparator(au, bu)
-	dest = append(destU, kMaxNumBytes...)
-	return
+	if bytes.Compare(destU, au) > 0 {
+		return append(destU, kMaxNumBytes...)
+	}
+	return append(dest, a...)
 }
 
 // return the successor that Gte ikey
@@ -496,29 +530,17 @@ func getSeparator(a, b []byte) (dest []byte) {
 	return
 }
 
-func getPrefixKey(prevIKey, ikey InternalKey) []byte {
-
-	prevUkey := prevIKey.ukey()
-	uKey := ikey.ukey()
+// getPrefixKey the shared prefix of the keys, the previous key is empty at the restart points
+func getPrefixKey(prevIKey, ikey []byte) []byte {
 
-	size := len(prevUkey)
-	if len(uKey) < size {
-		size = len(uKey)
+	size := len(prevIKey)
+	if len(ikey) < size {
+		size = len(ikey)
 	}
 
-	dest := make([]byte, size)
-
 	var sharePrefixIndex = 0
-
-	for sharePrefixIndex = 0; sharePrefixIndex < size; sharePrefixIndex++ {
-		c1 := prevUkey[sharePrefixIndex]
-		c2 := uKey[sharePrefixIndex]
-		if c1 == c2 {
-			dest[sharePrefixIndex] = c1
-		} else {
-			break
-		}
+	for ; sharePrefixIndex < size && prevIKey[sharePrefixIndex] == ikey[sharePrefixIndex]; sharePrefixIndex++ {
 	}
 
-	return dest[:sharePrefixIndex]
+	return ikey[:sharePrefixIndex]
 }
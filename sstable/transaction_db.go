@@ -0,0 +1,187 @@
+package sstable
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLockStripes = 16
+	defaultLockTimeout = time.Second
+)
+
+/**
+pessimistic transaction, the keys are locked before written
+
+	Put/Delete/GetForUpdate -> lock the key -> free or owned -> done
+	                                       \-> held by others -> add wait-for edge -> cycle ? -> ErrDeadlock
+	                                                                              \-> wait released or timeout
+	Commit -> db.write (group commit) -> release the locks
+	Rollback -> release the locks
+
+	the locks are exclusive and reentrant, kept in memory only, striped by the hash of key
+**/
+
+type TransactionDBOptions struct {
+	// NumStripes the number of lock stripes, the keys of different stripes never contend the stripe mutex
+	NumStripes int
+
+	// LockTimeout the max duration waiting for a lock, ErrLockTimeout is returned once exceeded,
+	// negative means wait forever, 0 means the default 1s
+	LockTimeout time.Duration
+}
+
+// TransactionDB the DB supports pessimistic transactions
+type TransactionDB struct {
+	*DB
+	locks     *lockManager
+	nextTxnID uint64
+}
+
+// NewTransactionDB nil opt means the default options
+func NewTransactionDB(db *DB, opt *TransactionDBOptions) *TransactionDB {
+
+	o := TransactionDBOptions{}
+	if opt != nil {
+		o = *opt
+	}
+	if o.NumStripes <= 0 {
+		o.NumStripes = defaultLockStripes
+	}
+	if o.LockTimeout == 0 {
+		o.LockTimeout = defaultLockTimeout
+	}
+
+	return &TransactionDB{
+		DB:    db,
+		locks: newLockManager(o.NumStripes, o.LockTimeout),
+	}
+}
+
+// Begin start a transaction, the transaction is not safe for concurrent use
+func (tdb *TransactionDB) Begin() *Txn {
+	txn := newTxn(tdb.DB)
+	txn.tdb = tdb
+	txn.id = atomic.AddUint64(&tdb.nextTxnID, 1)
+	txn.locked = make(map[string]struct{})
+	return txn
+}
+
+type rowLock struct {
+	owner    uint64        // txn id
+	released chan struct{} // closed when unlocked
+}
+
+type lockStripe struct {
+	mu    sync.Mutex
+	locks map[string]*rowLock
+}
+
+type lockManager struct {
+	stripes []*lockStripe
+	timeout time.Duration
+
+	// wait-for graph, waiter -> holder, a txn waits at most one lock at a time
+	graphMu sync.Mutex
+	waitFor map[uint64]uint64
+}
+
+func newLockManager(stripes int, timeout time.Duration) *lockManager {
+	lm := &lockManager{
+		stripes: make([]*lockStripe, stripes),
+		timeout: timeout,
+		waitFor: make(map[uint64]uint64),
+	}
+	for i := range lm.stripes {
+		lm.stripes[i] = &lockStripe{locks: make(map[string]*rowLock)}
+	}
+	return lm
+}
+
+func (lm *lockManager) stripe(key string) *lockStripe {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return lm.stripes[h.Sum32()%uint32(len(lm.stripes))]
+}
+
+// lock the key for txn, reentrant
+func (lm *lockManager) lock(txnID uint64, key string) error {
+
+	var timeout <-chan time.Time
+	if lm.timeout > 0 {
+		timer := time.NewTimer(lm.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	s := lm.stripe(key)
+	for {
+		s.mu.Lock()
+		l, ok := s.locks[key]
+		if !ok {
+			s.locks[key] = &rowLock{owner: txnID, released: make(chan struct{})}
+			s.mu.Unlock()
+			return nil
+		}
+		if l.owner == txnID {
+			s.mu.Unlock()
+			return nil
+		}
+		holder, released := l.owner, l.released
+		s.mu.Unlock()
+
+		if lm.addWait(txnID, holder) {
+			return fmt.Errorf("%w, key %q held by txn %d", ErrDeadlock, key, holder)
+		}
+
+		select {
+		case <-released:
+			lm.removeWait(txnID)
+		case <-timeout:
+			lm.removeWait(txnID)
+			return fmt.Errorf("%w, key %q held by txn %d", ErrLockTimeout, key, holder)
+		}
+	}
+}
+
+func (lm *lockManager) unlock(txnID uint64, key string) {
+	s := lm.stripe(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.locks[key]; ok && l.owner == txnID {
+		delete(s.locks, key)
+		close(l.released)
+	}
+}
+
+// addWait add the edge waiter -> holder, return true without adding if it makes a cycle
+func (lm *lockManager) addWait(waiter, holder uint64) bool {
+
+	lm.graphMu.Lock()
+	defer lm.graphMu.Unlock()
+
+	// each txn has at most one out edge, follow the path from holder
+	next := holder
+	for steps := 0; steps <= len(lm.waitFor); steps++ {
+		if next == waiter {
+			return true
+		}
+		n, ok := lm.waitFor[next]
+		if !ok {
+			break
+		}
+		next = n
+	}
+
+	lm.waitFor[waiter] = holder
+	return false
+}
+
+func (lm *lockManager) removeWait(waiter uint64) {
+	lm.graphMu.Lock()
+	defer lm.graphMu.Unlock()
+	delete(lm.waitFor, waiter)
+}
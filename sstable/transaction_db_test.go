@@ -0,0 +1,218 @@
+package sstable
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockTimeout(t *testing.T) {
+
+	lm := newLockManager(4, 50*time.Millisecond)
+	if err := lm.lock(1, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.lock(1, "k"); err != nil {
+		t.Fatalf("expect the lock reentrant, got %v", err)
+	}
+
+	if err := lm.lock(2, "k"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expect lock timeout, got %v", err)
+	}
+
+	// the waiter acquires the lock once released
+	done := make(chan error)
+	go func() {
+		done <- lm.lock(2, "k")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	lm.unlock(1, "k")
+	if err := <-done; err != nil {
+		t.Fatalf("expect the lock acquired after released, got %v", err)
+	}
+}
+
+func TestDeadlockDetection(t *testing.T) {
+
+	lm := newLockManager(4, -1)
+	if err := lm.lock(1, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.lock(2, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// txn 1 waits txn 2
+	done := make(chan error)
+	go func() {
+		done <- lm.lock(1, "b")
+	}()
+	for {
+		lm.graphMu.Lock()
+		_, waiting := lm.waitFor[1]
+		lm.graphMu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// txn 2 -> txn 1 -> txn 2
+	if err := lm.lock(2, "a"); !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("expect deadlock, got %v", err)
+	}
+
+	lm.unlock(2, "b")
+	if err := <-done; err != nil {
+		t.Fatalf("expect txn 1 acquired the lock, got %v", err)
+	}
+}
+
+func TestTxnSavePoint(t *testing.T) {
+
+	tdb := NewTransactionDB(nil, nil)
+	txn := tdb.Begin()
+
+	_ = txn.Put([]byte("a"), []byte("1"))
+	txn.SetSavePoint()
+	_ = txn.Put([]byte("a"), []byte("2"))
+	_ = txn.Delete([]byte("b"))
+
+	size := txn.batch.Size()
+	if err := txn.RollbackToSavePoint(); err != nil {
+		t.Fatal(err)
+	}
+	if txn.batch.Len() != 1 || txn.batch.Size() >= size {
+		t.Fatalf("expect the writes after save point discarded, got %d records", txn.batch.Len())
+	}
+	if value, err := txn.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Fatalf("expect a=1, got %q, %v", value, err)
+	}
+	if err := txn.RollbackToSavePoint(); err != ErrNoSavePoint {
+		t.Fatalf("expect no save point, got %v", err)
+	}
+
+	// the locks of the discarded writes are kept until rollback
+	other := tdb.Begin()
+	tdb.locks.timeout = 10 * time.Millisecond
+	if err := other.Put([]byte("b"), nil); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expect b locked, got %v", err)
+	}
+	txn.Rollback()
+	if err := other.Put([]byte("b"), nil); err != nil {
+		t.Fatalf("expect b unlocked after rollback, got %v", err)
+	}
+}
+
+func openTransactionDB(t *testing.T, timeout time.Duration) *TransactionDB {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewTransactionDB(db, &TransactionDBOptions{LockTimeout: timeout})
+}
+
+func TestTxnGetForUpdateCommit(t *testing.T) {
+
+	tdb := openTransactionDB(t, 200*time.Millisecond)
+	defer func() {
+		_ = tdb.Close()
+	}()
+	if err := tdb.Put([]byte("k"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn1 := tdb.Begin()
+	if value, err := txn1.GetForUpdate([]byte("k")); err != nil || string(value) != "0" {
+		t.Fatalf("expect k=0, got %q, %v", value, err)
+	}
+
+	// the key locked by txn1 can't be written by others until timeout
+	txn2 := tdb.Begin()
+	if err := txn2.Put([]byte("k"), []byte("2")); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expect lock timeout, got %v", err)
+	}
+	if _, err := txn2.GetForUpdate([]byte("k")); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expect lock timeout, got %v", err)
+	}
+	txn2.Rollback()
+
+	// the waiter acquires the lock once txn1 committed
+	txn3 := tdb.Begin()
+	done := make(chan error)
+	go func() {
+		if _, err := txn3.GetForUpdate([]byte("k")); err != nil {
+			done <- err
+			return
+		}
+		done <- txn3.Put([]byte("k"), []byte("3"))
+	}()
+
+	if err := txn1.Put([]byte("k"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := tdb.Get([]byte("k")); err != nil || string(value) != "0" {
+		t.Fatalf("expect the uncommitted write invisible, got %q, %v", value, err)
+	}
+	if err := txn1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := tdb.Get([]byte("k")); err != nil || string(value) != "1" {
+		t.Fatalf("expect k=1 committed, got %q, %v", value, err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("expect the lock acquired after commit, got %v", err)
+	}
+	if err := txn3.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := tdb.Get([]byte("k")); err != nil || string(value) != "3" {
+		t.Fatalf("expect k=3 committed, got %q, %v", value, err)
+	}
+}
+
+func TestTxnRollbackReleaseLocks(t *testing.T) {
+
+	tdb := openTransactionDB(t, 50*time.Millisecond)
+	defer func() {
+		_ = tdb.Close()
+	}()
+
+	txn := tdb.Begin()
+	if err := txn.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	other := tdb.Begin()
+	if err := other.Put([]byte("a"), []byte("2")); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expect a locked, got %v", err)
+	}
+
+	seq := tdb.LatestSequence()
+	txn.Rollback()
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Fatalf("expect txn done, got %v", err)
+	}
+	if got := tdb.LatestSequence(); got != seq {
+		t.Fatalf("expect nothing written by rolled back txn, sequence %d -> %d", seq, got)
+	}
+
+	if err := other.Put([]byte("a"), []byte("2")); err != nil {
+		t.Fatalf("expect a unlocked after rollback, got %v", err)
+	}
+	if err := other.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("expect b unlocked after rollback, got %v", err)
+	}
+	if err := other.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if value, err := tdb.Get([]byte(key)); err != nil || string(value) != "2" {
+			t.Fatalf("expect %s=2, got %q, %v", key, value, err)
+		}
+	}
+}
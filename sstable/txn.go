@@ -0,0 +1,214 @@
+package sstable
+
+type pendingWrite struct {
+	value   []byte
+	deleted bool
+}
+
+// savePoint the state of txn when SetSavePoint called
+type savePoint struct {
+	size   int // the size of batch
+	count  int
+	writes map[string]pendingWrite
+}
+
+// Txn buffer the writes until commit, created by OptimisticTransactionDB or TransactionDB.
+// the transaction is not safe for concurrent use
+type Txn struct {
+	db    *DB
+	batch *WriteBatch
+
+	// the buffered writes by key, read by Get
+	writes map[string]pendingWrite
+
+	// optimistic, the sequence when the key is first accessed, the key conflicts if written after it
+	tracked map[string]Sequence
+
+	// pessimistic, the keys are locked before written, the locks are released after commit or rollback
+	tdb    *TransactionDB
+	id     uint64
+	locked map[string]struct{}
+
+	savePoints []savePoint
+
+	done bool
+}
+
+func newTxn(db *DB) *Txn {
+	return &Txn{
+		db:      db,
+		batch:   &WriteBatch{},
+		writes:  make(map[string]pendingWrite),
+		tracked: make(map[string]Sequence),
+	}
+}
+
+func (txn *Txn) pessimistic() bool {
+	return txn.tdb != nil
+}
+
+// acquire lock the key for pessimistic txn, or track it for optimistic txn
+func (txn *Txn) acquire(key []byte) error {
+
+	if !txn.pessimistic() {
+		if _, ok := txn.tracked[string(key)]; !ok {
+			txn.tracked[string(key)] = txn.db.LatestSequence()
+		}
+		return nil
+	}
+
+	if _, ok := txn.locked[string(key)]; ok {
+		return nil
+	}
+	if err := txn.tdb.locks.lock(txn.id, string(key)); err != nil {
+		return err
+	}
+	txn.locked[string(key)] = struct{}{}
+	return nil
+}
+
+// Get read the key, the buffered writes of txn are visible.
+// the key is not locked by pessimistic txn, see GetForUpdate
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+
+	if w, ok := txn.writes[string(key)]; ok {
+		if w.deleted {
+			return nil, ErrNotFound
+		}
+		return append([]byte(nil), w.value...), nil
+	}
+
+	if !txn.pessimistic() {
+		// track before read, a write between them causes a false conflict rather than a lost update
+		if err := txn.acquire(key); err != nil {
+			return nil, err
+		}
+	}
+	return txn.db.Get(key)
+}
+
+// GetForUpdate read the key and lock it until the txn finished, so no other txn could write it.
+// for optimistic txn it's the same as Get
+func (txn *Txn) GetForUpdate(key []byte) ([]byte, error) {
+
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+
+	if err := txn.acquire(key); err != nil {
+		return nil, err
+	}
+	return txn.Get(key)
+}
+
+func (txn *Txn) Put(key, value []byte) error {
+
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	if err := txn.acquire(key); err != nil {
+		return err
+	}
+	txn.batch.Put(key, value)
+	txn.writes[string(key)] = pendingWrite{value: append([]byte(nil), value...)}
+	return nil
+}
+
+func (txn *Txn) Delete(key []byte) error {
+
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	if err := txn.acquire(key); err != nil {
+		return err
+	}
+	txn.batch.Delete(key)
+	txn.writes[string(key)] = pendingWrite{deleted: true}
+	return nil
+}
+
+// SetSavePoint record the buffered writes, which can be restored by RollbackToSavePoint
+func (txn *Txn) SetSavePoint() {
+
+	writes := make(map[string]pendingWrite, len(txn.writes))
+	for key, w := range txn.writes {
+		writes[key] = w
+	}
+
+	txn.savePoints = append(txn.savePoints, savePoint{
+		size:   txn.batch.Size(),
+		count:  txn.batch.Len(),
+		writes: writes,
+	})
+}
+
+// RollbackToSavePoint discard the writes after the last save point and pop it,
+// the locks acquired after it are kept until txn finished
+func (txn *Txn) RollbackToSavePoint() error {
+
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	if len(txn.savePoints) == 0 {
+		return ErrNoSavePoint
+	}
+
+	sp := txn.savePoints[len(txn.savePoints)-1]
+	txn.savePoints = txn.savePoints[:len(txn.savePoints)-1]
+	txn.batch.truncate(sp.size, sp.count)
+	txn.writes = sp.writes
+	return nil
+}
+
+// Commit write the buffered writes atomically.
+// optimistic txn returns ErrConflict if any key read or written by txn has been written by others since accessed
+func (txn *Txn) Commit() error {
+
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+
+	if txn.pessimistic() {
+		defer txn.releaseLocks()
+		return txn.db.write(txn.batch)
+	}
+
+	// read only transaction has nothing to commit
+	if txn.batch.Len() == 0 {
+		return nil
+	}
+
+	return txn.db.writeWithCheck(txn.batch, func() error {
+		return txn.db.checkConflict(txn.tracked)
+	})
+}
+
+// Rollback discard the buffered writes and release the locks
+func (txn *Txn) Rollback() {
+	if txn.done {
+		return
+	}
+	txn.done = true
+	txn.batch.Reset()
+	txn.writes = nil
+	txn.tracked = nil
+	txn.savePoints = nil
+	if txn.pessimistic() {
+		txn.releaseLocks()
+	}
+}
+
+func (txn *Txn) releaseLocks() {
+	for key := range txn.locked {
+		txn.tdb.locks.unlock(txn.id, key)
+	}
+	txn.locked = nil
+}
@@ -0,0 +1,372 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/**
+change data capture, read the write batches from journals
+
+	journal 5:  | batch seq=1 count=2 | batch seq=3 count=1 |
+	journal 8:  | batch seq=4 count=3 | batch seq=7 count=1 |   <- the live journal
+
+	GetUpdatesSince(5) -> (4, batch) -> (7, batch) -> end
+	                      the batch containing 5
+
+	an empty batch is the marker of IngestExternalFile, the ingested data is only in tables.
+
+	the iterator stops at the latest sequence when it's created, create a new one to read the later writes,
+	or Refresh it to continue from the journal offset it stopped at.
+	the journals are removed once flushed, keep them by Options.JournalTTL or Options.JournalSizeLimit
+	for the readers falling behind
+**/
+
+// UpdatesIterator iterate the write batches in sequence order, caller should call UnRef after iterate end
+type UpdatesIterator struct {
+	*BasicReleaser
+	db       *DB
+	journals []Fd  // the journal being read and the later ones
+	offset   int64 // the end of the last batch read in journals[0]
+
+	reader  Reader
+	jr      *JournalReader
+	lastSeq Sequence // the latest sequence when created or refreshed
+	nextSeq Sequence // the first sequence of the next batch wanted
+
+	seq   Sequence
+	batch *WriteBatch
+	err   error
+}
+
+// GetUpdatesSince return the iterator starting at the batch containing seq,
+// ErrUpdatesPurged is returned if the journal of seq has been removed
+func (db *DB) GetUpdatesSince(seq Sequence) (*UpdatesIterator, error) {
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return nil, ErrClosed
+	}
+	if seq == 0 {
+		seq = 1
+	}
+
+	it := &UpdatesIterator{
+		db:      db,
+		nextSeq: seq,
+	}
+
+	db.rwMutex.Lock()
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		db.rwMutex.Unlock()
+		return nil, ErrClosed
+	}
+	fds, err := db.VersionSet.storage.List()
+	if err != nil {
+		db.rwMutex.Unlock()
+		return nil, err
+	}
+	for _, fd := range fds {
+		if fd.FileType == KJournalFile {
+			it.journals = append(it.journals, fd)
+		}
+	}
+	sort.Slice(it.journals, func(i, j int) bool {
+		return it.journals[i].Num < it.journals[j].Num
+	})
+	it.lastSeq = db.seqNum
+	if len(it.journals) > 0 {
+		// pin the journals before unlocked
+		db.updatesPins[it] = it.journals[0].Num
+	}
+	atomic.AddInt32(&db.openIterators, 1)
+	db.rwMutex.Unlock()
+
+	it.BasicReleaser = &BasicReleaser{
+		OnClose: func() {
+			it.closeJournal()
+			it.batch = nil
+			db.rwMutex.Lock()
+			delete(db.updatesPins, it)
+			db.rwMutex.Unlock()
+			atomic.AddInt32(&db.openIterators, -1)
+		},
+	}
+	it.Ref()
+
+	if err := it.seekJournal(seq); err != nil {
+		it.UnRef()
+		return nil, err
+	}
+	return it, nil
+}
+
+// seekJournal skip the journals before the one containing seq
+func (it *UpdatesIterator) seekJournal(seq Sequence) error {
+
+	start := -1
+	minSeq := it.lastSeq + 1 // the min sequence in journals
+	for i, fd := range it.journals {
+		firstSeq, ok, err := it.db.firstSequenceOfJournal(fd)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if firstSeq < minSeq {
+			minSeq = firstSeq
+		}
+		if firstSeq <= seq {
+			start = i
+		}
+	}
+
+	if seq < minSeq && seq <= it.lastSeq {
+		return ErrUpdatesPurged
+	}
+	if start > 0 {
+		it.journals = it.journals[start:]
+		it.pin()
+	}
+	return nil
+}
+
+// firstSequenceOfJournal read the sequence of the first batch of journal, ok is false if it's empty
+func (db *DB) firstSequenceOfJournal(fd Fd) (seq Sequence, ok bool, err error) {
+
+	reader, err := db.VersionSet.storage.Open(fd)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	jr := NewJournalReader(reader)
+	defer jr.Close()
+
+	chunk, err := jr.NextChunk()
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return
+	}
+	p, err := ioutil.ReadAll(chunk)
+	if err != nil {
+		return
+	}
+	if len(p) < kWriteBatchHeaderSize {
+		return 0, false, NewErrCorruption("journal batch less than header size")
+	}
+	return Sequence(binary.LittleEndian.Uint64(p[:kWriteBatchSeqSize])), true, nil
+}
+
+// pin the journal being read, the journals before it could be removed
+func (it *UpdatesIterator) pin() {
+	it.db.rwMutex.Lock()
+	defer it.db.rwMutex.Unlock()
+	if len(it.journals) > 0 {
+		it.db.updatesPins[it] = it.journals[0].Num
+	}
+}
+
+func (it *UpdatesIterator) closeJournal() {
+	if it.reader != nil {
+		_ = it.jr.Close()
+		_ = it.reader.Close()
+		it.reader = nil
+		it.jr = nil
+	}
+}
+
+// Next move to the next batch, false is returned at the end or on error, see Valid
+func (it *UpdatesIterator) Next() bool {
+
+	if it.err != nil {
+		return false
+	}
+	if it.released() {
+		it.err = ErrReleased
+		return false
+	}
+
+	for it.nextSeq <= it.lastSeq {
+
+		if it.reader == nil {
+			if len(it.journals) == 0 {
+				break
+			}
+			reader, err := it.db.VersionSet.storage.Open(it.journals[0])
+			if err != nil {
+				it.err = err
+				break
+			}
+			it.reader = reader
+			it.jr = newJournalReaderAt(reader, it.offset)
+		}
+
+		chunk, err := it.jr.NextChunk()
+		if err == io.EOF {
+			if len(it.journals) == 1 {
+				// the live journal, the later writes are read after refreshed
+				break
+			}
+			it.closeJournal()
+			it.journals = it.journals[1:]
+			it.offset = 0
+			it.pin()
+			continue
+		}
+		if err != nil {
+			it.err = err
+			break
+		}
+		p, err := ioutil.ReadAll(chunk)
+		if err != nil {
+			it.err = err
+			break
+		}
+		if it.jr.partial {
+			// the batch is being written
+			break
+		}
+		batch, err := NewWriteBatchFromContents(p)
+		if err != nil {
+			it.err = err
+			break
+		}
+
+		if batch.seq > it.lastSeq {
+			// written after the iterator created or refreshed, read it again after refreshed
+			break
+		}
+		it.offset = it.jr.offset()
+		if batch.nextSequence() <= it.nextSeq {
+			// before the start or replayed
+			continue
+		}
+
+		it.seq = batch.seq
+		it.batch = batch
+		it.nextSeq = batch.nextSequence()
+		return true
+	}
+
+	it.closeJournal()
+	it.batch = nil
+	return false
+}
+
+// Refresh extend the iterator to the latest sequence and pick up the new journals,
+// the following Next continues from the journal offset it stopped at
+func (it *UpdatesIterator) Refresh() error {
+
+	if it.released() {
+		return ErrReleased
+	}
+
+	db := it.db
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return ErrClosed
+	}
+
+	fds, err := db.VersionSet.storage.List()
+	if err != nil {
+		return err
+	}
+
+	var newJournals []Fd
+	for _, fd := range fds {
+		if fd.FileType == KJournalFile && (len(it.journals) == 0 || fd.Num > it.journals[len(it.journals)-1].Num) {
+			newJournals = append(newJournals, fd)
+		}
+	}
+	sort.Slice(newJournals, func(i, j int) bool {
+		return newJournals[i].Num < newJournals[j].Num
+	})
+
+	it.journals = append(it.journals, newJournals...)
+	it.lastSeq = db.seqNum
+	if len(it.journals) > 0 {
+		db.updatesPins[it] = it.journals[0].Num
+	}
+	return nil
+}
+
+// Sequence the sequence of the first record of current batch
+func (it *UpdatesIterator) Sequence() Sequence {
+	return it.seq
+}
+
+// Batch the current batch, it's not changed by the following Next
+func (it *UpdatesIterator) Batch() *WriteBatch {
+	return it.batch
+}
+
+func (it *UpdatesIterator) Valid() error {
+	return it.err
+}
+
+// minPinnedJournalNum the min journal pinned by the opened UpdatesIterator
+// required: mutex held
+func (db *DB) minPinnedJournalNum() (num uint64, ok bool) {
+	for _, pinned := range db.updatesPins {
+		if !ok || pinned < num {
+			num, ok = pinned, true
+		}
+	}
+	return
+}
+
+// expiredJournals filter the obsolete journals exceeding Options.JournalTTL or Options.JournalSizeLimit,
+// the newer journals are kept first
+// required: mutex held
+func (db *DB) expiredJournals(obsolete []Fd) (expired []Fd) {
+
+	opt := db.VersionSet.opt
+	if opt.JournalTTL <= 0 && opt.JournalSizeLimit <= 0 {
+		return obsolete
+	}
+
+	sort.Slice(obsolete, func(i, j int) bool {
+		return obsolete[i].Num > obsolete[j].Num
+	})
+
+	var (
+		now       = time.Now()
+		totalSize int64
+		logger    = db.VersionSet.logger()
+	)
+	for i, fd := range obsolete {
+		if opt.JournalTTL > 0 {
+			modTime, err := db.VersionSet.storage.ModTime(fd)
+			if err != nil {
+				logger.Warnf("stat journal %s failed, err=%v", fd, err)
+				continue
+			}
+			if now.Sub(modTime) > opt.JournalTTL {
+				expired = append(expired, fd)
+				continue
+			}
+		}
+		if opt.JournalSizeLimit > 0 {
+			size, err := db.VersionSet.storage.Size(fd)
+			if err != nil {
+				logger.Warnf("stat journal %s failed, err=%v", fd, err)
+				continue
+			}
+			totalSize += size
+			if totalSize > opt.JournalSizeLimit {
+				// the older journals are over the limit too
+				return append(expired, obsolete[i:]...)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,249 @@
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// journalStorage keep the journals in memory, only the methods used by GetUpdatesSince are implemented
+type journalStorage struct {
+	Storage
+	files    map[Fd]*memWriter
+	modTimes map[Fd]time.Time
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (r *memReader) Close() error { return nil }
+
+func (js *journalStorage) List() ([]Fd, error) {
+	fds := make([]Fd, 0, len(js.files))
+	for fd := range js.files {
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+func (js *journalStorage) Open(fd Fd) (Reader, error) {
+	w, ok := js.files[fd]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &memReader{bytes.NewReader(w.Bytes())}, nil
+}
+
+func (js *journalStorage) ModTime(fd Fd) (time.Time, error) {
+	return js.modTimes[fd], nil
+}
+
+func (js *journalStorage) Size(fd Fd) (int64, error) {
+	return int64(js.files[fd].Len()), nil
+}
+
+// writeJournal write the batches of (seq, count) into journal num
+func (js *journalStorage) writeJournal(t *testing.T, num uint64, batches ...[2]int) {
+	w := &memWriter{}
+	jw := NewJournalWriter(w)
+	for _, b := range batches {
+		wb := &WriteBatch{}
+		for i := 0; i < b[1]; i++ {
+			wb.Put([]byte{byte(b[0] + i)}, nil)
+		}
+		wb.SetSequence(Sequence(b[0]))
+		if _, err := jw.Write(wb.Data()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fd := Fd{FileType: KJournalFile, Num: num}
+	js.files[fd] = w
+	js.modTimes[fd] = time.Now()
+}
+
+func TestGetUpdatesSince(t *testing.T) {
+
+	js := &journalStorage{files: make(map[Fd]*memWriter), modTimes: make(map[Fd]time.Time)}
+	js.writeJournal(t, 5, [2]int{1, 2}, [2]int{3, 1})
+	js.writeJournal(t, 6)
+	js.writeJournal(t, 8, [2]int{4, 3}, [2]int{7, 1}, [2]int{8, 1})
+
+	db := newDB(js, nil)
+	db.seqNum = 7 // batch 8 is written after the iterator created
+
+	readAll := func(seq Sequence) []Sequence {
+		it, err := db.GetUpdatesSince(seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.UnRef()
+		var seqs []Sequence
+		for it.Next() {
+			seqs = append(seqs, it.Sequence())
+		}
+		if err := it.Valid(); err != nil {
+			t.Fatal(err)
+		}
+		return seqs
+	}
+
+	for seq, expect := range map[Sequence][]Sequence{
+		0: {1, 3, 4, 7},
+		2: {1, 3, 4, 7},
+		5: {4, 7},
+		7: {7},
+		8: nil,
+	} {
+		got := readAll(seq)
+		if len(got) != len(expect) {
+			t.Fatalf("since %d, expect %v, got %v", seq, expect, got)
+		}
+		for i := range got {
+			if got[i] != expect[i] {
+				t.Fatalf("since %d, expect %v, got %v", seq, expect, got)
+			}
+		}
+	}
+
+	// the opened iterator pins its journals
+	it, err := db.GetUpdatesSince(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num, ok := db.minPinnedJournalNum(); !ok || num != 8 {
+		t.Fatalf("expect journal 8 pinned, got %d", num)
+	}
+	it.UnRef()
+	if _, ok := db.minPinnedJournalNum(); ok {
+		t.Fatal("expect no journal pinned after released")
+	}
+
+	delete(js.files, Fd{FileType: KJournalFile, Num: 5})
+	if _, err := db.GetUpdatesSince(2); !errors.Is(err, ErrUpdatesPurged) {
+		t.Fatalf("expect purged, got %v", err)
+	}
+}
+
+func TestExpiredJournals(t *testing.T) {
+
+	js := &journalStorage{files: make(map[Fd]*memWriter), modTimes: make(map[Fd]time.Time)}
+	js.writeJournal(t, 1, [2]int{1, 1})
+	js.writeJournal(t, 2, [2]int{2, 1})
+	js.writeJournal(t, 3, [2]int{3, 1})
+	js.modTimes[Fd{FileType: KJournalFile, Num: 1}] = time.Now().Add(-time.Hour)
+
+	obsolete, _ := js.List()
+	size, _ := js.Size(Fd{FileType: KJournalFile, Num: 3})
+
+	expiredNums := func(opt *Options) map[uint64]bool {
+		db := newDB(js, opt)
+		nums := make(map[uint64]bool)
+		for _, fd := range db.expiredJournals(append([]Fd(nil), obsolete...)) {
+			nums[fd.Num] = true
+		}
+		return nums
+	}
+
+	if nums := expiredNums(nil); len(nums) != 3 {
+		t.Fatalf("expect all removed without retention, got %v", nums)
+	}
+	if nums := expiredNums(&Options{JournalTTL: time.Minute}); len(nums) != 1 || !nums[1] {
+		t.Fatalf("expect journal 1 expired by ttl, got %v", nums)
+	}
+	if nums := expiredNums(&Options{JournalSizeLimit: 2 * size}); len(nums) != 1 || !nums[1] {
+		t.Fatalf("expect the oldest journal over the size limit, got %v", nums)
+	}
+	if nums := expiredNums(&Options{JournalTTL: time.Minute, JournalSizeLimit: size}); len(nums) != 2 || nums[3] {
+		t.Fatalf("expect the newest journal kept, got %v", nums)
+	}
+}
+
+// appendJournal append the batch to journal, only the first cut bytes of it are written if cut > 0
+func (js *journalStorage) appendJournal(t *testing.T, num uint64, seq, count int, cut int) []byte {
+	fd := Fd{FileType: KJournalFile, Num: num}
+	w, ok := js.files[fd]
+	if !ok {
+		w = &memWriter{}
+		js.files[fd] = w
+		js.modTimes[fd] = time.Now()
+	}
+	wb := &WriteBatch{}
+	for i := 0; i < count; i++ {
+		wb.Put([]byte{byte(seq + i)}, bytes.Repeat([]byte{'v'}, 100))
+	}
+	wb.SetSequence(Sequence(seq))
+
+	record := &memWriter{}
+	jw := NewJournalWriter(record)
+	jw.blockOffset = w.Len() % kJournalBlockSize
+	if _, err := jw.Write(wb.Data()); err != nil {
+		t.Fatal(err)
+	}
+	p := record.Bytes()
+	if cut > 0 {
+		w.Write(p[:cut])
+		return p[cut:]
+	}
+	w.Write(p)
+	return nil
+}
+
+func TestUpdatesIteratorRefresh(t *testing.T) {
+
+	db, js := newPrimaryDB(t)
+	it, err := db.GetUpdatesSince(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.UnRef()
+
+	next := func(expect ...Sequence) {
+		var got []Sequence
+		for it.Next() {
+			got = append(got, it.Sequence())
+		}
+		if err := it.Valid(); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expect) {
+			t.Fatalf("expect batches %v, got %v", expect, got)
+		}
+	}
+	refresh := func(seq Sequence) {
+		db.seqNum = seq
+		if err := it.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	next(1, 3, 4, 7)
+
+	// continue from the offset in the live journal
+	js.appendJournal(t, 8, 8, 2, 0)
+	next()
+	refresh(9)
+	next(8)
+
+	// the journal is switched, the rest of the old one is read first
+	js.appendJournal(t, 8, 10, 1, 0)
+	js.appendJournal(t, 11, 11, 1, 0)
+	refresh(11)
+	if pinned := db.updatesPins[it]; pinned != 8 {
+		t.Fatalf("expect journal 8 pinned, got %d", pinned)
+	}
+	next(10, 11)
+	if pinned := db.updatesPins[it]; pinned != 11 {
+		t.Fatalf("expect journal 11 pinned, got %d", pinned)
+	}
+
+	// the batch being written is read after it's finished
+	rest := js.appendJournal(t, 11, 12, 400, kJournalBlockSize)
+	refresh(411)
+	next()
+	js.files[Fd{FileType: KJournalFile, Num: 11}].Write(rest)
+	next(12)
+}
@@ -0,0 +1,254 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// TableVerifyResult the verification result of a live table
+type TableVerifyResult struct {
+	Level      int
+	FileNum    uint64
+	Size       int
+	DataBlocks int
+	MetaBlocks int // filter blocks referenced by meta index block
+	Entries    int
+	Smallest   InternalKey // actual smallest key read from the table
+	Largest    InternalKey // actual largest key read from the table
+	Err        error       // nil if the table is intact
+}
+
+// VerifyReport the result of DB.VerifyChecksums
+type VerifyReport struct {
+	Tables     []TableVerifyResult
+	DataBlocks int
+	Entries    int
+	Bytes      int
+	Corrupted  int // number of tables failed the verification
+}
+
+/**
+full verification of a table, every block is read from storage without cache
+
+	footer -> magic
+	index block -> crc -> each entry -> data block -> crc -> keys ascending within block
+	                                               \-> last key <= index key < first key of next block
+	meta index block -> crc -> each entry -> filter block -> crc
+	first key == tFile.iMin, last key == tFile.iMax
+**/
+
+// VerifyChecksums read and verify every block of the live tables in current version,
+// a corruption of one table doesn't stop verifying the others.
+// the returned error is the first corruption found, the report is returned anyway
+func (db *DB) VerifyChecksums() (*VerifyReport, error) {
+
+	if atomic.LoadUint32(&db.shutdown) == 1 {
+		return nil, ErrClosed
+	}
+
+	db.rwMutex.RLock()
+	v := db.VersionSet.getCurrent()
+	v.Ref()
+	db.rwMutex.RUnlock()
+
+	defer func() {
+		db.rwMutex.Lock()
+		v.UnRef()
+		db.rwMutex.Unlock()
+	}()
+
+	return db.VersionSet.verifyVersion(v)
+}
+
+// verifyVersion required: v is referenced
+func (vSet *VersionSet) verifyVersion(v *Version) (*VerifyReport, error) {
+
+	var (
+		report   = &VerifyReport{}
+		firstErr error
+	)
+
+	for level, tables := range v.levels {
+		for _, t := range tables {
+			result := vSet.verifyTable(level, t)
+			report.Tables = append(report.Tables, result)
+			report.DataBlocks += result.DataBlocks
+			report.Entries += result.Entries
+			report.Bytes += result.Size
+			if result.Err != nil {
+				report.Corrupted++
+				if firstErr == nil {
+					firstErr = fmt.Errorf("table %d at level %d: %w", t.fd.Num, level, result.Err)
+				}
+			}
+		}
+	}
+
+	return report, firstErr
+}
+
+func (vSet *VersionSet) verifyTable(level int, t tFile) (result TableVerifyResult) {
+
+	result = TableVerifyResult{
+		Level:   level,
+		FileNum: t.fd.Num,
+		Size:    t.Size,
+	}
+
+	reader, err := vSet.storage.Open(t.fd)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	defer reader.Close()
+
+	if t.Size < tableFooterLen {
+		result.Err = NewErrCorruption("file too short")
+		return
+	}
+
+	// the reader is not cached, every block is read from storage
+	tr := &TableReader{
+		r:         reader,
+		tableSize: t.Size,
+	}
+	if result.Err = tr.readFooter(); result.Err != nil {
+		return
+	}
+
+	if result.Err = vSet.verifyDataBlocks(tr, &result); result.Err != nil {
+		return
+	}
+
+	if result.Err = verifyMetaBlocks(tr, &result); result.Err != nil {
+		return
+	}
+
+	if result.Entries == 0 {
+		result.Err = NewErrCorruption("table has no entries")
+	} else if !bytes.Equal(result.Smallest, t.iMin) {
+		result.Err = NewErrCorruption(fmt.Sprintf("smallest key %q mismatches manifest %q", result.Smallest, t.iMin))
+	} else if !bytes.Equal(result.Largest, t.iMax) {
+		result.Err = NewErrCorruption(fmt.Sprintf("largest key %q mismatches manifest %q", result.Largest, t.iMax))
+	}
+	return
+}
+
+// verifyBlockHandle the block and its tail must be inside the table, before the footer
+func verifyBlockHandle(tr *TableReader, bh blockHandle) error {
+	if bh.offset+bh.length+blockTailLen > uint64(tr.tableSize-tableFooterLen) {
+		return NewErrCorruption(fmt.Sprintf("block handle out of range, offset=%d, length=%d", bh.offset, bh.length))
+	}
+	return nil
+}
+
+// readVerifiedBlock read the block and verify the crc, kind is for the error message
+func readVerifiedBlock(tr *TableReader, bh blockHandle, kind string) (*blockIter, error) {
+	if err := verifyBlockHandle(tr, bh); err != nil {
+		return nil, fmt.Errorf("%s block: %w", kind, err)
+	}
+	block, err := tr.readRawBlock(bh)
+	if err != nil {
+		return nil, fmt.Errorf("%s block offset %d: %w", kind, bh.offset, err)
+	}
+	// the iter takes over the reference of block
+	return newBlockIter(block), nil
+}
+
+func (vSet *VersionSet) verifyDataBlocks(tr *TableReader, result *TableVerifyResult) error {
+
+	indexIter, err := readVerifiedBlock(tr, tr.indexBH, "index")
+	if err != nil {
+		return err
+	}
+	defer indexIter.UnRef()
+
+	var (
+		prevKey      InternalKey
+		prevIndexKey InternalKey
+	)
+
+	for indexIter.Next() {
+		indexKey := append(InternalKey(nil), indexIter.Key()...)
+		_, bh := readBH(indexIter.Value())
+
+		if prevIndexKey != nil && vSet.cmp.Compare(prevIndexKey, indexKey) >= 0 {
+			return NewErrCorruption(fmt.Sprintf("index keys out of order at block offset %d", bh.offset))
+		}
+		prevIndexKey = indexKey
+
+		err = func() error {
+			dataIter, err := readVerifiedBlock(tr, bh, "data")
+			if err != nil {
+				return err
+			}
+			defer dataIter.UnRef()
+
+			entries := 0
+			for dataIter.Next() {
+				key := append(InternalKey(nil), dataIter.Key()...)
+				if _, _, _, err := parseInternalKey(key); err != nil {
+					return NewErrCorruption(fmt.Sprintf("invalid key in block offset %d, %v", bh.offset, err))
+				}
+				// keys are strictly ascending across blocks, so the key is greater than the last key of previous block
+				if prevKey != nil && vSet.cmp.Compare(prevKey, key) >= 0 {
+					return NewErrCorruption(fmt.Sprintf("keys out of order in block offset %d, %q >= %q", bh.offset, prevKey, key))
+				}
+				if result.Smallest == nil {
+					result.Smallest = key
+				}
+				prevKey = key
+				entries++
+			}
+			if err := dataIter.Valid(); err != nil {
+				return err
+			}
+
+			if entries == 0 {
+				return NewErrCorruption(fmt.Sprintf("empty data block offset %d", bh.offset))
+			}
+			// the index key separates the block from the next one
+			if vSet.cmp.Compare(prevKey, indexKey) > 0 {
+				return NewErrCorruption(fmt.Sprintf("last key of block offset %d is greater than index key", bh.offset))
+			}
+
+			result.DataBlocks++
+			result.Entries += entries
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = indexIter.Valid(); err != nil {
+		return err
+	}
+
+	result.Largest = prevKey
+	return nil
+}
+
+func verifyMetaBlocks(tr *TableReader, result *TableVerifyResult) error {
+
+	metaIter, err := readVerifiedBlock(tr, tr.metaIndexBH, "meta index")
+	if err != nil {
+		return err
+	}
+	defer metaIter.UnRef()
+
+	for metaIter.Next() {
+		_, bh := readBH(metaIter.Value())
+		if err = verifyBlockHandle(tr, bh); err != nil {
+			return fmt.Errorf("meta block %q: %w", metaIter.Key(), err)
+		}
+		// the filter block is not a data block, only verify the crc
+		if _, err = tr.readBlockContents(bh); err != nil {
+			return fmt.Errorf("meta block %q offset %d: %w", metaIter.Key(), bh.offset, err)
+		}
+		result.MetaBlocks++
+	}
+
+	return metaIter.Valid()
+}
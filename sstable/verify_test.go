@@ -0,0 +1,112 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestVerifyChecksums(t *testing.T) {
+
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	putTestKeys(t, db, 500)
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := db.VerifyChecksums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Entries != 500 || report.DataBlocks == 0 || report.Corrupted != 0 || len(report.Tables) != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	// flip a byte in the first data block
+	table := db.VersionSet.current.levels[0][0]
+	f, err := os.OpenFile(path.Join(dir, table.fd.String()), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err = f.ReadAt(b, 16); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err = f.WriteAt(b, 16); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	report, err = db.VerifyChecksums()
+	if err == nil {
+		t.Fatal("expect corruption reported")
+	}
+	if report.Corrupted != 1 || report.Tables[0].Err == nil || report.Tables[0].FileNum != table.fd.Num {
+		t.Fatalf("expect table %d corrupted, got %+v", table.fd.Num, report)
+	}
+
+	// the db refuses to open with paranoid checks
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenWithOptions(dir, &Options{ParanoidChecks: true}); err == nil {
+		t.Fatal("expect open fails with a corrupted table")
+	}
+	if db, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockIterSharedKeys(t *testing.T) {
+
+	// the keys share prefix with the previous one, each key is decoded from the previous key
+	w := &memWriter{}
+	tw := NewTableWriter(w)
+	var keys []InternalKey
+	for i := 0; i < 1000; i++ {
+		ikey := buildInternalKey(nil, []byte(fmt.Sprintf("shared-prefix-%06d", i)), keyTypeValue, Sequence(i+1))
+		if err := tw.Append(ikey, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, ikey)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := NewTableReader(&memReader{bytes.NewReader(w.Bytes())}, w.Len())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.UnRef()
+	iter, err := tr.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.UnRef()
+
+	i := 0
+	for iter.Next() {
+		if i >= len(keys) || !bytes.Equal(iter.Key(), keys[i]) {
+			t.Fatalf("key %d: got %q", i, iter.Key())
+		}
+		i++
+	}
+	if err = iter.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(keys) {
+		t.Fatalf("expect %d keys, got %d", len(keys), i)
+	}
+}
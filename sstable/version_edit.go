@@ -13,6 +13,14 @@ const (
 	kCompact
 	kDelTable
 	kAddTable
+
+	// column family records, the edit is applied to the family of kColumnFamily, default family if absent
+	kColumnFamily
+	kAddColumnFamily
+	kDropColumnFamily
+
+	// kAddTable with the creation time of the table
+	kAddTableTime
 )
 
 type VersionEdit struct {
@@ -26,6 +34,10 @@ type VersionEdit struct {
 	delTables    []delTable
 	addedTables  []addTable
 	err          error
+
+	familyID       uint32
+	familyName     []byte // name of the added family
+	familyComparer []byte // comparer name of the added family
 }
 
 func (edit *VersionEdit) reset() {
@@ -38,6 +50,9 @@ func (edit *VersionEdit) reset() {
 	edit.delTables = nil
 	edit.addedTables = nil
 	edit.err = nil
+	edit.familyID = 0
+	edit.familyName = nil
+	edit.familyComparer = nil
 }
 
 type compactPtr struct {
@@ -56,6 +71,7 @@ type addTable struct {
 	number uint64
 	imin   InternalKey
 	imax   InternalKey
+	ctime  int64 // unix nano, 0 if unknown
 }
 
 func (edit *VersionEdit) hasRec(bitPos uint8) bool {
@@ -114,49 +130,90 @@ func (edit *VersionEdit) addNewTable(level, size int, fileNumber uint64, imin, i
 	})
 }
 
+// addTableFile add t with its creation time
+func (edit *VersionEdit) addTableFile(level int, t tFile) {
+	edit.addNewTable(level, t.Size, t.fd.Num, t.iMin, t.iMax)
+	edit.addedTables[len(edit.addedTables)-1].ctime = t.ctime
+}
+
+func (edit *VersionEdit) setColumnFamily(id uint32) {
+	edit.setRec(kColumnFamily)
+	edit.familyID = id
+}
+
+func (edit *VersionEdit) addColumnFamily(name string, comparerName []byte) {
+	edit.setRec(kAddColumnFamily)
+	edit.familyName = []byte(name)
+	edit.familyComparer = comparerName
+}
+
+func (edit *VersionEdit) dropColumnFamily() {
+	edit.setRec(kDropColumnFamily)
+}
+
+// encodeColumnFamily the family records precede the others, so the tables are applied to the family
+func (edit *VersionEdit) encodeColumnFamily(dest io.Writer) {
+	if edit.hasRec(kColumnFamily) {
+		edit.writeHeader(dest, kColumnFamily)
+		edit.putUVarInt(dest, uint64(edit.familyID))
+	}
+	if edit.hasRec(kAddColumnFamily) {
+		edit.writeHeader(dest, kAddColumnFamily)
+		edit.writeBytes(dest, edit.familyName)
+		edit.writeBytes(dest, edit.familyComparer)
+	}
+	if edit.hasRec(kDropColumnFamily) {
+		edit.writeHeader(dest, kDropColumnFamily)
+	}
+}
+
 func (edit *VersionEdit) EncodeTo(dest io.Writer) {
-	switch {
-	case edit.hasRec(kComparerName):
+	edit.encodeColumnFamily(dest)
+	if edit.rec&^(1<<kColumnFamily|1<<kAddColumnFamily|1<<kDropColumnFamily) == 0 && edit.rec != 0 {
+		// only the family records
+		return
+	}
+	if edit.hasRec(kComparerName) {
 		edit.writeHeader(dest, kComparerName)
 		edit.writeBytes(dest, edit.comparerName)
-		fallthrough
-	case edit.hasRec(kJournalNum):
+	}
+	if edit.hasRec(kJournalNum) {
 		edit.writeHeader(dest, kJournalNum)
 		edit.putUVarInt(dest, edit.journalNum)
-		fallthrough
-	case edit.hasRec(kNextFileNum):
+	}
+	if edit.hasRec(kNextFileNum) {
 		edit.writeHeader(dest, kNextFileNum)
 		edit.putUVarInt(dest, edit.nextFileNum)
-		fallthrough
-	case edit.hasRec(kSeqNum):
+	}
+	if edit.hasRec(kSeqNum) {
 		edit.writeHeader(dest, kSeqNum)
 		edit.putUVarInt(dest, uint64(edit.lastSeq))
-		fallthrough
-	case edit.hasRec(kCompact):
+	}
+	// a header for each entry, the decoder reads one entry after a header
+	for _, cptr := range edit.compactPtrs {
 		edit.writeHeader(dest, kCompact)
-		for _, cptr := range edit.compactPtrs {
-			edit.putVarInt(dest, cptr.level)
-			edit.writeBytes(dest, cptr.ikey)
-		}
-		fallthrough
-	case edit.hasRec(kDelTable):
+		edit.putVarInt(dest, cptr.level)
+		edit.writeBytes(dest, cptr.ikey)
+	}
+	for _, dt := range edit.delTables {
 		edit.writeHeader(dest, kDelTable)
-		for _, dt := range edit.delTables {
-			edit.putVarInt(dest, dt.level)
-			edit.putUVarInt(dest, dt.number)
+		edit.putVarInt(dest, dt.level)
+		edit.putUVarInt(dest, dt.number)
+	}
+	for _, dt := range edit.addedTables {
+		if dt.ctime != 0 {
+			edit.writeHeader(dest, kAddTableTime)
+		} else {
+			edit.writeHeader(dest, kAddTable)
 		}
-		fallthrough
-	case edit.hasRec(kAddTable):
-		edit.writeHeader(dest, kAddTable)
-		for _, dt := range edit.addedTables {
-			edit.putVarInt(dest, dt.level)
-			edit.putVarInt(dest, dt.size)
-			edit.putUVarInt(dest, dt.number)
-			edit.writeBytes(dest, dt.imin)
-			edit.writeBytes(dest, dt.imax)
+		edit.putVarInt(dest, dt.level)
+		edit.putVarInt(dest, dt.size)
+		edit.putUVarInt(dest, dt.number)
+		edit.writeBytes(dest, dt.imin)
+		edit.writeBytes(dest, dt.imax)
+		if dt.ctime != 0 {
+			edit.putVarInt(dest, int(dt.ctime))
 		}
-	default:
-		panic("leveldb/version_edit unsupport type")
 	}
 }
 
@@ -181,61 +238,72 @@ func (edit *VersionEdit) DecodeFrom(src SequentialReader) {
 			if edit.err != nil {
 				return
 			}
-			edit.comparerName = cName
+			edit.setCompareName(cName)
 		case kNextFileNum:
 			nextFileNum := edit.readUVarInt(src)
 			if edit.err != nil {
 				return
 			}
-			edit.nextFileNum = nextFileNum
+			edit.setNextFile(nextFileNum)
 		case kJournalNum:
 			logNum := edit.readUVarInt(src)
 			if edit.err != nil {
 				return
 			}
-			edit.journalNum = logNum
+			edit.setLogNum(logNum)
 		case kSeqNum:
 			seqNum := edit.readUVarInt(src)
 			if edit.err != nil {
 				return
 			}
-			edit.lastSeq = Sequence(seqNum)
+			edit.setLastSeq(Sequence(seqNum))
 		case kCompact:
 			level := edit.readVarInt(src)
 			ikey := edit.readBytes(src)
 			if edit.err != nil {
 				return
 			}
-			edit.compactPtrs = append(edit.compactPtrs, compactPtr{
-				level: level,
-				ikey:  ikey,
-			})
+			edit.addCompactPtr(level, ikey)
 		case kDelTable:
 			level := edit.readVarInt(src)
 			fileNum := edit.readUVarInt(src)
 			if edit.err != nil {
 				return
 			}
-			edit.delTables = append(edit.delTables, delTable{
-				level:  level,
-				number: fileNum,
-			})
-		case kAddTable:
+			edit.addDelTable(level, fileNum)
+		case kAddTable, kAddTableTime:
 			level := edit.readVarInt(src)
 			size := edit.readVarInt(src)
 			fileNum := edit.readUVarInt(src)
 			imin := edit.readBytes(src)
 			imax := edit.readBytes(src)
+			var ctime int
+			if typ == kAddTableTime && edit.err == nil {
+				ctime = edit.readVarInt(src)
+			}
+			if edit.err != nil {
+				return
+			}
+			edit.addNewTable(level, size, fileNum, imin, imax)
+			edit.addedTables[len(edit.addedTables)-1].ctime = int64(ctime)
+		case kColumnFamily:
+			id := edit.readUVarInt(src)
 			if edit.err != nil {
 				return
 			}
-			edit.addedTables = append(edit.addedTables, addTable{
-				level:  level,
-				size:   size,
-				number: fileNum,
-				imin:   imin,
-				imax:   imax,
-			})
+			edit.setColumnFamily(uint32(id))
+		case kAddColumnFamily:
+			name := edit.readBytes(src)
+			comparerName := edit.readBytes(src)
+			if edit.err != nil {
+				return
+			}
+			edit.addColumnFamily(string(name), comparerName)
+		case kDropColumnFamily:
+			edit.dropColumnFamily()
+		default:
+			edit.err = NewErrCorruption("unknown version edit record")
+			return
 		}
 	}
 
@@ -286,13 +354,12 @@ func (edit *VersionEdit) readBytes(src SequentialReader) []byte {
 		edit.err = err
 		return nil
 	}
-	b := make([]byte, size)
-	var n int
-	n, edit.err = src.Read(b)
-	if edit.err != nil {
-		return b[:n]
+	if size < 0 {
+		edit.err = NewErrCorruption("negative bytes length")
+		return nil
 	}
-
-	return b[:n]
+	b := make([]byte, size)
+	_, edit.err = io.ReadFull(src, b)
+	return b
 
 }
@@ -1,13 +1,13 @@
 package sstable
 
-import "C"
 import (
 	"bytes"
 	"container/list"
-	"encoding/binary"
+	"fmt"
 	"io"
 	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 type VersionSet struct {
@@ -15,22 +15,49 @@ type VersionSet struct {
 	current     *Version
 	compactPtrs [kLevelNum]compactPtr
 	cmp         *iComparer
+	opt         *Options
 
 	comparerName   []byte
-	nextFileNum    uint64
+	nextFileNum    uint64 // atomic, allocated by the background jobs without mutex
 	stJournalNum   uint64
 	stSeqNum       Sequence // current memtable start seq num
 	manifestFd     Fd
 	manifestWriter *JournalWriter // lazy init
+	manifestBroken bool           // the last write failed, the next edit is written into a new manifest
+	optionsFd      Fd
 
 	tableOperation *tableOperation
 
+	// the levels being compacted by the running compactions, the compactions
+	// which don't share any level can run concurrently
+	compactingLevels [kLevelNum]bool
+
+	// logAndApply releases the mutex while writing manifest, serialize it between the background jobs
+	manifestWriting bool
+	manifestCond    *sync.Cond
+
 	tableCache *TableCache
 
 	storage Storage
 
 	// todo move to db
 	snapshots *list.List
+
+	// column families share the file numbers, manifest and journal of the root,
+	// each family has its own VersionSet, root is nil for the default family
+	root       *VersionSet
+	familyID   uint32
+	familyName string
+	dropped    bool
+
+	// only used by the default family
+	families     map[uint32]*VersionSet
+	nextFamilyID uint32
+
+	// the tables being written by flush, compaction and ingestion, they are kept
+	// by removeObsoleteFiles until the edit adding them is applied or dropped
+	pendingMu      sync.Mutex
+	pendingOutputs map[uint64]struct{}
 }
 
 type Version struct {
@@ -40,21 +67,27 @@ type Version struct {
 	levels [kLevelNum]tFiles
 
 	// compaction
-	cScore float64
-	cLevel int
+	cScore  float64
+	cLevel  int
+	cScores [kLevelNum]float64
+
+	// seek compaction, set when the seek budget of file runs out
+	seekCompactFile  *tFile
+	seekCompactLevel int
 }
 
 func newVersion(vSet *VersionSet) *Version {
 	return &Version{
-		vSet: vSet,
+		vSet:          vSet,
+		BasicReleaser: &BasicReleaser{},
 	}
 }
 
 type vBuilder struct {
 	vSet     *VersionSet
-	base     *Version
-	inserted [kLevelNum]*tFileSortedSet
-	deleted  [kLevelNum]*uintSortedSet
+	base     *Version // nil when building from scratch, e.g. recover
+	inserted [kLevelNum]map[uint64]tFile
+	deleted  [kLevelNum]map[uint64]struct{}
 }
 
 func newBuilder(session *VersionSet, base *Version) *vBuilder {
@@ -63,10 +96,8 @@ func newBuilder(session *VersionSet, base *Version) *vBuilder {
 		base: base,
 	}
 	for i := 0; i < kLevelNum; i++ {
-		builder.inserted[i] = newTFileSortedSet()
-	}
-	for i := 0; i < kLevelNum; i++ {
-		builder.deleted[i] = newUintSortedSet()
+		builder.inserted[i] = make(map[uint64]tFile)
+		builder.deleted[i] = make(map[uint64]struct{})
 	}
 	return builder
 }
@@ -77,248 +108,60 @@ func (builder *vBuilder) apply(edit VersionEdit) {
 	}
 	for _, delTable := range edit.delTables {
 		level, number := delTable.level, delTable.number
-		builder.deleted[level].add(number)
+		builder.deleted[level][number] = struct{}{}
+		delete(builder.inserted[level], number)
 	}
 	for _, addTable := range edit.addedTables {
 		level, number := addTable.level, addTable.number
-		builder.deleted[level].remove(number)
-		builder.inserted[level].add(addTable)
+		delete(builder.deleted[level], number)
+		fd := Fd{FileType: KTableFile, Num: number}
+		t := newTFile(fd, addTable.size, addTable.imin, addTable.imax)
+		t.ctime = addTable.ctime
+		builder.inserted[level][number] = t
 	}
 }
 
+// saveTo the files of base and the inserted ones without the deleted ones,
+// level 0 is sorted by file number, the others by the smallest key
 func (builder *vBuilder) saveTo(v *Version) {
 
+	cmp := builder.vSet.cmp
 	for level := 0; level < kLevelNum; level++ {
-		baseFile := v.levels[level]
-		beginPos := 0
-		iter := builder.inserted[level].NewIterator()
-		v.levels[level] = make(tFiles, 0, len(baseFile)+builder.inserted[level].size) // reverse pre alloc capacity
-		for iter.Next() {
-			addTable, ok := iter.Value().(tFile)
-			if !ok {
-				panic("vBuilder iter convert value to tFile failed...")
+
+		var baseFiles tFiles
+		if builder.base != nil {
+			baseFiles = builder.base.levels[level]
+		}
+
+		files := make(tFiles, 0, len(baseFiles)+len(builder.inserted[level]))
+		for _, file := range baseFiles {
+			if _, ok := builder.inserted[level][file.fd.Num]; ok {
+				continue
 			}
-			pos := upperBound(baseFile, level, iter, builder.vSet.cmp)
-			for i := beginPos; i < pos; i++ {
-				builder.maybeAddFile(v, baseFile[i], level)
+			if _, ok := builder.deleted[level][file.fd.Num]; ok {
+				continue
 			}
-			builder.maybeAddFile(v, addTable, level)
-			beginPos = pos
+			files = append(files, file)
 		}
-
-		for i := beginPos; i < len(baseFile); i++ {
-			builder.maybeAddFile(v, baseFile[i], level)
+		for _, file := range builder.inserted[level] {
+			files = append(files, file)
 		}
-	}
-
-}
-
-func upperBound(s tFiles, level int, iter *BTreeIter, cmp BasicComparer) int {
-
-	ok, ikey, fileNum := decodeBinaryToTFile(iter.Key())
-	if !ok {
-		panic("leveldb decodeBinaryToTFile failed")
-	}
-
-	if level == 0 {
-		idx := sort.Search(len(s), func(i int) bool {
-			return s[i].fd.Num > fileNum
-		})
-		return idx
-	}
-	idx := sort.Search(len(s), func(i int) bool {
-		return cmp.Compare(s[i].iMax, ikey) > 0
-	})
-	return idx
-}
-
-func (builder *vBuilder) maybeAddFile(v *Version, file tFile, level int) {
-
-	if builder.deleted[level].contains(file.fd.Num) {
-		return
-	}
-
-	files := v.levels[level]
-	cmp := builder.vSet.cmp
-	if level > 0 && len(files) > 0 {
-		assert(cmp.Compare(files[len(files)-1].iMax, file.iMin) < 0)
-	}
-
-	v.levels[level] = append(v.levels[level], file)
-}
-
-type uintSortedSet struct {
-	*anySortedSet
-}
-
-func newUintSortedSet() *uintSortedSet {
-	uSet := &uintSortedSet{
-		anySortedSet: &anySortedSet{
-			BTree:                 InitBTree(3, &uint64Comparer{}),
-			anySortedSetEncodeKey: encodeUint64ToBinary,
-		},
-	}
-	return uSet
-}
-
-func encodeUint64ToBinary(item interface{}) (bool, []byte) {
-
-	num, ok := item.(uint64)
-	if !ok {
-		return false, nil
-	}
-
-	switch {
-	case num < uint64(1<<16)-1:
-		buf := make([]byte, 2)
-		binary.LittleEndian.PutUint16(buf, uint16(num))
-		return true, buf
-	case num < uint64(1<<32)-1:
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, uint32(num))
-		return true, buf
-	default:
-		buf := make([]byte, 8)
-		binary.LittleEndian.PutUint64(buf, num)
-		return true, buf
-	}
-}
-
-func decodeBinaryToUint64(b []byte) uint64 {
-
-	size := len(b)
-	var value uint64
-	switch {
-	case size == 2:
-		value = uint64(binary.LittleEndian.Uint16(b))
-	case size == 4:
-		value = uint64(binary.LittleEndian.Uint32(b))
-	case size == 8:
-		value = binary.LittleEndian.Uint64(b)
-	default:
-		panic("unsupport type decode to uint64")
-	}
-	return value
-}
-
-type uint64Comparer struct{}
-
-func (uc uint64Comparer) Compare(a, b []byte) int {
-	uinta, uintb := decodeBinaryToUint64(a), decodeBinaryToUint64(b)
-	if uinta < uintb {
-		return -1
-	} else if uinta == uintb {
-		return 0
-	} else {
-		return 1
-	}
-}
-
-func (uc uint64Comparer) Name() []byte {
-	return []byte("leveldb.uint64comparator")
-}
-
-type tFileSortedSet struct {
-	*anySortedSet
-}
-
-func newTFileSortedSet() *tFileSortedSet {
-	tSet := &tFileSortedSet{
-		anySortedSet: &anySortedSet{
-			BTree:                 InitBTree(3, &tFileComparer{}),
-			anySortedSetEncodeKey: encodeTFileToBinary,
-		},
-	}
-	return tSet
-}
-
-type tFileComparer struct {
-	*iComparer
-}
-
-func (tc *tFileComparer) Compare(a, b []byte) int {
-
-	ia := a[:len(a)-8]
-	ib := a[:len(b)-8]
-	r := tc.iComparer.Compare(ia, ib)
-	if r != 0 {
-		return r
-	}
-
-	if aNum, bNum := binary.LittleEndian.Uint64(a[len(a)-8:]), binary.LittleEndian.Uint64(b[len(b)-8:]); aNum < bNum {
-		return -1
-	}
-	return 1
-}
-
-func (tc *tFileComparer) Name() []byte {
-	return []byte("leveldb.tFilecomparator")
-}
-
-func encodeTFileToBinary(item interface{}) (bool, []byte) {
-	tFile, ok := item.(tFile)
-	if !ok {
-		return false, nil
-	}
-	fileNum := make([]byte, 8)
-	binary.LittleEndian.PutUint64(fileNum, tFile.fd.Num)
-	key := append(tFile.iMax, fileNum...)
-	return true, key
-}
-
-func decodeBinaryToTFile(b []byte) (bool, InternalKey, uint64) {
-	if len(b) < 16 {
-		return false, nil, 0
-	}
-	fileNumBuf := b[len(b)-8:]
-	fileNum := binary.LittleEndian.Uint64(fileNumBuf)
-	return true, InternalKey(b[:len(b)-8]), fileNum
-}
-
-type anySortedSet struct {
-	*BTree
-	anySortedSetEncodeKey
-	addValue bool
-	size     int
-}
-
-type anySortedSetEncodeKey func(item interface{}) (bool, []byte)
 
-func (set *anySortedSet) add(item interface{}) bool {
-	ok, key := set.anySortedSetEncodeKey(item)
-	if !ok {
-		panic("anySortedSet add item encode failed, please check...")
-	}
-	if !set.Has(key) {
-		if set.addValue {
-			set.Insert(key, item)
+		if level == 0 {
+			sort.Slice(files, func(i, j int) bool {
+				return files[i].fd.Num < files[j].fd.Num
+			})
 		} else {
-			set.Insert(key, nil)
+			sort.Slice(files, func(i, j int) bool {
+				return cmp.Compare(files[i].iMin, files[j].iMin) < 0
+			})
+			for i := 1; i < len(files); i++ {
+				assert(cmp.Compare(files[i-1].iMax, files[i].iMin) < 0)
+			}
 		}
-		set.size++
-		return true
+		v.levels[level] = files
 	}
-	return false
-}
 
-func (set *anySortedSet) remove(item interface{}) bool {
-	ok, key := set.anySortedSetEncodeKey(item)
-	if !ok {
-		panic("anySortedSet remove item encode failed, please check...")
-	}
-	ok = set.Remove(key)
-	if ok {
-		set.size--
-	}
-	return ok
-}
-
-func (set *anySortedSet) contains(item interface{}) bool {
-	ok, key := set.anySortedSetEncodeKey(item)
-	if !ok {
-		panic("anySortedSet contains item encode failed, please check...")
-	}
-	return set.Has(key)
 }
 
 // LogAndApply apply a new version and record change into manifest file
@@ -328,6 +171,26 @@ func (vSet *VersionSet) logAndApply(edit *VersionEdit, mutex *sync.RWMutex) erro
 
 	assertMutexHeld(mutex)
 
+	// the manifest is shared by the column families
+	root := vSet.rootSet()
+
+	for root.manifestWriting {
+		root.manifestCond.Wait()
+	}
+	root.manifestWriting = true
+	defer func() {
+		root.manifestWriting = false
+		root.manifestCond.Broadcast()
+	}()
+
+	if vSet.dropped {
+		return ErrColumnFamilyDropped
+	}
+
+	if vSet.root != nil {
+		edit.setColumnFamily(vSet.familyID)
+	}
+
 	/**
 	case 1: compactMemtable
 		edit.setReq(db.frozenSeqNum)
@@ -344,20 +207,21 @@ func (vSet *VersionSet) logAndApply(edit *VersionEdit, mutex *sync.RWMutex) erro
 	so we can let mem compact and table compact concurrently execute. when install new version, we need a lock
 	to protect.
 	*/
+	// the journal num is tracked by each family, the records of the family before it are persisted
 	if edit.hasRec(kJournalNum) {
 		assert(edit.journalNum >= vSet.stJournalNum)
-		assert(edit.journalNum < vSet.nextFileNum)
+		assert(edit.journalNum < atomic.LoadUint64(&root.nextFileNum))
 	} else {
 		edit.journalNum = vSet.stJournalNum
 	}
 
 	if edit.hasRec(kSeqNum) {
-		assert(edit.lastSeq >= vSet.stSeqNum)
+		assert(edit.lastSeq >= root.stSeqNum)
 	} else {
-		edit.lastSeq = vSet.stSeqNum
+		edit.lastSeq = root.stSeqNum
 	}
 
-	edit.setNextFile(vSet.nextFileNum)
+	edit.setNextFile(atomic.LoadUint64(&root.nextFileNum))
 
 	// apply new version
 	v := newVersion(vSet)
@@ -370,9 +234,9 @@ func (vSet *VersionSet) logAndApply(edit *VersionEdit, mutex *sync.RWMutex) erro
 
 	var (
 		writer         SequentialWriter
-		storage        = vSet.storage
-		manifestWriter = vSet.manifestWriter
-		manifestFd     = vSet.manifestFd
+		storage        = root.storage
+		manifestWriter = root.manifestWriter
+		manifestFd     = root.manifestFd
 		newManifest    bool
 		err            error
 	)
@@ -381,11 +245,12 @@ func (vSet *VersionSet) logAndApply(edit *VersionEdit, mutex *sync.RWMutex) erro
 		newManifest = true
 	}
 
-	if manifestWriter != nil && manifestWriter.size() >= kManifestSizeThreshold {
+	// the manifest may end with a partial record after a write error, roll over to a new one
+	if manifestWriter != nil && (root.manifestBroken || manifestWriter.size() >= kManifestSizeThreshold) {
 		newManifest = true
 		manifestFd = Fd{
-			FileType: KJournalFile,
-			Num:      vSet.allocFileNum(),
+			FileType: KDescriptorFile,
+			Num:      root.allocFileNum(),
 		}
 	}
 
@@ -393,20 +258,27 @@ func (vSet *VersionSet) logAndApply(edit *VersionEdit, mutex *sync.RWMutex) erro
 		writer, err = storage.Create(manifestFd)
 		if err == nil {
 			manifestWriter = NewJournalWriter(writer)
-			err = vSet.writeSnapShot(manifestWriter) // write current version snapshot into manifest
+			err = root.writeSnapShot(manifestWriter) // write current version snapshot into manifest
 		}
 	}
 
 	if err == nil {
-		edit.EncodeTo(manifestWriter)
-		err = edit.err
+		err = writeEditRecord(manifestWriter, edit)
+	}
+	if err == nil {
+		err = manifestWriter.Sync()
 	}
 
 	if err == nil {
 		err = storage.SetCurrent(manifestFd.Num)
+		if err == nil && newManifest && root.manifestWriter != nil {
+			vSet.logger().Infof("manifest rolled over from %s to %s", root.manifestFd, manifestFd)
+			_ = root.manifestWriter.Close()
+		}
 		if err == nil {
-			vSet.manifestFd = manifestFd
-			vSet.manifestWriter = manifestWriter
+			root.manifestFd = manifestFd
+			root.manifestWriter = manifestWriter
+			root.manifestBroken = false
 		}
 	}
 
@@ -414,14 +286,82 @@ func (vSet *VersionSet) logAndApply(edit *VersionEdit, mutex *sync.RWMutex) erro
 
 	if err == nil {
 		vSet.appendVersion(v)
-		vSet.stSeqNum = edit.lastSeq
+		root.stSeqNum = edit.lastSeq
 		vSet.stJournalNum = edit.journalNum
+	} else if newManifest {
+		if manifestWriter != nil {
+			_ = manifestWriter.Close()
+		}
+		_ = storage.Remove(manifestFd)
 	} else {
-		if newManifest {
-			err = storage.Remove(manifestFd)
+		root.manifestBroken = true
+	}
+
+	return err
+}
+
+// writeSnapShot write the current version as a full edit record into the manifest
+// required: mutex held
+func (vSet *VersionSet) writeSnapShot(w *JournalWriter) error {
+
+	edit := &VersionEdit{}
+	edit.setCompareName(vSet.cmp.Name())
+	edit.setLogNum(vSet.stJournalNum)
+	edit.setNextFile(atomic.LoadUint64(&vSet.nextFileNum))
+	edit.setLastSeq(vSet.stSeqNum)
+
+	for level, cPtr := range vSet.compactPtrs {
+		if cPtr.ikey != nil {
+			edit.addCompactPtr(level, cPtr.ikey)
+		}
+	}
+
+	if vSet.current != nil {
+		for level, tFiles := range vSet.current.levels {
+			for _, t := range tFiles {
+				edit.addTableFile(level, t)
+			}
+		}
+	}
+
+	if err := writeEditRecord(w, edit); err != nil {
+		return err
+	}
+
+	// each column family is a record, created by kAddColumnFamily
+	for _, family := range vSet.liveFamilies() {
+		edit = &VersionEdit{}
+		edit.setColumnFamily(family.familyID)
+		edit.addColumnFamily(family.familyName, family.cmp.uCmp.Name())
+		edit.setLogNum(family.stJournalNum)
+		edit.setNextFile(atomic.LoadUint64(&vSet.nextFileNum))
+		edit.setLastSeq(vSet.stSeqNum)
+		for level, cPtr := range family.compactPtrs {
+			if cPtr.ikey != nil {
+				edit.addCompactPtr(level, cPtr.ikey)
+			}
+		}
+		for level, tFiles := range family.current.levels {
+			for _, t := range tFiles {
+				edit.addTableFile(level, t)
+			}
+		}
+		if err := writeEditRecord(w, edit); err != nil {
+			return err
 		}
 	}
 
+	return nil
+}
+
+// writeEditRecord encode the whole edit as one journal record
+func writeEditRecord(w *JournalWriter, edit *VersionEdit) error {
+	var record bytes.Buffer
+	edit.EncodeTo(&record)
+	if edit.err != nil {
+		return edit.err
+	}
+	_, err := w.Write(record.Bytes())
 	return err
 }
 
@@ -441,6 +381,7 @@ func (vSet *VersionSet) appendVersion(v *Version) {
 func finalize(v *Version) {
 
 	var (
+		opt       = v.vSet.opt
 		bestLevel int
 		bestScore float64
 	)
@@ -448,11 +389,13 @@ func finalize(v *Version) {
 	for level := 0; level < len(v.levels); level++ {
 		if level == 0 {
 			length := len(v.levels[level])
-			bestScore = float64(length) / kLevel0CompactionTrigger
+			bestScore = float64(length) / float64(opt.Level0FileNumCompactionTrigger)
 			bestLevel = 0
+			v.cScores[level] = bestScore
 		} else {
 			totalSize := uint64(v.levels[level].size())
-			score := float64(totalSize / maxBytesForLevel(level))
+			score := float64(totalSize) / float64(maxBytesForLevel(uint64(opt.MaxBytesForLevelBase), level))
+			v.cScores[level] = score
 			if score > bestScore {
 				bestScore = score
 				bestLevel = level
@@ -464,6 +407,31 @@ func finalize(v *Version) {
 	v.cLevel = bestLevel
 }
 
+func (vSet *VersionSet) needCompaction() bool {
+	switch vSet.opt.CompactionStyle {
+	case CompactionStyleUniversal:
+		return vSet.needUniversalCompaction()
+	case CompactionStyleFIFO:
+		return vSet.needFIFOCompaction()
+	}
+	c := vSet.current
+	_, sizeCompaction := vSet.pickSizeCompactionLevel()
+	return sizeCompaction ||
+		(c.seekCompactFile != nil && !vSet.levelsCompacting(c.seekCompactLevel, c.seekCompactLevel+1))
+}
+
+// pickCompactionByStyle pick a compaction by the compaction style, return nil if no need to compact
+// required: mutex held
+func (vSet *VersionSet) pickCompactionByStyle() *compaction1 {
+	switch vSet.opt.CompactionStyle {
+	case CompactionStyleUniversal:
+		return vSet.pickUniversalCompaction()
+	case CompactionStyleFIFO:
+		return vSet.pickFIFOCompaction()
+	}
+	return vSet.pickCompaction1()
+}
+
 func (vSet *VersionSet) levelFilesNum(level int) int {
 	c := vSet.current
 	c.Ref()
@@ -471,14 +439,23 @@ func (vSet *VersionSet) levelFilesNum(level int) int {
 	return len(c.levels[level])
 }
 
+// level0StallFilesNum the level0 files num used to slow down or stop the writes,
+// fifo never compacts level0 files, so writes are never stalled by them
+func (vSet *VersionSet) level0StallFilesNum() int {
+	if vSet.opt.CompactionStyle == CompactionStyleFIFO {
+		return 0
+	}
+	return vSet.levelFilesNum(0)
+}
+
 func (vSet *VersionSet) recover(manifest Fd) (err error) {
 
 	var (
-		hasComparerName, hasLogFileNum, hasNextFileNum bool
-		comparerName                                   []byte
-		logFileNum                                     uint64
-		seqNum                                         Sequence
-		nextFileNum                                    uint64
+		hasComparerName, hasLogFileNum, hasNextFileNum, hasSeqNum bool
+		comparerName                                              []byte
+		logFileNum                                                uint64
+		seqNum                                                    Sequence
+		nextFileNum                                               uint64
 	)
 
 	reader, rErr := vSet.storage.Open(manifest)
@@ -486,22 +463,26 @@ func (vSet *VersionSet) recover(manifest Fd) (err error) {
 		err = rErr
 		return
 	}
+	defer reader.Close()
+
+	// the builders of the non default families
+	familyBuilders := make(map[uint32]*vBuilder)
 
 	var (
-		edit     VersionEdit
-		vBuilder vBuilder
-		version  Version
+		edit    VersionEdit
+		builder = newBuilder(vSet, nil)
+		version = newVersion(vSet)
 	)
 
 	journalReader := NewJournalReader(reader)
-	vBuilder.vSet = vSet
 	for {
 
-		chunkReader, err := journalReader.NextChunk()
-		if err == io.EOF {
+		chunkReader, cErr := journalReader.NextChunk()
+		if cErr == io.EOF {
 			break
 		}
-		if err != nil {
+		if cErr != nil {
+			err = cErr
 			return
 		}
 
@@ -526,11 +507,23 @@ func (vSet *VersionSet) recover(manifest Fd) (err error) {
 			nextFileNum = edit.nextFileNum
 		}
 
+		if edit.hasRec(kColumnFamily) && edit.familyID != kDefaultColumnFamilyID {
+			if fErr := vSet.recoverFamilyEdit(&edit, familyBuilders); fErr != nil {
+				return fErr
+			}
+			edit.reset()
+			continue
+		}
+
 		if edit.hasRec(kJournalNum) {
 			hasLogFileNum = true
 			logFileNum = edit.journalNum
 		}
-		vBuilder.apply(edit)
+		if edit.hasRec(kSeqNum) {
+			hasSeqNum = true
+			seqNum = edit.lastSeq
+		}
+		builder.apply(edit)
 		edit.reset()
 	}
 
@@ -549,29 +542,83 @@ func (vSet *VersionSet) recover(manifest Fd) (err error) {
 		return
 	}
 
+	if !hasSeqNum {
+		err = NewErrCorruption("missing last seq num")
+		return
+	}
+
 	vSet.markFileUsed(logFileNum)
 	vSet.markFileUsed(nextFileNum)
 
-	vBuilder.saveTo(&version)
-	finalize(&version)
-	vSet.appendVersion(&version)
-	vSet.current = &version
+	builder.saveTo(version)
+	finalize(version)
+	vSet.appendVersion(version)
+	vSet.current = version
 	vSet.manifestFd = Fd{
 		FileType: KDescriptorFile,
 		Num:      nextFileNum,
 	}
-	vSet.nextFileNum = nextFileNum + 1
+	atomic.StoreUint64(&vSet.nextFileNum, nextFileNum+1)
 	vSet.stSeqNum = seqNum
 	vSet.stJournalNum = logFileNum
 	vSet.comparerName = comparerName
+
+	for id, builder := range familyBuilders {
+		family := vSet.families[id]
+		v := newVersion(family)
+		builder.saveTo(v)
+		finalize(v)
+		family.appendVersion(v)
+	}
 	return
 }
 
+// recoverFamilyEdit apply the edit of a non default family, the edits of dropped families are skipped
+func (vSet *VersionSet) recoverFamilyEdit(edit *VersionEdit, builders map[uint32]*vBuilder) error {
+
+	id := edit.familyID
+	if id >= vSet.nextFamilyID {
+		vSet.nextFamilyID = id + 1
+	}
+
+	if edit.hasRec(kAddColumnFamily) {
+		name := string(edit.familyName)
+		family := vSet.newFamilyVersionSet(id, name, vSet.opt.ColumnFamilies[name])
+		if !bytes.Equal(family.cmp.uCmp.Name(), edit.familyComparer) {
+			return NewErrCorruption(fmt.Sprintf("comparer of column family %s mismatches, %s != %s",
+				name, family.cmp.uCmp.Name(), edit.familyComparer))
+		}
+		vSet.families[id] = family
+		builders[id] = newBuilder(family, nil)
+	}
+
+	family, ok := vSet.families[id]
+	if !ok {
+		return nil
+	}
+
+	if edit.hasRec(kDropColumnFamily) {
+		delete(vSet.families, id)
+		delete(builders, id)
+		return nil
+	}
+
+	if edit.hasRec(kJournalNum) {
+		family.stJournalNum = edit.journalNum
+	}
+	builders[id].apply(*edit)
+	return nil
+}
+
 func (vSet *VersionSet) getCurrent() *Version {
 	return vSet.current
 }
 
 func (vSet *VersionSet) addLiveFiles(expected map[Fd]struct{}) {
+	// the dropped families are included, their versions may be pinned by the running jobs
+	for _, family := range vSet.families {
+		family.addLiveFiles(expected)
+	}
 	ele := vSet.versions.Front()
 	for ele != nil {
 		ver := ele.Value.(*Version)
@@ -602,12 +649,33 @@ const (
 	kStatCorruption
 )
 
-func (v *Version) get(ikey InternalKey, value *[]byte) (err error) {
+// seekStat the first file probed by Version.get when more than one file probed
+type seekStat struct {
+	seekFile      *tFile
+	seekFileLevel int
+}
+
+func (v *Version) get(ikey InternalKey, value *[]byte, sStat *seekStat) (err error) {
 
 	userKey := ikey.ukey()
 	stat := kStatNotFound
 
+	var (
+		firstFile  *tFile
+		firstLevel int
+	)
+
 	match := func(level int, tFile tFile) bool {
+
+		// charge the first file if the key is probed in more than one file
+		if firstFile == nil {
+			firstFile = &tFile
+			firstLevel = level
+		} else if sStat.seekFile == nil {
+			sStat.seekFile = firstFile
+			sStat.seekFileLevel = firstLevel
+		}
+
 		getErr := v.vSet.tableCache.Get(ikey, tFile, func(rkey InternalKey, rValue []byte) {
 			ukey, kt, _, pErr := parseInternalKey(rkey)
 			if pErr != nil {
@@ -624,7 +692,9 @@ func (v *Version) get(ikey InternalKey, value *[]byte) (err error) {
 			return
 		})
 
-		if getErr != nil {
+		if getErr == ErrNotFound {
+			return true
+		} else if getErr != nil {
 			err = getErr
 			return false
 		}
@@ -659,6 +729,53 @@ func (v *Version) get(ikey InternalKey, value *[]byte) (err error) {
 	return
 }
 
+// latestSequence the sequence of the newest entry of the user key of ikey in tables, deletion included,
+// found is false if the key is not in any table
+func (v *Version) latestSequence(ikey InternalKey) (seq Sequence, found bool, err error) {
+
+	userKey := ikey.ukey()
+
+	match := func(level int, tFile tFile) bool {
+		getErr := v.vSet.tableCache.Get(ikey, tFile, func(rkey InternalKey, rValue []byte) {
+			ukey, _, rSeq, pErr := parseInternalKey(rkey)
+			if pErr != nil {
+				err = NewErrCorruption("leveldb/get key corruption")
+			} else if bytes.Compare(ukey, userKey) == 0 {
+				seq = Sequence(rSeq)
+				found = true
+			}
+		})
+
+		if getErr == ErrNotFound {
+			return true
+		} else if getErr != nil {
+			err = getErr
+		}
+		// the newer levels are visited first
+		return err == nil && !found
+	}
+
+	v.foreachOverlapping(ikey, match)
+	return
+}
+
+// updateSeekStat charge the seek file, return true if the seek budget of file runs out.
+// the budget is shared by the versions, but only the current version is marked to be compacted,
+// the old versions are never picked
+// required: mutex held
+func (v *Version) updateSeekStat(sStat seekStat) bool {
+	f := sStat.seekFile
+	if f == nil || f.seekLeft == nil {
+		return false
+	}
+	if atomic.AddInt32(f.seekLeft, -1) <= 0 && v == v.vSet.current && v.seekCompactFile == nil {
+		v.seekCompactFile = f
+		v.seekCompactLevel = sStat.seekFileLevel
+		return true
+	}
+	return false
+}
+
 func (v *Version) foreachOverlapping(ikey InternalKey, f func(level int, tFile tFile) bool) {
 	tmp := make([]tFile, 0)
 	ukey := ikey.ukey()
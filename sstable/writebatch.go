@@ -2,7 +2,9 @@ package sstable
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"sync"
 )
 
@@ -12,31 +14,79 @@ type WriteBatch struct {
 	scratch [binary.MaxVarintLen64]byte
 	rep     []byte
 	once    sync.Once
-}
 
-func (wb *WriteBatch) Put(key, value []byte) {
+	// the non default column families written by the batch
+	families []uint32
+}
 
+func (wb *WriteBatch) init() {
 	wb.once.Do(func() {
-		wb.rep = make([]byte, kWriteBatchHeaderSize)
+		if len(wb.rep) < kWriteBatchHeaderSize {
+			wb.rep = make([]byte, kWriteBatchHeaderSize)
+		}
 	})
+}
 
+func (wb *WriteBatch) Put(key, value []byte) {
+	wb.init()
 	wb.count++
 	wb.rep = append(wb.rep, kTypeValue)
-	n := binary.PutUvarint(wb.scratch[:], uint64(len(key)))
-	wb.rep = append(wb.rep, wb.scratch[:n]...)
-	wb.rep = append(wb.rep, key...)
-
-	n = binary.PutUvarint(wb.scratch[:], uint64(len(value)))
-	wb.rep = append(wb.rep, wb.scratch[:n]...)
-	wb.rep = append(wb.rep, value...)
+	wb.appendSlice(key)
+	wb.appendSlice(value)
 }
 
 func (wb *WriteBatch) Delete(key []byte) {
+	wb.init()
 	wb.count++
 	wb.rep = append(wb.rep, kTypeDel)
-	n := binary.PutUvarint(wb.scratch[:], uint64(len(key)))
+	wb.appendSlice(key)
+}
+
+// PutCF put the key into the column family, the records of the default family are the same as Put
+func (wb *WriteBatch) PutCF(h *ColumnFamilyHandle, key, value []byte) {
+	if h.id == kDefaultColumnFamilyID {
+		wb.Put(key, value)
+		return
+	}
+	wb.init()
+	wb.count++
+	wb.rep = append(wb.rep, kTypeColumnFamilyValue)
+	wb.appendFamily(h.id)
+	wb.appendSlice(key)
+	wb.appendSlice(value)
+}
+
+func (wb *WriteBatch) DeleteCF(h *ColumnFamilyHandle, key []byte) {
+	if h.id == kDefaultColumnFamilyID {
+		wb.Delete(key)
+		return
+	}
+	wb.init()
+	wb.count++
+	wb.rep = append(wb.rep, kTypeColumnFamilyDel)
+	wb.appendFamily(h.id)
+	wb.appendSlice(key)
+}
+
+func (wb *WriteBatch) appendSlice(p []byte) {
+	n := binary.PutUvarint(wb.scratch[:], uint64(len(p)))
+	wb.rep = append(wb.rep, wb.scratch[:n]...)
+	wb.rep = append(wb.rep, p...)
+}
+
+func (wb *WriteBatch) appendFamily(id uint32) {
+	n := binary.PutUvarint(wb.scratch[:], uint64(id))
 	wb.rep = append(wb.rep, wb.scratch[:n]...)
-	wb.rep = append(wb.rep, key...)
+	wb.addFamily(id)
+}
+
+func (wb *WriteBatch) addFamily(id uint32) {
+	for _, family := range wb.families {
+		if family == id {
+			return
+		}
+	}
+	wb.families = append(wb.families, id)
 }
 
 func (wb *WriteBatch) SetSequence(seq Sequence) {
@@ -49,9 +99,103 @@ func (wb *WriteBatch) Contents() []byte {
 	return wb.rep[:]
 }
 
+// Data the encoded batch, which can be shipped to other processes and restored by NewWriteBatchFromContents.
+// the returned slice is valid until the batch modified
+func (wb *WriteBatch) Data() []byte {
+	wb.init()
+	return wb.Contents()
+}
+
+// NewWriteBatchFromContents decode the batch encoded by Data, the contents are copied
+func NewWriteBatchFromContents(p []byte) (*WriteBatch, error) {
+	wb := &WriteBatch{}
+	if err := wb.SetContents(p); err != nil {
+		return nil, err
+	}
+	return wb, nil
+}
+
+// SetContents replace the batch with the encoded batch p, the batch is unchanged if p is invalid
+func (wb *WriteBatch) SetContents(p []byte) error {
+
+	if len(p) < kWriteBatchHeaderSize {
+		return NewErrCorruption("batch less than header size")
+	}
+
+	decoded := WriteBatch{
+		rep:   append([]byte(nil), p...),
+		seq:   Sequence(binary.LittleEndian.Uint64(p[:kWriteBatchSeqSize])),
+		count: int(binary.LittleEndian.Uint32(p[kWriteBatchSeqSize:kWriteBatchHeaderSize])),
+	}
+
+	// validate the records
+	err := decoded.foreach(func(familyID uint32, kt keyType, ukey []byte, seq Sequence, value []byte) error {
+		if familyID != kDefaultColumnFamilyID {
+			decoded.addFamily(familyID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	wb.init()
+	wb.rep = decoded.rep
+	wb.seq = decoded.seq
+	wb.count = decoded.count
+	wb.families = decoded.families
+	return nil
+}
+
+// Handler receive the records of WriteBatch.Iterate in order, the iteration stops at the first error
+type Handler interface {
+	Put(key, value []byte) error
+	Delete(key []byte) error
+}
+
+// ColumnFamilyHandler receive the records of the non default column families too,
+// Iterate returns ErrBatchColumnFamily for them if the handler is not a ColumnFamilyHandler
+type ColumnFamilyHandler interface {
+	Handler
+	PutCF(familyID uint32, key, value []byte) error
+	DeleteCF(familyID uint32, key []byte) error
+}
+
+// Iterate call the handler for each record of batch, the key and value are valid only in the callback
+func (wb *WriteBatch) Iterate(h Handler) error {
+	cfh, _ := h.(ColumnFamilyHandler)
+	return wb.foreach(func(familyID uint32, kt keyType, ukey []byte, seq Sequence, value []byte) error {
+		if familyID == kDefaultColumnFamilyID {
+			if kt == keyTypeDel {
+				return h.Delete(ukey)
+			}
+			return h.Put(ukey, value)
+		}
+		if cfh == nil {
+			return fmt.Errorf("%w, family %d", ErrBatchColumnFamily, familyID)
+		}
+		if kt == keyTypeDel {
+			return cfh.DeleteCF(familyID, ukey)
+		}
+		return cfh.PutCF(familyID, ukey, value)
+	})
+}
+
 func (wb *WriteBatch) Reset() {
+	wb.init()
 	wb.count = 0
 	wb.rep = wb.rep[:kWriteBatchHeaderSize] // resize to header
+	wb.families = wb.families[:0]
+}
+
+// truncate discard the records after size, count is the number of records kept
+func (wb *WriteBatch) truncate(size, count int) {
+	wb.init()
+	if size < kWriteBatchHeaderSize {
+		size = kWriteBatchHeaderSize
+	}
+	wb.rep = wb.rep[:size]
+	wb.count = count
 }
 
 func (wb *WriteBatch) Len() int {
@@ -67,8 +211,12 @@ func (wb *WriteBatch) Capacity() int {
 }
 
 func (dst *WriteBatch) append(src *WriteBatch) {
+	dst.init()
 	dst.count += src.count
-	dst.rep = append(dst.rep, src.rep...)
+	dst.rep = append(dst.rep, src.rep[kWriteBatchHeaderSize:]...)
+	for _, id := range src.families {
+		dst.addFamily(id)
+	}
 }
 
 type writer struct {
@@ -76,6 +224,10 @@ type writer struct {
 	done  bool
 	err   error
 	cv    *sync.Cond
+
+	// check is called when the writer becomes the head, the batch is not written if it fails,
+	// e.g. the conflict check of transaction. the writer is never merged into others' group
+	check func() error
 }
 
 func newWriter(batch *WriteBatch, mutex *sync.RWMutex) *writer {
@@ -99,98 +251,122 @@ func buildBatchGroup(reader SequentialReader, seqNum Sequence) (wb WriteBatch, e
 }
 
 func decodeBatchChunk(p []byte, seqNum Sequence) (wb WriteBatch, err error) {
-	if len(p) < kWriteBatchHeaderSize {
-		err = NewErrCorruption("batch group header less than header size")
-		return
-	}
-
-	seq := Sequence(binary.LittleEndian.Uint64(p[:kWriteBatchHeaderSize]))
-	batchCount := binary.LittleEndian.Uint32(p[kWriteBatchHeaderSize:kWriteBatchHeaderSize])
-	assert(seq >= seqNum)
-	assert(seq+Sequence(batchCount) > seqNum)
-
-	for i := uint32(0); i < batchCount; i++ {
-		offset, err := decodeBatchData(p, &wb, seq+Sequence(i))
-		if err != nil {
-			return
-		}
-		p = p[offset:]
-	}
-
+	err = wb.SetContents(p)
 	return
 }
 
-func decodeBatchData(p []byte, wb *WriteBatch, seq Sequence) (offset int, err error) {
-	var (
-		kLen, vLen uint64
-		value      []byte
-		m, n       int
-	)
-
-	kt := p[m]
-	m += 1
-	kLen, n = binary.Uvarint(p[m:])
-	m += n
-
-	uKey := p[m : m+int(kLen)]
-	m += int(kLen)
+// ingestMarker report whether the batch is the journal record of an ingestion, which has no record
+// and consumes its own sequence, see DB.IngestExternalFile. the empty batches are never written into journal
+func (wb *WriteBatch) ingestMarker() bool {
+	return wb.count == 0
+}
 
-	if kt == byte(keyTypeValue) {
-		vLen, n = binary.Uvarint(p[m:])
-		m += n
-		value = p[m : m+int(vLen)]
-		m += int(vLen)
+// nextSequence the first sequence after the batch
+func (wb *WriteBatch) nextSequence() Sequence {
+	if wb.ingestMarker() {
+		return wb.seq + 1
 	}
+	return wb.seq + Sequence(wb.count)
+}
 
-	assert(m+int(kLen)+int(vLen) <= len(p))
-
-	iKey := buildInternalKey(nil, uKey, keyType(kt), seq)
-	wb.Put(iKey, value)
-
-	offset = m
-	return
+// stale report whether the records are already persisted in tables, i.e. all of them are not newer than seqNum.
+// seqNum only covers the default family, the other families are recovered by their journal numbers
+func (wb *WriteBatch) stale(seqNum Sequence) bool {
+	return len(wb.families) == 0 && wb.seq+Sequence(wb.count) <= seqNum+1
 }
 
-func (wb *WriteBatch) insertInto(memDb *MemDB) error {
-	assert(memDb != nil)
-	err := wb.foreach(func(kt keyType, ukey []byte, seq Sequence, value []byte) error {
-		if kt == keyTypeValue {
+// insertInto apply the records to the mems of their families, the records of the families
+// not in mems are skipped, e.g. dropped or already flushed
+func (wb *WriteBatch) insertInto(mems map[uint32]*MemDB) error {
+	return wb.foreach(func(familyID uint32, kt keyType, ukey []byte, seq Sequence, value []byte) error {
+		memDb, ok := mems[familyID]
+		if !ok {
+			return nil
+		}
+		if kt == keyTypeDel {
 			return memDb.Del(ukey, seq)
-		} else {
-			return memDb.Put(ukey, seq, value)
 		}
+		return memDb.Put(ukey, seq, value)
 	})
-	return err
 }
 
-func (wb *WriteBatch) foreach(fn func(kt keyType, ukey []byte, seq Sequence, value []byte) error) error {
+/**
+batch record
+
+	| type (1 byte) | family id (uvarint, only column family types) | key len (uvarint) | key | value len (uvarint) | value |
+
+	the value is absent for the delete types
+**/
 
-	pos := kWriteBatchHeaderSize
+func (wb *WriteBatch) foreach(fn func(familyID uint32, kt keyType, ukey []byte, seq Sequence, value []byte) error) error {
+
+	if len(wb.rep) < kWriteBatchHeaderSize {
+		// never written
+		return nil
+	}
+
+	p := wb.rep[kWriteBatchHeaderSize:]
 
 	for i := 0; i < wb.count; i++ {
 
+		if len(p) == 0 {
+			return NewErrCorruption("batch record truncated")
+		}
+
 		var (
+			familyID    uint64
+			kt          keyType
 			ukey, value []byte
+			err         error
 		)
 
-		kt := wb.rep[pos]
-		pos += 1
-		keyLen, m := binary.Uvarint(wb.rep[pos:])
-		pos += m
-		ukey = wb.rep[m : m+int(keyLen)]
-
-		if keyType(kt) == keyTypeValue {
-			pos += int(keyLen)
-			valLen, m := binary.Uvarint(wb.rep[pos:])
-			pos += m
-			value = wb.rep[pos : pos+int(valLen)]
+		rt := p[0]
+		p = p[1:]
+
+		switch rt {
+		case kTypeValue, kTypeColumnFamilyValue:
+			kt = keyTypeValue
+		case kTypeDel, kTypeColumnFamilyDel:
+			kt = keyTypeDel
+		default:
+			return NewErrCorruption(fmt.Sprintf("unknown batch record type %d", rt))
 		}
 
-		err := fn(keyType(kt), ukey, wb.seq+Sequence(i), value)
+		if rt == kTypeColumnFamilyValue || rt == kTypeColumnFamilyDel {
+			var n int
+			familyID, n = binary.Uvarint(p)
+			if n <= 0 || familyID > math.MaxUint32 {
+				return NewErrCorruption("invalid column family of batch record")
+			}
+			p = p[n:]
+		}
+
+		if ukey, p, err = readBatchSlice(p); err != nil {
+			return err
+		}
+		if kt == keyTypeValue {
+			if value, p, err = readBatchSlice(p); err != nil {
+				return err
+			}
+		}
+
+		err = fn(uint32(familyID), kt, ukey, wb.seq+Sequence(i), value)
 		if err != nil {
 			return err
 		}
 	}
 
+	if len(p) != 0 {
+		return NewErrCorruption(fmt.Sprintf("%d bytes after the last batch record", len(p)))
+	}
 	return nil
 }
+
+func readBatchSlice(p []byte) (slice []byte, rest []byte, err error) {
+	n, m := binary.Uvarint(p)
+	if m <= 0 || n > uint64(len(p)-m) {
+		err = NewErrCorruption("batch record truncated")
+		return
+	}
+	return p[m : m+int(n)], p[m+int(n):], nil
+}
@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+package sstable
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testing.F requires go1.18
+func FuzzWriteBatchDecode(f *testing.F) {
+
+	wb := &WriteBatch{}
+	wb.Put([]byte("a"), []byte("1"))
+	wb.Delete([]byte("b"))
+	wb.PutCF(&ColumnFamilyHandle{id: 2}, []byte("c"), []byte("3"))
+	f.Add(wb.Data())
+	f.Add(make([]byte, kWriteBatchHeaderSize))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, p []byte) {
+		decoded, err := NewWriteBatchFromContents(p)
+		if err != nil {
+			return
+		}
+		// a valid batch is encoded back as it is, and decoded into the same records
+		if !bytes.Equal(decoded.Data(), p) {
+			t.Fatalf("expect %x encoded back, got %x", p, decoded.Data())
+		}
+		records := 0
+		if err := decoded.Iterate(&familyRecordHandler{}); err != nil {
+			t.Fatal(err)
+		}
+		_ = decoded.foreach(func(familyID uint32, kt keyType, ukey []byte, seq Sequence, value []byte) error {
+			records++
+			return nil
+		})
+		if records != decoded.Len() {
+			t.Fatalf("expect %d records, got %d", decoded.Len(), records)
+		}
+	})
+}
@@ -0,0 +1,376 @@
+package sstable
+
+import "math/rand"
+
+/**
+WriteBatchWithIndex keep a skiplist over the records of batch, so the uncommitted writes are readable
+
+	batch:  | header | put a=1 | put b=2 | del a | put c=3 |
+	index:  a -> del a, b -> put b=2, c -> put c=3   (the newest record of each key)
+
+	GetFromBatchAndDB: found in index ? -> put -> value
+	                                    \-> del -> ErrNotFound
+	                   \-> db.Get
+	NewIteratorWithBase: merge the index and the base iterator, the batch wins on the same key,
+	                     the keys deleted in batch are hidden
+**/
+
+// WriteBatchWithIndex the records of default column family are indexed only
+type WriteBatchWithIndex struct {
+	batch *WriteBatch
+	index *batchIndex
+	cmp   BasicComparer
+}
+
+// NewWriteBatchWithIndex nil cmp means DefaultComparer, it should be the comparer of the DB read together
+func NewWriteBatchWithIndex(cmp BasicComparer) *WriteBatchWithIndex {
+	if cmp == nil {
+		cmp = DefaultComparer
+	}
+	return &WriteBatchWithIndex{
+		batch: &WriteBatch{},
+		index: newBatchIndex(cmp),
+		cmp:   cmp,
+	}
+}
+
+func (wbi *WriteBatchWithIndex) Put(key, value []byte) {
+	offset := wbi.batch.Size()
+	if offset == 0 {
+		offset = kWriteBatchHeaderSize
+	}
+	wbi.batch.Put(key, value)
+	wbi.index.put(key, offset)
+}
+
+func (wbi *WriteBatchWithIndex) Delete(key []byte) {
+	offset := wbi.batch.Size()
+	if offset == 0 {
+		offset = kWriteBatchHeaderSize
+	}
+	wbi.batch.Delete(key)
+	wbi.index.put(key, offset)
+}
+
+// Batch the underlying batch to be written by DB.Write
+func (wbi *WriteBatchWithIndex) Batch() *WriteBatch {
+	return wbi.batch
+}
+
+func (wbi *WriteBatchWithIndex) Len() int {
+	return wbi.batch.Len()
+}
+
+func (wbi *WriteBatchWithIndex) Reset() {
+	wbi.batch.Reset()
+	wbi.index = newBatchIndex(wbi.cmp)
+}
+
+// get the newest record of key in batch, ok is false if the key is not written by batch
+func (wbi *WriteBatchWithIndex) get(key []byte) (kt keyType, value []byte, ok bool, err error) {
+	n := wbi.index.findGreaterOrEqual(key)
+	if n == nil || wbi.cmp.Compare(n.key, key) != 0 {
+		return
+	}
+	kt, value, err = wbi.record(n.offset)
+	return kt, value, err == nil, err
+}
+
+// record parse the record at offset of batch
+func (wbi *WriteBatchWithIndex) record(offset int) (kt keyType, value []byte, err error) {
+	rep := wbi.batch.rep
+	assert(offset < len(rep))
+
+	rt := rep[offset]
+	_, p, err := readBatchSlice(rep[offset+1:])
+	if err != nil {
+		return
+	}
+	switch rt {
+	case kTypeValue:
+		kt = keyTypeValue
+		value, _, err = readBatchSlice(p)
+	case kTypeDel:
+		kt = keyTypeDel
+	default:
+		err = NewErrCorruption("unexpected batch record type of index")
+	}
+	return
+}
+
+// GetFromBatch read the key written by batch only, ErrNotFound is returned if it's deleted or not written
+func (wbi *WriteBatchWithIndex) GetFromBatch(key []byte) ([]byte, error) {
+	kt, value, ok, err := wbi.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || kt == keyTypeDel {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+// GetFromBatchAndDB read the key from batch first, then from db if batch has not written it
+func (wbi *WriteBatchWithIndex) GetFromBatchAndDB(db *DB, key []byte) ([]byte, error) {
+	kt, value, ok, err := wbi.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return db.Get(key)
+	}
+	if kt == keyTypeDel {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+// NewIteratorWithBase iterate the user keys of batch merged with base, e.g. the iterator of DB.NewIterator.
+// nil base iterates the batch only. the base is UnRef when the returned iterator released.
+// the batch should not be written during iteration
+func (wbi *WriteBatchWithIndex) NewIteratorWithBase(base Iterator) Iterator {
+	if base == nil {
+		base = &emptyIterator{}
+	}
+	return newBaseDeltaIterator(base, wbi)
+}
+
+type batchIndexNode struct {
+	key    []byte
+	offset int // the offset of the newest record of key in batch
+	next   []*batchIndexNode
+}
+
+// batchIndex a single goroutine skiplist, the keys are never removed
+type batchIndex struct {
+	head   *batchIndexNode
+	height int
+	rand   *rand.Rand
+	cmp    BasicComparer
+	prev   [kMaxHeight]*batchIndexNode
+}
+
+func newBatchIndex(cmp BasicComparer) *batchIndex {
+	return &batchIndex{
+		head:   &batchIndexNode{next: make([]*batchIndexNode, kMaxHeight)},
+		height: 1,
+		rand:   rand.New(rand.NewSource(0xdeadbeef)),
+		cmp:    cmp,
+	}
+}
+
+func (bi *batchIndex) randHeight() int {
+	height := 1
+	for height < kMaxHeight && bi.rand.Int()%kBranching == 0 {
+		height++
+	}
+	return height
+}
+
+// findGreaterOrEqual find the first node >= key, fill prev if it's not nil
+func (bi *batchIndex) findGreaterOrEqual(key []byte) *batchIndexNode {
+	n := bi.head
+	for i := bi.height - 1; i >= 0; i-- {
+		for n.next[i] != nil && bi.cmp.Compare(n.next[i].key, key) < 0 {
+			n = n.next[i]
+		}
+		bi.prev[i] = n
+	}
+	return n.next[0]
+}
+
+// put point the key to the record at offset, the older record of key is shadowed
+func (bi *batchIndex) put(key []byte, offset int) {
+	n := bi.findGreaterOrEqual(key)
+	if n != nil && bi.cmp.Compare(n.key, key) == 0 {
+		n.offset = offset
+		return
+	}
+
+	height := bi.randHeight()
+	for i := bi.height; i < height; i++ {
+		bi.prev[i] = bi.head
+	}
+	if height > bi.height {
+		bi.height = height
+	}
+
+	n = &batchIndexNode{
+		key:    append([]byte(nil), key...),
+		offset: offset,
+		next:   make([]*batchIndexNode, height),
+	}
+	for i := 0; i < height; i++ {
+		n.next[i] = bi.prev[i].next[i]
+		bi.prev[i].next[i] = n
+	}
+}
+
+/**
+baseDeltaIterator merge the base (db) and the delta (batch)
+
+	base:   a=1  b=2       d=4
+	delta:       b=5  c=6  d(del)
+	merged: a=1  b=5  c=6
+**/
+
+type baseDeltaIterator struct {
+	*BasicReleaser
+	base  Iterator
+	wbi   *WriteBatchWithIndex
+	delta *batchIndexNode // the current node of index
+
+	baseOK    bool
+	fromDelta bool
+	dir       direction
+	value     []byte
+	err       error
+}
+
+func newBaseDeltaIterator(base Iterator, wbi *WriteBatchWithIndex) *baseDeltaIterator {
+	it := &baseDeltaIterator{
+		base: base,
+		wbi:  wbi,
+	}
+	it.BasicReleaser = &BasicReleaser{
+		OnClose: func() {
+			base.UnRef()
+			it.delta = nil
+			it.value = nil
+		},
+	}
+	it.Ref()
+	return it
+}
+
+func (it *baseDeltaIterator) SeekFirst() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.released() {
+		it.err = ErrReleased
+		return false
+	}
+	it.baseOK = it.base.SeekFirst()
+	it.delta = it.wbi.index.head.next[0]
+	return it.findCurrent()
+}
+
+// Seek move to the first user key >= key
+func (it *baseDeltaIterator) Seek(key InternalKey) bool {
+	if it.err != nil {
+		return false
+	}
+	if it.released() {
+		it.err = ErrReleased
+		return false
+	}
+	it.baseOK = it.base.Seek(key)
+	it.delta = it.wbi.index.findGreaterOrEqual(key)
+	return it.findCurrent()
+}
+
+func (it *baseDeltaIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.released() {
+		it.err = ErrReleased
+		return false
+	}
+	if it.dir == dirEOI {
+		return false
+	} else if it.dir != dirForward {
+		return it.SeekFirst()
+	}
+
+	if it.fromDelta {
+		// the base entry of the same key is shadowed
+		if it.baseOK && it.wbi.cmp.Compare(it.base.Key(), it.delta.key) == 0 {
+			it.baseOK = it.base.Next()
+		}
+		it.delta = it.delta.next[0]
+	} else {
+		it.baseOK = it.base.Next()
+	}
+	return it.findCurrent()
+}
+
+// findCurrent choose the smaller key of base and delta, skip the keys deleted in batch
+func (it *baseDeltaIterator) findCurrent() bool {
+
+	for {
+		if !it.baseOK {
+			if err := it.base.Valid(); err != nil {
+				it.err = err
+				break
+			}
+		}
+
+		if it.delta == nil {
+			if !it.baseOK {
+				break
+			}
+			it.fromDelta = false
+			it.dir = dirForward
+			return true
+		}
+
+		c := -1
+		if it.baseOK {
+			c = it.wbi.cmp.Compare(it.delta.key, it.base.Key())
+		}
+		if c > 0 {
+			it.fromDelta = false
+			it.dir = dirForward
+			return true
+		}
+
+		kt, value, err := it.wbi.record(it.delta.offset)
+		if err != nil {
+			it.err = err
+			break
+		}
+		if kt == keyTypeValue {
+			it.fromDelta = true
+			it.value = value
+			it.dir = dirForward
+			return true
+		}
+
+		// deleted in batch, skip it and the base entry of the same key
+		if c == 0 {
+			it.baseOK = it.base.Next()
+		}
+		it.delta = it.delta.next[0]
+	}
+
+	it.dir = dirEOI
+	it.delta = nil
+	it.value = nil
+	return false
+}
+
+func (it *baseDeltaIterator) Key() []byte {
+	if it.dir != dirForward {
+		return nil
+	}
+	if it.fromDelta {
+		return it.delta.key
+	}
+	return it.base.Key()
+}
+
+func (it *baseDeltaIterator) Value() []byte {
+	if it.dir != dirForward {
+		return nil
+	}
+	if it.fromDelta {
+		return it.value
+	}
+	return it.base.Value()
+}
+
+func (it *baseDeltaIterator) Valid() error {
+	return it.err
+}
@@ -0,0 +1,124 @@
+package sstable
+
+import (
+	"sort"
+	"testing"
+)
+
+// sliceIterator a user key iterator over the sorted kvs, as the base of baseDeltaIterator
+type sliceIterator struct {
+	*BasicReleaser
+	kvs [][2]string
+	i   int
+}
+
+func newSliceIterator(kvs ...[2]string) *sliceIterator {
+	it := &sliceIterator{kvs: kvs, i: len(kvs)}
+	it.BasicReleaser = &BasicReleaser{
+		OnClose: func() {
+			it.kvs = nil
+		},
+	}
+	it.Ref()
+	return it
+}
+
+func (it *sliceIterator) SeekFirst() bool {
+	it.i = 0
+	return it.i < len(it.kvs)
+}
+
+func (it *sliceIterator) Seek(key InternalKey) bool {
+	it.i = sort.Search(len(it.kvs), func(i int) bool {
+		return it.kvs[i][0] >= string(key)
+	})
+	return it.i < len(it.kvs)
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.i < len(it.kvs) {
+		it.i++
+	}
+	return it.i < len(it.kvs)
+}
+
+func (it *sliceIterator) Key() []byte {
+	return []byte(it.kvs[it.i][0])
+}
+
+func (it *sliceIterator) Value() []byte {
+	return []byte(it.kvs[it.i][1])
+}
+
+func (it *sliceIterator) Valid() error {
+	return nil
+}
+
+func TestWriteBatchWithIndexGet(t *testing.T) {
+
+	wbi := NewWriteBatchWithIndex(nil)
+	wbi.Put([]byte("a"), []byte("1"))
+	wbi.Put([]byte("b"), []byte("2"))
+	wbi.Put([]byte("a"), []byte("3"))
+	wbi.Delete([]byte("b"))
+
+	if value, err := wbi.GetFromBatch([]byte("a")); err != nil || string(value) != "3" {
+		t.Fatalf("expect a=3, got %q, %v", value, err)
+	}
+	if _, err := wbi.GetFromBatch([]byte("b")); err != ErrNotFound {
+		t.Fatalf("expect b deleted, got %v", err)
+	}
+	if _, err := wbi.GetFromBatch([]byte("c")); err != ErrNotFound {
+		t.Fatalf("expect c not found, got %v", err)
+	}
+	if wbi.Len() != 4 {
+		t.Fatalf("expect 4 records, got %d", wbi.Len())
+	}
+
+	wbi.Reset()
+	if _, err := wbi.GetFromBatch([]byte("a")); err != ErrNotFound {
+		t.Fatalf("expect a not found after reset, got %v", err)
+	}
+}
+
+func TestWriteBatchWithIndexIterator(t *testing.T) {
+
+	wbi := NewWriteBatchWithIndex(nil)
+	wbi.Put([]byte("b"), []byte("5"))
+	wbi.Put([]byte("c"), []byte("6"))
+	wbi.Delete([]byte("d"))
+	wbi.Delete([]byte("f"))
+	wbi.Put([]byte("g"), []byte("7"))
+
+	base := newSliceIterator([2]string{"a", "1"}, [2]string{"b", "2"}, [2]string{"d", "4"}, [2]string{"e", "5"})
+	it := wbi.NewIteratorWithBase(base)
+
+	var got []string
+	for ok := it.SeekFirst(); ok; ok = it.Next() {
+		got = append(got, string(it.Key())+"="+string(it.Value()))
+	}
+	if err := it.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a=1", "b=5", "c=6", "e=5", "g=7"}
+	if len(got) != len(want) {
+		t.Fatalf("expect %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expect %v, got %v", want, got)
+		}
+	}
+
+	if !it.Seek(InternalKey("c")) || string(it.Key()) != "c" {
+		t.Fatalf("expect seek to c, got %q", it.Key())
+	}
+	if !it.Next() || string(it.Key()) != "e" {
+		t.Fatalf("expect d skipped, got %q", it.Key())
+	}
+
+	it.UnRef()
+	if !base.released() {
+		t.Fatal("expect base released with the merged iterator")
+	}
+}
@@ -0,0 +1,108 @@
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// recordHandler record the batch records as strings
+type recordHandler struct {
+	records []string
+}
+
+func (h *recordHandler) Put(key, value []byte) error {
+	h.records = append(h.records, fmt.Sprintf("put %s=%s", key, value))
+	return nil
+}
+
+func (h *recordHandler) Delete(key []byte) error {
+	h.records = append(h.records, fmt.Sprintf("del %s", key))
+	return nil
+}
+
+type familyRecordHandler struct {
+	recordHandler
+}
+
+func (h *familyRecordHandler) PutCF(familyID uint32, key, value []byte) error {
+	h.records = append(h.records, fmt.Sprintf("put %d/%s=%s", familyID, key, value))
+	return nil
+}
+
+func (h *familyRecordHandler) DeleteCF(familyID uint32, key []byte) error {
+	h.records = append(h.records, fmt.Sprintf("del %d/%s", familyID, key))
+	return nil
+}
+
+func TestWriteBatchIterate(t *testing.T) {
+
+	wb := &WriteBatch{}
+	wb.Put([]byte("a"), []byte("1"))
+	wb.Delete([]byte("b"))
+	wb.SetSequence(7)
+
+	decoded, err := NewWriteBatchFromContents(wb.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.seq != 7 || decoded.Len() != 2 || !bytes.Equal(decoded.Data(), wb.Data()) {
+		t.Fatalf("expect the same batch decoded, got seq %d, %d records", decoded.seq, decoded.Len())
+	}
+
+	h := &recordHandler{}
+	if err := decoded.Iterate(h); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(h.records) != "[put a=1 del b]" {
+		t.Fatalf("unexpected records %v", h.records)
+	}
+
+	// the column family records need a ColumnFamilyHandler
+	wb.PutCF(&ColumnFamilyHandle{id: 3}, []byte("c"), []byte("2"))
+	if err := wb.Iterate(&recordHandler{}); !errors.Is(err, ErrBatchColumnFamily) {
+		t.Fatalf("expect column family record not handled, got %v", err)
+	}
+	fh := &familyRecordHandler{}
+	if err := wb.Iterate(fh); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(fh.records) != "[put a=1 del b put 3/c=2]" {
+		t.Fatalf("unexpected records %v", fh.records)
+	}
+}
+
+func TestWriteBatchSetContentsInvalid(t *testing.T) {
+
+	wb := &WriteBatch{}
+	wb.Put([]byte("key"), []byte("value"))
+	data := wb.Data()
+
+	withCount := func(count uint32) []byte {
+		p := append([]byte(nil), data...)
+		p[kWriteBatchSeqSize] = byte(count)
+		return p
+	}
+
+	cases := map[string][]byte{
+		"short header":   data[:kWriteBatchHeaderSize-1],
+		"count too big":  withCount(2),
+		"count too less": withCount(0),
+		"truncated":      data[:len(data)-1],
+		"trailing bytes": append(append([]byte(nil), data...), 0),
+		"unknown type":   append(append([]byte(nil), data[:kWriteBatchHeaderSize]...), 9, 0),
+		"bad varint":     append(append([]byte(nil), data[:kWriteBatchHeaderSize]...), kTypeDel, 0xff),
+	}
+	for name, p := range cases {
+		target := &WriteBatch{}
+		target.Put([]byte("kept"), nil)
+		size := target.Size()
+		if err := target.SetContents(p); err == nil {
+			t.Fatalf("%s: expect corruption", name)
+		}
+		if target.Size() != size || target.Len() != 1 {
+			t.Fatalf("%s: expect the batch unchanged", name)
+		}
+	}
+}